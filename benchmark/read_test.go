@@ -6,15 +6,19 @@ package benchmark
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 )
 
@@ -24,6 +28,17 @@ func BenchmarkGoFuseMemoryRead(b *testing.B) {
 	benchmarkRead(mnt, b, "direct")
 }
 
+// BenchmarkGoFuseHoleRead reads a sparse file, comparing
+// fuse.ReadResultZero to returning an allocated buffer of zeroes.
+func BenchmarkGoFuseHoleRead(b *testing.B) {
+	for _, zero := range []bool{false, true} {
+		b.Run(fmt.Sprintf("zero=%v", zero), func(b *testing.B) {
+			mnt := setupFS(&holeFS{zero: zero}, b.N, b)
+			benchmarkRead(mnt, b, "direct")
+		})
+	}
+}
+
 const blockSize = 128 * 1024 // Fuse default request size 128k
 
 func benchmarkRead(mnt string, b *testing.B, ddflag string) {
@@ -77,7 +92,23 @@ func benchmarkRead(mnt string, b *testing.B, ddflag string) {
 	b.StopTimer()
 }
 
+// BenchmarkGoFuseFDRead reads through the loopback file system,
+// which returns fuse.ReadResultFd, so data is spliced from the
+// backing file.
 func BenchmarkGoFuseFDRead(b *testing.B) {
+	benchmarkFDRead(b, &fs.Options{})
+}
+
+// BenchmarkGoFuseFDReadNoSplice is BenchmarkGoFuseFDRead with
+// splicing disabled, so data is copied through userspace. The
+// difference between the two is the gain of zero-copy reads.
+func BenchmarkGoFuseFDReadNoSplice(b *testing.B) {
+	opts := &fs.Options{}
+	opts.DisableSplice = true
+	benchmarkFDRead(b, opts)
+}
+
+func benchmarkFDRead(b *testing.B, opts *fs.Options) {
 	orig := b.TempDir()
 	fn := orig + "/foo.txt"
 
@@ -89,7 +120,7 @@ func BenchmarkGoFuseFDRead(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
-	mnt := setupFS(root, b.N, b)
+	mnt := setupFSWithOptions(root, opts, b)
 	benchmarkRead(mnt, b, "")
 }
 
@@ -135,3 +166,83 @@ func BenchmarkLibfuseHP(b *testing.B) {
 
 	benchmarkRead(mnt, b, "")
 }
+
+// slowReadFile is a file whose reads take a millisecond, like one
+// backed by a disk or the network.
+type slowReadFile struct {
+	readFS
+}
+
+var _ = (fs.NodeOpener)((*slowReadFile)(nil))
+
+func (f *slowReadFile) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+var _ = (fs.NodeReader)((*slowReadFile)(nil))
+
+func (f *slowReadFile) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	time.Sleep(time.Millisecond)
+	return fuse.ReadResultData(dest), fs.OK
+}
+
+// BenchmarkGoFuseStatDuringRead measures the latency of stat while
+// readers saturate MaxConcurrentRequests with slow reads, with and
+// without MountOptions.PrioritizeSyncRequests.
+func BenchmarkGoFuseStatDuringRead(b *testing.B) {
+	for _, prio := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prioritize=%v", prio), func(b *testing.B) {
+			root := &fs.Inode{}
+			zero := time.Duration(0)
+			opts := &fs.Options{
+				EntryTimeout: &zero,
+				AttrTimeout:  &zero,
+				OnAdd: func(ctx context.Context) {
+					ch := root.NewPersistentInode(ctx, &slowReadFile{}, fs.StableAttr{})
+					root.AddChild("foo.txt", ch, false)
+				},
+			}
+			opts.MaxConcurrentRequests = 4
+			opts.PrioritizeSyncRequests = prio
+			mnt := setupFSWithOptions(root, opts, b)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < 4*opts.MaxConcurrentRequests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f, err := os.Open(mnt + "/foo.txt")
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					defer f.Close()
+					buf := make([]byte, blockSize)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						if _, err := f.Read(buf); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := os.Lstat(mnt + "/foo.txt"); err != nil {
+					b.Fatalf("Lstat: %v", err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
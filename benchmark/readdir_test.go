@@ -0,0 +1,89 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package benchmark
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const hugeDirSize = 100000
+
+// hugeDirStream generates the entries of a huge directory. With
+// reuse, all names are generated into the same buffer.
+type hugeDirStream struct {
+	reuse bool
+	buf   []byte
+	i     int
+}
+
+func (s *hugeDirStream) HasNext() bool {
+	return s.i < hugeDirSize
+}
+
+func (s *hugeDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	e := fuse.DirEntry{Mode: fuse.S_IFREG, Ino: uint64(s.i + 1)}
+	if s.reuse {
+		s.buf = strconv.AppendInt(append(s.buf[:0], "file"...), int64(s.i), 10)
+		e.SetNameBytes(s.buf)
+	} else {
+		e.Name = "file" + strconv.Itoa(s.i)
+	}
+	s.i++
+	return e, 0
+}
+
+func (s *hugeDirStream) Close() {}
+
+type hugeDir struct {
+	fs.Inode
+	reuse bool
+}
+
+var _ = (fs.NodeReaddirer)((*hugeDir)(nil))
+
+func (n *hugeDir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	return &hugeDirStream{reuse: n.reuse}, 0
+}
+
+func benchmarkHugeDir(b *testing.B, reuse bool) {
+	opts := &fs.Options{}
+	opts.DisableReadDirPlus = true
+	mnt := setupFSWithOptions(&hugeDir{reuse: reuse}, opts, b)
+
+	// Read with getdents(2), so the client does not allocate.
+	buf := make([]byte, 64*1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fd, err := syscall.Open(mnt, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for {
+			n, err := syscall.ReadDirent(fd, buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		syscall.Close(fd)
+	}
+}
+
+func BenchmarkGoFuseReaddirHuge(b *testing.B) {
+	benchmarkHugeDir(b, false)
+}
+
+func BenchmarkGoFuseReaddirHugeReuse(b *testing.B) {
+	benchmarkHugeDir(b, true)
+}
@@ -47,3 +47,34 @@ var _ = (fs.FileReader)((*readFS)(nil))
 func (n *readFS) Read(ctx context.Context, dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
 	return fuse.ReadResultData(dest), fs.OK
 }
+
+// holeFS is like readFS, but its files are one big hole. If zero is
+// set, reads return fuse.ReadResultZero, otherwise they allocate a
+// buffer of zeroes, like a naive sparse file implementation.
+type holeFS struct {
+	readFS
+
+	zero bool
+}
+
+var _ = (fs.NodeLookuper)((*holeFS)(nil))
+
+func (n *holeFS) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	sattr := fs.StableAttr{Mode: fuse.S_IFREG}
+	return n.NewInode(ctx, &holeFS{zero: n.zero}, sattr), fs.OK
+}
+
+var _ = (fs.NodeOpener)((*holeFS)(nil))
+
+func (n *holeFS) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+var _ = (fs.NodeReader)((*holeFS)(nil))
+
+func (n *holeFS) Read(ctx context.Context, f fs.FileHandle, dest []byte, offset int64) (fuse.ReadResult, syscall.Errno) {
+	if n.zero {
+		return fuse.ReadResultZero(len(dest)), fs.OK
+	}
+	return fuse.ReadResultData(make([]byte, len(dest))), fs.OK
+}
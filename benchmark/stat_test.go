@@ -5,6 +5,7 @@
 package benchmark
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -22,7 +23,10 @@ import (
 )
 
 func setupFS(node fs.InodeEmbedder, N int, tb testing.TB) string {
-	opts := &fs.Options{}
+	return setupFSWithOptions(node, &fs.Options{}, tb)
+}
+
+func setupFSWithOptions(node fs.InodeEmbedder, opts *fs.Options, tb testing.TB) string {
 	opts.Debug = testutil.VerboseTest()
 	mountPoint := tb.TempDir()
 	server, err := fs.Mount(mountPoint, node, opts)
@@ -110,6 +114,79 @@ func BenchmarkGoFSStat(b *testing.B) {
 	}
 }
 
+// BenchmarkGoFSStatReaders measures stat throughput for different
+// MountOptions.MaxReaders settings.
+func BenchmarkGoFSStatReaders(b *testing.B) {
+	wd, _ := os.Getwd()
+	fileList := wd + "/testpaths.txt"
+	files := ReadLines(fileList)
+	threads := runtime.GOMAXPROCS(0)
+
+	for _, readers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			b.StopTimer()
+			root := &StatFS{}
+			for _, fn := range files {
+				root.AddFile(fn, fuse.Attr{Mode: syscall.S_IFREG})
+			}
+			opts := &fs.Options{}
+			opts.MaxReaders = readers
+			mnt := setupFSWithOptions(root, opts, b)
+
+			if err := TestingBOnePass(b, threads, fileList, mnt); err != nil {
+				b.Fatalf("TestingBOnePass %v", err)
+			}
+		})
+	}
+}
+
+// slowStatFile is a file whose Getattr is expensive, like one
+// backed by a network filesystem.
+type slowStatFile struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeGetattrer)((*slowStatFile)(nil))
+
+func (f *slowStatFile) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	time.Sleep(100 * time.Microsecond)
+	out.Mode = 0644
+	return 0
+}
+
+// BenchmarkGoFSStatAttrCache measures a storm of stat calls, which
+// the kernel may not cache, with and without Options.AttrCacheSize.
+func BenchmarkGoFSStatAttrCache(b *testing.B) {
+	const files = 100
+	for _, size := range []int{0, files} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			root := &fs.Inode{}
+			zero := time.Duration(0)
+			opts := &fs.Options{
+				EntryTimeout:  &zero,
+				AttrTimeout:   &zero,
+				AttrCacheSize: size,
+				OnAdd: func(ctx context.Context) {
+					for i := 0; i < files; i++ {
+						ch := root.NewPersistentInode(ctx, &slowStatFile{}, fs.StableAttr{})
+						root.AddChild(fmt.Sprintf("file%d", i), ch, false)
+					}
+				},
+			}
+			mnt := setupFSWithOptions(root, opts, b)
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := os.Lstat(fmt.Sprintf("%s/file%d", mnt, i%files)); err != nil {
+						b.Fatalf("Lstat: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
 func readdir(d string) error {
 	f, err := os.Open(d)
 	if err != nil {
@@ -0,0 +1,99 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// writeFS is a file system whose files discard all data
+// written. Useful to benchmark the overhead of the write path.
+type writeFS struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeLookuper)((*writeFS)(nil))
+
+func (n *writeFS) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	out.Mode = fuse.S_IFREG | 0644
+	return n.NewInode(ctx, &writeFS{}, fs.StableAttr{Mode: fuse.S_IFREG}), fs.OK
+}
+
+var _ = (fs.NodeOpener)((*writeFS)(nil))
+
+func (n *writeFS) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, fs.OK
+}
+
+var _ = (fs.NodeWriter)((*writeFS)(nil))
+
+func (n *writeFS) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	return uint32(len(data)), fs.OK
+}
+
+const writeBlockSize = 1 << 20
+
+// BenchmarkGoFuseStreamingWrite writes a file sequentially in large
+// blocks. The kernel splits each block into WRITE requests of at
+// most MaxWrite bytes, whose data is read from the device straight
+// into the request buffer and handed to the file system without
+// further copies. "discard" measures this overhead alone, and
+// "loopback" adds the copy into the backing file. With
+// "passthrough", the kernel writes to the backing file itself,
+// if it supports passthrough.
+func BenchmarkGoFuseStreamingWrite(b *testing.B) {
+	for _, maxWrite := range []int{0, writeBlockSize} {
+		b.Run(fmt.Sprintf("discard/maxwrite=%d", maxWrite), func(b *testing.B) {
+			opts := &fs.Options{}
+			opts.MaxWrite = maxWrite
+			mnt := setupFSWithOptions(&writeFS{}, opts, b)
+			benchmarkStreamingWrite(b, mnt+"/foo.txt")
+		})
+	}
+	for _, passthrough := range []bool{false, true} {
+		name := "loopback"
+		if passthrough {
+			name = "passthrough"
+		}
+		b.Run(name, func(b *testing.B) {
+			root, err := fs.NewLoopbackRoot(b.TempDir())
+			if err != nil {
+				b.Fatal(err)
+			}
+			opts := &fs.Options{}
+			opts.DisablePassthrough = !passthrough
+			mnt := setupFSWithOptions(root, opts, b)
+			benchmarkStreamingWrite(b, mnt+"/foo.txt")
+		})
+	}
+}
+
+func benchmarkStreamingWrite(b *testing.B, fn string) {
+	f, err := os.Create(fn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	// Wrap around, so the backing file stays small.
+	const wrap = 64
+	data := make([]byte, writeBlockSize)
+	b.SetBytes(writeBlockSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.WriteAt(data, int64(i%wrap)*writeBlockSize); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This program implements a character device that behaves like
+// /dev/zero: reads return zeros and writes are discarded. It must
+// run as root, as it needs access to /dev/cuse.
+package main
+
+import (
+	"flag"
+	"log"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type zeroDevice struct{}
+
+func (d *zeroDevice) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	// There is no file handle state, and the content is
+	// not seekable, so bypass the page cache.
+	out.OpenFlags = fuse.FOPEN_DIRECT_IO | fuse.FOPEN_NONSEEKABLE
+	return fuse.OK
+}
+
+func (d *zeroDevice) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	buf = buf[:input.Size]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return fuse.ReadResultData(buf), fuse.OK
+}
+
+func (d *zeroDevice) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	return uint32(len(data)), fuse.OK
+}
+
+func (d *zeroDevice) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+}
+
+func (d *zeroDevice) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, outbuf []byte) fuse.Status {
+	return fuse.Status(syscall.ENOTTY)
+}
+
+func main() {
+	debug := flag.Bool("debug", false, "print debug data")
+	major := flag.Uint("major", 0, "device major number; 0 picks a free one")
+	minor := flag.Uint("minor", 0, "device minor number")
+	flag.Parse()
+	if len(flag.Args()) < 1 {
+		log.Fatal("Usage:\n  cusezero DEVNAME")
+	}
+	opts := &fuse.MountOptions{Debug: *debug}
+	server, err := fuse.NewCUSEServer(flag.Arg(0), uint32(*major), uint32(*minor), &zeroDevice{}, opts)
+	if err != nil {
+		log.Fatalf("NewCUSEServer: %v", err)
+	}
+	log.Printf("serving /dev/%s", flag.Arg(0))
+	server.Serve()
+}
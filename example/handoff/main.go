@@ -0,0 +1,94 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// This program shows how to daemonize a FUSE file system: the
+// process started from the shell mounts the file system, re-executes
+// itself with the FUSE device as an inherited file, and exits once
+// the child serves the mount. Unmount with "fusermount -u MOUNTPOINT".
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// stateEnv holds the fuse.ServerState for the child, in JSON.
+const stateEnv = "HANDOFF_FUSE_STATE"
+
+// The device is the first of exec.Cmd.ExtraFiles.
+const childFd = 3
+
+type root struct {
+	fs.Inode
+}
+
+func (r *root) OnAdd(ctx context.Context) {
+	ch := r.NewPersistentInode(ctx, &fs.MemRegularFile{
+		Data: []byte(fmt.Sprintf("served by pid %d\n", os.Getpid())),
+		Attr: fuse.Attr{Mode: 0644},
+	}, fs.StableAttr{})
+	r.AddChild("pid.txt", ch, false)
+}
+
+var _ = (fs.NodeOnAdder)((*root)(nil))
+
+func main() {
+	debug := flag.Bool("debug", false, "print debug data")
+	flag.Parse()
+	if len(flag.Args()) < 1 {
+		log.Fatal("Usage:\n  handoff MOUNTPOINT")
+	}
+	mnt := flag.Arg(0)
+	opts := &fs.Options{}
+	opts.Debug = *debug
+
+	if s := os.Getenv(stateEnv); s != "" {
+		serve(mnt, s, opts)
+		return
+	}
+
+	// The parent only mounts; it never calls Serve.
+	server, err := fuse.NewServer(fs.NewNodeFS(&root{}, opts), mnt, &opts.MountOptions)
+	if err != nil {
+		log.Fatalf("Mount fail: %v", err)
+	}
+	fd, state, err := server.Handoff()
+	if err != nil {
+		log.Fatalf("Handoff: %v", err)
+	}
+	data, err := json.Marshal(&state)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), stateEnv+"="+string(data))
+	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(fd), "/dev/fuse")}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Fatalf("Start: %v", err)
+	}
+	log.Printf("pid %d serves %s", cmd.Process.Pid, mnt)
+}
+
+func serve(mnt string, data string, opts *fs.Options) {
+	var state fuse.ServerState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		log.Fatalf("bad state: %v", err)
+	}
+	server, err := fuse.NewServerFromFd(fs.NewNodeFS(&root{}, opts), childFd, mnt, &state, &opts.MountOptions)
+	if err != nil {
+		log.Fatalf("NewServerFromFd: %v", err)
+	}
+	server.Serve()
+}
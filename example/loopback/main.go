@@ -8,9 +8,11 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
@@ -53,6 +55,7 @@ func main() {
 	directmountstrict := flag.Bool("directmountstrict", false, "like directmount, but don't fall back to fusermount")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to this file")
 	memprofile := flag.String("memprofile", "", "write memory profile to this file")
+	statsAddr := flag.String("stats", "", "serve per-opcode statistics through expvar at http://ADDR/debug/vars")
 	flag.Parse()
 	if flag.NArg() < 2 {
 		fmt.Printf("usage: %s MOUNTPOINT ORIGINAL\n", path.Base(os.Args[0]))
@@ -107,6 +110,7 @@ func main() {
 			DirectMount:       *directmount,
 			DirectMountStrict: *directmountstrict,
 			IDMappedMount:     *idmap,
+			RecordStats:       *statsAddr != "",
 			FsName:            orig,       // First column in "df -T": original dir
 			Name:              "loopback", // Second column in "df -T" will be shown as "fuse." + Name
 		},
@@ -129,6 +133,14 @@ func main() {
 	if !*quiet {
 		fmt.Println("Mounted!")
 	}
+	if *statsAddr != "" {
+		expvar.Publish("fuse", expvar.Func(func() interface{} {
+			return server.Stats()
+		}))
+		go func() {
+			log.Println(http.ListenAndServe(*statsAddr, nil))
+		}()
+	}
 
 	c := make(chan os.Signal)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
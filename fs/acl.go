@@ -0,0 +1,88 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Names of the extended attributes that hold POSIX ACLs. With
+// fuse.MountOptions.EnableAcl, the kernel reads and writes these
+// through the Node*xattr methods, in the format handled by
+// ParseACL and SerializeACL.
+const (
+	XATTR_POSIX_ACL_ACCESS  = "system.posix_acl_access"
+	XATTR_POSIX_ACL_DEFAULT = "system.posix_acl_default"
+)
+
+// Tags for ACLEntry, from <linux/posix_acl.h>.
+const (
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+)
+
+// ACL_UNDEFINED_ID is the ID of ACL entries that do not refer to a
+// specific user or group.
+const ACL_UNDEFINED_ID = ^uint32(0)
+
+// posixACLXattrVersion is the version in the header of the
+// xattr encoding.
+const posixACLXattrVersion = 2
+
+// ACLEntry is an entry of a POSIX ACL.
+type ACLEntry struct {
+	// Tag is one of the ACL_* tag constants.
+	Tag uint16
+
+	// Perm holds the permission bits: 4 (read), 2 (write) and 1
+	// (execute).
+	Perm uint16
+
+	// ID is the uid or gid for ACL_USER and ACL_GROUP entries,
+	// and ACL_UNDEFINED_ID otherwise.
+	ID uint32
+}
+
+// ParseACL decodes a POSIX ACL from the value of an ACL extended
+// attribute (struct posix_acl_xattr_header followed by struct
+// posix_acl_xattr_entry). It returns EINVAL for malformed data.
+func ParseACL(data []byte) ([]ACLEntry, syscall.Errno) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 {
+		return nil, syscall.EINVAL
+	}
+	if binary.LittleEndian.Uint32(data) != posixACLXattrVersion {
+		return nil, syscall.EINVAL
+	}
+
+	data = data[4:]
+	entries := make([]ACLEntry, 0, len(data)/8)
+	for ; len(data) > 0; data = data[8:] {
+		entries = append(entries, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data),
+			Perm: binary.LittleEndian.Uint16(data[2:]),
+			ID:   binary.LittleEndian.Uint32(data[4:]),
+		})
+	}
+	return entries, 0
+}
+
+// SerializeACL encodes a POSIX ACL as the value of an ACL extended
+// attribute. It is the inverse of ParseACL.
+func SerializeACL(entries []ACLEntry) []byte {
+	data := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(data, posixACLXattrVersion)
+	for i, e := range entries {
+		b := data[4+8*i:]
+		binary.LittleEndian.PutUint16(b, e.Tag)
+		binary.LittleEndian.PutUint16(b[2:], e.Perm)
+		binary.LittleEndian.PutUint32(b[4:], e.ID)
+	}
+	return data
+}
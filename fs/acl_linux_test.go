@@ -0,0 +1,92 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestACLRoundTrip(t *testing.T) {
+	acl := []ACLEntry{
+		{Tag: ACL_USER_OBJ, Perm: 6, ID: ACL_UNDEFINED_ID},
+		{Tag: ACL_USER, Perm: 4, ID: 1000},
+		{Tag: ACL_GROUP_OBJ, Perm: 4, ID: ACL_UNDEFINED_ID},
+		{Tag: ACL_MASK, Perm: 4, ID: ACL_UNDEFINED_ID},
+		{Tag: ACL_OTHER, Perm: 0, ID: ACL_UNDEFINED_ID},
+	}
+	data := SerializeACL(acl)
+	if len(data) != 4+8*len(acl) {
+		t.Fatalf("got %d bytes, want %d", len(data), 4+8*len(acl))
+	}
+	got, errno := ParseACL(data)
+	if errno != 0 {
+		t.Fatalf("ParseACL: %v", errno)
+	}
+	if !reflect.DeepEqual(got, acl) {
+		t.Errorf("got %v, want %v", got, acl)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		data[:len(data)-1],
+		{1, 0, 0, 0},
+	} {
+		if _, errno := ParseACL(bad); errno != syscall.EINVAL {
+			t.Errorf("ParseACL(%v): got %v, want EINVAL", bad, errno)
+		}
+	}
+}
+
+func TestACLSetfacl(t *testing.T) {
+	for _, tool := range []string{"setfacl", "getfacl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	tc := newTestCase(t, &testOptions{enableAcl: true})
+	tc.writeOrig("file", "hello", 0644)
+
+	fn := tc.mntDir + "/file"
+	if out, err := exec.Command("setfacl", "-m", "u:12345:r", fn).CombinedOutput(); err != nil {
+		if strings.Contains(string(out), "not supported") {
+			t.Skipf("backing file system does not support ACLs: %s", out)
+		}
+		t.Fatalf("setfacl: %v, %s", err, out)
+	}
+	out, err := exec.Command("getfacl", "-n", fn).CombinedOutput()
+	if err != nil {
+		t.Fatalf("getfacl: %v, %s", err, out)
+	}
+	if !strings.Contains(string(out), "user:12345:r--") {
+		t.Errorf("getfacl output lacks entry: %s", out)
+	}
+
+	buf := make([]byte, 1024)
+	sz, err := syscall.Getxattr(tc.origDir+"/file", XATTR_POSIX_ACL_ACCESS, buf)
+	if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	acl, errno := ParseACL(buf[:sz])
+	if errno != 0 {
+		t.Fatalf("ParseACL: %v", errno)
+	}
+	found := false
+	for _, e := range acl {
+		if e.Tag == ACL_USER && e.ID == 12345 && e.Perm == 4 {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ACL entry not in backing file: %v", acl)
+	}
+	if _, err := os.Stat(fn); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+}
@@ -134,6 +134,13 @@
 // (which the Go runtime uses for managing goroutine preemption) also
 // generates an interrupt.
 //
+// The error code matters: EINTR is passed to the interrupted system
+// call, which callers know to retry. Do not return EAGAIN for an
+// interrupted call: to a process doing blocking I/O, it looks like a
+// real failure. If the interrupt arrives before the request was
+// picked up, the library answers EAGAIN to the kernel, which then
+// sends the interrupt again.
+//
 // # Locking
 //
 // Locks for networked filesystems are supported through the suite of
@@ -279,13 +286,24 @@ type InodeEmbedder interface {
 }
 
 // Statfs implements statistics for the filesystem that holds this
-// Inode. If not defined, the `out` argument will zeroed with an OK
-// result.  This is because OSX filesystems must Statfs, or the mount
-// will not work.
+// Inode. Implementing it on a subtree lets file systems that combine
+// several backing stores report the free space of the store that
+// holds the path. If not defined, the root's Statfs is used. If the
+// root does not define it either, the `out` argument will zeroed
+// with an OK result.  This is because OSX filesystems must Statfs,
+// or the mount will not work.
 type NodeStatfser interface {
 	Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
 }
 
+// Syncfs is called on the root for syncfs(2), and should flush all
+// dirty data of the file system to stable storage. If the root
+// does not implement it, all open files that implement FileFsyncer
+// are fsync'ed instead.
+type NodeSyncfser interface {
+	Syncfs(ctx context.Context) syscall.Errno
+}
+
 // Access should return if the caller can access the file with the
 // given mode.  This is used for two purposes: to determine if a user
 // may enter a directory, and to implement the access system
@@ -293,6 +311,10 @@ type NodeStatfser interface {
 // UID. For example, a root-SUID binary called by user susan gets the
 // UID and GID for susan here.
 //
+// The mask is a combination of R_OK, W_OK and X_OK from access(2),
+// all of which must be granted, or 0 (F_OK) to only check that the
+// file exists. The kernel also calls Access with X_OK for chdir(2).
+//
 // If not defined, a default implementation will check traditional
 // unix permissions of the Getattr result agains the caller. If access
 // permissions must be obeyed precisely, the filesystem should return
@@ -300,6 +322,10 @@ type NodeStatfser interface {
 // Without [Options.NullPermissions], a missing permission (mode =
 // 0000) is interpreted as 0755 for directories, and chdir is always
 // allowed.
+//
+// With [fuse.MountOptions.DefaultPermissions] (also implied by
+// IDMappedMount and EnableAcl), the kernel checks permissions
+// against the attributes itself, and Access is never called.
 type NodeAccesser interface {
 	Access(ctx context.Context, mask uint32) syscall.Errno
 }
@@ -309,16 +335,29 @@ type NodeAccesser interface {
 // FOPEN_DIRECTIO, Size should be set so it can be read correctly.  If
 // returning zeroed permissions, the default behavior is to change the
 // mode of 0755 (directory) or 0644 (files). This can be switched off
-// with the Options.NullPermissions setting. If blksize is unset, 4096
-// is assumed, and the 'blocks' field is set accordingly. The 'f'
-// argument is provided for consistency, however, in practice the
-// kernel never sends a file handle, even if the Getattr call
-// originated from an fstat system call.
+// with the Options.NullPermissions setting.
+//
+// Blocks (in units of 512 bytes) may differ from Size, eg. for sparse
+// or compressed files, and is passed through as is. If Blksize is
+// unset, 4096 is assumed, and if Blocks is unset too, it is computed
+// from Size. To report a file that occupies no blocks at all, set
+// Blksize.
+//
+// The 'f' argument is the file handle the kernel sent along
+// (FUSE_GETATTR_FH). The kernel rarely does so, even for fstat(2),
+// so if the Inode has open files, one of them is passed instead.
+// Implementations should prefer 'f' when it is non-nil, typically by
+// calling its FileGetattrer method: this is cheaper than resolving
+// the path, and it works for files that were unlinked while open.
 type NodeGetattrer interface {
 	Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno
 }
 
 // SetAttr sets attributes for an Inode. Default is to return ENOTSUP.
+// Only the attributes flagged in in.Valid change; see
+// [fuse.SetAttrInCommon] for how to apply them. The implementation
+// should also update the status change time, and return the new
+// attributes in out. MemRegularFile.Setattr is an example.
 type NodeSetattrer interface {
 	Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
 }
@@ -357,39 +396,149 @@ type NodeListxattrer interface {
 	Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno)
 }
 
-// Readlink reads the content of a symlink.
+// Readlink reads the content of a symlink. With
+// [fuse.MountOptions.EnableSymlinkCaching], the kernel caches the
+// result until NotifyContent is called on the Inode.
+//
+// The target may be up to PATH_MAX-1 (4095) bytes long; longer
+// targets fail with ENAMETOOLONG. The returned slice is sent to the
+// kernel after Readlink returns, so it must not be modified
+// afterwards. The library only reads it, and does not retain it
+// after the reply, so returning a shared buffer such as
+// MemSymlink.Data is fine as long as it is not changed in place.
 type NodeReadlinker interface {
 	Readlink(ctx context.Context) ([]byte, syscall.Errno)
 }
 
 // Open opens an Inode (of regular file type) for reading. It
-// is optional but recommended to return a FileHandle.
+// is optional but recommended to return a FileHandle. The
+// fuseFlags return value may contain FOPEN_* flags, eg.
+// FOPEN_KEEP_CACHE, FOPEN_DIRECT_IO, FOPEN_STREAM or FOPEN_NOFLUSH.
+//
+// For open(2) with O_TRUNC, the kernel either sends SETATTR before
+// Open, or, with fuse.MountOptions.EnableAtomicTrunc, passes O_TRUNC
+// in the flags. In the latter case, the file is truncated with
+// Setattr (on the node, or on the returned FileHandle) after Open
+// returns, so Open need not handle O_TRUNC itself, unless the file
+// implements no Setattr.
 type NodeOpener interface {
 	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
 
 // Reads data from a file. The data should be returned as
 // ReadResult, which may be constructed from the incoming
-// `dest` buffer. If the file was opened without FileHandle,
-// the FileHandle argument here is nil. The default
-// implementation forwards to the FileHandle.
+// `dest` buffer. If the data lives in a file descriptor, return
+// fuse.ReadResultFd instead, so the data can be spliced into the
+// kernel without copying it through userspace. If the file was
+// opened without FileHandle, the FileHandle argument here is nil.
+// The default implementation forwards to the FileHandle.
 type NodeReader interface {
 	Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 }
 
-// Writes the data into the file handle at given offset. After
-// returning, the data will be reused and may not referenced.
-// The default implementation forwards to the FileHandle.
+// ReadOptions holds the flags of a READ request.
+type ReadOptions struct {
+	// Flags are the open flags of the file descriptor that the
+	// read came from. For example, syscall.O_DIRECT is set for
+	// reads that bypass the page cache, so a file system can
+	// prefetch generously for cached reads, and read only what
+	// was asked for direct reads.
+	Flags uint32
+
+	// ReadFlags holds fuse.READ_* flags.
+	ReadFlags uint32
+
+	// LockOwner identifies the owner of POSIX locks, if
+	// ReadFlags has fuse.READ_LOCKOWNER.
+	LockOwner uint64
+}
+
+// NodeReaderWithOptions is like NodeReader, but also receives the
+// flags of the request. If implemented, it is used instead of
+// NodeReader.
+type NodeReaderWithOptions interface {
+	ReadWithOptions(ctx context.Context, f FileHandle, dest []byte, off int64, opts *ReadOptions) (fuse.ReadResult, syscall.Errno)
+}
+
+// Writes the data into the file handle at given offset. The data
+// is the buffer that the request was read into from the FUSE
+// device, so it reaches the file system without intermediate
+// copies. After returning, the data will be reused and may not
+// referenced. The default implementation forwards to the
+// FileHandle.
+//
+// The kernel splits large writes into requests of at most
+// [fuse.MountOptions.MaxWrite] bytes, so raising it speeds up
+// streaming writes. Files backed by a file descriptor can bypass
+// the FUSE process altogether with FilePassthroughFder.
+//
+// Like write(2), Write may accept only part of the data by
+// returning written < len(data). The kernel then stops the write(2)
+// call at that point, and returns the bytes written so far to the
+// application, for direct as well as buffered I/O; it is up to the
+// application to write the remainder. If some data was written, a
+// non-zero errno is dropped, so the error should be reported on the
+// next call. With
+// [fuse.MountOptions.EnableWritebackCache], the kernel does not
+// retry short writes of dirty pages, so these must be written in
+// full.
+//
+// Writes to a shared writable mapping (mmap with MAP_SHARED) reach
+// the file system when the kernel writes back the dirty pages, eg.
+// on msync, munmap or close. These writes have fuse.WRITE_CACHE set
+// in the write flags, cover whole pages, and do not carry the
+// caller of the original write. This works with and without
+// [fuse.MountOptions.EnableWritebackCache].
 type NodeWriter interface {
 	Write(ctx context.Context, f FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno)
 }
 
+// WriteOptions holds the flags of a WRITE request.
+type WriteOptions struct {
+	// Flags are the open flags of the file descriptor that the
+	// write came from.
+	Flags uint32
+
+	// WriteFlags holds fuse.WRITE_* flags. fuse.WRITE_CACHE is
+	// set for writeback of the page cache, as opposed to writes
+	// issued directly by an application.
+	// fuse.WRITE_KILL_SUIDGID is set if the set-user-ID and
+	// set-group-ID bits must be cleared, see
+	// [fuse.MountOptions.HandleKillPrivV2].
+	WriteFlags uint32
+
+	// LockOwner identifies the owner of POSIX locks, if
+	// WriteFlags has fuse.WRITE_LOCKOWNER.
+	LockOwner uint64
+}
+
+// NodeWriterWithOptions is like NodeWriter, but also receives the
+// flags of the request. If implemented, it is used instead of
+// NodeWriter. The file system must then clear the set-user-ID and
+// set-group-ID bits itself for fuse.WRITE_KILL_SUIDGID, which lets
+// it do so atomically with the write.
+type NodeWriterWithOptions interface {
+	WriteWithOptions(ctx context.Context, f FileHandle, data []byte, off int64, opts *WriteOptions) (written uint32, errno syscall.Errno)
+}
+
 // Fsync is a signal to ensure writes to the Inode are flushed
-// to stable storage.
+// to stable storage. If neither the node nor the file handle
+// implements it, fsync(2) and msync(2) succeed, since written data
+// has already been passed to Write.
 type NodeFsyncer interface {
 	Fsync(ctx context.Context, f FileHandle, flags uint32) syscall.Errno
 }
 
+// Fsyncdir is called for fsync(2) on a directory, eg. to persist
+// the entries of newly created files. fuse.FSYNC_FDATASYNC is set
+// in flags for fdatasync(2). f is the handle returned by
+// NodeOpendirHandler, if any. If neither this nor
+// FileFsyncdirer is implemented, NodeFsyncer is called, and
+// otherwise the call succeeds.
+type NodeFsyncDirer interface {
+	Fsyncdir(ctx context.Context, f FileHandle, flags uint32) syscall.Errno
+}
+
 // Flush is called for the close(2) call on a file descriptor. In case
 // of a descriptor that was duplicated using dup(2), it may be called
 // more than once for the same FileHandle.  The default implementation
@@ -411,7 +560,10 @@ type NodeReleaser interface {
 }
 
 // Allocate preallocates space for future writes, so they will
-// never encounter ESPACE.
+// never encounter ESPACE. The mode holds the FALLOC_FL_* flags of
+// fallocate(2), such as FALLOC_FL_KEEP_SIZE, FALLOC_FL_PUNCH_HOLE
+// or FALLOC_FL_ZERO_RANGE. Implementations that do not support a
+// mode should return EOPNOTSUPP.
 type NodeAllocater interface {
 	Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno
 }
@@ -426,6 +578,12 @@ type NodeCopyFileRanger interface {
 	// Ugh. should have been called Copyfilerange
 }
 
+// Statx returns extended attributes (see statx(2)), eg. the
+// creation time (STATX_BTIME), for Linux. The mask holds the
+// STATX_* fields the caller asked for; out.Mask should be set to the
+// fields that were filled in. If neither the node nor the
+// FileHandle implements Statx, the result is synthesized from
+// Getattr.
 type NodeStatxer interface {
 	Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
 }
@@ -437,6 +595,16 @@ type NodeLseeker interface {
 	Lseek(ctx context.Context, f FileHandle, Off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// Bmap maps the logical block `block` of a file, in units of
+// `blocksize`, to the block on the underlying block device that
+// holds its data. This is only meaningful for file systems that
+// store file data on a block device, and are mounted as "fuseblk";
+// it lets the kernel use such files as loop devices or swap.
+// If not defined, returns ENOSYS.
+type NodeBmaper interface {
+	Bmap(ctx context.Context, block uint64, blocksize uint32) (uint64, syscall.Errno)
+}
+
 // Getlk returns locks that would conflict with the given input
 // lock. If no locks conflict, the output has type L_UNLCK. See
 // fcntl(2) for more information.
@@ -453,12 +621,43 @@ type NodeSetlker interface {
 }
 
 // Setlkw obtains a lock on a file, waiting if necessary. See fcntl(2)
-// for more information.  If not defined, returns ENOTSUP
+// for more information.  If not defined, returns ENOTSUP. The wait
+// should end with EINTR once ctx is done, ie. when the waiting
+// process receives a signal.
 type NodeSetlkwer interface {
 	Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno
 }
 
-// Ioctl implements an ioctl on an open file.
+// Flock handles flock(2) requests, ie. SETLK and SETLKW with
+// FUSE_LK_FLOCK set. The op is LOCK_SH, LOCK_EX or LOCK_UN, with
+// LOCK_NB added for non-blocking requests; these should fail with
+// EAGAIN rather than wait. A blocking request should end with EINTR
+// once ctx is done. If the file is released while holding a flock
+// lock, Flock is called with LOCK_UN.
+//
+// If not implemented, flock requests go to NodeSetlker and
+// NodeSetlkwer. Locks are only forwarded to the file system if
+// MountOptions.EnableLocks is set.
+type NodeFlocker interface {
+	Flock(ctx context.Context, f FileHandle, owner uint64, op uint32) syscall.Errno
+}
+
+// Poll reports which of the poll(2) events are ready on an open
+// file. If none are, and kh is nonzero, the file system should
+// store kh and call fuse.Server.PollNotify(kh) once events may
+// be ready, after which the kernel polls again. Poll is only called
+// if MountOptions.EnablePoll is set. If neither the node nor the
+// file handle implement it, the file is always readable and
+// writable.
+type NodePoller interface {
+	Poll(ctx context.Context, f FileHandle, events uint32, kh uint64) (revents uint32, errno syscall.Errno)
+}
+
+// Ioctl implements an ioctl on an open file. The input and output
+// buffers have the argument size encoded in cmd, and arg should only
+// be used for ioctls that pass a plain integer. For unrestricted
+// ioctls (CUSE), the library retries the call to fetch the
+// fixed-size argument first.
 type NodeIoctler interface {
 	Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno)
 }
@@ -466,15 +665,29 @@ type NodeIoctler interface {
 // OnForget is called when the node becomes unreachable. This can
 // happen because the kernel issues a FORGET request,
 // ForgetPersistent() is called on the inode, the last child of the
-// directory disappears, or (for the root node) unmounting the file
-// system. Implementers must make sure that the inode cannot be
-// revived concurrently by a LOOKUP call. Modifying the tree using
-// RmChild and AddChild can also trigger a spurious OnForget; use
-// MvChild instead.
+// directory disappears, or unmounting the file system, which
+// forgets all nodes that are still live, the root last. A node
+// created by Lookup that loses against an existing node with the
+// same StableAttr is forgotten right away, so every OnAdd is
+// balanced by one OnForget. Implementers must make sure that the
+// inode cannot be revived concurrently by a LOOKUP call. Modifying
+// the tree using RmChild and AddChild can also trigger a spurious
+// OnForget; use MvChild instead. A revived node gets OnForget
+// again when it becomes unreachable again. See also
+// Inode.IsForgotten.
 type NodeOnForgetter interface {
 	OnForget()
 }
 
+// OnBatchForget is called on the root node with all nodes that
+// became unreachable through a single BATCH_FORGET request from the
+// kernel, after their individual OnForget calls. File systems that
+// track external resources per inode can use it to release them in
+// bulk.
+type NodeBatchForgetter interface {
+	OnBatchForget(nodes []*Inode)
+}
+
 // DirStream lists directory entries.
 type DirStream interface {
 	// HasNext indicates if there are further entries. HasNext
@@ -484,6 +697,13 @@ type DirStream interface {
 	// Next retrieves the next entry. It is only called if HasNext
 	// has previously returned true.  The Errno return may be used to
 	// indicate I/O errors
+	//
+	// The Name of the entry may be backed by a buffer owned by the
+	// stream (see fuse.DirEntry.SetNameBytes), and is then only
+	// valid until the next call on the stream. Streams of large
+	// directories can use this to reuse one buffer for all names.
+	// The library copies the name into the reply right away, and
+	// copies it again where it needs to keep it.
 	Next() (fuse.DirEntry, syscall.Errno)
 
 	// Close releases resources related to this directory
@@ -491,6 +711,25 @@ type DirStream interface {
 	Close()
 }
 
+// SeekableDirStream is a DirStream that can continue from an
+// earlier position. The positions are the DirEntry.Off values
+// returned by Next: seeking to the Off of an entry makes the
+// stream continue with the entry after it, and 0 is the start of
+// the stream. If Next leaves Off at zero, the entries are numbered
+// 1, 2, 3, ... from the start of the stream.
+//
+// The bridge hands these values to the kernel as the d_off cookies
+// of the directory entries. A READDIR that does not continue where
+// the previous one stopped, eg. after seekdir(3) or an interrupted
+// read, calls Seekdir. For a DirStream that does not implement
+// SeekableDirStream, the bridge instead reads the directory again
+// from the start, up to the requested offset, which is slow for
+// large directories.
+type SeekableDirStream interface {
+	DirStream
+	FileSeekdirer
+}
+
 // Lookup should find a direct child of a directory by the child's name.  If
 // the entry does not exist, it should return ENOENT and optionally
 // set a NegativeTimeout in `out`. If it does exist, it should return
@@ -562,6 +801,11 @@ type NodeOpendirer interface {
 // If a directory does not implement NodeReaddirer, a list of
 // currently known children from the tree is returned. This means that
 // static in-memory file systems need not implement NodeReaddirer.
+//
+// If the DirStream also implements FileLookuper, its Lookup method
+// supplies the attributes for READDIRPLUS, so the file system can
+// return attributes fetched along with the listing, instead of
+// serving a NodeLookuper.Lookup call for each entry.
 type NodeReaddirer interface {
 	Readdir(ctx context.Context) (DirStream, syscall.Errno)
 }
@@ -594,6 +838,12 @@ type NodeSymlinker interface {
 // child. It typically also returns a FileHandle as a
 // reference for future reads/writes.
 // Default is to return EROFS.
+//
+// Create should fill in out completely: the attributes of the new
+// file, and optionally the entry and attribute timeouts, which
+// default to Options.EntryTimeout and Options.AttrTimeout if zero.
+// The reply is built from out without calling Getattr, so creating
+// a file takes a single call into the file system.
 type NodeCreater interface {
 	Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
@@ -611,9 +861,28 @@ type NodeRmdirer interface {
 	Rmdir(ctx context.Context, name string) syscall.Errno
 }
 
+// Tmpfile creates an unnamed file in this directory, for open(2)
+// with O_TMPFILE. The flags include O_TMPFILE. The returned Inode
+// is not added to the FS tree; it can be given a name later with
+// linkat(2), which arrives as NodeLinker.Link on the directory.
+// It is called for the TMPFILE opcode, which Linux sends since
+// version 6.1, and for CREATE with O_TMPFILE in the flags.
+// If not defined, O_TMPFILE fails with EOPNOTSUPP.
+type NodeTmpfiler interface {
+	Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
 // Rename should move a child from one directory to a different
 // one. The change is effected in the FS tree if the return status is
 // OK. Default is to return ENOTSUP.
+//
+// The flags argument holds the renameat2(2) flags
+// RENAME_NOREPLACE, RENAME_EXCHANGE and RENAME_WHITEOUT.
+// Implementations that do not support a flag should return EINVAL,
+// like the kernel does for file systems without renameat2 support.
+// For RENAME_EXCHANGE, the two children are swapped in the FS tree.
+// For RENAME_WHITEOUT, the kernel looks up the source name again
+// to find the whiteout.
 type NodeRenamer interface {
 	Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno
 }
@@ -650,16 +919,33 @@ type FilePassthroughFder interface {
 	PassthroughFd() (int, bool)
 }
 
+// FileDirectIOAligner is a file that can only do I/O at aligned
+// offsets and sizes, typically because it is backed by a file
+// opened with O_DIRECT. DirectIOAlignment returns the required
+// alignment in bytes, which must be a power of two. READ and WRITE
+// requests whose offset or size is not a multiple of it fail with
+// EINVAL before reaching the file, as they would for O_DIRECT. A
+// return value of 0 or 1 disables the check.
+//
+// Misaligned requests only come from the kernel if the file is
+// not cached, so this should be combined with
+// fuse.FOPEN_DIRECT_IO.
+type FileDirectIOAligner interface {
+	DirectIOAlignment() int
+}
+
 // See NodeReleaser.
 type FileReleaser interface {
 	Release(ctx context.Context) syscall.Errno
 }
 
-// See NodeGetattrer.
+// FileGetattrer is called for GETATTR if the Inode does not
+// implement NodeGetattrer, and the file is open. See NodeGetattrer.
 type FileGetattrer interface {
 	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
 }
 
+// See NodeStatxer.
 type FileStatxer interface {
 	Statx(ctx context.Context, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
 }
@@ -669,11 +955,21 @@ type FileReader interface {
 	Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 }
 
+// See NodeReaderWithOptions.
+type FileReaderWithOptions interface {
+	ReadWithOptions(ctx context.Context, dest []byte, off int64, opts *ReadOptions) (fuse.ReadResult, syscall.Errno)
+}
+
 // See NodeWriter.
 type FileWriter interface {
 	Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno)
 }
 
+// See NodeWriterWithOptions.
+type FileWriterWithOptions interface {
+	WriteWithOptions(ctx context.Context, data []byte, off int64, opts *WriteOptions) (written uint32, errno syscall.Errno)
+}
+
 // See NodeGetlker.
 type FileGetlker interface {
 	Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno
@@ -689,6 +985,11 @@ type FileSetlkwer interface {
 	Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno
 }
 
+// See NodeFlocker.
+type FileFlocker interface {
+	Flock(ctx context.Context, owner uint64, op uint32) syscall.Errno
+}
+
 // See NodeLseeker.
 type FileLseeker interface {
 	Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno)
@@ -719,6 +1020,11 @@ type FileIoctler interface {
 	Ioctl(ctx context.Context, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno)
 }
 
+// See NodePoller.
+type FilePoller interface {
+	Poll(ctx context.Context, events uint32, kh uint64) (revents uint32, errno syscall.Errno)
+}
+
 // Opens a directory. This supersedes NodeOpendirer, allowing to pass
 // back flags (eg. FOPEN_CACHE_DIR).
 type NodeOpendirHandler interface {
@@ -727,13 +1033,16 @@ type NodeOpendirHandler interface {
 
 // FileReaddirenter is a directory that supports reading.
 type FileReaddirenter interface {
-	// Read a single directory entry.
+	// Read a single directory entry. As with DirStream.Next, the
+	// entry and its Name only have to remain valid until the next
+	// call.
 	Readdirent(ctx context.Context) (*fuse.DirEntry, syscall.Errno)
 }
 
 // FileLookuper is a directory handle that supports lookup. If this is
 // defined, FileLookuper.Lookup on the directory is called for
-// READDIRPLUS calls, rather than NodeLookuper.Lookup. The name passed
+// READDIRPLUS calls, rather than NodeLookuper.Lookup. It may also be
+// implemented by a DirStream returned from NodeReaddirer. The name passed
 // in will always be the last name produced by Readdirent. If a child
 // with the given name already exists, that should be returned. In
 // case of directory seeks that straddle response boundaries,
@@ -742,7 +1051,8 @@ type FileLookuper interface {
 	Lookup(ctx context.Context, name string, out *fuse.EntryOut) (child *Inode, errno syscall.Errno)
 }
 
-// FileFsyncer is a directory that supports fsyncdir.
+// FileFsyncdirer is a directory handle that supports fsyncdir. See
+// NodeFsyncDirer.
 type FileFsyncdirer interface {
 	Fsyncdir(ctx context.Context, flags uint32) syscall.Errno
 }
@@ -777,18 +1087,68 @@ type Options struct {
 	// NegativeTimeout, if non-nil, defines the overall entry timeout
 	// for failed lookups (fuse.ENOENT). See [fuse.EntryOut] for
 	// more information.
+	//
+	// The three timeouts can be changed after mounting with
+	// [fuse.Server.UpdateTimeouts].
 	NegativeTimeout *time.Duration
 
+	// EntryTimeoutFunc, if set, is called to compute the entry
+	// timeout for each node returned in an EntryOut. A negative
+	// return value falls back to EntryTimeout. Timeouts set
+	// explicitly by the node's own methods take precedence.
+	EntryTimeoutFunc func(node *Inode) time.Duration
+
+	// AttrTimeoutFunc, if set, is called to compute the
+	// attribute timeout for each node in an EntryOut, AttrOut or
+	// StatxOut. A negative return value falls back to
+	// AttrTimeout. Timeouts set explicitly by the node's own
+	// methods take precedence.
+	AttrTimeoutFunc func(node *Inode) time.Duration
+
+	// ReaddirPlusSkipCached, if set, makes READDIRPLUS skip the
+	// lookup for children whose entry, as sent in an earlier
+	// LOOKUP or READDIRPLUS reply, has not expired yet. These are
+	// sent with a zero NodeId, which tells the kernel to keep its
+	// cached entry. This saves lookups when listing the same
+	// directory repeatedly, at the cost of not refreshing
+	// attributes before AttrTimeout.
+	ReaddirPlusSkipCached bool
+
 	// FirstAutomaticIno is start of the automatic inode numbers that are handed
 	// out sequentially.
 	//
 	// If unset, the default is 2^63.
 	FirstAutomaticIno uint64
 
+	// Ino32, if set, reports compact 32-bit inode numbers to the
+	// kernel, for tools and 32-bit programs that cannot handle
+	// 64-bit st_ino values. Each StableAttr.Ino is assigned a
+	// free number below 2^31 when the kernel looks it up (the
+	// root has 1), and keeps it until the kernel forgets the
+	// node, after which the number may be reused. The numbers
+	// are thus only stable while the kernel holds the node.
+	// READDIR entries for nodes that the kernel does not hold are
+	// folded into the numbers from 2^31 on, which may collide
+	// among themselves. If all numbers below 2^31 are in use,
+	// newly looked up nodes are folded too, and a warning is
+	// logged.
+	//
+	// StableAttr.Ino itself, as seen by the file system, is not
+	// affected.
+	Ino32 bool
+
 	// OnAdd, if non-nil, is an alternative way to specify the OnAdd
 	// functionality of the root node.
 	OnAdd func(ctx context.Context)
 
+	// OnMount, if non-nil, is called once, when the file system
+	// is first mounted. Unlike OnAdd, it runs when the kernel
+	// connection is up, so nodes can send notifications. It is
+	// called before the first request is served, so it is a good
+	// place for global setup, such as opening a database or
+	// starting a file watcher.
+	OnMount func(ctx context.Context, root *Inode)
+
 	// NullPermissions, if set, leaves null file permissions
 	// alone. Otherwise, they are set to 755 (dirs) or 644 (other
 	// files.), which is necessary for doing a chdir into the FUSE
@@ -803,6 +1163,54 @@ type Options struct {
 	// zero (zero) GID.
 	GID uint32
 
+	// XattrFilter, if non-nil, is consulted before passing an
+	// extended attribute to the Node*xattr methods. The ns
+	// argument is XattrNamespace(name), and the context carries
+	// the caller. Attributes for which it returns false are
+	// hidden from getxattr(2) and listxattr(2) (ENOATTR), and
+	// cannot be set or removed (EPERM). For example, a filter
+	// could allow "system.posix_acl_access" while rejecting the
+	// "trusted" namespace for callers other than root.
+	XattrFilter func(ctx context.Context, ns, name string) bool
+
+	// AttrCacheSize, if positive, enables a cache in the bridge
+	// for the results of Getattr, holding the attributes of up to
+	// this many nodes, evicting the least recently used. Unlike the
+	// kernel's attribute cache, it survives the kernel forgetting
+	// a node. Entries are dropped when the node is changed through
+	// the file system: by SETATTR, WRITE, FALLOCATE,
+	// COPY_FILE_RANGE, truncating OPEN, xattr changes, by entry
+	// operations on it or its parent directory, and by
+	// Inode.NotifyContent, NotifyAttr, NotifyEntry and
+	// NotifyDelete. File systems must call one of these if the
+	// backend changes by other means. Writes to passthrough files
+	// bypass the file system, so the cache should not be used
+	// with them.
+	//
+	// This helps metadata-heavy workloads if Getattr is
+	// expensive, eg. on network backends.
+	AttrCacheSize int
+
+	// MaxNameLen is the maximum length in bytes of a file name.
+	// Longer names fail with ENAMETOOLONG in LOOKUP, CREATE,
+	// MKNOD, MKDIR, SYMLINK, LINK and RENAME, without calling the
+	// file system. Statfs reports it as NameLen if the file
+	// system leaves that at zero or returns more. If zero or
+	// negative, names are not checked, and the kernel passes names
+	// up to 1024 bytes.
+	MaxNameLen int
+
+	// NotifyDebounce, if positive, coalesces the invalidations
+	// of Inode.NotifyContent and NotifyAttr. The first call for
+	// an inode is sent right away. Later calls within
+	// NotifyDebounce are merged into a single invalidation of the
+	// smallest range covering all of them, which is sent when the
+	// window ends. This avoids flooding the kernel if the backend
+	// changes rapidly, at the cost of invalidating more and
+	// later. Merged calls return OK, even if the kernel no longer
+	// knows the inode.
+	NotifyDebounce time.Duration
+
 	// ServerCallbacks are optional callbacks to stub out notification functions
 	// for testing a filesystem without mounting it.
 	ServerCallbacks ServerCallbacks
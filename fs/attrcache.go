@@ -0,0 +1,85 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// attrCache is a bounded LRU cache of Getattr results, keyed by
+// StableAttr so entries survive the kernel forgetting the node. See
+// Options.AttrCacheSize.
+type attrCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[StableAttr]*list.Element
+	lru     list.List
+
+	// gen is incremented by every invalidation. A Getattr result
+	// is only stored if no invalidation happened while it was
+	// computed, as it may predate the change.
+	gen uint64
+}
+
+type attrCacheEntry struct {
+	key  StableAttr
+	attr fuse.AttrOut
+}
+
+func newAttrCache(size int) *attrCache {
+	return &attrCache{
+		size:    size,
+		entries: make(map[StableAttr]*list.Element),
+	}
+}
+
+// get copies the cached attributes for key into out, and returns
+// whether there were any. On a miss, gen should be passed to put.
+func (c *attrCache) get(key StableAttr, out *fuse.AttrOut) (gen uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[key]
+	if e == nil {
+		return c.gen, false
+	}
+	c.lru.MoveToFront(e)
+	*out = e.Value.(*attrCacheEntry).attr
+	return c.gen, true
+}
+
+// put stores attr for key, unless the cache was invalidated since
+// get returned gen.
+func (c *attrCache) put(key StableAttr, gen uint64, attr *fuse.AttrOut) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if e := c.entries[key]; e != nil {
+		e.Value.(*attrCacheEntry).attr = *attr
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&attrCacheEntry{key: key, attr: *attr})
+	if c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*attrCacheEntry).key)
+	}
+}
+
+// invalidate drops the entry for key.
+func (c *attrCache) invalidate(key StableAttr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e := c.entries[key]; e != nil {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// countGetattrNode is a file whose size is its Getattr call count.
+type countGetattrNode struct {
+	Inode
+
+	calls uint64
+}
+
+var _ = (NodeGetattrer)((*countGetattrNode)(nil))
+var _ = (NodeSetattrer)((*countGetattrNode)(nil))
+
+func (n *countGetattrNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = atomic.AddUint64(&n.calls, 1)
+	return 0
+}
+
+func (n *countGetattrNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return 0
+}
+
+// nopServerCallbacks accepts all notifications.
+type nopServerCallbacks struct{}
+
+func (nopServerCallbacks) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return fuse.OK
+}
+func (nopServerCallbacks) EntryNotify(parent uint64, name string) fuse.Status { return fuse.OK }
+func (nopServerCallbacks) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	return fuse.OK
+}
+func (nopServerCallbacks) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return 0, fuse.OK
+}
+func (nopServerCallbacks) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return fuse.OK
+}
+
+func TestAttrCache(t *testing.T) {
+	root := &Inode{}
+	var nodes []*countGetattrNode
+	rawFS := NewNodeFS(root, &Options{
+		AttrCacheSize:   2,
+		ServerCallbacks: nopServerCallbacks{},
+		OnAdd: func(ctx context.Context) {
+			for _, name := range []string{"a", "b", "c"} {
+				n := &countGetattrNode{}
+				nodes = append(nodes, n)
+				root.AddChild(name, root.NewPersistentInode(ctx, n, StableAttr{}), false)
+			}
+		},
+	})
+
+	ids := map[string]uint64{}
+	lookup := func(name string) {
+		t.Helper()
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		ids[name] = out.NodeId
+	}
+
+	// getattr returns the Getattr call count of the node,
+	// as seen through the cache.
+	getattr := func(name string) uint64 {
+		t.Helper()
+		var out fuse.AttrOut
+		if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: ids[name]}}, &out); !code.Ok() {
+			t.Fatalf("GetAttr(%q): %v", name, code)
+		}
+		return out.Size
+	}
+
+	// LOOKUP fills the cache too. With room for 2 entries, "c"
+	// evicts "a".
+	for _, name := range []string{"a", "b", "c"} {
+		lookup(name)
+	}
+	if got := getattr("a"); got != 2 {
+		t.Errorf("first: got %d calls, want 2", got)
+	}
+	if got := getattr("a"); got != 2 {
+		t.Errorf("cached: got %d calls, want 2", got)
+	}
+
+	// The cache survives FORGET.
+	rawFS.Forget(ids["a"], 1)
+	lookup("a")
+	if got := getattr("a"); got != 2 {
+		t.Errorf("after FORGET: got %d calls, want 2", got)
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.NodeId = ids["a"]
+	if code := rawFS.SetAttr(nil, in, &fuse.AttrOut{}); !code.Ok() {
+		t.Fatalf("SetAttr: %v", code)
+	}
+	if got := getattr("a"); got != 3 {
+		t.Errorf("after SETATTR: got %d calls, want 3", got)
+	}
+
+	rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: ids["a"]}}, []byte("x"))
+	if got := getattr("a"); got != 4 {
+		t.Errorf("after WRITE: got %d calls, want 4", got)
+	}
+
+	nodes[0].NotifyContent(0, 0)
+	if got := getattr("a"); got != 5 {
+		t.Errorf("after NotifyContent: got %d calls, want 5", got)
+	}
+
+	// "b" and "c" evict "a" again.
+	getattr("b")
+	getattr("c")
+	if got := getattr("a"); got != 6 {
+		t.Errorf("after eviction: got %d calls, want 6", got)
+	}
+	if got := getattr("c"); got != 2 {
+		t.Errorf("c: got %d calls, want 2", got)
+	}
+}
+
+// TestAttrCacheConcurrentInvalidate checks that a Getattr that
+// started before an invalidation does not repopulate the cache with
+// stale data.
+func TestAttrCacheConcurrentInvalidate(t *testing.T) {
+	c := newAttrCache(10)
+	key := StableAttr{Ino: 2, Mode: syscall.S_IFREG}
+
+	var out fuse.AttrOut
+	gen, ok := c.get(key, &out)
+	if ok {
+		t.Fatal("empty cache had an entry")
+	}
+	// Getattr is running, while the file changes.
+	c.invalidate(key)
+	c.put(key, gen, &fuse.AttrOut{Attr: fuse.Attr{Size: 1}})
+	if _, ok := c.get(key, &out); ok {
+		t.Fatalf("stale entry was stored: %v", out)
+	}
+
+	var wg sync.WaitGroup
+	var size uint64
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				var out fuse.AttrOut
+				gen, ok := c.get(key, &out)
+				if !ok {
+					out.Size = atomic.LoadUint64(&size)
+					c.put(key, gen, &out)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				atomic.AddUint64(&size, 1)
+				c.invalidate(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := c.get(key, &out); ok && out.Size != atomic.LoadUint64(&size) {
+		t.Errorf("got cached size %d, want %d", out.Size, size)
+	}
+}
@@ -14,6 +14,8 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal"
+	"github.com/hanwen/go-fuse/v2/internal/ioctl"
+	"golang.org/x/sys/unix"
 )
 
 func errnoToStatus(errno syscall.Errno) fuse.Status {
@@ -40,6 +42,13 @@ type fileEntry struct {
 	// Store the last read, in case readdir was interrupted.
 	lastRead []fuse.DirEntry
 
+	// names holds the names of lastRead and overflow, since
+	// DirStream.Next may return names that are overwritten by the
+	// next call. The two buffers alternate between reads, because
+	// an interrupted read replays the entries of the previous one.
+	names    [2][]byte
+	namesIdx int
+
 	// dirOffset is the current location in the directory (see `telldir(3)`).
 	// The value is equivalent to `d_off` (see `getdents(2)`) of the last
 	// directory entry sent to the kernel so far.
@@ -71,10 +80,129 @@ type serverBackingFdCallbacks interface {
 	UnregisterBackingFd(id int32) syscall.Errno
 }
 
+// sharedServers is the ServerCallbacks for a bridge that serves
+// several mounts. Notifications are sent to all of them.
+type sharedServers struct {
+	// owner is the first server. Backing files registered before
+	// the tree was shared belong to it.
+	owner *fuse.Server
+
+	mu      sync.Mutex
+	servers []*fuse.Server
+}
+
+func (s *sharedServers) add(srv *fuse.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = append(s.servers, srv)
+}
+
+func (s *sharedServers) remove(srv *fuse.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.servers {
+		if e == srv {
+			s.servers = append(s.servers[:i], s.servers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *sharedServers) list() []*fuse.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*fuse.Server{}, s.servers...)
+}
+
+// each calls fn for all servers. It returns OK if any of the calls
+// succeeded. The kernel of a mount that has not seen the inode
+// returns ENOENT, so otherwise, it returns the first other error,
+// or ENOENT.
+func (s *sharedServers) each(fn func(srv *fuse.Server) fuse.Status) fuse.Status {
+	ok := false
+	result := fuse.ENOENT
+	for _, srv := range s.list() {
+		if code := fn(srv); code.Ok() {
+			ok = true
+		} else if result == fuse.ENOENT {
+			result = code
+		}
+	}
+	if ok {
+		return fuse.OK
+	}
+	return result
+}
+
+func (s *sharedServers) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	return s.each(func(srv *fuse.Server) fuse.Status { return srv.DeleteNotify(parent, child, name) })
+}
+
+func (s *sharedServers) EntryNotify(parent uint64, name string) fuse.Status {
+	return s.each(func(srv *fuse.Server) fuse.Status { return srv.EntryNotify(parent, name) })
+}
+
+func (s *sharedServers) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	return s.each(func(srv *fuse.Server) fuse.Status { return srv.InodeNotify(node, off, length) })
+}
+
+func (s *sharedServers) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	return s.each(func(srv *fuse.Server) fuse.Status { return srv.InodeNotifyStoreCache(node, offset, data) })
+}
+
+// InodeRetrieveCache reads from the first mount that has the inode
+// cached.
+func (s *sharedServers) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n int, st fuse.Status) {
+	st = fuse.ENOENT
+	for _, srv := range s.list() {
+		n, st = srv.InodeRetrieveCache(node, offset, dest)
+		if st.Ok() && n > 0 {
+			break
+		}
+	}
+	return n, st
+}
+
+// RegisterBackingFd fails: a backing ID is only valid for the
+// mount that registered it.
+func (s *sharedServers) RegisterBackingFd(*fuse.BackingMap) (int32, syscall.Errno) {
+	return 0, syscall.ENOTSUP
+}
+
+func (s *sharedServers) UnregisterBackingFd(id int32) syscall.Errno {
+	bc, ok := interface{}(s.owner).(serverBackingFdCallbacks)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return bc.UnregisterBackingFd(id)
+}
+
 type rawBridge struct {
 	options Options
 	root    *Inode
-	server  ServerCallbacks
+
+	// serverMu protects server, which changes when the bridge
+	// starts serving a second mount. See Init.
+	serverMu sync.Mutex
+	server   ServerCallbacks
+	// mounted is the first server passed to Init.
+	mounted *fuse.Server
+	// shared is set if the bridge serves more than one mount.
+	shared *sharedServers
+	// mounts counts the servers that have not been unmounted yet.
+	mounts int
+
+	// timeoutMu protects the timeouts in options, which may be
+	// changed by UpdateTimeouts.
+	timeoutMu sync.Mutex
+
+	// attrCache is set if Options.AttrCacheSize > 0.
+	attrCache *attrCache
+
+	// notifyMu protects notifyPending, the invalidations being
+	// coalesced for Options.NotifyDebounce.
+	notifyMu      sync.Mutex
+	notifyPending map[*Inode]*pendingNotify
 
 	// mu protects the following data.  Locks for inodes must be
 	// taken before rawBridge.mu
@@ -114,6 +242,89 @@ type rawBridge struct {
 
 	// If set, don't try to register backing file for Create/Open calls.
 	disableBackingFiles bool
+
+	// Set if the kernel agreed to do writeback caching.
+	writebackCache bool
+
+	// Set if the kernel understands FOPEN_NOFLUSH.
+	supportsNoFlush bool
+
+	// ino32Mu protects the following data, used for Options.Ino32.
+	ino32Mu sync.Mutex
+	// ino32 maps StableAttr.Ino to the number reported to the
+	// kernel, for the nodes the kernel holds. Nil unless
+	// Options.Ino32 is set.
+	ino32     map[uint64]uint32
+	nextIno32 uint32
+	// numbers released by forgotten nodes.
+	freeIno32 []uint32
+	// maxIno32 is the highest number handed out. Tests lower it
+	// to exercise exhaustion.
+	maxIno32       uint32
+	ino32Exhausted bool
+}
+
+// foldIno32 folds ino into the upper half of the 32-bit range,
+// which kernelIno never hands out.
+func foldIno32(ino uint64) uint64 {
+	return uint64(uint32(ino)^uint32(ino>>32)) | 1<<31
+}
+
+// kernelIno returns the inode number to report to the kernel for
+// the given StableAttr.Ino. The number is assigned on first use,
+// and released by releaseIno32 once the kernel forgets the node.
+func (b *rawBridge) kernelIno(ino uint64) uint64 {
+	if b.ino32 == nil {
+		return ino
+	}
+	b.ino32Mu.Lock()
+	defer b.ino32Mu.Unlock()
+	if i, ok := b.ino32[ino]; ok {
+		return uint64(i)
+	}
+	if ino == 0 {
+		return 0
+	}
+	var i uint32
+	if l := len(b.freeIno32); l > 0 {
+		i = b.freeIno32[l-1]
+		b.freeIno32 = b.freeIno32[:l-1]
+	} else if b.nextIno32 <= b.maxIno32 {
+		i = b.nextIno32
+		b.nextIno32++
+	} else {
+		if !b.ino32Exhausted {
+			b.ino32Exhausted = true
+			b.logf("warning: 32-bit inode numbers exhausted; inode numbers may collide from now on")
+		}
+		return foldIno32(ino)
+	}
+	b.ino32[ino] = i
+	return uint64(i)
+}
+
+// peekIno32 is like kernelIno, but does not assign a number. It is
+// for directory entries, which the kernel does not hold on to.
+func (b *rawBridge) peekIno32(ino uint64) uint64 {
+	b.ino32Mu.Lock()
+	defer b.ino32Mu.Unlock()
+	if i, ok := b.ino32[ino]; ok {
+		return uint64(i)
+	}
+	if ino == 0 {
+		return 0
+	}
+	return foldIno32(ino)
+}
+
+// releaseIno32 makes the number of ino available for reuse.
+func (b *rawBridge) releaseIno32(ino uint64) {
+	b.ino32Mu.Lock()
+	defer b.ino32Mu.Unlock()
+	if i, ok := b.ino32[ino]; ok && i != 1 {
+		delete(b.ino32, ino)
+		b.freeIno32 = append(b.freeIno32, i)
+	}
 }
 
 // newInode creates creates new inode pointing to ops.
@@ -171,10 +382,13 @@ func (b *rawBridge) newInode(ctx context.Context, ops InodeEmbedder, id StableAt
 	return ch
 }
 
-// addNewChild inserts the child into the tree. Returns file handle if file != nil.
-// Unless fileFlags has the syscall.O_EXCL bit set, child.stableAttr will be used
-// to find an already-known node. If one is found, `child` is ignored and the
-// already-known one is used. The node that was actually used is returned.
+// addNewChild registers child with the kernel, and adds it to parent
+// under name; an empty name registers it without adding it to the
+// tree, as for O_TMPFILE. Unless fileFlags has the syscall.O_EXCL bit
+// set, child.stableAttr will be used to find an already-known node.
+// If one is found, `child` is ignored and the already-known one is
+// used. The node that was actually used is returned, along with the
+// file handle entry if file != nil.
 func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file FileHandle, fileFlags uint32, out *fuse.EntryOut) (selected *Inode, fe *fileEntry) {
 	if name == "." || name == ".." {
 		log.Panicf("BUG: tried to add virtual entry %q to the actual tree", name)
@@ -229,6 +443,7 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 
 	child.lookupCount++
 	child.changeCounter++
+	child.forgotten = false
 
 	b.kernelNodeIds[child.nodeId] = child
 	if len(b.kernelNodeIds) > b.nodeCountHigh {
@@ -240,26 +455,112 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 		fe = b.registerFile(child, file, fileFlags)
 	}
 
-	parent.setEntry(name, child)
+	if name != "" {
+		parent.setEntry(name, child)
+	}
 
 	out.NodeId = child.nodeId
 	out.Generation = child.stableAttr.Gen
-	out.Attr.Ino = child.stableAttr.Ino
+	out.Attr.Ino = b.kernelIno(child.stableAttr.Ino)
 
 	b.mu.Unlock()
 	unlockNodes(parent, child)
 
+	if child != orig {
+		// orig lost against an existing node, and will not be
+		// used; balance its OnAdd.
+		orig.mu.Lock()
+		unused := orig.lookupCount == 0 && orig.parents.count() == 0 && !orig.keep() && orig.children.len() == 0
+		orig.mu.Unlock()
+		if unused {
+			orig.forget()
+		}
+	}
 	return child, fe
 }
 
-func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
+var _ = (fuse.TimeoutUpdater)((*rawBridge)(nil))
+
+// UpdateTimeouts replaces the EntryTimeout, AttrTimeout and
+// NegativeTimeout options.
+func (b *rawBridge) UpdateTimeouts(entry, attr, negative time.Duration) {
+	b.timeoutMu.Lock()
+	defer b.timeoutMu.Unlock()
+	b.options.EntryTimeout = &entry
+	b.options.AttrTimeout = &attr
+	b.options.NegativeTimeout = &negative
+}
+
+// timeouts returns the EntryTimeout, AttrTimeout and
+// NegativeTimeout options currently in effect.
+func (b *rawBridge) timeouts() (entry, attr, negative *time.Duration) {
+	b.timeoutMu.Lock()
+	defer b.timeoutMu.Unlock()
+	return b.options.EntryTimeout, b.options.AttrTimeout, b.options.NegativeTimeout
+}
+
+// nodeTimeouts returns the entry and attribute timeouts for n,
+// applying Options.EntryTimeoutFunc and Options.AttrTimeoutFunc.
+func (b *rawBridge) nodeTimeouts(n *Inode) (entry, attr *time.Duration) {
+	entry, attr, _ = b.timeouts()
+	if f := b.options.EntryTimeoutFunc; f != nil {
+		if d := f(n); d >= 0 {
+			entry = &d
+		}
+	}
+	if f := b.options.AttrTimeoutFunc; f != nil {
+		if d := f(n); d >= 0 {
+			attr = &d
+		}
+	}
+	return entry, attr
+}
+
+func (b *rawBridge) setEntryOutTimeout(n *Inode, out *fuse.EntryOut) {
 	b.setAttr(&out.Attr)
-	if b.options.AttrTimeout != nil && out.AttrTimeout() == 0 {
-		out.SetAttrTimeout(*b.options.AttrTimeout)
+	entry, attr := b.nodeTimeouts(n)
+	if attr != nil && out.AttrTimeout() == 0 {
+		out.SetAttrTimeout(*attr)
 	}
-	if b.options.EntryTimeout != nil && out.EntryTimeout() == 0 {
-		out.SetEntryTimeout(*b.options.EntryTimeout)
+	if entry != nil && out.EntryTimeout() == 0 {
+		out.SetEntryTimeout(*entry)
+	}
+}
+
+func (b *rawBridge) setNegativeTimeout(out *fuse.EntryOut) bool {
+	_, _, negative := b.timeouts()
+	if negative == nil {
+		return false
 	}
+	out.SetEntryTimeout(*negative)
+	return true
+}
+
+// setEntryExpiry records until when the kernel may use the entry
+// in out, for Options.ReaddirPlusSkipCached.
+func (b *rawBridge) setEntryExpiry(child *Inode, out *fuse.EntryOut) {
+	if !b.options.ReaddirPlusSkipCached {
+		return
+	}
+	expiry := time.Now().Add(out.EntryTimeout())
+	child.mu.Lock()
+	child.entryExpiry = expiry
+	child.mu.Unlock()
+}
+
+// entryCached returns whether the kernel has a valid entry for the
+// directory entry de in parent.
+func (b *rawBridge) entryCached(parent *Inode, de *fuse.DirEntry) bool {
+	child := parent.GetChild(de.Name)
+	if child == nil {
+		return false
+	}
+	if de.Mode != 0 && de.Mode&syscall.S_IFMT != child.stableAttr.Mode&syscall.S_IFMT {
+		return false
+	}
+	child.mu.Lock()
+	defer child.mu.Unlock()
+	return child.lookupCount > 0 && time.Now().Before(child.entryExpiry)
 }
 
 func (b *rawBridge) setAttr(out *fuse.Attr) {
@@ -278,14 +579,15 @@ func (b *rawBridge) setAttr(out *fuse.Attr) {
 	setBlocks(out)
 }
 
-func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
-	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
-		out.SetTimeout(*b.options.AttrTimeout)
+func (b *rawBridge) setAttrTimeout(n *Inode, out *fuse.AttrOut) {
+	if _, attr := b.nodeTimeouts(n); attr != nil && out.Timeout() == 0 {
+		out.SetTimeout(*attr)
 	}
 }
 
 // NewNodeFS creates a node based filesystem based on the
-// InodeEmbedder instance for the root of the tree.
+// InodeEmbedder instance for the root of the tree. The result may
+// be passed to several servers; see MountShared.
 func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 	bridge := &rawBridge{
 		automaticIno: opts.FirstAutomaticIno,
@@ -305,6 +607,9 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		bridge.options.EntryTimeout = &oneSec
 		bridge.options.AttrTimeout = &oneSec
 	}
+	if bridge.options.AttrCacheSize > 0 {
+		bridge.attrCache = newAttrCache(bridge.options.AttrCacheSize)
+	}
 
 	stableAttr := StableAttr{
 		Ino:  root.embed().StableAttr().Ino,
@@ -323,6 +628,12 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 	)
 	bridge.root = root.embed()
 	bridge.root.lookupCount = 1
+	if bridge.options.Ino32 {
+		// The root always has inode number 1.
+		bridge.ino32 = map[uint64]uint32{stableAttr.Ino: 1}
+		bridge.nextIno32 = 2
+		bridge.maxIno32 = 1<<31 - 1
+	}
 	bridge.kernelNodeIds = map[uint64]*Inode{
 		1: bridge.root,
 	}
@@ -354,13 +665,18 @@ func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 }
 
 func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	ctx := b.newContext(cancel, header)
+	if name == "." || name == ".." {
+		return b.lookupExport(ctx, header.NodeId, name, out)
+	}
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	parent, _ := b.inode(header.NodeId, 0)
-	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
 	child, errno := b.lookup(ctx, parent, name, out)
 
 	if errno != 0 {
-		if errno == syscall.ENOENT && b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
-			out.SetEntryTimeout(*b.options.NegativeTimeout)
+		if errno == syscall.ENOENT && out.EntryTimeout() == 0 && b.setNegativeTimeout(out) {
 			errno = 0
 		}
 		return errnoToStatus(errno)
@@ -368,7 +684,51 @@ func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name s
 
 	child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
+	b.setEntryExpiry(child, out)
+	return fuse.OK
+}
+
+// lookupExport handles the lookups of "." and ".." that the kernel
+// sends to decode file handles with CAP_EXPORT_SUPPORT. The NodeId
+// comes from the handle, so it may have been forgotten in the
+// meantime.
+func (b *rawBridge) lookupExport(ctx *fuse.Context, id uint64, name string, out *fuse.EntryOut) fuse.Status {
+	b.mu.Lock()
+	n := b.kernelNodeIds[id]
+	b.mu.Unlock()
+	if n == nil {
+		return fuse.Status(syscall.ESTALE)
+	}
+	if name == ".." && n != b.root {
+		_, n = n.Parent()
+		if n == nil {
+			return fuse.ENOENT
+		}
+	}
+
+	var attr fuse.AttrOut
+	if errno := b.getattr(ctx, n, nil, &attr); errno != 0 {
+		return errnoToStatus(errno)
+	}
+	out.Attr = attr.Attr
+
+	// The kernel will FORGET this lookup like any other.
+	n.mu.Lock()
+	b.mu.Lock()
+	n.lookupCount++
+	n.changeCounter++
+	n.forgotten = false
+	b.kernelNodeIds[n.nodeId] = n
+	if n != b.root {
+		b.stableAttrs[n.stableAttr] = n
+	}
+	b.mu.Unlock()
+	n.mu.Unlock()
+
+	n.setEntryOut(out)
+	out.Generation = n.stableAttr.Gen
+	b.setEntryOutTimeout(n, out)
 	return fuse.OK
 }
 
@@ -382,12 +742,9 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 		return nil, syscall.ENOENT
 	}
 
-	if ga, ok := child.ops.(NodeGetattrer); ok {
-		var a fuse.AttrOut
-		errno := ga.Getattr(ctx, nil, &a)
-		if errno == 0 {
-			out.Attr = a.Attr
-		}
+	var a fuse.AttrOut
+	if errno := b.fetchAttr(ctx, child, nil, &a); errno == 0 {
+		out.Attr = a.Attr
 	}
 
 	return child, OK
@@ -395,9 +752,10 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
+	defer b.invalidateAttr(parent, parent.GetChild(name))
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeRmdirer); ok {
-		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		errno = mops.Rmdir(b.newContext(cancel, header), name)
 	}
 
 	// TODO - this should not succeed silently.
@@ -410,9 +768,10 @@ func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name st
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
+	defer b.invalidateAttr(parent, parent.GetChild(name))
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeUnlinker); ok {
-		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
+		errno = mops.Unlink(b.newContext(cancel, header), name)
 	}
 
 	// TODO - this should not succeed silently.
@@ -424,9 +783,13 @@ func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name s
 }
 
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	defer b.invalidateAttr(parent)
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	mops, ok := parent.ops.(NodeMkdirer)
 	if !ok {
 		return fuse.ENOTSUP
@@ -447,18 +810,22 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	defer b.invalidateAttr(parent)
 
 	mops, ok := parent.ops.(NodeMknoder)
 	if !ok {
 		return fuse.ENOTSUP
 	}
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	child, errno := mops.Mknod(ctx, name, input.Mode, input.Rdev, out)
 	if errno != 0 {
 		return errnoToStatus(errno)
@@ -466,34 +833,66 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
 	parent, _ := b.inode(input.NodeId, 0)
+	ctx := b.newContext(cancel, &input.InHeader)
+	if isTmpfile(input.Flags) {
+		return b.tmpfile(ctx, parent, input, out)
+	}
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
+	defer b.invalidateAttr(parent)
 
 	mops, ok := parent.ops.(NodeCreater)
 	if !ok {
 		return fuse.EROFS
 	}
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
 	child, f, flags, errno := mops.Create(ctx, name, input.Flags, input.Mode, &out.EntryOut)
 
 	if errno != 0 {
 		return errnoToStatus(errno)
 	}
+	b.addCreated(parent, name, child, f, flags, input, out)
+	return fuse.OK
+}
+
+func (b *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	parent, _ := b.inode(input.NodeId, 0)
+	ctx := b.newContext(cancel, &input.InHeader)
+	return b.tmpfile(ctx, parent, input, out)
+}
+
+// tmpfile handles O_TMPFILE: the new file is not added to the tree.
+func (b *rawBridge) tmpfile(ctx *fuse.Context, parent *Inode, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	tops, ok := parent.ops.(NodeTmpfiler)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	child, f, flags, errno := tops.Tmpfile(ctx, input.Flags, input.Mode, &out.EntryOut)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+	b.addCreated(parent, "", child, f, flags, input, out)
+	return fuse.OK
+}
 
+// addCreated registers a newly created file and its handle, and
+// fills in out.
+func (b *rawBridge) addCreated(parent *Inode, name string, child *Inode, f FileHandle, flags uint32, input *fuse.CreateIn, out *fuse.CreateOut) {
 	child, fe := b.addNewChild(parent, name, child, f, input.Flags|syscall.O_CREAT|syscall.O_EXCL, &out.EntryOut)
 	if fe != nil {
 		out.Fh = uint64(fe.fh)
 	}
-	out.OpenFlags = flags
+	out.OpenFlags = b.openFlags(child, flags)
 
 	b.addBackingID(child, f, &out.OpenOut)
 	child.setEntryOut(&out.EntryOut)
-	b.setEntryOutTimeout(&out.EntryOut)
-	return fuse.OK
+	b.setEntryOutTimeout(child, &out.EntryOut)
 }
 
 func (b *rawBridge) Forget(nodeid, nlookup uint64) {
@@ -505,12 +904,37 @@ func (b *rawBridge) Forget(nodeid, nlookup uint64) {
 	}
 }
 
+var _ = (fuse.BatchForgetter)((*rawBridge)(nil))
+
+func (b *rawBridge) BatchForget(forgets []fuse.ForgetOne) {
+	var forgotten []*Inode
+	compact := false
+	for _, f := range forgets {
+		n, _ := b.inode(f.NodeId, 0)
+		var hasLookups bool
+		hasLookups, _, _, forgotten = n.removeRefForgotten(f.Nlookup, false, forgotten)
+		if !hasLookups {
+			compact = true
+		}
+	}
+
+	// Compacting takes the bridge lock, so do it once per batch.
+	if compact {
+		b.compactMemory()
+	}
+	if len(forgotten) > 0 {
+		if bf, ok := b.root.ops.(NodeBatchForgetter); ok {
+			bf.OnBatchForget(forgotten)
+		}
+	}
+}
+
 // compactMemory tries to free memory that was previously used by forgotten
 // nodes.
 //
 // Maps do not free all memory when elements get deleted
 // ( https://github.com/golang/go/issues/20135 ).
-// As a workaround, we recreate our two big maps (stableAttrs & kernelNodeIds)
+// As a workaround, we recreate our big maps (stableAttrs, kernelNodeIds & ino32)
 // every time they have shrunk dramatically (100 x smaller).
 // In this case, `nodeCountHigh` is reset to the new (smaller) size.
 func (b *rawBridge) compactMemory() {
@@ -533,6 +957,16 @@ func (b *rawBridge) compactMemory() {
 	}
 	b.kernelNodeIds = tmpKernelNodeIds
 
+	if b.ino32 != nil {
+		b.ino32Mu.Lock()
+		tmpIno32 := make(map[uint64]uint32, len(b.ino32))
+		for i, v := range b.ino32 {
+			tmpIno32[i] = v
+		}
+		b.ino32 = tmpIno32
+		b.ino32Mu.Unlock()
+	}
+
 	b.nodeCountHigh = len(b.kernelNodeIds)
 
 	b.mu.Unlock()
@@ -544,11 +978,17 @@ func (b *rawBridge) compactMemory() {
 func (b *rawBridge) SetDebug(debug bool) {}
 
 func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
-	n, fEntry := b.inode(input.NodeId, input.Fh())
+	var fh uint64
+	if input.Flags()&fuse.FUSE_GETATTR_FH != 0 {
+		fh = input.Fh()
+	}
+	n, fEntry := b.inode(input.NodeId, fh)
 	f := fEntry.file
 	if f == nil {
 		// The linux kernel doesnt pass along the file
-		// descriptor, so we have to fake it here.
+		// descriptor for fstat(2), so we have to fake it
+		// here. This also makes stat work on files that
+		// are unlinked but still open.
 		// See https://github.com/libfuse/libfuse/issues/62
 		b.mu.Lock()
 		for _, fh := range n.openFiles {
@@ -559,40 +999,61 @@ func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *
 		}
 		b.mu.Unlock()
 	}
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	return errnoToStatus(b.getattr(ctx, n, f, out))
 }
 
-func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
-	var errno syscall.Errno
+// fetchAttr calls Getattr on the node or file handle, going through
+// the attribute cache if there is one. It returns ENOSYS if neither
+// implements Getattr.
+func (b *rawBridge) fetchAttr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	var gen uint64
+	if c := b.attrCache; c != nil {
+		var ok bool
+		if gen, ok = c.get(n.stableAttr, out); ok {
+			return 0
+		}
+	}
 
+	errno := syscall.ENOSYS
 	if nodeOps, ok := n.ops.(NodeGetattrer); ok {
 		errno = nodeOps.Getattr(ctx, f, out)
 	} else if fileOps, ok := f.(FileGetattrer); ok {
 		errno = fileOps.Getattr(ctx, out)
-	} else {
+	}
+	if c := b.attrCache; c != nil && errno == 0 {
+		c.put(n.stableAttr, gen, out)
+	}
+	return errno
+}
+
+func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	errno := b.fetchAttr(ctx, n, f, out)
+	if errno == syscall.ENOSYS {
 		// We set Mode below, which is the minimum for success
+		errno = 0
 	}
 
 	if errno == 0 {
 		if out.Ino != 0 && n.stableAttr.Ino > 1 && out.Ino != n.stableAttr.Ino {
 			b.logf("warning: rawBridge.getattr: overriding ino %d with %d", out.Ino, n.stableAttr.Ino)
 		}
-		out.Ino = n.stableAttr.Ino
+		out.Ino = b.kernelIno(n.stableAttr.Ino)
 		out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
 		b.setAttr(&out.Attr)
-		b.setAttrTimeout(out)
+		b.setAttrTimeout(n, out)
 	}
 	return errno
 }
 
 func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
-	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &in.InHeader)
 
 	fh, _ := in.GetFh()
 
 	n, fEntry := b.inode(in.NodeId, fh)
 	f := fEntry.file
+	defer b.invalidateAttr(n)
 
 	var errno = syscall.ENOTSUP
 	if fops, ok := n.ops.(NodeSetattrer); ok {
@@ -600,17 +1061,24 @@ func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fus
 	} else if fops, ok := f.(FileSetattrer); ok {
 		errno = fops.Setattr(ctx, in, out)
 	}
+	if errno == 0 && in.Valid&fuse.FATTR_KILL_SUIDGID != 0 && in.Valid&fuse.FATTR_MODE == 0 {
+		errno = b.killSuidgid(ctx, n, f, out)
+	}
 
 	out.Mode = n.stableAttr.Mode | (out.Mode & 07777)
 	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !b.nameOK(newName) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
+	defer b.invalidateAttr(p1, p2, p1.GetChild(oldName), p2.GetChild(newName))
 
 	if mops, ok := p1.ops.(NodeRenamer); ok {
-		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
+		errno := mops.Rename(b.newContext(cancel, &input.InHeader), oldName, p2.ops, newName, input.Flags)
 		if errno == 0 {
 			if input.Flags&RENAME_EXCHANGE != 0 {
 				p1.ExchangeChild(oldName, p2, newName)
@@ -625,15 +1093,19 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName
 }
 
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 	target, _ := b.inode(input.Oldnodeid, 0)
+	defer b.invalidateAttr(parent, target)
 
 	mops, ok := parent.ops.(NodeLinker)
 	if !ok {
 		return fuse.ENOTSUP
 	}
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	child, errno := mops.Link(ctx, target.ops, name, out)
 	if errno != 0 {
 		return errnoToStatus(errno)
@@ -641,18 +1113,22 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 
 	child, _ = b.addNewChild(parent, name, child, nil, 0, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	if !b.nameOK(name) {
+		return fuse.Status(syscall.ENAMETOOLONG)
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	defer b.invalidateAttr(parent)
 
 	mops, ok := parent.ops.(NodeSymlinker)
 	if !ok {
 		return fuse.ENOTSUP
 	}
-	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, header)
 	child, status := mops.Symlink(ctx, target, name, out)
 	if status != 0 {
 		return errnoToStatus(status)
@@ -660,10 +1136,14 @@ func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, targe
 
 	child, _ = b.addNewChild(parent, name, child, nil, syscall.O_EXCL, out)
 	child.setEntryOut(out)
-	b.setEntryOutTimeout(out)
+	b.setEntryOutTimeout(child, out)
 	return fuse.OK
 }
 
+// maxSymlinkLen is the longest symlink target that the kernel
+// accepts in a READLINK reply: PATH_MAX minus the terminating NUL.
+const maxSymlinkLen = 4095
+
 func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 
@@ -671,11 +1151,16 @@ func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out
 	if !ok {
 		return nil, fuse.ENOTSUP
 	}
-	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, header)
 	result, errno := linker.Readlink(ctx)
 	if errno != 0 {
 		return nil, errnoToStatus(errno)
 	}
+	if len(result) > maxSymlinkLen {
+		// The kernel would reject the reply, and return EIO
+		// to the caller.
+		return nil, fuse.Status(syscall.ENAMETOOLONG)
+	}
 
 	return result, fuse.OK
 }
@@ -683,7 +1168,14 @@ func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out
 func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	// With default_permissions, the kernel checks access itself
+	// and does not send ACCESS, so this can only be a stray
+	// request.
+	if b.defaultPermissions() {
+		return fuse.OK
+	}
+
+	ctx := b.newContext(cancel, &input.InHeader)
 	if a, ok := n.ops.(NodeAccesser); ok {
 		return errnoToStatus(a.Access(ctx, input.Mask))
 	}
@@ -707,8 +1199,12 @@ func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.St
 func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, data []byte) (uint32, fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 
+	ctx := b.newContext(cancel, header)
+	if !b.xattrAllowed(ctx, attr) {
+		return 0, fuse.ENOATTR
+	}
 	if xops, ok := n.ops.(NodeGetxattrer); ok {
-		nb, errno := xops.Getxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr, data)
+		nb, errno := xops.Getxattr(ctx, attr, data)
 		return nb, errnoToStatus(errno)
 	}
 
@@ -718,7 +1214,12 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
 	if xops, ok := n.ops.(NodeListxattrer); ok {
-		sz, errno := xops.Listxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, dest)
+		ctx := b.newContext(cancel, header)
+		if b.options.XattrFilter != nil {
+			sz, errno := b.listxattrFiltered(ctx, xops, dest)
+			return sz, errnoToStatus(errno)
+		}
+		sz, errno := xops.Listxattr(ctx, dest)
 		return sz, errnoToStatus(errno)
 	}
 	return 0, fuse.OK
@@ -726,16 +1227,26 @@ func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, des
 
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
+	defer b.invalidateAttr(n)
+	ctx := b.newContext(cancel, &input.InHeader)
+	if !b.xattrAllowed(ctx, attr) {
+		return fuse.EPERM
+	}
 	if xops, ok := n.ops.(NodeSetxattrer); ok {
-		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
+		return errnoToStatus(xops.Setxattr(ctx, attr, data, input.Flags))
 	}
 	return fuse.ENOATTR
 }
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
 	n, _ := b.inode(header.NodeId, 0)
+	defer b.invalidateAttr(n)
+	ctx := b.newContext(cancel, header)
+	if !b.xattrAllowed(ctx, attr) {
+		return fuse.EPERM
+	}
 	if xops, ok := n.ops.(NodeRemovexattrer); ok {
-		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
+		return errnoToStatus(xops.Removexattr(ctx, attr))
 	}
 	return fuse.ENOATTR
 }
@@ -747,11 +1258,28 @@ func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.O
 	if !ok {
 		return fuse.ENOTSUP
 	}
-	f, flags, errno := op.Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
+	ctx := b.newContext(cancel, &input.InHeader)
+	f, flags, errno := op.Open(ctx, input.Flags)
 	if errno != 0 {
 		return errnoToStatus(errno)
 	}
-	out.OpenFlags = flags
+	if input.Flags&syscall.O_TRUNC != 0 {
+		// Only sent with CAP_ATOMIC_O_TRUNC. Otherwise, the
+		// kernel truncates the file with SETATTR before the
+		// OPEN.
+		defer b.invalidateAttr(n)
+		errno := b.truncate(ctx, n, f)
+		if errno == 0 && input.Mode&fuse.OPEN_KILL_SUIDGID != 0 {
+			errno = b.killSuidgid(ctx, n, f, &fuse.AttrOut{})
+		}
+		if errno != 0 {
+			if r, ok := f.(FileReleaser); ok {
+				r.Release(ctx)
+			}
+			return errnoToStatus(errno)
+		}
+	}
+	out.OpenFlags = b.openFlags(n, flags)
 
 	if f != nil {
 		b.mu.Lock()
@@ -764,13 +1292,73 @@ func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.O
 	return fuse.OK
 }
 
+// truncate sets the size of a file that was opened with O_TRUNC to
+// 0, like SETATTR does. Nodes that implement neither NodeSetattrer
+// nor FileSetattrer must handle O_TRUNC in Open themselves.
+func (b *rawBridge) truncate(ctx context.Context, n *Inode, f FileHandle) syscall.Errno {
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	return b.setattr(ctx, n, f, in, &fuse.AttrOut{})
+}
+
+// killSuidgid clears the set-user-ID bit, and the set-group-ID bit if
+// the file is group-executable, like the kernel does when a user
+// without CAP_FSETID modifies a file. With
+// MountOptions.HandleKillPrivV2, the kernel leaves this to us. On
+// return, out holds the current attributes.
+func (b *rawBridge) killSuidgid(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if errno := b.getattr(ctx, n, f, out); errno != 0 {
+		return errno
+	}
+	mode := out.Mode & 07777
+	kill := uint32(unix.S_ISUID)
+	if mode&unix.S_IXGRP != 0 {
+		kill |= unix.S_ISGID
+	}
+	if mode&kill == 0 {
+		return 0
+	}
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = mode &^ kill
+	return b.setattr(ctx, n, f, in, out)
+}
+
+// setattr calls Setattr on the node or file, if implemented.
+func (b *rawBridge) setattr(ctx context.Context, n *Inode, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if fops, ok := n.ops.(NodeSetattrer); ok {
+		return fops.Setattr(ctx, f, in, out)
+	} else if fops, ok := f.(FileSetattrer); ok {
+		return fops.Setattr(ctx, in, out)
+	}
+	return 0
+}
+
+// openFlags filters the FOPEN_* flags returned by the file system
+// for what the kernel supports, and applies Inode.SetKeepCache.
+func (b *rawBridge) openFlags(n *Inode, flags uint32) uint32 {
+	if !b.supportsNoFlush {
+		flags &^= fuse.FOPEN_NOFLUSH
+	}
+	n.mu.Lock()
+	keep := n.keepCache
+	n.mu.Unlock()
+	switch keep {
+	case 1:
+		flags |= fuse.FOPEN_KEEP_CACHE
+	case -1:
+		flags &^= fuse.FOPEN_KEEP_CACHE
+	}
+	return flags
+}
+
 // must hold bridge.mu
 func (b *rawBridge) addBackingID(n *Inode, f FileHandle, out *fuse.OpenOut) {
 	if b.disableBackingFiles {
 		return
 	}
 
-	bc, ok := b.server.(serverBackingFdCallbacks)
+	bc, ok := b.serverCallbacks().(serverBackingFdCallbacks)
 	if !ok {
 		b.disableBackingFiles = true
 		return
@@ -813,7 +1401,7 @@ func (b *rawBridge) releaseBackingIDRef(n *Inode) {
 
 	n.backingIDRefcount--
 	if n.backingIDRefcount == 0 {
-		errno := b.server.(serverBackingFdCallbacks).UnregisterBackingFd(n.backingID)
+		errno := b.serverCallbacks().(serverBackingFdCallbacks).UnregisterBackingFd(n.backingID)
 		if errno != 0 {
 			b.logf("UnregisterBackingFd: %v", errno)
 		}
@@ -851,11 +1439,28 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) *fileEntr
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if !aligned(f.file, input.Offset, uint64(input.Size)) {
+		return nil, fuse.EINVAL
+	}
+
+	ctx := b.newContext(cancel, &input.InHeader)
+	opts := ReadOptions{
+		Flags:     input.Flags,
+		ReadFlags: input.ReadFlags,
+		LockOwner: input.LockOwner,
+	}
+	if fops, ok := n.ops.(NodeReaderWithOptions); ok {
+		res, errno := fops.ReadWithOptions(ctx, f.file, buf, int64(input.Offset), &opts)
+		return res, errnoToStatus(errno)
+	}
 	if fops, ok := n.ops.(NodeReader); ok {
 		res, errno := fops.Read(ctx, f.file, buf, int64(input.Offset))
 		return res, errnoToStatus(errno)
 	}
+	if fr, ok := f.file.(FileReaderWithOptions); ok {
+		res, errno := fr.ReadWithOptions(ctx, buf, int64(input.Offset), &opts)
+		return res, errnoToStatus(errno)
+	}
 	if fr, ok := f.file.(FileReader); ok {
 		res, errno := fr.Read(ctx, buf, int64(input.Offset))
 		return res, errnoToStatus(errno)
@@ -864,10 +1469,25 @@ func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte)
 	return nil, fuse.ENOTSUP
 }
 
+// aligned returns false if fh requires aligned I/O (see
+// FileDirectIOAligner), and off or size are misaligned.
+func aligned(fh FileHandle, off, size uint64) bool {
+	al, ok := fh.(FileDirectIOAligner)
+	if !ok {
+		return true
+	}
+	a := al.DirectIOAlignment()
+	if a <= 1 {
+		return true
+	}
+	mask := uint64(a) - 1
+	return off&mask == 0 && size&mask == 0
+}
+
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	if lops, ok := n.ops.(NodeGetlker); ok {
 		return errnoToStatus(lops.Getlk(ctx, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
 	}
@@ -877,9 +1497,55 @@ func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.Lk
 	return fuse.ENOTSUP
 }
 
+// flock dispatches a flock(2) request to NodeFlocker or
+// FileFlocker. It returns false if neither is implemented.
+func (b *rawBridge) flock(ctx context.Context, n *Inode, f FileHandle, owner uint64, op uint32) (syscall.Errno, bool) {
+	if fl, ok := n.ops.(NodeFlocker); ok {
+		return fl.Flock(ctx, f, owner, op), true
+	}
+	if fl, ok := f.(FileFlocker); ok {
+		return fl.Flock(ctx, owner, op), true
+	}
+	return 0, false
+}
+
+// flockOp converts the lock type of a FUSE_LK_FLOCK request into a
+// flock(2) operation.
+func flockOp(lk *fuse.FileLock, blocking bool) (uint32, syscall.Errno) {
+	var op uint32
+	switch lk.Typ {
+	case syscall.F_RDLCK:
+		op = syscall.LOCK_SH
+	case syscall.F_WRLCK:
+		op = syscall.LOCK_EX
+	case syscall.F_UNLCK:
+		op = syscall.LOCK_UN
+	default:
+		return 0, syscall.EINVAL
+	}
+	if !blocking {
+		op |= syscall.LOCK_NB
+	}
+	return op, 0
+}
+
+func (b *rawBridge) setLk(ctx context.Context, n *Inode, f FileHandle, input *fuse.LkIn, blocking bool) (syscall.Errno, bool) {
+	if input.LkFlags&fuse.FUSE_LK_FLOCK == 0 {
+		return 0, false
+	}
+	op, errno := flockOp(&input.Lk, blocking)
+	if errno != 0 {
+		return errno, true
+	}
+	return b.flock(ctx, n, f, input.Owner, op)
+}
+
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
+	if errno, ok := b.setLk(ctx, n, f.file, input, false); ok {
+		return errnoToStatus(errno)
+	}
 	if lops, ok := n.ops.(NodeSetlker); ok {
 		return errnoToStatus(lops.Setlk(ctx, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
@@ -890,7 +1556,10 @@ func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status
 }
 func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
+	if errno, ok := b.setLk(ctx, n, f.file, input, true); ok {
+		return errnoToStatus(errno)
+	}
 	if lops, ok := n.ops.(NodeSetlkwer); ok {
 		return errnoToStatus(lops.Setlkw(ctx, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
@@ -908,7 +1577,10 @@ func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 
 	f.wg.Wait()
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
+	if input.ReleaseFlags&fuse.FUSE_RELEASE_FLOCK_UNLOCK != 0 {
+		b.flock(ctx, n, f.file, input.LockOwner, syscall.LOCK_UN)
+	}
 	if r, ok := n.ops.(NodeReleaser); ok {
 		r.Release(ctx, f.file)
 	} else if r, ok := f.file.(FileReleaser); ok {
@@ -927,7 +1599,7 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 	f.wg.Wait()
 
 	if frd, ok := f.file.(FileReleasedirer); ok {
-		frd.Releasedir(context.Background(), input.ReleaseFlags)
+		frd.Releasedir(b.newContext(nil, &input.InHeader), input.ReleaseFlags)
 	}
 
 	b.mu.Lock()
@@ -957,23 +1629,61 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	if !aligned(f.file, input.Offset, uint64(len(data))) {
+		return 0, fuse.EINVAL
+	}
+	defer b.invalidateAttr(n)
+
+	ctx := b.newContext(cancel, &input.InHeader)
+	opts := WriteOptions{
+		Flags:      input.Flags,
+		WriteFlags: input.WriteFlags,
+		LockOwner:  input.LockOwner,
+	}
+	if wr, ok := n.ops.(NodeWriterWithOptions); ok {
+		w, errno := wr.WriteWithOptions(ctx, f.file, data, int64(input.Offset), &opts)
+		return b.writeResult(w, errno, data)
+	}
+	_, nodeWriter := n.ops.(NodeWriter)
+	if fr, ok := f.file.(FileWriterWithOptions); ok && !nodeWriter {
+		w, errno := fr.WriteWithOptions(ctx, data, int64(input.Offset), &opts)
+		return b.writeResult(w, errno, data)
+	}
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if input.WriteFlags&fuse.WRITE_KILL_SUIDGID != 0 {
+		if errno := b.killSuidgid(ctx, n, f.file, &fuse.AttrOut{}); errno != 0 {
+			return 0, errnoToStatus(errno)
+		}
+	}
 	if wr, ok := n.ops.(NodeWriter); ok {
 		w, errno := wr.Write(ctx, f.file, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+		return b.writeResult(w, errno, data)
 	}
 	if fr, ok := f.file.(FileWriter); ok {
 		w, errno := fr.Write(ctx, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+		return b.writeResult(w, errno, data)
 	}
 
 	return 0, fuse.ENOTSUP
 }
 
+// writeResult converts the result of a Write call into a WRITE
+// reply. A short write is reported as success with the partial
+// count; the kernel rejects replies that claim more than was sent.
+func (b *rawBridge) writeResult(written uint32, errno syscall.Errno, data []byte) (uint32, fuse.Status) {
+	if written > uint32(len(data)) {
+		b.logf("warning: rawBridge.Write: wrote %d bytes, only %d available", written, len(data))
+		return 0, fuse.EIO
+	}
+	if written > 0 {
+		return written, fuse.OK
+	}
+	return 0, errnoToStatus(errno)
+}
+
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	if fl, ok := n.ops.(NodeFlusher); ok {
 		return errnoToStatus(fl.Flush(ctx, f.file))
 	}
@@ -985,19 +1695,23 @@ func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Stat
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	if fs, ok := n.ops.(NodeFsyncer); ok {
 		return errnoToStatus(fs.Fsync(ctx, f.file, input.FsyncFlags))
 	}
 	if fs, ok := f.file.(FileFsyncer); ok {
 		return errnoToStatus(fs.Fsync(ctx, input.FsyncFlags))
 	}
-	return fuse.ENOTSUP
+	// There is nothing to flush, and failing would make
+	// msync(MS_SYNC) fail after the dirty pages were written.
+	// ENOSYS would switch off FSYNC for the whole mount.
+	return fuse.OK
 }
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	defer b.invalidateAttr(n)
+	ctx := b.newContext(cancel, &input.InHeader)
 	if a, ok := n.ops.(NodeAllocater); ok {
 		return errnoToStatus(a.Allocate(ctx, f.file, input.Offset, input.Length, input.Mode))
 	}
@@ -1014,7 +1728,7 @@ func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fus
 	var fuseFlags uint32
 	var errno syscall.Errno
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 
 	nod, _ := n.ops.(NodeOpendirer)
 	nrd, _ := n.ops.(NodeReaddirer)
@@ -1076,6 +1790,20 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 	return b.readDirMaybeLookup(cancel, input, out, false)
 }
 
+// fillDirEntryType sets the file type of a directory entry that was
+// returned without one, so the kernel can report d_type without
+// stat'ing the file. The type is taken from the child Inode, if it
+// is known.
+func (b *rawBridge) fillDirEntryType(n *Inode, de *fuse.DirEntry) {
+	if de.Name == "." || de.Name == ".." {
+		de.Mode |= syscall.S_IFDIR
+		return
+	}
+	if child := n.GetChild(de.Name); child != nil {
+		de.Mode |= child.stableAttr.Mode & syscall.S_IFMT
+	}
+}
+
 func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList, lookup bool) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
 
@@ -1088,7 +1816,7 @@ func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadI
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &input.InHeader)
 	interruptedRead := false
 	if input.Offset != f.dirOffset {
 		// If the last readdir(plus) was interrupted, the
@@ -1134,6 +1862,11 @@ func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadI
 
 	first := true
 	f.lastRead = f.lastRead[:0]
+	f.namesIdx ^= 1
+	f.names[f.namesIdx] = f.names[f.namesIdx][:0]
+	if f.hasOverflow {
+		f.overflow = f.keepDirEntry(&f.overflow)
+	}
 	for {
 		var de *fuse.DirEntry
 		var errno syscall.Errno
@@ -1160,29 +1893,51 @@ func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadI
 			break
 		}
 
-		first = false
+		if de.Mode&syscall.S_IFMT == 0 {
+			e := *de
+			b.fillDirEntryType(n, &e)
+			de = &e
+		}
 		if de.Off == 0 {
 			// This logic is dup from fuse.DirEntryList, but we need the offset here so it is part of lastRead
 			de.Off = out.Offset + 1
 		}
+		if errno := b.checkDirOffset(n, out.Offset, de); errno != 0 {
+			if first {
+				return errnoToStatus(errno)
+			}
+			// Send what we have; the kernel reads on from the
+			// last good offset and gets the error then.
+			f.hasOverflow = true
+			f.overflowErrno = errno
+			return fuse.OK
+		}
+		first = false
+		// Only the copy for the kernel is translated; overflow
+		// and lastRead keep the file system's inode number, as
+		// they come through here again.
+		kde := *de
+		if b.ino32 != nil {
+			kde.Ino = b.peekIno32(kde.Ino)
+		}
 		if !lookup {
-			if !out.AddDirEntry(*de) {
-				f.overflow = *de
+			if !out.AddDirEntry(kde) {
+				f.overflow = f.keepDirEntry(de)
 				f.hasOverflow = true
 				return fuse.OK
 			}
 
-			f.lastRead = append(f.lastRead, *de)
+			f.lastRead = append(f.lastRead, f.keepDirEntry(de))
 			continue
 		}
 
-		entryOut := out.AddDirLookupEntry(*de)
+		entryOut := out.AddDirLookupEntry(kde)
 		if entryOut == nil {
-			f.overflow = *de
+			f.overflow = f.keepDirEntry(de)
 			f.hasOverflow = true
 			return fuse.OK
 		}
-		f.lastRead = append(f.lastRead, *de)
+		f.lastRead = append(f.lastRead, f.keepDirEntry(de))
 
 		// Virtual entries "." and ".." should be part of the
 		// directory listing, but not part of the filesystem tree.
@@ -1193,25 +1948,31 @@ func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadI
 			continue
 		}
 
+		if b.options.ReaddirPlusSkipCached && b.entryCached(n, de) {
+			// Zero NodeId: the kernel keeps its entry.
+			continue
+		}
+
+		// The name ends up in the tree, so it must not share
+		// memory with the DirStream.
+		name := string([]byte(de.Name))
 		var child *Inode
-		if fileLookupper, ok := f.file.(FileLookuper); ok {
-			child, errno = fileLookupper.Lookup(ctx, de.Name, entryOut)
+		if fileLookupper, ok := fileLookuper(f.file); ok {
+			child, errno = fileLookupper.Lookup(ctx, name, entryOut)
 		} else {
-			child, errno = b.lookup(ctx, n, de.Name, entryOut)
+			child, errno = b.lookup(ctx, n, name, entryOut)
 		}
 
 		if errno != 0 {
-			if b.options.NegativeTimeout != nil {
-				entryOut.SetEntryTimeout(*b.options.NegativeTimeout)
-
-				// TODO: maybe simply not produce the dirent here?
-				// test?
-			}
+			b.setNegativeTimeout(entryOut)
+			// TODO: maybe simply not produce the dirent here?
+			// test?
 			// TODO: should break?
 		} else {
-			child, _ = b.addNewChild(n, de.Name, child, nil, 0, entryOut)
+			child, _ = b.addNewChild(n, name, child, nil, 0, entryOut)
 			child.setEntryOut(entryOut)
-			b.setEntryOutTimeout(entryOut)
+			b.setEntryOutTimeout(child, entryOut)
+			b.setEntryExpiry(child, entryOut)
 			if de.Mode&syscall.S_IFMT != child.stableAttr.Mode&syscall.S_IFMT {
 				// The file type has changed behind our back. Use the new value.
 				out.FixMode(child.stableAttr.Mode)
@@ -1223,30 +1984,211 @@ func (b *rawBridge) readDirMaybeLookup(cancel <-chan struct{}, input *fuse.ReadI
 	return fuse.OK
 }
 
+// checkDirOffset checks the offset of a directory entry against prev,
+// the offset of the entry before it. The kernel continues reading at
+// the offset of the last entry it got, so if an entry repeats the
+// offset, the kernel can read the same entries forever. Offsets need
+// not increase, since some file systems (eg. ext4) use hashes as
+// offsets, but with Debug, decreasing offsets are logged.
+func (b *rawBridge) checkDirOffset(n *Inode, prev uint64, de *fuse.DirEntry) syscall.Errno {
+	if de.Off == prev {
+		b.logf("warning: readdir n%d: entry %q repeats offset %d", n.nodeId, de.Name, de.Off)
+		return syscall.EIO
+	}
+	if b.options.Debug && de.Off < prev {
+		b.logf("readdir n%d: entry %q has offset %d after %d", n.nodeId, de.Name, de.Off, prev)
+	}
+	return 0
+}
+
+// keepDirEntry returns a copy of de whose name is stored in the
+// current name buffer of f.
+func (f *fileEntry) keepDirEntry(de *fuse.DirEntry) fuse.DirEntry {
+	buf := f.names[f.namesIdx]
+	start := len(buf)
+	buf = append(buf, de.Name...)
+	f.names[f.namesIdx] = buf
+
+	e := *de
+	e.SetNameBytes(buf[start:len(buf):len(buf)])
+	return e
+}
+
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
-	if fsd, ok := f.file.(FileFsyncdirer); ok {
+	ctx := b.newContext(cancel, &input.InHeader)
+	if fsd, ok := n.ops.(NodeFsyncDirer); ok {
+		return errnoToStatus(fsd.Fsyncdir(ctx, f.file, input.FsyncFlags))
+	} else if fsd, ok := f.file.(FileFsyncdirer); ok {
 		return errnoToStatus(fsd.Fsyncdir(ctx, input.FsyncFlags))
 	} else if fs, ok := n.ops.(NodeFsyncer); ok {
 		return errnoToStatus(fs.Fsync(ctx, f.file, input.FsyncFlags))
 	}
 
-	return fuse.ENOTSUP
+	// ENOSYS would switch off FSYNCDIR for the whole mount.
+	return fuse.OK
 }
 
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	if sf, ok := n.ops.(NodeStatfser); ok {
-		return errnoToStatus(sf.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
+	sf, ok := n.ops.(NodeStatfser)
+	if !ok {
+		sf, ok = b.root.ops.(NodeStatfser)
+	}
+	if ok {
+		errno := sf.Statfs(b.newContext(cancel, input), out)
+		if max := uint32(b.maxNameLen()); errno == 0 && max > 0 && (out.NameLen == 0 || out.NameLen > max) {
+			out.NameLen = max
+		}
+		return errnoToStatus(errno)
 	}
 
-	// leave zeroed out
+	// leave zeroed out, except for the name length
+	out.NameLen = uint32(b.maxNameLen())
 	return fuse.OK
 }
 
+// defaultPermissions returns whether the kernel checks permissions
+// itself. ID-mapped mounts and kernel ACL support imply
+// default_permissions.
+func (b *rawBridge) defaultPermissions() bool {
+	if b.options.DefaultPermissions || b.options.IDMappedMount || b.options.EnableAcl {
+		return true
+	}
+	for _, o := range b.options.Options {
+		if o == "default_permissions" {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateAttr drops the cached attributes of nodes, which may
+// contain nil entries.
+func (b *rawBridge) invalidateAttr(nodes ...*Inode) {
+	if b.attrCache == nil {
+		return
+	}
+	for _, n := range nodes {
+		if n != nil {
+			b.attrCache.invalidate(n.stableAttr)
+		}
+	}
+}
+
+// maxNameLen returns the name length limit from Options.MaxNameLen,
+// or 0 if there is none.
+func (b *rawBridge) maxNameLen() int {
+	if b.options.MaxNameLen < 0 {
+		return 0
+	}
+	return b.options.MaxNameLen
+}
+
+// nameOK returns false if name exceeds Options.MaxNameLen.
+func (b *rawBridge) nameOK(name string) bool {
+	max := b.maxNameLen()
+	return max == 0 || len(name) <= max
+}
+
+func (b *rawBridge) SyncFs(cancel <-chan struct{}, input *fuse.SyncFsIn) fuse.Status {
+	ctx := b.newContext(cancel, &input.InHeader)
+	if sf, ok := b.root.ops.(NodeSyncfser); ok {
+		return errnoToStatus(sf.Syncfs(ctx))
+	}
+
+	var files []*fileEntry
+	b.mu.Lock()
+	for _, n := range b.kernelNodeIds {
+		for _, fh := range n.openFiles {
+			fe := b.files[fh]
+			if _, ok := fe.file.(FileFsyncer); ok {
+				fe.wg.Add(1)
+				files = append(files, fe)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	var errno syscall.Errno
+	for _, fe := range files {
+		if e := fe.file.(FileFsyncer).Fsync(ctx, 0); e != 0 && errno == 0 {
+			errno = e
+		}
+		fe.wg.Done()
+	}
+	return errnoToStatus(errno)
+}
+
+// newContext returns the context for the request with header h.
+func (b *rawBridge) newContext(cancel <-chan struct{}, h *fuse.InHeader) *fuse.Context {
+	// mounted is set by Init, before any request is served.
+	return &fuse.Context{Caller: h.Caller, Unique: h.Unique, Cancel: cancel, Server: b.mounted}
+}
+
+// serverCallbacks returns the ServerCallbacks for sending
+// notifications, or nil if the bridge is not mounted.
+func (b *rawBridge) serverCallbacks() ServerCallbacks {
+	b.serverMu.Lock()
+	defer b.serverMu.Unlock()
+	return b.server
+}
+
 func (b *rawBridge) Init(s *fuse.Server) {
-	b.server = s
+	if b.addMount(s) {
+		// The settings below come from the first mount, as
+		// documented on MountShared. The new mount has not
+		// served requests yet, so this takes effect before it
+		// opens files.
+		b.mu.Lock()
+		b.disableBackingFiles = true
+		b.mu.Unlock()
+		return
+	}
+
+	// Backing files cannot be registered if passthrough was not
+	// negotiated.
+	if s.Capabilities()&fuse.CAP_PASSTHROUGH == 0 {
+		b.disableBackingFiles = true
+	}
+
+	b.supportsNoFlush = s.KernelSettings().SupportsVersion(7, 35)
+	b.writebackCache = b.options.EnableWritebackCache &&
+		b.options.DisabledCapabilities&fuse.CAP_WRITEBACK_CACHE == 0 &&
+		s.KernelSettings().Flags64()&fuse.CAP_WRITEBACK_CACHE != 0
+
+	if b.options.OnMount != nil {
+		b.options.OnMount(fuse.NewServerContext(context.Background(), s), b.root)
+	}
+}
+
+// addMount registers s as a server for this bridge. It returns false
+// for the first server. For later ones, notifications are sent to all
+// mounts, and each server is dropped from that list when its serve
+// loop exits.
+func (b *rawBridge) addMount(s *fuse.Server) bool {
+	b.serverMu.Lock()
+	defer b.serverMu.Unlock()
+	b.mounts++
+	if b.mounted == nil {
+		b.mounted = s
+		b.server = s
+		return false
+	}
+	if b.shared == nil {
+		b.shared = &sharedServers{owner: b.mounted}
+		b.shared.add(b.mounted)
+		b.server = b.shared
+		go b.removeOnExit(b.mounted)
+	}
+	b.shared.add(s)
+	go b.removeOnExit(s)
+	return true
+}
+
+func (b *rawBridge) removeOnExit(s *fuse.Server) {
+	s.Wait()
+	b.shared.remove(s)
 }
 
 func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (size uint32, status fuse.Status) {
@@ -1257,22 +2199,60 @@ func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRange
 	}
 
 	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	defer b.invalidateAttr(n2)
 
-	sz, errno := cfr.CopyFileRange(&fuse.Context{Caller: in.Caller, Cancel: cancel},
+	sz, errno := cfr.CopyFileRange(b.newContext(cancel, &in.InHeader),
 		f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
 	return sz, errnoToStatus(errno)
 }
 
+func (b *rawBridge) SetupMapping(cancel <-chan struct{}, in *fuse.SetupMappingIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (b *rawBridge) RemoveMapping(cancel <-chan struct{}, in *fuse.RemoveMappingIn, mappings []fuse.RemoveMappingOne) fuse.Status {
+	return fuse.ENOSYS
+}
+
+// ioctlRetry decodes the argument size from the ioctl command. If
+// the kernel passed less data than the command needs, it returns the
+// iovecs for an IOCTL_RETRY.
+func ioctlRetry(in *fuse.IoctlIn) (inIovs, outIovs []fuse.IoctlIovec, retry bool) {
+	cmd := ioctl.Command(in.Cmd)
+	size := uint32(cmd.Size())
+	if size == 0 {
+		return nil, nil, false
+	}
+	iov := []fuse.IoctlIovec{{Base: in.Arg, Len: uint64(size)}}
+	if cmd.Read() {
+		inIovs = iov
+		retry = retry || in.InSize < size
+	}
+	if cmd.Write() {
+		outIovs = iov
+		retry = retry || in.OutSize < size
+	}
+	return inIovs, outIovs, retry
+}
+
 func (b *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, inbuf []byte, out *fuse.IoctlOut, outbuf []byte) (code fuse.Status) {
+	if in.Flags&fuse.IOCTL_UNRESTRICTED != 0 {
+		// Unrestricted ioctls arrive without data. Fetch
+		// fixed-size arguments as encoded in the command.
+		if inIovs, outIovs, retry := ioctlRetry(in); retry {
+			return out.Retry(outbuf, inIovs, outIovs)
+		}
+	}
+
 	n, f := b.inode(in.NodeId, in.Fh)
 	if nio, ok := n.ops.(NodeIoctler); ok {
-		ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+		ctx := b.newContext(cancel, &in.InHeader)
 		result, errno := nio.Ioctl(ctx, f.file, in.Cmd, in.Arg, inbuf, outbuf)
 		out.Result = result
 		return errnoToStatus(errno)
 	}
 	if fio, ok := f.file.(FileIoctler); ok {
-		ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+		ctx := b.newContext(cancel, &in.InHeader)
 		result, errno := fio.Ioctl(ctx, in.Cmd, in.Arg, inbuf, outbuf)
 		out.Result = result
 		return errnoToStatus(errno)
@@ -1280,10 +2260,55 @@ func (b *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, inbuf []byte
 	return fuse.Status(syscall.ENOTTY)
 }
 
+// defaultPollMask is what we report for files that do not
+// support poll.
+const defaultPollMask = unix.POLLIN | unix.POLLOUT
+
+func (b *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	if !b.options.EnablePoll {
+		// Switch off POLL for the mount, like the poll hack
+		// expects.
+		return fuse.ENOSYS
+	}
+	n, f := b.inode(in.NodeId, in.Fh)
+	ctx := b.newContext(cancel, &in.InHeader)
+
+	var kh uint64
+	if in.Flags&fuse.FUSE_POLL_SCHEDULE_NOTIFY != 0 {
+		kh = in.Kh
+	}
+
+	// Don't return ENOSYS from here on, as that switches off
+	// POLL for the whole mount.
+	if p, ok := n.ops.(NodePoller); ok {
+		revents, errno := p.Poll(ctx, f.file, in.Events, kh)
+		out.Revents = revents
+		return errnoToStatus(errno)
+	}
+	if p, ok := f.file.(FilePoller); ok {
+		revents, errno := p.Poll(ctx, in.Events, kh)
+		out.Revents = revents
+		return errnoToStatus(errno)
+	}
+	out.Revents = in.Events & defaultPollMask
+	return fuse.OK
+}
+
+func (b *rawBridge) Bmap(cancel <-chan struct{}, in *fuse.BmapIn, out *fuse.BmapOut) fuse.Status {
+	n, _ := b.inode(in.NodeId, 0)
+	if bm, ok := n.ops.(NodeBmaper); ok {
+		ctx := b.newContext(cancel, &in.InHeader)
+		block, errno := bm.Bmap(ctx, in.Block, in.Blocksize)
+		out.Block = block
+		return errnoToStatus(errno)
+	}
+	return fuse.ENOSYS
+}
+
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
 
-	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &in.InHeader)
 
 	ls, ok := n.ops.(NodeLseeker)
 	if ok {
@@ -1321,7 +2346,57 @@ func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.Ls
 }
 
 func (b *rawBridge) OnUnmount() {
-	if of, ok := b.root.ops.(NodeOnForgetter); ok {
-		of.OnForget()
+	b.serverMu.Lock()
+	b.mounts--
+	last := b.mounts <= 0
+	b.serverMu.Unlock()
+	if !last {
+		return
+	}
+	b.stopNotify()
+	b.forgetAll()
+}
+
+// forgetAll calls OnForget on all nodes that are still live when the
+// file system is unmounted: children before their parents, and the
+// root last.
+func (b *rawBridge) forgetAll() {
+	seen := map[*Inode]bool{b.root: true}
+	order := []*Inode{b.root}
+	for i := 0; i < len(order); i++ {
+		for _, e := range order[i].childrenList() {
+			if !seen[e.Inode] {
+				seen[e.Inode] = true
+				order = append(order, e.Inode)
+			}
+		}
+	}
+
+	// Nodes the kernel knows that are not in the tree, eg. unlinked
+	// files that are still open, and pinned nodes that were removed
+	// from the tree.
+	b.mu.Lock()
+	var orphans []*Inode
+	for _, n := range b.kernelNodeIds {
+		if !seen[n] {
+			seen[n] = true
+			orphans = append(orphans, n)
+		}
+	}
+	for _, n := range b.stableAttrs {
+		if !seen[n] {
+			seen[n] = true
+			orphans = append(orphans, n)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, n := range orphans {
+		n.unpinAll()
+		n.forget()
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		order[i].unpinAll()
+		order[i].forget()
 	}
 }
@@ -4,8 +4,13 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
+func isTmpfile(flags uint32) bool {
+	return flags&unix.O_TMPFILE == unix.O_TMPFILE
+}
+
 // see rawBridge.setAttr
 func (b *rawBridge) setStatx(out *fuse.Statx) {
 	if !b.options.NullPermissions && out.Mode&07777 == 0 {
@@ -24,9 +29,9 @@ func (b *rawBridge) setStatx(out *fuse.Statx) {
 }
 
 // see rawBridge.setAttrTimeout
-func (b *rawBridge) setStatxTimeout(out *fuse.StatxOut) {
-	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
-		out.SetTimeout(*b.options.AttrTimeout)
+func (b *rawBridge) setStatxTimeout(n *Inode, out *fuse.StatxOut) {
+	if _, attr := b.nodeTimeouts(n); attr != nil && out.Timeout() == 0 {
+		out.SetTimeout(*attr)
 	}
 }
 
@@ -37,23 +42,34 @@ func (b *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.St
 		fh = fe.file
 	}
 
-	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	ctx := b.newContext(cancel, &in.InHeader)
 
-	errno := syscall.ENOSYS
+	var errno syscall.Errno
 	if sx, ok := n.ops.(NodeStatxer); ok {
 		errno = sx.Statx(ctx, fh, in.SxFlags, in.SxMask, out)
-	} else if fsx, ok := n.ops.(FileStatxer); ok {
+	} else if fsx, ok := fh.(FileStatxer); ok {
 		errno = fsx.Statx(ctx, in.SxFlags, in.SxMask, out)
+	} else {
+		// Synthesize the result from GETATTR, so the kernel
+		// gets a consistent answer for files with and without
+		// Statx.
+		var attrOut fuse.AttrOut
+		errno = b.getattr(ctx, n, fh, &attrOut)
+		if errno == 0 {
+			out.Statx.FromAttr(&attrOut.Attr)
+			out.AttrValid = attrOut.AttrValid
+			out.AttrValidNsec = attrOut.AttrValidNsec
+		}
 	}
 
 	if errno == 0 {
 		if out.Ino != 0 && n.stableAttr.Ino > 1 && out.Ino != n.stableAttr.Ino {
 			b.logf("warning: rawBridge.getattr: overriding ino %d with %d", out.Ino, n.stableAttr.Ino)
 		}
-		out.Ino = n.stableAttr.Ino
+		out.Ino = b.kernelIno(n.stableAttr.Ino)
 		out.Mode = (out.Statx.Mode & 07777) | uint16(n.stableAttr.Mode)
 		b.setStatx(&out.Statx)
-		b.setStatxTimeout(out)
+		b.setStatxTimeout(n, out)
 	}
 
 	return errnoToStatus(errno)
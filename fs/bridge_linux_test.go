@@ -0,0 +1,171 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+type getattrOnlyNode struct {
+	Inode
+}
+
+var _ = (NodeGetattrer)((*getattrOnlyNode)(nil))
+
+func (n *getattrOnlyNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = 42
+	out.Mtime = 1000
+	out.Mtimensec = 5
+	out.Nlink = 1
+	return 0
+}
+
+// TestStatxFromGetattr checks that STATX falls back to Getattr.
+func TestStatxFromGetattr(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	root.AddChild("file", root.NewPersistentInode(ctx, &getattrOnlyNode{}, StableAttr{Mode: syscall.S_IFREG, Ino: 17}), false)
+
+	var entry fuse.EntryOut
+	if status := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !status.Ok() {
+		t.Fatalf("Lookup: %v", status)
+	}
+
+	in := fuse.StatxIn{SxMask: unix.STATX_BASIC_STATS | unix.STATX_BTIME}
+	in.NodeId = entry.NodeId
+	var out fuse.StatxOut
+	if status := rawFS.Statx(nil, &in, &out); !status.Ok() {
+		t.Fatalf("Statx: %v", status)
+	}
+	if out.Mask&unix.STATX_BASIC_STATS != unix.STATX_BASIC_STATS || out.Mask&unix.STATX_BTIME != 0 {
+		t.Errorf("got mask %x, want basic stats without btime", out.Mask)
+	}
+	if out.Size != 42 || out.Ino != 17 || out.Mode != syscall.S_IFREG|0644 || out.Mtime.Sec != 1000 || out.Mtime.Nsec != 5 {
+		t.Errorf("got %+v", out.Statx)
+	}
+}
+
+// sparseNode reports a size of 1 MiB, of which only `blocks` are
+// allocated.
+type sparseNode struct {
+	Inode
+	blocks  uint64
+	blksize uint32
+}
+
+var _ = (NodeGetattrer)((*sparseNode)(nil))
+
+func (n *sparseNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = 1 << 20
+	out.Blocks = n.blocks
+	out.Blksize = n.blksize
+	return 0
+}
+
+// TestGetattrBlocks checks that Blocks is passed through, rather
+// than computed from Size.
+func TestGetattrBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		blocks      uint64
+		blksize     uint32
+		wantBlocks  uint64
+		wantBlksize uint32
+	}{
+		{8, 0, 8, 4096},
+		{8, 512, 8, 512},
+		{0, 512, 0, 512},
+		{0, 0, 2048, 4096},
+	} {
+		root := &Inode{}
+		rawFS := NewNodeFS(root, &Options{})
+		ctx := context.Background()
+		node := &sparseNode{blocks: tc.blocks, blksize: tc.blksize}
+		root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{Mode: syscall.S_IFREG}), false)
+
+		var entry fuse.EntryOut
+		if status := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !status.Ok() {
+			t.Fatalf("Lookup: %v", status)
+		}
+		if entry.Blocks != tc.wantBlocks || entry.Blksize != tc.wantBlksize {
+			t.Errorf("blocks %d blksize %d: Lookup got blocks %d blksize %d, want %d %d", tc.blocks, tc.blksize, entry.Blocks, entry.Blksize, tc.wantBlocks, tc.wantBlksize)
+		}
+
+		var out fuse.AttrOut
+		if status := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !status.Ok() {
+			t.Fatalf("GetAttr: %v", status)
+		}
+		if out.Blocks != tc.wantBlocks || out.Blksize != tc.wantBlksize {
+			t.Errorf("blocks %d blksize %d: GetAttr got blocks %d blksize %d, want %d %d", tc.blocks, tc.blksize, out.Blocks, out.Blksize, tc.wantBlocks, tc.wantBlksize)
+		}
+
+		in := fuse.StatxIn{SxMask: unix.STATX_BASIC_STATS}
+		in.NodeId = entry.NodeId
+		var sx fuse.StatxOut
+		if status := rawFS.Statx(nil, &in, &sx); !status.Ok() {
+			t.Fatalf("Statx: %v", status)
+		}
+		if sx.Blocks != tc.wantBlocks || sx.Blksize != tc.wantBlksize {
+			t.Errorf("blocks %d blksize %d: Statx got blocks %d blksize %d, want %d %d", tc.blocks, tc.blksize, sx.Blocks, sx.Blksize, tc.wantBlocks, tc.wantBlksize)
+		}
+	}
+}
+
+// TestOpenByHandle checks that open_by_handle_at(2) works on files
+// that were evicted from the kernel's inode cache, with
+// EnableExportSupport and RememberInodes.
+func TestOpenByHandle(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("open_by_handle_at requires CAP_DAC_READ_SEARCH")
+	}
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{Gen: 3}), false)
+		},
+	}
+	opts.EnableExportSupport = true
+	opts.RememberInodes = true
+	mnt, server := testMount(t, root, opts)
+	if server.KernelSettings().Flags64()&fuse.CAP_EXPORT_SUPPORT == 0 {
+		t.Skip("kernel does not support CAP_EXPORT_SUPPORT")
+	}
+
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, mnt+"/file", 0)
+	if err != nil {
+		t.Fatalf("NameToHandleAt: %v", err)
+	}
+
+	// Evict the file from the kernel's caches.
+	if errno := root.NotifyEntry("file"); errno != 0 {
+		t.Fatalf("NotifyEntry: %v", errno)
+	}
+	if err := os.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+		t.Skipf("cannot drop caches: %v", err)
+	}
+
+	mntFd, err := unix.Open(mnt, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(mntFd)
+	fd, err := unix.OpenByHandleAt(mntFd, handle, unix.O_RDONLY)
+	if err != nil {
+		t.Fatalf("OpenByHandleAt: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "file")
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil || string(content) != "hello" {
+		t.Errorf("got %q, %v, want %q", content, err, "hello")
+	}
+}
@@ -4,6 +4,10 @@ package fs
 
 import "github.com/hanwen/go-fuse/v2/fuse"
 
+func isTmpfile(flags uint32) bool {
+	return false
+}
+
 func (b *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
 	return fuse.ENOSYS
 }
@@ -6,9 +6,12 @@ package fs
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
@@ -16,6 +19,7 @@ import (
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
 )
 
 // TestBridgeReaddirPlusVirtualEntries looks at "." and ".." in the ReadDirPlus
@@ -279,3 +283,938 @@ func TestNegativeLookupCache(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdateTimeouts(t *testing.T) {
+	sec := time.Second
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		EntryTimeout:    &sec,
+		AttrTimeout:     &sec,
+		NegativeTimeout: &sec,
+	})
+
+	header := fuse.InHeader{NodeId: 1}
+	var out fuse.EntryOut
+	if code := rawFS.Lookup(nil, &header, "missing", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	if got := out.EntryTimeout(); got != sec {
+		t.Errorf("negative timeout: got %v, want %v", got, sec)
+	}
+
+	rawFS.(fuse.TimeoutUpdater).UpdateTimeouts(2*time.Second, 3*time.Second, 4*time.Second)
+
+	out = fuse.EntryOut{}
+	if code := rawFS.Lookup(nil, &header, "missing", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	if got, want := out.EntryTimeout(), 4*time.Second; got != want {
+		t.Errorf("negative timeout: got %v, want %v", got, want)
+	}
+
+	var attrOut fuse.AttrOut
+	if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: header}, &attrOut); !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	if got, want := attrOut.Timeout(), 3*time.Second; got != want {
+		t.Errorf("attr timeout: got %v, want %v", got, want)
+	}
+}
+
+func TestTimeoutFuncs(t *testing.T) {
+	sec := time.Second
+	root := &Inode{}
+	timeouts := map[string]time.Duration{
+		"short": 2 * time.Second,
+		"long":  time.Hour,
+	}
+	timeoutFunc := func(n *Inode) time.Duration {
+		if d, ok := timeouts[n.Path(nil)]; ok {
+			return d
+		}
+		return -1
+	}
+	rawFS := NewNodeFS(root, &Options{
+		EntryTimeout:     &sec,
+		AttrTimeout:      &sec,
+		EntryTimeoutFunc: timeoutFunc,
+		AttrTimeoutFunc: func(n *Inode) time.Duration {
+			d := timeoutFunc(n)
+			if d > 0 {
+				d *= 2
+			}
+			return d
+		},
+		OnAdd: func(ctx context.Context) {
+			for _, name := range []string{"short", "long", "default"} {
+				root.AddChild(name, root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+			}
+		},
+	})
+
+	for name, want := range map[string]time.Duration{
+		"short":   2 * time.Second,
+		"long":    time.Hour,
+		"default": sec,
+	} {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		if got := out.EntryTimeout(); got != want {
+			t.Errorf("%s: entry timeout: got %v, want %v", name, got, want)
+		}
+		wantAttr := 2 * want
+		if name == "default" {
+			wantAttr = sec
+		}
+		if got := out.AttrTimeout(); got != wantAttr {
+			t.Errorf("%s: attr timeout: got %v, want %v", name, got, wantAttr)
+		}
+
+		var attrOut fuse.AttrOut
+		in := fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}
+		if code := rawFS.GetAttr(nil, &in, &attrOut); !code.Ok() {
+			t.Fatalf("GetAttr(%q): %v", name, code)
+		}
+		if got := attrOut.Timeout(); got != wantAttr {
+			t.Errorf("%s: GetAttr timeout: got %v, want %v", name, got, wantAttr)
+		}
+	}
+}
+
+type readOptionsNode struct {
+	Inode
+
+	opts ReadOptions
+}
+
+var _ = (NodeReaderWithOptions)((*readOptionsNode)(nil))
+
+func (n *readOptionsNode) ReadWithOptions(ctx context.Context, f FileHandle, dest []byte, off int64, opts *ReadOptions) (fuse.ReadResult, syscall.Errno) {
+	n.opts = *opts
+	return fuse.ReadResultData(nil), 0
+}
+
+func TestReadWithOptions(t *testing.T) {
+	root := &readOptionsNode{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	in := fuse.ReadIn{
+		InHeader:  fuse.InHeader{NodeId: 1},
+		Size:      4096,
+		Flags:     syscall.O_RDWR,
+		ReadFlags: fuse.READ_LOCKOWNER,
+		LockOwner: 42,
+	}
+	if _, code := rawFS.Read(nil, &in, make([]byte, in.Size)); !code.Ok() {
+		t.Fatalf("Read: %v", code)
+	}
+	want := ReadOptions{Flags: syscall.O_RDWR, ReadFlags: fuse.READ_LOCKOWNER, LockOwner: 42}
+	if root.opts != want {
+		t.Errorf("got %+v, want %+v", root.opts, want)
+	}
+}
+
+// writeOptionsFile records the options of WRITE requests. It is
+// set-user-ID, so a bridge that cleared the bit itself would call
+// Setattr.
+type writeOptionsFile struct {
+	Inode
+
+	mu       sync.Mutex
+	opts     []WriteOptions
+	setattrs int
+}
+
+var _ = (NodeWriterWithOptions)((*writeOptionsFile)(nil))
+var _ = (NodeGetattrer)((*writeOptionsFile)(nil))
+var _ = (NodeSetattrer)((*writeOptionsFile)(nil))
+var _ = (NodeOpener)((*writeOptionsFile)(nil))
+
+func (f *writeOptionsFile) WriteWithOptions(ctx context.Context, fh FileHandle, data []byte, off int64, opts *WriteOptions) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opts = append(f.opts, *opts)
+	return uint32(len(data)), 0
+}
+
+func (f *writeOptionsFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = syscall.S_ISUID | 0755
+	return 0
+}
+
+func (f *writeOptionsFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setattrs++
+	return 0
+}
+
+func (f *writeOptionsFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, 0
+}
+
+// writeOptionsHandle records the options of WRITE requests.
+type writeOptionsHandle struct {
+	opts WriteOptions
+}
+
+var _ = (FileWriterWithOptions)((*writeOptionsHandle)(nil))
+
+func (h *writeOptionsHandle) WriteWithOptions(ctx context.Context, data []byte, off int64, opts *WriteOptions) (uint32, syscall.Errno) {
+	h.opts = *opts
+	return uint32(len(data)), 0
+}
+
+type writeOptionsHandleNode struct {
+	Inode
+
+	fh *writeOptionsHandle
+}
+
+var _ = (NodeOpener)((*writeOptionsHandleNode)(nil))
+
+func (n *writeOptionsHandleNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return n.fh, 0, 0
+}
+
+func TestWriteWithOptions(t *testing.T) {
+	in := fuse.WriteIn{
+		InHeader:   fuse.InHeader{NodeId: 1},
+		Flags:      syscall.O_WRONLY,
+		WriteFlags: fuse.WRITE_LOCKOWNER | fuse.WRITE_KILL_SUIDGID,
+		LockOwner:  42,
+	}
+	want := WriteOptions{
+		Flags:      syscall.O_WRONLY,
+		WriteFlags: fuse.WRITE_LOCKOWNER | fuse.WRITE_KILL_SUIDGID,
+		LockOwner:  42,
+	}
+
+	t.Run("node", func(t *testing.T) {
+		root := &writeOptionsFile{}
+		rawFS := NewNodeFS(root, &Options{})
+		if _, code := rawFS.Write(nil, &in, []byte("hello")); !code.Ok() {
+			t.Fatalf("Write: %v", code)
+		}
+		if len(root.opts) != 1 || root.opts[0] != want {
+			t.Errorf("got %+v, want %+v", root.opts, want)
+		}
+		// WRITE_KILL_SUIDGID is left to the file system.
+		if root.setattrs != 0 {
+			t.Errorf("got %d Setattr calls, want 0", root.setattrs)
+		}
+	})
+
+	t.Run("handle", func(t *testing.T) {
+		root := &writeOptionsHandleNode{fh: &writeOptionsHandle{}}
+		rawFS := NewNodeFS(root, &Options{})
+		var out fuse.OpenOut
+		if code := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_WRONLY}, &out); !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		fhIn := in
+		fhIn.Fh = out.Fh
+		if _, code := rawFS.Write(nil, &fhIn, []byte("hello")); !code.Ok() {
+			t.Fatalf("Write: %v", code)
+		}
+		if root.fh.opts != want {
+			t.Errorf("got %+v, want %+v", root.fh.opts, want)
+		}
+	})
+}
+
+// TestWriteOptionsCache checks that writes from the page cache carry
+// fuse.WRITE_CACHE, and direct writes do not.
+func TestWriteOptionsCache(t *testing.T) {
+	for _, writeback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("writeback=%v", writeback), func(t *testing.T) {
+			root := &Inode{}
+			file := &writeOptionsFile{}
+			opts := &Options{
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+				},
+			}
+			opts.EnableWritebackCache = writeback
+			mnt, _ := testMount(t, root, opts)
+
+			if err := os.WriteFile(mnt+"/file", []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			file.mu.Lock()
+			defer file.mu.Unlock()
+			if len(file.opts) == 0 {
+				t.Fatal("no writes")
+			}
+			for _, o := range file.opts {
+				if got := o.WriteFlags&fuse.WRITE_CACHE != 0; got != writeback {
+					t.Errorf("got WRITE_CACHE %v, want %v", got, writeback)
+				}
+			}
+		})
+	}
+}
+
+// accessFile records the masks of Access calls, and denies W_OK.
+type accessFile struct {
+	Inode
+
+	mu    sync.Mutex
+	masks []uint32
+}
+
+var _ = (NodeAccesser)((*accessFile)(nil))
+var _ = (NodeGetattrer)((*accessFile)(nil))
+
+func (f *accessFile) Access(ctx context.Context, mask uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.masks = append(f.masks, mask)
+	if mask&unix.W_OK != 0 {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+func (f *accessFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	return 0
+}
+
+func TestAccess(t *testing.T) {
+	masks := []uint32{unix.F_OK, unix.R_OK, unix.W_OK, unix.X_OK, unix.R_OK | unix.X_OK}
+	for _, defaultPerms := range []bool{false, true} {
+		t.Run(fmt.Sprintf("default_permissions=%v", defaultPerms), func(t *testing.T) {
+			root := &Inode{}
+			file := &accessFile{}
+			opts := &Options{
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+				},
+			}
+			opts.DefaultPermissions = defaultPerms
+			mnt, _ := testMount(t, root, opts)
+
+			for _, mask := range masks {
+				err := unix.Access(mnt+"/file", mask)
+				var want error
+				if defaultPerms {
+					// The kernel checks against 0644.
+					// Even root needs an x bit to
+					// execute.
+					if mask&unix.X_OK != 0 {
+						want = syscall.EACCES
+					}
+				} else if mask&unix.W_OK != 0 {
+					want = syscall.EACCES
+				}
+				if err != want {
+					t.Errorf("access(%o): got %v, want %v", mask, err, want)
+				}
+			}
+
+			file.mu.Lock()
+			defer file.mu.Unlock()
+			var want []uint32
+			if !defaultPerms {
+				want = masks
+			}
+			if !reflect.DeepEqual(file.masks, want) {
+				t.Errorf("got Access masks %o, want %o", file.masks, want)
+			}
+		})
+	}
+}
+
+// TestAccessDefaultPermissionsOption checks that ACCESS is not
+// dispatched if default_permissions is passed as a raw mount option.
+func TestAccessDefaultPermissionsOption(t *testing.T) {
+	root := &accessFile{}
+	opts := &Options{}
+	opts.Options = []string{"default_permissions"}
+	rawFS := NewNodeFS(root, opts)
+
+	in := fuse.AccessIn{InHeader: fuse.InHeader{NodeId: 1}, Mask: unix.W_OK}
+	if code := rawFS.Access(nil, &in); !code.Ok() {
+		t.Errorf("Access: %v", code)
+	}
+	if len(root.masks) != 0 {
+		t.Errorf("Access was called with %o", root.masks)
+	}
+}
+
+type slowLookupNode struct {
+	Inode
+
+	canceled chan struct{}
+}
+
+func (n *slowLookupNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name == "late" {
+		// Ignore the cancellation, and succeed after the
+		// kernel has given up.
+		time.Sleep(500 * time.Millisecond)
+		return n.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFREG}), OK
+	}
+	if name != "slow" {
+		return nil, syscall.ENOENT
+	}
+	select {
+	case <-ctx.Done():
+		close(n.canceled)
+		return nil, syscall.EINTR
+	case <-time.After(time.Minute):
+		return nil, syscall.ENOENT
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	root := &slowLookupNode{canceled: make(chan struct{})}
+	opts := &Options{}
+	opts.RequestTimeout = 100 * time.Millisecond
+	mnt, _ := testMount(t, root, opts)
+
+	start := time.Now()
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/slow", &st); err != syscall.EIO {
+		t.Errorf("got %v, want EIO", err)
+	}
+	if dt := time.Since(start); dt > 10*time.Second {
+		t.Errorf("Lstat took %v", dt)
+	}
+	select {
+	case <-root.canceled:
+	case <-time.After(10 * time.Second):
+		t.Error("Lookup was not canceled")
+	}
+}
+
+// TestRequestTimeoutForget checks that a node from a dropped LOOKUP
+// reply is forgotten.
+func TestRequestTimeoutForget(t *testing.T) {
+	root := &slowLookupNode{canceled: make(chan struct{})}
+	opts := &Options{}
+	opts.RequestTimeout = 100 * time.Millisecond
+	mnt, _ := testMount(t, root, opts)
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/late", &st); err != syscall.EIO {
+		t.Fatalf("got %v, want EIO", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		// The node is added when Lookup returns, and must
+		// disappear when the dropped reply is undone.
+		time.Sleep(time.Second)
+		if root.GetChild("late") == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("node from dropped reply was not forgotten")
+		}
+	}
+}
+
+// callerDir records the caller and request ID of Lookup and
+// Releasedir calls.
+type callerDir struct {
+	Inode
+	callers []fuse.Caller
+	uniques []uint64
+}
+
+var _ = (NodeLookuper)((*callerDir)(nil))
+var _ = (NodeOpendirHandler)((*callerDir)(nil))
+
+func (d *callerDir) record(ctx context.Context) {
+	// Contexts derived from the bridge's should work too.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	caller, _ := CallerFromContext(ctx)
+	unique, _ := RequestUnique(ctx)
+	d.callers = append(d.callers, *caller)
+	d.uniques = append(d.uniques, unique)
+}
+
+func (d *callerDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	d.record(ctx)
+	return nil, syscall.ENOENT
+}
+
+func (d *callerDir) OpendirHandle(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &callerDirHandle{d}, 0, 0
+}
+
+type callerDirHandle struct {
+	d *callerDir
+}
+
+func (h *callerDirHandle) Releasedir(ctx context.Context, flags uint32) {
+	h.d.record(ctx)
+}
+
+func TestContextCallerUnique(t *testing.T) {
+	root := &callerDir{}
+	rawFS := NewNodeFS(root, &Options{})
+	caller := fuse.Caller{Owner: fuse.Owner{Uid: 5, Gid: 6}, Pid: 7}
+
+	var out fuse.EntryOut
+	rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1, Unique: 42, Caller: caller}, "x", &out)
+
+	var openOut fuse.OpenOut
+	if status := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !status.Ok() {
+		t.Fatalf("OpenDir: %v", status)
+	}
+	rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1, Unique: 43, Caller: caller}, Fh: openOut.Fh})
+
+	if len(root.callers) != 2 {
+		t.Fatalf("got %d calls, want 2", len(root.callers))
+	}
+	for i, want := range []uint64{42, 43} {
+		if root.callers[i] != caller {
+			t.Errorf("call %d: got caller %v, want %v", i, root.callers[i], caller)
+		}
+		if root.uniques[i] != want {
+			t.Errorf("call %d: got unique %d, want %d", i, root.uniques[i], want)
+		}
+	}
+}
+
+// getattrFhNode records the file handle passed to Getattr.
+type getattrFhNode struct {
+	Inode
+	mu    sync.Mutex
+	opens int
+	seen  []FileHandle
+}
+
+type getattrFhHandle struct {
+	id int
+}
+
+var _ = (NodeGetattrer)((*getattrFhNode)(nil))
+var _ = (NodeOpener)((*getattrFhNode)(nil))
+
+func (n *getattrFhNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.opens++
+	return &getattrFhHandle{id: n.opens}, 0, 0
+}
+
+func (n *getattrFhNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seen = append(n.seen, f)
+	return 0
+}
+
+func TestGetattrFh(t *testing.T) {
+	root := &Inode{}
+	node := &getattrFhNode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	hdr := fuse.InHeader{NodeId: entry.NodeId}
+	getattr := func(flags uint32, fh uint64) FileHandle {
+		node.seen = nil
+		var out fuse.AttrOut
+		if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: hdr, Flags_: flags, Fh_: fh}, &out); !code.Ok() {
+			t.Fatalf("GetAttr: %v", code)
+		}
+		return node.seen[0]
+	}
+
+	if f := getattr(0, 0); f != nil {
+		t.Errorf("no open files: got %v, want nil", f)
+	}
+
+	var open1, open2 fuse.OpenOut
+	rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &open1)
+	rawFS.Open(nil, &fuse.OpenIn{InHeader: hdr}, &open2)
+
+	// The Fh field is only valid with FUSE_GETATTR_FH.
+	if f := getattr(0, 12345); f == nil {
+		t.Errorf("open files, no FH flag: got nil, want an open file")
+	}
+	f := getattr(fuse.FUSE_GETATTR_FH, open2.Fh)
+	if h, ok := f.(*getattrFhHandle); !ok || h.id != 2 {
+		t.Errorf("FUSE_GETATTR_FH: got %#v, want second handle", f)
+	}
+}
+
+// TestFsyncDefault checks that FSYNC succeeds for nodes that do not
+// implement it, rather than switching off FSYNC for the mount.
+func TestFsyncDefault(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+		},
+	})
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	if code := rawFS.Fsync(nil, &fuse.FsyncIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}); code != fuse.OK {
+		t.Errorf("Fsync: got %v, want OK", code)
+	}
+}
+
+// bmapNode stores its data in consecutive blocks on a device,
+// starting at block `start` (in units of 512 bytes).
+type bmapNode struct {
+	Inode
+	start uint64
+}
+
+var _ = (NodeBmaper)((*bmapNode)(nil))
+
+func (n *bmapNode) Bmap(ctx context.Context, block uint64, blocksize uint32) (uint64, syscall.Errno) {
+	if blocksize%512 != 0 {
+		return 0, syscall.EINVAL
+	}
+	return n.start*512/uint64(blocksize) + block, 0
+}
+
+func TestBmap(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("image", root.NewPersistentInode(ctx, &bmapNode{start: 80}, StableAttr{}), false)
+			root.AddChild("plain", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+	lookup := func(name string) uint64 {
+		var entry fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		return entry.NodeId
+	}
+
+	image := lookup("image")
+	for _, tc := range []struct {
+		block     uint64
+		blocksize uint32
+		want      uint64
+		code      fuse.Status
+	}{
+		{0, 512, 80, fuse.OK},
+		{3, 4096, 13, fuse.OK},
+		{1, 1000, 0, fuse.EINVAL},
+	} {
+		var out fuse.BmapOut
+		code := rawFS.Bmap(nil, &fuse.BmapIn{InHeader: fuse.InHeader{NodeId: image}, Block: tc.block, Blocksize: tc.blocksize}, &out)
+		if code != tc.code || out.Block != tc.want {
+			t.Errorf("Bmap(%d, %d): got %d, %v, want %d, %v", tc.block, tc.blocksize, out.Block, code, tc.want, tc.code)
+		}
+	}
+
+	var out fuse.BmapOut
+	if code := rawFS.Bmap(nil, &fuse.BmapIn{InHeader: fuse.InHeader{NodeId: lookup("plain")}, Blocksize: 512}, &out); code != fuse.ENOSYS {
+		t.Errorf("Bmap without NodeBmaper: got %v, want ENOSYS", code)
+	}
+}
+
+// TestIno32 checks that Options.Ino32 maps 64-bit inode numbers to
+// compact 32-bit numbers, consistently across LOOKUP, GETATTR and
+// READDIR.
+func TestIno32(t *testing.T) {
+	root := &Inode{}
+	var logBuf strings.Builder
+	rawFS := NewNodeFS(root, &Options{
+		Ino32:  true,
+		Logger: log.New(&logBuf, "", 0),
+		OnAdd: func(ctx context.Context) {
+			for i, ino := range []uint64{1 << 40, 1<<40 + 1, 0, 1 << 50, 1<<40 + 1} {
+				ch := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Ino: ino})
+				root.AddChild(fmt.Sprintf("f%d", i), ch, false)
+			}
+		},
+	})
+	b := rawFS.(*rawBridge)
+
+	lookup := func(name string) uint64 {
+		var entry fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		var out fuse.AttrOut
+		if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &out); !code.Ok() {
+			t.Fatalf("GetAttr(%q): %v", name, code)
+		}
+		if out.Ino != entry.Ino {
+			t.Errorf("%q: LOOKUP gave ino %d, GETATTR %d", name, entry.Ino, out.Ino)
+		}
+		if entry.Ino == 0 || entry.Ino > 1<<32-1 {
+			t.Errorf("%q: ino %d out of 32-bit range", name, entry.Ino)
+		}
+		return entry.Ino
+	}
+
+	var root1 fuse.AttrOut
+	if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &root1); !code.Ok() || root1.Ino != 1 {
+		t.Errorf("root: got ino %d, %v, want 1", root1.Ino, code)
+	}
+
+	inos := map[string]uint64{}
+	for _, name := range []string{"f0", "f1", "f2", "f3", "f4"} {
+		inos[name] = lookup(name)
+	}
+	if inos["f1"] != inos["f4"] {
+		t.Errorf("hard links f1 and f4 got inos %d and %d", inos["f1"], inos["f4"])
+	}
+	seen := map[uint64]string{}
+	for _, name := range []string{"f0", "f1", "f2", "f3"} {
+		if other, ok := seen[inos[name]]; ok {
+			t.Errorf("%q and %q share ino %d", name, other, inos[name])
+		}
+		seen[inos[name]] = name
+	}
+
+	// READDIR reports the same numbers, also for entries that
+	// carry over to the next batch, and for replayed entries.
+	var openOut fuse.OpenOut
+	if code := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	// readDir returns the offsets of the entries read at off. The
+	// buffer only holds two entries.
+	readDir := func(off uint64) []uint64 {
+		buf := make([]byte, 64)
+		dirents := fuse.NewDirEntryList(buf, off)
+		readIn := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh, Offset: off, Size: uint32(len(buf))}
+		if code := rawFS.ReadDir(nil, &readIn, dirents); !code.Ok() {
+			t.Fatalf("ReadDir: %v", code)
+		}
+		var offs []uint64
+		// Each entry is a struct { Ino, Off uint64; NameLen, Typ uint32 },
+		// followed by the name, padded to 8 bytes.
+		for off := 0; off+24 <= len(buf); {
+			ino := *(*uint64)(unsafe.Pointer(&buf[off]))
+			nameLen := int(*(*uint32)(unsafe.Pointer(&buf[off+16])))
+			if nameLen == 0 {
+				break
+			}
+			name := string(buf[off+24 : off+24+nameLen])
+			if want, ok := inos[name]; ok && ino != want {
+				t.Errorf("READDIR %q: got ino %d, want %d", name, ino, want)
+			}
+			offs = append(offs, *(*uint64)(unsafe.Pointer(&buf[off+8])))
+			off += (24 + nameLen + 7) / 8 * 8
+		}
+		return offs
+	}
+	var off uint64
+	batches := 0
+	for {
+		offs := readDir(off)
+		if len(offs) == 0 {
+			break
+		}
+		batches++
+		off = offs[len(offs)-1]
+		if len(offs) > 1 {
+			// As after an interrupted READDIR.
+			offs = readDir(offs[0])
+			off = offs[len(offs)-1]
+		}
+	}
+	if batches < 2 {
+		t.Errorf("read directory in %d batches, want several", batches)
+	}
+
+	// Once the numbers run out, they are folded and a warning is
+	// logged.
+	b.maxIno32 = b.nextIno32
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		ch := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Ino: 1<<60 + uint64(i)})
+		root.AddChild(fmt.Sprintf("g%d", i), ch, false)
+		lookup(fmt.Sprintf("g%d", i))
+	}
+	if !strings.Contains(logBuf.String(), "exhausted") {
+		t.Errorf("no warning logged on exhaustion; got %q", logBuf.String())
+	}
+	if got := lookup("f3"); got != inos["f3"] {
+		t.Errorf("after exhaustion: f3 changed ino from %d to %d", inos["f3"], got)
+	}
+}
+
+type ino32ForgetRoot struct {
+	Inode
+}
+
+func (r *ino32ForgetRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return r.NewInode(ctx, &Inode{}, StableAttr{}), 0
+}
+
+// TestIno32Forget checks that forgetting nodes releases their
+// 32-bit inode numbers, even though each new lookup gets a new
+// automatic StableAttr.Ino.
+func TestIno32Forget(t *testing.T) {
+	rawFS := NewNodeFS(&ino32ForgetRoot{}, &Options{Ino32: true})
+	b := rawFS.(*rawBridge)
+
+	for i := 0; i < 100; i++ {
+		var a, c fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "a", &a); !code.Ok() {
+			t.Fatalf("Lookup: %v", code)
+		}
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "c", &c); !code.Ok() {
+			t.Fatalf("Lookup: %v", code)
+		}
+		if a.Ino == c.Ino || a.Ino > 3 || c.Ino > 3 {
+			t.Fatalf("iteration %d: got inos %d and %d, want 2 and 3", i, a.Ino, c.Ino)
+		}
+		rawFS.Forget(a.NodeId, 1)
+		b.BatchForget([]fuse.ForgetOne{{NodeId: c.NodeId, Nlookup: 1}})
+	}
+
+	b.ino32Mu.Lock()
+	defer b.ino32Mu.Unlock()
+	if len(b.ino32) != 1 {
+		t.Errorf("got %d ino32 entries, want 1 (the root)", len(b.ino32))
+	}
+	if b.nextIno32 != 4 {
+		t.Errorf("handed out numbers up to %d, want 3", b.nextIno32-1)
+	}
+}
+
+// TestLookupExport checks the lookups of "." and ".." that the
+// kernel sends to decode NFS file handles.
+func TestLookupExport(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			dir.AddChild("file", dir.NewInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{Gen: 7}), false)
+		},
+	})
+	lookup := func(id uint64, name string) (fuse.EntryOut, fuse.Status) {
+		var out fuse.EntryOut
+		code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: id}, name, &out)
+		return out, code
+	}
+
+	dir, code := lookup(1, "dir")
+	if !code.Ok() {
+		t.Fatalf("Lookup(dir): %v", code)
+	}
+	file, code := lookup(dir.NodeId, "file")
+	if !code.Ok() {
+		t.Fatalf("Lookup(file): %v", code)
+	}
+
+	self, code := lookup(file.NodeId, ".")
+	if !code.Ok() || self.NodeId != file.NodeId || self.Generation != 7 || self.Size != 5 {
+		t.Errorf(`Lookup(file, "."): got %v, %+v, want NodeId %d, Generation 7, Size 5`, code, self, file.NodeId)
+	}
+	if parent, code := lookup(file.NodeId, ".."); !code.Ok() || parent.NodeId != dir.NodeId {
+		t.Errorf(`Lookup(file, ".."): got %v, NodeId %d, want %d`, code, parent.NodeId, dir.NodeId)
+	}
+	if parent, code := lookup(1, ".."); !code.Ok() || parent.NodeId != 1 {
+		t.Errorf(`Lookup(root, ".."): got %v, NodeId %d, want 1`, code, parent.NodeId)
+	}
+
+	// The lookup of "." counts like any other. Once the kernel
+	// has forgotten all of them, the handle is stale.
+	rawFS.Forget(file.NodeId, 1)
+	if _, code := lookup(file.NodeId, "."); !code.Ok() {
+		t.Errorf(`Lookup(file, ".") after 1 forget: %v`, code)
+	}
+	rawFS.Forget(file.NodeId, 2)
+	if _, code := lookup(file.NodeId, "."); code != fuse.Status(syscall.ESTALE) {
+		t.Errorf(`Lookup(file, ".") after forget: got %v, want ESTALE`, code)
+	}
+}
+
+func TestMaxNameLen(t *testing.T) {
+	for _, tc := range []struct {
+		maxNameLen int
+		ok, long   int
+	}{
+		{0, 1000, 0},
+		{10, 10, 11},
+		{255, 255, 256},
+		{-1, 1000, 0},
+	} {
+		t.Run(fmt.Sprintf("MaxNameLen=%d", tc.maxNameLen), func(t *testing.T) {
+			loopback, err := NewLoopbackRoot(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawFS := NewNodeFS(loopback, &Options{MaxNameLen: tc.maxNameLen})
+			header := fuse.InHeader{NodeId: 1}
+
+			name := strings.Repeat("x", tc.ok)
+			var out fuse.EntryOut
+			code := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: header, Mode: 0755}, name, &out)
+			if tc.ok > 255 {
+				// The check is disabled, so the error comes from
+				// the underlying file system.
+				if code != fuse.Status(syscall.ENAMETOOLONG) {
+					t.Errorf("Mkdir(%d bytes): got %v, want ENAMETOOLONG from the backend", len(name), code)
+				}
+			} else if !code.Ok() {
+				t.Errorf("Mkdir(%d bytes): %v", len(name), code)
+			}
+
+			var statfs fuse.StatfsOut
+			if code := rawFS.StatFs(nil, &header, &statfs); !code.Ok() {
+				t.Fatalf("StatFs: %v", code)
+			}
+			if tc.maxNameLen > 0 && statfs.NameLen != uint32(tc.maxNameLen) {
+				t.Errorf("StatFs: got NameLen %d, want %d", statfs.NameLen, tc.maxNameLen)
+			}
+			if tc.long == 0 {
+				return
+			}
+
+			long := strings.Repeat("y", tc.long)
+			for op, f := range map[string]func() fuse.Status{
+				"Lookup": func() fuse.Status {
+					return rawFS.Lookup(nil, &header, long, &fuse.EntryOut{})
+				},
+				"Mkdir": func() fuse.Status {
+					return rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: header, Mode: 0755}, long, &fuse.EntryOut{})
+				},
+				"Mknod": func() fuse.Status {
+					return rawFS.Mknod(nil, &fuse.MknodIn{InHeader: header, Mode: syscall.S_IFIFO | 0644}, long, &fuse.EntryOut{})
+				},
+				"Create": func() fuse.Status {
+					return rawFS.Create(nil, &fuse.CreateIn{InHeader: header, Flags: syscall.O_WRONLY, Mode: 0644}, long, &fuse.CreateOut{})
+				},
+				"Symlink": func() fuse.Status {
+					return rawFS.Symlink(nil, &header, "target", long, &fuse.EntryOut{})
+				},
+				"Link": func() fuse.Status {
+					return rawFS.Link(nil, &fuse.LinkIn{InHeader: header, Oldnodeid: out.NodeId}, long, &fuse.EntryOut{})
+				},
+				"Rename": func() fuse.Status {
+					return rawFS.Rename(nil, &fuse.RenameIn{InHeader: header, Newdir: 1}, name, long)
+				},
+			} {
+				if code := f(); code != fuse.Status(syscall.ENAMETOOLONG) {
+					t.Errorf("%s(%d bytes): got %v, want ENAMETOOLONG", op, len(long), code)
+				}
+			}
+
+			// The file system was not called.
+			if entries, err := os.ReadDir(loopback.(*LoopbackNode).path()); err != nil || len(entries) != 1 {
+				t.Errorf("ReadDir: got %v, %v, want only %q", entries, err, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// bufferedFile coalesces contiguous writes before passing them on
+// to the wrapped file.
+type bufferedFile struct {
+	mu        sync.Mutex
+	file      FileHandle
+	flushSize int
+
+	// pending data, to be written at off.
+	buf []byte
+	off int64
+}
+
+var _ = (FileReader)((*bufferedFile)(nil))
+var _ = (FileWriter)((*bufferedFile)(nil))
+var _ = (FileFlusher)((*bufferedFile)(nil))
+var _ = (FileFsyncer)((*bufferedFile)(nil))
+var _ = (FileReleaser)((*bufferedFile)(nil))
+var _ = (FileGetattrer)((*bufferedFile)(nil))
+var _ = (FileSetattrer)((*bufferedFile)(nil))
+var _ = (FileAllocater)((*bufferedFile)(nil))
+
+// NewBufferedFileHandle returns a FileHandle that collects
+// contiguous writes to fh, and passes them on in chunks of at least
+// flushSize bytes. This helps backends with a high cost per write,
+// as the kernel typically issues writes of a single page unless
+// writeback caching is enabled.
+//
+// Buffered data is written before reads, attribute queries and
+// changes, fallocate, and on flush, fsync and release, and when a
+// write is not contiguous with the buffered data. As a consequence,
+// an error from writing buffered data can be reported by a later
+// operation. Only the methods of FileReader, FileWriter,
+// FileFlusher, FileFsyncer, FileReleaser, FileGetattrer,
+// FileSetattrer and FileAllocater are forwarded to fh. The file
+// must not be opened with passthrough, and the node should not
+// implement NodeWriter, as writes would then bypass the buffer.
+func NewBufferedFileHandle(fh FileHandle, flushSize int) FileHandle {
+	return &bufferedFile{
+		file:      fh,
+		flushSize: flushSize,
+	}
+}
+
+// flushLocked writes out the buffered data. The buffer is dropped
+// even if writing fails, so the error is reported only once.
+func (f *bufferedFile) flushLocked(ctx context.Context) syscall.Errno {
+	data := f.buf
+	off := f.off
+	f.buf = f.buf[:0]
+	if len(data) == 0 {
+		return 0
+	}
+	w, ok := f.file.(FileWriter)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	for len(data) > 0 {
+		n, errno := w.Write(ctx, data, off)
+		if errno != 0 {
+			return errno
+		}
+		if n == 0 {
+			return syscall.EIO
+		}
+		data = data[n:]
+		off += int64(n)
+	}
+	return 0
+}
+
+func (f *bufferedFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	w, ok := f.file.(FileWriter)
+	if !ok {
+		return 0, syscall.ENOTSUP
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.buf) > 0 && off != f.off+int64(len(f.buf)) {
+		if errno := f.flushLocked(ctx); errno != 0 {
+			return 0, errno
+		}
+	}
+	if len(f.buf) == 0 {
+		if len(data) >= f.flushSize {
+			return w.Write(ctx, data, off)
+		}
+		f.off = off
+	}
+	f.buf = append(f.buf, data...)
+	if len(f.buf) >= f.flushSize {
+		if errno := f.flushLocked(ctx); errno != 0 {
+			return 0, errno
+		}
+	}
+	return uint32(len(data)), 0
+}
+
+func (f *bufferedFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return nil, errno
+	}
+	if r, ok := f.file.(FileReader); ok {
+		return r.Read(ctx, dest, off)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+func (f *bufferedFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	if fl, ok := f.file.(FileFlusher); ok {
+		return fl.Flush(ctx)
+	}
+	return 0
+}
+
+func (f *bufferedFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	if fs, ok := f.file.(FileFsyncer); ok {
+		return fs.Fsync(ctx, flags)
+	}
+	return syscall.ENOTSUP
+}
+
+func (f *bufferedFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if r, ok := f.file.(FileReleaser); ok {
+		if e := r.Release(ctx); errno == 0 {
+			errno = e
+		}
+	}
+	return errno
+}
+
+func (f *bufferedFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	if g, ok := f.file.(FileGetattrer); ok {
+		return g.Getattr(ctx, out)
+	}
+	return 0
+}
+
+func (f *bufferedFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	if s, ok := f.file.(FileSetattrer); ok {
+		return s.Setattr(ctx, in, out)
+	}
+	return syscall.ENOTSUP
+}
+
+func (f *bufferedFile) Allocate(ctx context.Context, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	errno := f.flushLocked(ctx)
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	if a, ok := f.file.(FileAllocater); ok {
+		return a.Allocate(ctx, off, size, mode)
+	}
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// countingFile is an in-memory file that counts writes.
+type countingFile struct {
+	mu     sync.Mutex
+	data   []byte
+	writes int
+}
+
+func writeAt(dst []byte, data []byte, off int64) []byte {
+	if end := int(off) + len(data); end > len(dst) {
+		dst = append(dst, make([]byte, end-len(dst))...)
+	}
+	copy(dst[off:], data)
+	return dst
+}
+
+func (f *countingFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes++
+	f.data = writeAt(f.data, data, off)
+	return uint32(len(data)), 0
+}
+
+func (f *countingFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if int(off) >= len(f.data) {
+		return fuse.ReadResultData(nil), 0
+	}
+	n := copy(dest, f.data[off:])
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (f *countingFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Size = uint64(len(f.data))
+	return 0
+}
+
+func (f *countingFile) snapshot() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]byte{}, f.data...)
+}
+
+func TestBufferedFileSequential(t *testing.T) {
+	under := &countingFile{}
+	fh := NewBufferedFileHandle(under, 64*1024)
+	ctx := context.Background()
+
+	var want []byte
+	for i := 0; i < 64; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, 4096)
+		if n, errno := fh.(FileWriter).Write(ctx, chunk, int64(i*4096)); errno != 0 || int(n) != len(chunk) {
+			t.Fatalf("Write: %d, %v", n, errno)
+		}
+		want = append(want, chunk...)
+	}
+	if errno := fh.(FileFlusher).Flush(ctx); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	if got := under.snapshot(); !bytes.Equal(got, want) {
+		t.Errorf("data mismatch")
+	}
+	if under.writes != 4 {
+		t.Errorf("got %d underlying writes, want 4", under.writes)
+	}
+}
+
+func TestBufferedFileRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ctx := context.Background()
+	for iter := 0; iter < 50; iter++ {
+		under := &countingFile{}
+		fh := NewBufferedFileHandle(under, 1+rnd.Intn(16384))
+		var ref []byte
+		off := int64(0)
+		for op := 0; op < 200; op++ {
+			switch r := rnd.Intn(20); {
+			case r == 0:
+				// Non-contiguous write.
+				off = rnd.Int63n(int64(len(ref) + 4096))
+			case r == 1:
+				if errno := fh.(FileFlusher).Flush(ctx); errno != 0 {
+					t.Fatalf("Flush: %v", errno)
+				}
+				if got := under.snapshot(); !bytes.Equal(got, ref) {
+					t.Fatalf("iter %d op %d: data mismatch after Flush", iter, op)
+				}
+				continue
+			case r == 2:
+				var out fuse.AttrOut
+				if errno := fh.(FileGetattrer).Getattr(ctx, &out); errno != 0 {
+					t.Fatalf("Getattr: %v", errno)
+				}
+				if out.Size != uint64(len(ref)) {
+					t.Fatalf("iter %d op %d: got size %d, want %d", iter, op, out.Size, len(ref))
+				}
+				continue
+			case r == 3:
+				roff := rnd.Int63n(int64(len(ref) + 1))
+				dest := make([]byte, rnd.Intn(8192))
+				res, errno := fh.(FileReader).Read(ctx, dest, roff)
+				if errno != 0 {
+					t.Fatalf("Read: %v", errno)
+				}
+				got, _ := res.Bytes(dest)
+				want := ref[roff:]
+				if len(want) > len(dest) {
+					want = want[:len(dest)]
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("iter %d op %d: Read(%d, %d) mismatch", iter, op, roff, len(dest))
+				}
+				continue
+			}
+
+			data := make([]byte, 1+rnd.Intn(8192))
+			rnd.Read(data)
+			if n, errno := fh.(FileWriter).Write(ctx, data, off); errno != 0 || int(n) != len(data) {
+				t.Fatalf("Write: %d, %v", n, errno)
+			}
+			ref = writeAt(ref, data, off)
+			off += int64(len(data))
+		}
+
+		if errno := fh.(FileReleaser).Release(ctx); errno != 0 {
+			t.Fatalf("Release: %v", errno)
+		}
+		if got := under.snapshot(); !bytes.Equal(got, ref) {
+			t.Fatalf("iter %d: data mismatch after Release", iter)
+		}
+	}
+}
@@ -237,6 +237,40 @@ func TestSymlinkCaching(t *testing.T) {
 	}
 }
 
+// TestSymlinkCachingCount counts the Readlink calls for repeated
+// reads of a symlink, with and without symlink caching.
+func TestSymlinkCachingCount(t *testing.T) {
+	const reads = 100
+	for _, caching := range []bool{false, true} {
+		t.Run(fmt.Sprintf("caching=%v", caching), func(t *testing.T) {
+			link := &countingSymlink{data: []byte("target")}
+			root := &Inode{}
+			opts := &Options{
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("link",
+						root.NewPersistentInode(ctx, link, StableAttr{Mode: syscall.S_IFLNK}), false)
+				},
+			}
+			opts.EnableSymlinkCaching = caching
+			mnt, _ := testMount(t, root, opts)
+
+			for i := 0; i < reads; i++ {
+				if got, err := os.Readlink(mnt + "/link"); err != nil || got != "target" {
+					t.Fatalf("Readlink: %q, %v", got, err)
+				}
+			}
+
+			want := reads
+			if caching {
+				want = 1
+			}
+			if c := link.count(); c != want {
+				t.Errorf("got %d Readlink calls, want %d", c, want)
+			}
+		})
+	}
+}
+
 type autoInvalNode struct {
 	Inode
 
@@ -328,3 +362,88 @@ func TestAutoInvalData(t *testing.T) {
 		t.Errorf("got %c want y", data[1])
 	}
 }
+
+func TestNotifyAttr(t *testing.T) {
+	node := &autoInvalNode{
+		content: []byte("hello"),
+		mtime:   time.Now(),
+	}
+	unseen := &autoInvalNode{}
+	root := &Inode{}
+	dt := time.Hour
+	opts := &Options{
+		EntryTimeout: &dt,
+		AttrTimeout:  &dt,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file",
+				root.NewPersistentInode(ctx, node, StableAttr{Mode: syscall.S_IFREG}), false)
+			root.AddChild("unseen",
+				root.NewPersistentInode(ctx, unseen, StableAttr{Mode: syscall.S_IFREG}), false)
+		},
+	}
+	mnt, _ := testMount(t, root, opts)
+
+	fi, err := os.Stat(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 5 {
+		t.Fatalf("got size %d, want 5", fi.Size())
+	}
+
+	node.mu.Lock()
+	node.content = []byte("hello world")
+	node.mu.Unlock()
+
+	if fi, err := os.Stat(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 5 {
+		t.Fatalf("got size %d, want cached size 5", fi.Size())
+	}
+
+	if errno := node.NotifyAttr(); errno != 0 {
+		t.Fatalf("NotifyAttr: %v", errno)
+	}
+
+	if fi, err := os.Stat(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 11 {
+		t.Errorf("got size %d, want 11", fi.Size())
+	}
+
+	if errno := unseen.NotifyAttr(); errno != syscall.ENOENT {
+		t.Errorf("NotifyAttr on unknown inode: got %v, want ENOENT", errno)
+	}
+}
+
+func TestWriteCache(t *testing.T) {
+	root := &keepCacheRoot{}
+	mntDir, _ := testMount(t, root, nil)
+
+	if errno := root.nokeep.WriteCache(0, []byte("abcdefghij")); errno != syscall.ENOENT {
+		t.Errorf("WriteCache on unknown inode: got %v, want ENOENT", errno)
+	}
+
+	if _, err := os.Stat(mntDir + "/keep"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("abcdefghij")
+	if errno := root.keep.WriteCache(0, want); errno != 0 {
+		t.Fatalf("WriteCache: %v", errno)
+	}
+
+	got, err := os.ReadFile(mntDir + "/keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	root.keep.mu.Lock()
+	defer root.keep.mu.Unlock()
+	if root.keep.count != 0 {
+		t.Errorf("got %d READ calls, want 0", root.keep.count)
+	}
+}
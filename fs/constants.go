@@ -5,6 +5,7 @@
 package fs
 
 import (
+	"context"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -20,8 +21,43 @@ func ToErrno(err error) syscall.Errno {
 	return syscall.Errno(s)
 }
 
-// RENAME_EXCHANGE is a flag argument for renameat2()
-const RENAME_EXCHANGE = 0x2
+// Flags for renameat2(2), passed to NodeRenamer.Rename.
+const (
+	// RENAME_NOREPLACE fails the rename with EEXIST if the
+	// destination exists.
+	RENAME_NOREPLACE = 0x1
+
+	// RENAME_EXCHANGE atomically swaps source and destination.
+	RENAME_EXCHANGE = 0x2
+
+	// RENAME_WHITEOUT leaves a whiteout (a character device with
+	// device number 0:0) in place of the source, as used by
+	// overlay file systems.
+	RENAME_WHITEOUT = 0x4
+)
+
+// Flags that NodeOpener, NodeCreater and FileHandle implementations
+// may return as fuseFlags.
+const (
+	// FOPEN_DIRECT_IO bypasses the page cache for this file.
+	FOPEN_DIRECT_IO = fuse.FOPEN_DIRECT_IO
+
+	// FOPEN_KEEP_CACHE keeps cached file data from a previous open.
+	FOPEN_KEEP_CACHE = fuse.FOPEN_KEEP_CACHE
+
+	// FOPEN_NONSEEKABLE marks the file as not seekable.
+	FOPEN_NONSEEKABLE = fuse.FOPEN_NONSEEKABLE
+
+	// FOPEN_STREAM gives the file stream semantics: reads and
+	// writes ignore the file position, and the kernel never
+	// seeks.
+	FOPEN_STREAM = fuse.FOPEN_STREAM
+
+	// FOPEN_NOFLUSH makes the kernel skip the FLUSH call on
+	// close(2). It is dropped for kernels older than protocol
+	// 7.35, which do not know the flag.
+	FOPEN_NOFLUSH = fuse.FOPEN_NOFLUSH
+)
 
 // seek to the next data
 const _SEEK_DATA = 3
@@ -31,3 +67,28 @@ const _SEEK_HOLE = 4
 
 // ENOATTR indicates that an extended attribute was not present.
 const ENOATTR = xattr.ENOATTR
+
+// CallerFromContext returns the process that issued the request
+// for which the bridge created ctx, or a context derived from it.
+func CallerFromContext(ctx context.Context) (*fuse.Caller, bool) {
+	return fuse.FromContext(ctx)
+}
+
+// RequestUnique returns the ID of the FUSE request for which the
+// bridge created ctx, or a context derived from it. It is the number
+// shown in debug output, and used by the kernel to interrupt
+// requests.
+func RequestUnique(ctx context.Context) (uint64, bool) {
+	return fuse.UniqueFromContext(ctx)
+}
+
+// ServerFromContext returns the server that is mounting the file
+// system, for contexts that the bridge passes to node methods and to
+// Options.OnMount, and contexts derived from them. It lets nodes use
+// the server, eg. for Stats, without storing it. If a file system
+// is mounted several times (see MountShared), this is the first
+// server. The root's OnAdd runs before the server exists, so it has
+// no server in its context.
+func ServerFromContext(ctx context.Context) (*fuse.Server, bool) {
+	return fuse.ServerFromContext(ctx)
+}
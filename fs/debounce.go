@@ -0,0 +1,120 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"syscall"
+	"time"
+)
+
+// pendingNotify collects the invalidations for an inode during a
+// window of Options.NotifyDebounce.
+type pendingNotify struct {
+	// timer ends the window.
+	timer *time.Timer
+
+	// dirty is set if there were calls since the last
+	// notification.
+	dirty bool
+
+	// content is set if the calls invalidated content, in the
+	// range [start, end). An end of -1 is the end of the file.
+	content    bool
+	start, end int64
+}
+
+// add merges an invalidation, as passed to Inode.NotifyContent.
+func (p *pendingNotify) add(off, sz int64) {
+	p.dirty = true
+	if off < 0 {
+		// Only attributes, which any notification
+		// invalidates.
+		return
+	}
+	end := off + sz
+	if sz <= 0 {
+		end = -1
+	}
+	if !p.content {
+		p.content = true
+		p.start, p.end = off, end
+		return
+	}
+	if off < p.start {
+		p.start = off
+	}
+	if p.end >= 0 && (end < 0 || end > p.end) {
+		p.end = end
+	}
+}
+
+// args returns the arguments for InodeNotify that cover all calls.
+func (p *pendingNotify) args() (off, sz int64) {
+	if !p.content {
+		return -1, 0
+	}
+	if p.end < 0 {
+		return p.start, 0
+	}
+	return p.start, p.end - p.start
+}
+
+// debounceNotify implements Inode.NotifyContent for
+// Options.NotifyDebounce. The first call for n is sent right away,
+// and opens a window in which further calls are merged.
+func (b *rawBridge) debounceNotify(n *Inode, off, sz int64) syscall.Errno {
+	b.notifyMu.Lock()
+	if p := b.notifyPending[n]; p != nil {
+		p.add(off, sz)
+		b.notifyMu.Unlock()
+		return 0
+	}
+	if b.notifyPending == nil {
+		b.notifyPending = map[*Inode]*pendingNotify{}
+	}
+	b.notifyPending[n] = &pendingNotify{
+		timer: time.AfterFunc(b.options.NotifyDebounce, func() { b.flushNotify(n) }),
+	}
+	b.notifyMu.Unlock()
+
+	return syscall.Errno(b.serverCallbacks().InodeNotify(n.nodeId, off, sz))
+}
+
+// flushNotify runs at the end of a window for n. It sends the merged
+// calls, if any, and opens a new window for calls that come in the
+// meantime. Otherwise, the next call is sent right away again.
+func (b *rawBridge) flushNotify(n *Inode) {
+	b.notifyMu.Lock()
+	p := b.notifyPending[n]
+	if p == nil {
+		// stopNotify ran after the timer fired.
+		b.notifyMu.Unlock()
+		return
+	}
+	if !p.dirty {
+		delete(b.notifyPending, n)
+		b.notifyMu.Unlock()
+		return
+	}
+	off, sz := p.args()
+	*p = pendingNotify{
+		timer: time.AfterFunc(b.options.NotifyDebounce, func() { b.flushNotify(n) }),
+	}
+	b.notifyMu.Unlock()
+
+	b.serverCallbacks().InodeNotify(n.nodeId, off, sz)
+}
+
+// stopNotify drops the pending invalidations, and stops their
+// timers. It is called on unmount, when there is no kernel left to
+// notify.
+func (b *rawBridge) stopNotify() {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	for _, p := range b.notifyPending {
+		p.timer.Stop()
+	}
+	b.notifyPending = nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// inodeNotifyRecorder records the InodeNotify calls.
+type inodeNotifyRecorder struct {
+	nopServerCallbacks
+
+	mu    sync.Mutex
+	calls [][2]int64
+}
+
+func (r *inodeNotifyRecorder) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, [2]int64{off, length})
+	return fuse.OK
+}
+
+func (r *inodeNotifyRecorder) get() [][2]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][2]int64{}, r.calls...)
+}
+
+func TestNotifyDebounce(t *testing.T) {
+	const window = 50 * time.Millisecond
+	rec := &inodeNotifyRecorder{}
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		NotifyDebounce:  window,
+	})
+
+	// The first call goes out right away, the rest is merged.
+	for i := int64(0); i < 1000; i++ {
+		if errno := root.NotifyContent(1000+10*i, 10); errno != 0 {
+			t.Fatalf("NotifyContent: %v", errno)
+		}
+	}
+	if got, want := rec.get(), [][2]int64{{1000, 10}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	time.Sleep(3 * window)
+	want := [][2]int64{{1000, 10}, {1010, 9990}}
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// After a quiet window, the next call is sent right away
+	// again. Invalidations up to the end of the file, and of
+	// only attributes merge with others.
+	root.NotifyContent(500, 10)
+	root.NotifyAttr()
+	root.NotifyContent(100, 0)
+	root.NotifyContent(2000, 10)
+	time.Sleep(3 * window)
+	want = append(want, [2]int64{500, 10}, [2]int64{100, 0})
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	root.NotifyAttr()
+	root.NotifyAttr()
+	time.Sleep(3 * window)
+	want = append(want, [2]int64{-1, 0}, [2]int64{-1, 0})
+	if got := rec.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestNotifyDebounceOff(t *testing.T) {
+	rec := &inodeNotifyRecorder{}
+	root := &Inode{}
+	NewNodeFS(root, &Options{ServerCallbacks: rec})
+	for i := int64(0); i < 1000; i++ {
+		root.NotifyContent(10*i, 10)
+	}
+	if got := len(rec.get()); got != 1000 {
+		t.Errorf("got %d notifications, want 1000", got)
+	}
+}
+
+// TestNotifyDebounceStorm checks that a continuous storm of
+// notifications is sent about once per window.
+func TestNotifyDebounceStorm(t *testing.T) {
+	const window = 20 * time.Millisecond
+	rec := &inodeNotifyRecorder{}
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		NotifyDebounce:  window,
+	})
+
+	start := time.Now()
+	for i := 0; time.Since(start) < 10*window; i++ {
+		root.NotifyContent(0, 0)
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(3 * window)
+
+	// Expect 1 + 10 notifications, but allow for slow timers.
+	if got := len(rec.get()); got < 2 || got > 13 {
+		t.Errorf("got %d notifications, want about 11", got)
+	}
+}
+
+// TestNotifyDebounceUnmount checks that merged calls are dropped on
+// unmount, rather than sent after it.
+func TestNotifyDebounceUnmount(t *testing.T) {
+	const window = 20 * time.Millisecond
+	rec := &inodeNotifyRecorder{}
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		ServerCallbacks: rec,
+		NotifyDebounce:  window,
+	})
+	b := rawFS.(*rawBridge)
+
+	root.NotifyContent(0, 10)
+	root.NotifyContent(10, 10)
+	b.OnUnmount()
+
+	b.notifyMu.Lock()
+	pending := len(b.notifyPending)
+	b.notifyMu.Unlock()
+	if pending != 0 {
+		t.Errorf("got %d pending notifications after unmount, want 0", pending)
+	}
+
+	time.Sleep(3 * window)
+	if got, want := rec.get(), [][2]int64{{0, 10}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// TestReaddirTypeMount checks d_type as returned by getdents(2).
+func TestReaddirTypeMount(t *testing.T) {
+	mnt, _ := testMount(t, &typelessDirNode{}, &Options{})
+	fd, err := syscall.Open(mnt, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	got := map[string]uint32{}
+	buf := make([]byte, 8192)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			t.Fatalf("ReadDirent: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		// struct linux_dirent64: ino, off (uint64), reclen
+		// (uint16), type (uint8), NUL-terminated name.
+		for b := buf[:n]; len(b) > 0; {
+			reclen := int(*(*uint16)(unsafe.Pointer(&b[16])))
+			name := b[19:reclen]
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			got[string(name)] = uint32(b[18])
+			b = b[reclen:]
+		}
+	}
+	if !reflect.DeepEqual(got, typelessDirWant) {
+		t.Errorf("got types %v, want %v", got, typelessDirWant)
+	}
+}
+
+// fsyncdirNode records the flags of Fsyncdir calls.
+type fsyncdirNode struct {
+	Inode
+
+	mu    sync.Mutex
+	flags []uint32
+}
+
+var _ = (NodeFsyncDirer)((*fsyncdirNode)(nil))
+
+func (n *fsyncdirNode) Fsyncdir(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.flags = append(n.flags, flags)
+	return 0
+}
+
+var _ = (NodeCreater)((*fsyncdirNode)(nil))
+
+func (n *fsyncdirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	ch := n.NewPersistentInode(ctx, &MemRegularFile{Attr: fuse.Attr{Mode: mode}}, StableAttr{})
+	n.AddChild(name, ch, true)
+	return ch, nil, 0, 0
+}
+
+func TestNodeFsyncDir(t *testing.T) {
+	root := &fsyncdirNode{}
+	mnt, _ := testMount(t, root, nil)
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(mnt+"/"+name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := os.Open(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := syscall.Fsync(int(d.Fd())); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+	if err := syscall.Fdatasync(int(d.Fd())); err != nil {
+		t.Fatalf("Fdatasync: %v", err)
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if want := []uint32{0, fuse.FSYNC_FDATASYNC}; !reflect.DeepEqual(root.flags, want) {
+		t.Errorf("got flags %v, want %v", root.flags, want)
+	}
+}
@@ -7,10 +7,16 @@ package fs
 import (
 	"context"
 	"fmt"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -263,3 +269,312 @@ func TestFsyncDir(t *testing.T) {
 	}
 
 }
+
+// TestFsyncdirDefault checks that FSYNCDIR succeeds if the file
+// system does not implement it.
+func TestFsyncdirDefault(t *testing.T) {
+	rawFS := NewNodeFS(&Inode{}, &Options{})
+	var out fuse.OpenOut
+	if code := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	in := &fuse.FsyncIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: out.Fh}
+	if code := rawFS.FsyncDir(nil, in); code != fuse.OK {
+		t.Errorf("FsyncDir: got %v, want OK", code)
+	}
+}
+
+type readdirplusNode struct {
+	Inode
+
+	mu         sync.Mutex
+	lookups    int
+	dirLookups int
+}
+
+var _ = (NodeLookuper)((*readdirplusNode)(nil))
+
+func (n *readdirplusNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.mu.Lock()
+	n.lookups++
+	n.mu.Unlock()
+	return n.newChild(ctx, name, out), 0
+}
+
+func (n *readdirplusNode) newChild(ctx context.Context, name string, out *fuse.EntryOut) *Inode {
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(len(name))
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFREG})
+}
+
+var _ = (NodeReaddirer)((*readdirplusNode)(nil))
+
+func (n *readdirplusNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var l []fuse.DirEntry
+	for i := 0; i < 10; i++ {
+		l = append(l, fuse.DirEntry{
+			Name: fmt.Sprintf("file%d", i),
+			Mode: fuse.S_IFREG,
+		})
+	}
+	return &readdirplusStream{DirStream: NewListDirStream(l), node: n}, 0
+}
+
+type readdirplusStream struct {
+	DirStream
+	node *readdirplusNode
+}
+
+var _ = (FileLookuper)((*readdirplusStream)(nil))
+
+func (s *readdirplusStream) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	s.node.mu.Lock()
+	s.node.dirLookups++
+	s.node.mu.Unlock()
+	return s.node.newChild(ctx, name, out), 0
+}
+
+func TestDirStreamLookup(t *testing.T) {
+	root := &readdirplusNode{}
+	sec := time.Minute
+	opts := Options{
+		EntryTimeout: &sec,
+		AttrTimeout:  &sec,
+	}
+	mnt, _ := testMount(t, root, &opts)
+
+	entries, err := os.ReadDir(mnt)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, e := range entries {
+		fi, err := os.Lstat(filepath.Join(mnt, e.Name()))
+		if err != nil {
+			t.Fatalf("Lstat: %v", err)
+		}
+		if got, want := fi.Size(), int64(len(e.Name())); got != want {
+			t.Errorf("%s: got size %d, want %d", e.Name(), got, want)
+		}
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.dirLookups == 0 {
+		t.Skip("kernel did not issue READDIRPLUS")
+	}
+	if root.dirLookups != len(entries) {
+		t.Errorf("got %d DirStream lookups, want %d", root.dirLookups, len(entries))
+	}
+	if root.lookups != 0 {
+		t.Errorf("got %d node lookups, want 0", root.lookups)
+	}
+}
+
+func (n *readdirplusNode) lookupCount() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.lookups + n.dirLookups
+}
+
+func TestReaddirPlusSkipCached(t *testing.T) {
+	root := &readdirplusNode{}
+	sec := time.Minute
+	rawFS := NewNodeFS(root, &Options{
+		EntryTimeout:          &sec,
+		AttrTimeout:           &sec,
+		ReaddirPlusSkipCached: true,
+	})
+
+	readDirPlus := func() {
+		var openOut fuse.OpenOut
+		openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}
+		if code := rawFS.OpenDir(nil, &openIn, &openOut); !code.Ok() {
+			t.Fatalf("OpenDir: %v", code)
+		}
+		defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: openIn.InHeader, Fh: openOut.Fh})
+
+		readIn := fuse.ReadIn{InHeader: openIn.InHeader, Fh: openOut.Fh}
+		if code := rawFS.ReadDirPlus(nil, &readIn, fuse.NewDirEntryList(make([]byte, 8192), 0)); !code.Ok() {
+			t.Fatalf("ReadDirPlus: %v", code)
+		}
+	}
+
+	readDirPlus()
+	if got, want := root.lookupCount(), 10; got != want {
+		t.Fatalf("first listing: got %d lookups, want %d", got, want)
+	}
+	readDirPlus()
+	if got, want := root.lookupCount(), 10; got != want {
+		t.Errorf("second listing: got %d lookups, want %d", got, want)
+	}
+}
+
+func TestReaddirPlusSkipCachedMount(t *testing.T) {
+	root := &readdirplusNode{}
+	sec := time.Minute
+	mnt, _ := testMount(t, root, &Options{
+		EntryTimeout:          &sec,
+		AttrTimeout:           &sec,
+		ReaddirPlusSkipCached: true,
+	})
+
+	// Like "ls -l".
+	list := func() {
+		entries, err := os.ReadDir(mnt)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		for _, e := range entries {
+			if _, err := os.Lstat(filepath.Join(mnt, e.Name())); err != nil {
+				t.Fatalf("Lstat: %v", err)
+			}
+		}
+	}
+
+	list()
+	first := root.lookupCount()
+	list()
+	if got := root.lookupCount() - first; got != 0 {
+		t.Errorf("second listing: got %d lookups, want 0", got)
+	}
+}
+
+// typelessDirNode lists its children without file types.
+type typelessDirNode struct {
+	Inode
+}
+
+var _ = (NodeReaddirer)((*typelessDirNode)(nil))
+var _ = (NodeOnAdder)((*typelessDirNode)(nil))
+
+func (n *typelessDirNode) OnAdd(ctx context.Context) {
+	for name, mode := range map[string]uint32{
+		"file": syscall.S_IFREG,
+		"dir":  syscall.S_IFDIR,
+		"link": syscall.S_IFLNK,
+		"fifo": syscall.S_IFIFO,
+	} {
+		n.AddChild(name, n.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: mode}), false)
+	}
+}
+
+func (n *typelessDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var es []fuse.DirEntry
+	for _, name := range []string{".", "..", "file", "dir", "link", "fifo", "unknown"} {
+		es = append(es, fuse.DirEntry{Name: name})
+	}
+	return NewListDirStream(es), 0
+}
+
+// typelessDirWant lists the d_type values expected for
+// typelessDirNode.
+var typelessDirWant = map[string]uint32{
+	".":       syscall.DT_DIR,
+	"..":      syscall.DT_DIR,
+	"file":    syscall.DT_REG,
+	"dir":     syscall.DT_DIR,
+	"link":    syscall.DT_LNK,
+	"fifo":    syscall.DT_FIFO,
+	"unknown": syscall.DT_UNKNOWN,
+}
+
+func TestReaddirFillsType(t *testing.T) {
+	rawFS := NewNodeFS(&typelessDirNode{}, &Options{})
+
+	var openOut fuse.OpenOut
+	openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}
+	if code := rawFS.OpenDir(nil, &openIn, &openOut); !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: openIn.InHeader, Fh: openOut.Fh})
+
+	buf := make([]byte, 8192)
+	out := fuse.NewDirEntryList(buf, 0)
+	readIn := fuse.ReadIn{InHeader: openIn.InHeader, Fh: openOut.Fh, Size: uint32(len(buf))}
+	if code := rawFS.ReadDir(nil, &readIn, out); !code.Ok() {
+		t.Fatalf("ReadDir: %v", code)
+	}
+
+	// Parse the fuse_dirent records: ino, off (uint64), namelen,
+	// type (uint32), followed by the name, padded to 8 bytes.
+	got := map[string]uint32{}
+	for b := buf; len(b) >= 24; {
+		nameLen := int(*(*uint32)(unsafe.Pointer(&b[16])))
+		if nameLen == 0 {
+			break
+		}
+		got[string(b[24:24+nameLen])] = *(*uint32)(unsafe.Pointer(&b[20]))
+		b = b[(24+nameLen+7)/8*8:]
+	}
+	if !reflect.DeepEqual(got, typelessDirWant) {
+		t.Errorf("got types %v, want %v", got, typelessDirWant)
+	}
+}
+
+// constOffsetNode lists entries that all have the same offset.
+type constOffsetNode struct {
+	Inode
+}
+
+var _ = (NodeReaddirer)((*constOffsetNode)(nil))
+
+func (n *constOffsetNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	var l []fuse.DirEntry
+	for _, name := range []string{"a", "b", "c"} {
+		l = append(l, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG, Off: 5})
+	}
+	return &constOffsetStream{l}, 0
+}
+
+type constOffsetStream struct {
+	todo []fuse.DirEntry
+}
+
+func (s *constOffsetStream) HasNext() bool { return len(s.todo) > 0 }
+func (s *constOffsetStream) Close()        {}
+
+func (s *constOffsetStream) Next() (fuse.DirEntry, syscall.Errno) {
+	e := s.todo[0]
+	s.todo = s.todo[1:]
+	return e, 0
+}
+
+func TestReaddirRepeatedOffset(t *testing.T) {
+	for _, plus := range []bool{false, true} {
+		t.Run(fmt.Sprintf("plus=%v", plus), func(t *testing.T) {
+			var logBuf strings.Builder
+			rawFS := NewNodeFS(&constOffsetNode{}, &Options{Logger: log.New(&logBuf, "", 0)})
+			var openOut fuse.OpenOut
+			openIn := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}
+			if code := rawFS.OpenDir(nil, &openIn, &openOut); !code.Ok() {
+				t.Fatalf("OpenDir: %v", code)
+			}
+			readDir := func(off uint64) (*fuse.DirEntryList, fuse.Status) {
+				out := fuse.NewDirEntryList(make([]byte, 4096), off)
+				readIn := fuse.ReadIn{InHeader: openIn.InHeader, Fh: openOut.Fh, Offset: off, Size: 4096}
+				if plus {
+					return out, rawFS.ReadDirPlus(nil, &readIn, out)
+				}
+				return out, rawFS.ReadDir(nil, &readIn, out)
+			}
+
+			// The first entry is sent, the second is rejected.
+			out, code := readDir(0)
+			if !code.Ok() {
+				t.Fatalf("ReadDir: %v", code)
+			}
+			if out.Offset != 5 {
+				t.Errorf("got offset %d, want 5", out.Offset)
+			}
+			if !strings.Contains(logBuf.String(), "repeats offset") {
+				t.Errorf("no warning logged; got %q", logBuf.String())
+			}
+
+			// Reading on fails, rather than returning "b" at
+			// offset 5 forever.
+			if _, code := readDir(out.Offset); code != fuse.EIO {
+				t.Errorf("got %v, want EIO", code)
+			}
+		})
+	}
+}
@@ -93,3 +93,68 @@ func TestFUSEDirectIO(t *testing.T) {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+// alignedFH requires 512-byte aligned I/O.
+type alignedFH struct {
+	dioFH
+}
+
+var _ = (FileDirectIOAligner)((*alignedFH)(nil))
+var _ = (FileWriter)((*alignedFH)(nil))
+
+func (fh *alignedFH) DirectIOAlignment() int {
+	return 512
+}
+
+func (fh *alignedFH) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	return uint32(len(data)), OK
+}
+
+type alignedFile struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*alignedFile)(nil))
+
+func (f *alignedFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	return &alignedFH{}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func TestDirectIOAlignment(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &alignedFile{}, StableAttr{}), false)
+		},
+	})
+
+	var entryOut fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entryOut); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	var openOut fuse.OpenOut
+	if code := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entryOut.NodeId}, Flags: uint32(os.O_RDWR)}, &openOut); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+
+	for _, tc := range []struct {
+		off, size uint64
+		want      fuse.Status
+	}{
+		{0, 512, fuse.OK},
+		{4096, 1024, fuse.OK},
+		{1, 512, fuse.EINVAL},
+		{512, 100, fuse.EINVAL},
+	} {
+		hdr := fuse.InHeader{NodeId: entryOut.NodeId}
+		buf := make([]byte, tc.size)
+		_, code := rawFS.Read(nil, &fuse.ReadIn{InHeader: hdr, Fh: openOut.Fh, Offset: tc.off, Size: uint32(tc.size)}, buf)
+		if code != tc.want {
+			t.Errorf("Read(off=%d, size=%d): got %v, want %v", tc.off, tc.size, code, tc.want)
+		}
+		_, code = rawFS.Write(nil, &fuse.WriteIn{InHeader: hdr, Fh: openOut.Fh, Offset: tc.off, Size: uint32(tc.size)}, buf)
+		if code != tc.want {
+			t.Errorf("Write(off=%d, size=%d): got %v, want %v", tc.off, tc.size, code, tc.want)
+		}
+	}
+}
@@ -15,6 +15,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+var _ = (SeekableDirStream)((*dirArray)(nil))
+
 type dirArray struct {
 	idx     int
 	entries []fuse.DirEntry
@@ -69,10 +71,85 @@ func NewListDirStream(list []fuse.DirEntry) DirStream {
 	return &dirArray{entries: list}
 }
 
+// NewChanDirStream returns a DirStream whose entries are sent on ch
+// by produce, which runs in its own goroutine. Entries are only
+// received when they are needed for a READDIR reply, so a slow
+// source can be listed incrementally. The stream ends when produce
+// returns; a non-zero errno makes it fail with that errno after the
+// entries sent before. produce must stop sending and return once
+// its ctx is done, which happens when the stream is closed, eg.
+// because the directory is released before it was read to the end.
+// If the parent ctx is canceled first, the stream fails with EINTR.
+func NewChanDirStream(ctx context.Context, produce func(ctx context.Context, ch chan<- fuse.DirEntry) syscall.Errno) DirStream {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan fuse.DirEntry)
+	s := &chanDirStream{ctx: ctx, cancel: cancel, ch: ch}
+	go func() {
+		// Closing ch publishes result to the reader.
+		s.result = produce(ctx, ch)
+		close(ch)
+	}()
+	return s
+}
+
+type chanDirStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	ch     <-chan fuse.DirEntry
+	result syscall.Errno
+
+	next    fuse.DirEntry
+	hasNext bool
+	errno   syscall.Errno
+	done    bool
+}
+
+func (s *chanDirStream) HasNext() bool {
+	if !s.hasNext && !s.done {
+		select {
+		case e, ok := <-s.ch:
+			if ok {
+				s.next, s.hasNext = e, true
+			} else {
+				s.errno = s.result
+				s.done = true
+			}
+		case <-s.ctx.Done():
+			s.Close()
+			s.errno = syscall.EINTR
+		}
+	}
+	return s.hasNext || s.errno != 0
+}
+
+func (s *chanDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if !s.HasNext() {
+		return fuse.DirEntry{}, syscall.EINVAL
+	}
+	if !s.hasNext {
+		errno := s.errno
+		s.errno = 0
+		return fuse.DirEntry{}, errno
+	}
+	s.hasNext = false
+	return s.next, 0
+}
+
+func (s *chanDirStream) Close() {
+	s.done = true
+	s.hasNext = false
+	s.errno = 0
+	s.cancel()
+}
+
 // implement FileReaddirenter/FileReleasedirer
 type dirStreamAsFile struct {
 	creator func(context.Context) (DirStream, syscall.Errno)
 	ds      DirStream
+
+	// cur holds the entry returned by Readdirent, to avoid an
+	// allocation per entry.
+	cur fuse.DirEntry
 }
 
 func (d *dirStreamAsFile) Releasedir(ctx context.Context, releaseFlags uint32) {
@@ -92,12 +169,13 @@ func (d *dirStreamAsFile) Readdirent(ctx context.Context) (de *fuse.DirEntry, er
 		return nil, 0
 	}
 
-	e, errno := d.ds.Next()
-	return &e, errno
+	d.cur, errno = d.ds.Next()
+	return &d.cur, errno
 }
 
 func (d *dirStreamAsFile) Seekdir(ctx context.Context, off uint64) syscall.Errno {
-	if d.ds == nil {
+	fresh := d.ds == nil
+	if fresh {
 		var errno syscall.Errno
 		d.ds, errno = d.creator(ctx)
 		if errno != 0 {
@@ -107,7 +185,44 @@ func (d *dirStreamAsFile) Seekdir(ctx context.Context, off uint64) syscall.Errno
 	if sd, ok := d.ds.(FileSeekdirer); ok {
 		return sd.Seekdir(ctx, off)
 	}
-	return syscall.ENOTSUP
+
+	// Not seekable: read again from the start.
+	if !fresh {
+		d.ds.Close()
+		var errno syscall.Errno
+		d.ds, errno = d.creator(ctx)
+		if errno != 0 {
+			d.ds = nil
+			return errno
+		}
+	}
+	var cur uint64
+	for i := uint64(1); cur != off; i++ {
+		if !d.ds.HasNext() {
+			return syscall.EINVAL
+		}
+		e, errno := d.ds.Next()
+		if errno != 0 {
+			return errno
+		}
+		cur = e.Off
+		if cur == 0 {
+			cur = i
+		}
+	}
+	return 0
+}
+
+// fileLookuper returns the FileLookuper for READDIRPLUS on a
+// directory handle. For directories read through NodeReaddirer, this
+// is the DirStream, if it implements FileLookuper.
+func fileLookuper(f FileHandle) (FileLookuper, bool) {
+	if d, ok := f.(*dirStreamAsFile); ok {
+		lu, ok := d.ds.(FileLookuper)
+		return lu, ok
+	}
+	lu, ok := f.(FileLookuper)
+	return lu, ok
 }
 
 type loopbackDirStream struct {
@@ -167,7 +282,7 @@ var _ = (FileFsyncdirer)((*loopbackDirStream)(nil))
 func (ds *loopbackDirStream) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
 	ds.mu.Lock()
 	defer ds.mu.Unlock()
-	return ToErrno(syscall.Fsync(ds.fd))
+	return ToErrno(fsyncFd(ds.fd, flags))
 }
 
 func (ds *loopbackDirStream) HasNext() bool {
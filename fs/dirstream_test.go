@@ -8,8 +8,12 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -39,3 +43,290 @@ func TestDirSeek(t *testing.T) {
 
 	testDirSeek(t, mountDir)
 }
+
+// countingDirStream counts the entries read from a DirStream.
+type countingDirStream struct {
+	DirStream
+	nexts *int
+}
+
+func (s *countingDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	*s.nexts++
+	return s.DirStream.Next()
+}
+
+type seekableCountingDirStream struct {
+	countingDirStream
+}
+
+func (s *seekableCountingDirStream) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	return s.DirStream.(FileSeekdirer).Seekdir(ctx, off)
+}
+
+type bigDirNode struct {
+	Inode
+
+	seekable bool
+	nexts    int
+}
+
+var _ = (NodeReaddirer)((*bigDirNode)(nil))
+
+func (n *bigDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	entries := make([]fuse.DirEntry, 100000)
+	for i := range entries {
+		entries[i] = fuse.DirEntry{
+			Name: fmt.Sprintf("name%06d", i),
+			Mode: fuse.S_IFREG,
+			Ino:  uint64(i + 100),
+		}
+	}
+	ds := countingDirStream{NewListDirStream(entries), &n.nexts}
+	if n.seekable {
+		return &seekableCountingDirStream{ds}, 0
+	}
+	return &ds, 0
+}
+
+// TestDirStreamSeekLarge reads a large directory in READDIR chunks,
+// and then seeks back into the middle.
+func TestDirStreamSeekLarge(t *testing.T) {
+	for _, seekable := range []bool{true, false} {
+		t.Run(fmt.Sprintf("seekable=%v", seekable), func(t *testing.T) {
+			root := &bigDirNode{seekable: seekable}
+			rawFS := NewNodeFS(root, &Options{})
+
+			header := fuse.InHeader{NodeId: 1}
+			var openOut fuse.OpenOut
+			if code := rawFS.OpenDir(nil, &fuse.OpenIn{InHeader: header}, &openOut); !code.Ok() {
+				t.Fatalf("OpenDir: %v", code)
+			}
+			defer rawFS.ReleaseDir(&fuse.ReleaseIn{InHeader: header, Fh: openOut.Fh})
+
+			buf := make([]byte, 4096)
+			readDir := func(off uint64) *fuse.DirEntryList {
+				in := fuse.ReadIn{InHeader: header, Fh: openOut.Fh, Offset: off}
+				out := fuse.NewDirEntryList(buf, off)
+				if code := rawFS.ReadDir(nil, &in, out); !code.Ok() {
+					t.Fatalf("ReadDir(%d): %v", off, code)
+				}
+				return out
+			}
+
+			var off uint64
+			for {
+				out := readDir(off)
+				if out.Offset == off {
+					break
+				}
+				off = out.Offset
+			}
+			if off != 100000 {
+				t.Fatalf("got final offset %d, want 100000", off)
+			}
+			// The entry that did not fit in a chunk is kept for
+			// the next one, so the directory is read exactly once.
+			if root.nexts != 100000 {
+				t.Errorf("got %d entries read, want 100000", root.nexts)
+			}
+
+			readDir(50000)
+			// The first dirent (struct fuse_dirent: ino, off,
+			// namelen, type) holds the entry after offset 50000.
+			namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+			if got, want := string(buf[24:24+namelen]), "name050000"; got != want {
+				t.Errorf("after seek: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// producer returns a function for NewChanDirStream that sends n
+// entries, sleeping between them, and then returns errno.
+func producer(n int, errno syscall.Errno) func(context.Context, chan<- fuse.DirEntry) syscall.Errno {
+	return func(ctx context.Context, ch chan<- fuse.DirEntry) syscall.Errno {
+		for i := 0; i < n; i++ {
+			time.Sleep(time.Millisecond)
+			select {
+			case ch <- fuse.DirEntry{Name: fmt.Sprintf("name%04d", i), Mode: fuse.S_IFREG}:
+			case <-ctx.Done():
+				return syscall.EINTR
+			}
+		}
+		return errno
+	}
+}
+
+func TestChanDirStream(t *testing.T) {
+	ds := NewChanDirStream(context.Background(), producer(10, 0))
+	defer ds.Close()
+	var got []string
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			t.Fatalf("Next: %v", errno)
+		}
+		got = append(got, e.Name)
+	}
+	if len(got) != 10 || got[0] != "name0000" || got[9] != "name0009" {
+		t.Errorf("got %v", got)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after end of stream")
+	}
+}
+
+func TestChanDirStreamError(t *testing.T) {
+	ds := NewChanDirStream(context.Background(), producer(2, syscall.EIO))
+	defer ds.Close()
+	for i := 0; i < 2; i++ {
+		if _, errno := ds.Next(); errno != 0 {
+			t.Fatalf("Next %d: %v", i, errno)
+		}
+	}
+	if _, errno := ds.Next(); errno != syscall.EIO {
+		t.Errorf("got %v, want EIO", errno)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after error")
+	}
+}
+
+func TestChanDirStreamCloseEarly(t *testing.T) {
+	done := make(chan syscall.Errno, 1)
+	produce := producer(100, 0)
+	ds := NewChanDirStream(context.Background(), func(ctx context.Context, ch chan<- fuse.DirEntry) syscall.Errno {
+		errno := produce(ctx, ch)
+		done <- errno
+		return errno
+	})
+	if _, errno := ds.Next(); errno != 0 {
+		t.Fatalf("Next: %v", errno)
+	}
+	ds.Close()
+	select {
+	case errno := <-done:
+		if errno != syscall.EINTR {
+			t.Errorf("producer returned %v, want EINTR", errno)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("producer was not stopped by Close")
+	}
+}
+
+// TestChanDirStreamCancel checks that a stream waiting for a
+// producer fails when its context is canceled.
+func TestChanDirStreamCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ds := NewChanDirStream(ctx, func(ctx context.Context, ch chan<- fuse.DirEntry) syscall.Errno {
+		<-ctx.Done()
+		return 0
+	})
+	defer ds.Close()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, errno := ds.Next(); errno != syscall.EINTR {
+		t.Errorf("got %v, want EINTR", errno)
+	}
+	if ds.HasNext() {
+		t.Errorf("HasNext after cancel")
+	}
+}
+
+type chanDirNode struct {
+	Inode
+}
+
+var _ = (NodeReaddirer)((*chanDirNode)(nil))
+
+func (n *chanDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return NewChanDirStream(ctx, producer(200, 0)), 0
+}
+
+func TestChanDirStreamMount(t *testing.T) {
+	mnt, _ := testMount(t, &chanDirNode{}, nil)
+	entries, err := os.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 200 {
+		t.Errorf("got %d entries, want 200", len(entries))
+	}
+}
+
+// reuseDirStream returns n entries whose names share one buffer.
+type reuseDirStream struct {
+	buf []byte
+	i   int
+	n   int
+}
+
+func (s *reuseDirStream) HasNext() bool {
+	return s.i < s.n
+}
+
+func (s *reuseDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	s.buf = strconv.AppendInt(append(s.buf[:0], "file"...), int64(s.i), 10)
+	s.i++
+	e := fuse.DirEntry{Mode: fuse.S_IFREG}
+	e.SetNameBytes(s.buf)
+	return e, 0
+}
+
+func (s *reuseDirStream) Close() {}
+
+type reuseDirNode struct {
+	Inode
+}
+
+var _ = (NodeReaddirer)((*reuseDirNode)(nil))
+
+func (n *reuseDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return &reuseDirStream{n: 2000}, 0
+}
+
+var _ = (NodeLookuper)((*reuseDirNode)(nil))
+
+func (n *reuseDirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(len(name))
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFREG}), 0
+}
+
+func TestDirStreamReuseName(t *testing.T) {
+	root := &reuseDirNode{}
+	sec := time.Minute
+	mnt, _ := testMount(t, root, &Options{
+		EntryTimeout: &sec,
+		AttrTimeout:  &sec,
+	})
+
+	for j := 0; j < 2; j++ {
+		entries, err := os.ReadDir(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2000 {
+			t.Fatalf("got %d entries, want 2000", len(entries))
+		}
+		seen := map[string]bool{}
+		for _, e := range entries {
+			seen[e.Name()] = true
+		}
+		for i := 0; i < 2000; i++ {
+			if name := fmt.Sprintf("file%d", i); !seen[name] {
+				t.Fatalf("missing %q", name)
+			}
+		}
+	}
+
+	// Names added by READDIRPLUS must be copies.
+	for name, ch := range root.Children() {
+		fi, err := os.Lstat(filepath.Join(mnt, name))
+		if err != nil {
+			t.Fatalf("Lstat(%q): %v", name, err)
+		}
+		if got := ch.StableAttr().Ino; fi.Sys().(*syscall.Stat_t).Ino != got {
+			t.Errorf("%q: got ino %d, want %d", name, fi.Sys().(*syscall.Stat_t).Ino, got)
+		}
+	}
+}
@@ -37,6 +37,7 @@ var _ = (FileWriter)((*loopbackFile)(nil))
 var _ = (FileGetlker)((*loopbackFile)(nil))
 var _ = (FileSetlker)((*loopbackFile)(nil))
 var _ = (FileSetlkwer)((*loopbackFile)(nil))
+var _ = (FileFlocker)((*loopbackFile)(nil))
 var _ = (FileLseeker)((*loopbackFile)(nil))
 var _ = (FileFlusher)((*loopbackFile)(nil))
 var _ = (FileFsyncer)((*loopbackFile)(nil))
@@ -52,9 +53,23 @@ func (f *loopbackFile) PassthroughFd() (int, bool) {
 	return f.fd, true
 }
 
+// interrupted returns true if the request was interrupted, eg. while
+// waiting for the file lock.
+func interrupted(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
 func (f *loopbackFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if interrupted(ctx) {
+		return nil, syscall.EINTR
+	}
 	r := fuse.ReadResultFd(uintptr(f.fd), off, len(buf))
 	return r, OK
 }
@@ -62,6 +77,9 @@ func (f *loopbackFile) Read(ctx context.Context, buf []byte, off int64) (res fus
 func (f *loopbackFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if interrupted(ctx) {
+		return 0, syscall.EINTR
+	}
 	n, err := syscall.Pwrite(f.fd, data, off)
 	return uint32(n), ToErrno(err)
 }
@@ -95,7 +113,7 @@ func (f *loopbackFile) Flush(ctx context.Context) syscall.Errno {
 func (f *loopbackFile) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	r := ToErrno(syscall.Fsync(f.fd))
+	r := ToErrno(fsyncFd(f.fd, flags))
 
 	return r
 }
@@ -124,9 +142,65 @@ func (f *loopbackFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLo
 	return f.setLock(ctx, owner, lk, flags, true)
 }
 
+func (f *loopbackFile) Flock(ctx context.Context, owner uint64, op uint32) syscall.Errno {
+	lk := fuse.FileLock{}
+	switch op &^ syscall.LOCK_NB {
+	case syscall.LOCK_SH:
+		lk.Typ = syscall.F_RDLCK
+	case syscall.LOCK_EX:
+		lk.Typ = syscall.F_WRLCK
+	case syscall.LOCK_UN:
+		lk.Typ = syscall.F_UNLCK
+	default:
+		return syscall.EINVAL
+	}
+	return f.setLock(ctx, owner, &lk, fuse.FUSE_LK_FLOCK, op&syscall.LOCK_NB == 0)
+}
+
+// setLock sets a lock. A blocking request waits outside f.mu, on a
+// duplicate of the file descriptor, so other operations and the
+// release of the file can go ahead meanwhile. The wait cannot be
+// aborted, as the Go runtime restarts system calls interrupted by
+// signals. Instead, an interrupted request returns EINTR right away,
+// and the lock is released again if it is granted later.
 func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) (errno syscall.Errno) {
+	if !blocking {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return setFdLock(f.fd, lk, flags, false)
+	}
+
 	f.mu.Lock()
-	defer f.mu.Unlock()
+	fd, err := syscall.Dup(f.fd)
+	f.mu.Unlock()
+	if err != nil {
+		return ToErrno(err)
+	}
+	want := *lk
+	result := make(chan syscall.Errno, 1)
+	go func() {
+		result <- setFdLock(fd, &want, flags, true)
+	}()
+	select {
+	case errno = <-result:
+		syscall.Close(fd)
+		return errno
+	case <-ctx.Done():
+		go func() {
+			if errno := <-result; errno == 0 && want.Typ != syscall.F_UNLCK {
+				unlock := want
+				unlock.Typ = syscall.F_UNLCK
+				setFdLock(fd, &unlock, flags, false)
+			}
+			syscall.Close(fd)
+		}()
+		return syscall.EINTR
+	}
+}
+
+// setFdLock sets a lock on fd, with flock(2) for FUSE_LK_FLOCK, and
+// as an open file description lock otherwise.
+func setFdLock(fd int, lk *fuse.FileLock, flags uint32, blocking bool) syscall.Errno {
 	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
 		var op int
 		switch lk.Typ {
@@ -142,7 +216,7 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 		if !blocking {
 			op |= syscall.LOCK_NB
 		}
-		return ToErrno(syscall.Flock(f.fd, op))
+		return ToErrno(syscall.Flock(fd, op))
 	} else {
 		flk := syscall.Flock_t{}
 		lk.ToFlockT(&flk)
@@ -152,7 +226,7 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 		} else {
 			op = _OFD_SETLK
 		}
-		return ToErrno(syscall.FcntlFlock(uintptr(f.fd), op, &flk))
+		return ToErrno(syscall.FcntlFlock(uintptr(fd), op, &flk))
 	}
 }
 
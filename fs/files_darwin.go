@@ -30,3 +30,13 @@ func (f *loopbackFile) utimens(a *time.Time, m *time.Time) syscall.Errno {
 	err := syscall.Futimes(int(f.fd), tv)
 	return ToErrno(err)
 }
+
+func (f *loopbackFile) linkTo(newPath string) error {
+	return syscall.ENOTSUP
+}
+
+// fsyncFd flushes fd. There is no fdatasync, so
+// fuse.FSYNC_FDATASYNC is ignored.
+func fsyncFd(fd int, flags uint32) error {
+	return syscall.Fsync(fd)
+}
@@ -1,6 +1,20 @@
 package fs
 
-import "github.com/hanwen/go-fuse/v2/fuse"
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
 
 func setBlocks(out *fuse.Attr) {
 }
+
+func (f *loopbackFile) linkTo(newPath string) error {
+	return syscall.ENOTSUP
+}
+
+// fsyncFd flushes fd. There is no fdatasync, so
+// fuse.FSYNC_FDATASYNC is ignored.
+func fsyncFd(fd int, flags uint32) error {
+	return syscall.Fsync(fd)
+}
@@ -6,6 +6,7 @@ package fs
 
 import (
 	"context"
+	"fmt"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -18,8 +19,10 @@ func setBlocks(out *fuse.Attr) {
 	}
 
 	out.Blksize = 4096
-	pages := (out.Size + 4095) / 4096
-	out.Blocks = pages * 8
+	if out.Blocks == 0 {
+		pages := (out.Size + 4095) / 4096
+		out.Blocks = pages * 8
+	}
 }
 
 func setStatxBlocks(out *fuse.Statx) {
@@ -28,8 +31,10 @@ func setStatxBlocks(out *fuse.Statx) {
 	}
 
 	out.Blksize = 4096
-	pages := (out.Size + 4095) / 4096
-	out.Blocks = pages * 8
+	if out.Blocks == 0 {
+		pages := (out.Size + 4095) / 4096
+		out.Blocks = pages * 8
+	}
 }
 
 func (f *loopbackFile) Statx(ctx context.Context, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
@@ -44,3 +49,19 @@ func (f *loopbackFile) Statx(ctx context.Context, flags uint32, mask uint32, out
 
 	return OK
 }
+
+// linkTo gives the file a new name, which is needed for O_TMPFILE
+// files, as they have no name to pass to link(2).
+func (f *loopbackFile) linkTo(newPath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.fd), unix.AT_FDCWD, newPath, unix.AT_SYMLINK_FOLLOW)
+}
+
+// fsyncFd flushes fd, using fdatasync for fuse.FSYNC_FDATASYNC.
+func fsyncFd(fd int, flags uint32) error {
+	if flags&fuse.FSYNC_FDATASYNC != 0 {
+		return syscall.Fdatasync(fd)
+	}
+	return syscall.Fsync(fd)
+}
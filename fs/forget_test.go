@@ -7,6 +7,7 @@ package fs
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"sync"
@@ -214,3 +215,274 @@ func TestOnForget(t *testing.T) {
 		t.Errorf("got count %d, want 3", got)
 	}
 }
+
+type batchForgetRoot struct {
+	Inode
+
+	forgotten []*Inode
+}
+
+var _ = (NodeOnAdder)((*batchForgetRoot)(nil))
+
+func (r *batchForgetRoot) OnAdd(ctx context.Context) {
+	for _, name := range []string{"a", "b", "c"} {
+		r.AddChild(name, r.NewInode(ctx, &Inode{}, StableAttr{}), false)
+	}
+}
+
+var _ = (NodeBatchForgetter)((*batchForgetRoot)(nil))
+
+func (r *batchForgetRoot) OnBatchForget(nodes []*Inode) {
+	r.forgotten = append(r.forgotten, nodes...)
+}
+
+func TestBatchForget(t *testing.T) {
+	root := &batchForgetRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var forgets []fuse.ForgetOne
+	for _, name := range []string{"a", "b"} {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !code.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, code)
+		}
+		forgets = append(forgets, fuse.ForgetOne{NodeId: out.NodeId, Nlookup: 1})
+	}
+
+	rawFS.(fuse.BatchForgetter).BatchForget(forgets)
+
+	if len(root.forgotten) != 2 {
+		t.Fatalf("got %d forgotten nodes, want 2", len(root.forgotten))
+	}
+	for _, n := range root.forgotten {
+		if !n.Forgotten() {
+			t.Errorf("node %d is not forgotten", n.StableAttr().Ino)
+		}
+	}
+	if root.GetChild("a") != nil || root.GetChild("b") != nil {
+		t.Errorf("forgotten children are still in the tree")
+	}
+	if root.GetChild("c") == nil {
+		t.Errorf("child c was dropped")
+	}
+}
+
+// lifecycleNode counts OnAdd and OnForget calls for all nodes in the
+// tree. Directories have 5 children, which are created anew on
+// every lookup.
+type lifecycleNode struct {
+	Inode
+
+	counts *lifecycleCounts
+	depth  int
+}
+
+type lifecycleCounts struct {
+	mu     sync.Mutex
+	added  int
+	forgot int
+	nodes  []*lifecycleNode
+}
+
+var _ = (NodeOnAdder)((*lifecycleNode)(nil))
+var _ = (NodeOnForgetter)((*lifecycleNode)(nil))
+var _ = (NodeLookuper)((*lifecycleNode)(nil))
+
+func (n *lifecycleNode) OnAdd(ctx context.Context) {
+	n.counts.mu.Lock()
+	defer n.counts.mu.Unlock()
+	n.counts.added++
+	n.counts.nodes = append(n.counts.nodes, n)
+}
+
+func (n *lifecycleNode) OnForget() {
+	n.counts.mu.Lock()
+	defer n.counts.mu.Unlock()
+	n.counts.forgot++
+}
+
+func (n *lifecycleNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if n.depth == 0 || len(name) != 1 || name[0] < '0' || name[0] > '4' {
+		return nil, syscall.ENOENT
+	}
+	i := int(name[0] - '0')
+	mode := uint32(syscall.S_IFDIR)
+	if n.depth == 1 {
+		mode = syscall.S_IFREG
+	}
+	ch := &lifecycleNode{counts: n.counts, depth: n.depth - 1}
+	ino := n.StableAttr().Ino*10 + uint64(i) + 1
+	return n.NewInode(ctx, ch, StableAttr{Mode: mode, Ino: ino}), 0
+}
+
+func TestOnForgetLifecycle(t *testing.T) {
+	counts := &lifecycleCounts{}
+	root := &lifecycleNode{counts: counts, depth: 2}
+	rawFS := NewNodeFS(root, &Options{})
+
+	type lookup struct {
+		parent, node uint64
+	}
+	var live []lookup
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		if len(live) > 0 && rng.Intn(2) == 0 {
+			j := rng.Intn(len(live))
+			rawFS.Forget(live[j].node, 1)
+			live = append(live[:j], live[j+1:]...)
+			continue
+		}
+
+		parent := uint64(1)
+		if len(live) > 0 && rng.Intn(2) == 0 {
+			parent = live[rng.Intn(len(live))].node
+		}
+		var out fuse.EntryOut
+		name := fmt.Sprintf("%d", rng.Intn(5))
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: parent}, name, &out); code.Ok() {
+			live = append(live, lookup{parent, out.NodeId})
+		} else if code != fuse.ENOENT {
+			t.Fatalf("Lookup: %v", code)
+		}
+	}
+
+	counts.mu.Lock()
+	if counts.forgot >= counts.added {
+		t.Errorf("before unmount: got %d OnForget for %d OnAdd, want fewer", counts.forgot, counts.added)
+	}
+	counts.mu.Unlock()
+
+	// Unmounting forgets all live nodes. The root's OnAdd is
+	// called by NewNodeFS, so it is counted too.
+	rawFS.(*rawBridge).OnUnmount()
+
+	counts.mu.Lock()
+	defer counts.mu.Unlock()
+	if counts.forgot != counts.added {
+		t.Errorf("got %d OnForget for %d OnAdd", counts.forgot, counts.added)
+	}
+	for _, n := range counts.nodes {
+		if !n.IsForgotten() {
+			t.Errorf("node %d is not forgotten", n.StableAttr().Ino)
+		}
+	}
+}
+
+func TestIsForgotten(t *testing.T) {
+	root := &Inode{}
+	rawFS := NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	ch := root.NewInode(ctx, &Inode{}, StableAttr{})
+	if ch.IsForgotten() {
+		t.Error("new node is forgotten")
+	}
+	root.AddChild("ch", ch, false)
+
+	var out fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "ch", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	rawFS.Forget(out.NodeId, 1)
+	if !ch.IsForgotten() {
+		t.Error("node is not forgotten after FORGET")
+	}
+
+	// Reviving the node clears the flag.
+	root.AddChild("ch", ch, false)
+	if ch.IsForgotten() {
+		t.Error("node is forgotten after AddChild")
+	}
+}
+
+// pinRoot creates a new node for every lookup of "ctl".
+type pinRoot struct {
+	Inode
+}
+
+type pinCtl struct {
+	Inode
+	state int
+}
+
+var _ = (NodeLookuper)((*pinRoot)(nil))
+
+func (r *pinRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name != "ctl" {
+		return nil, syscall.ENOENT
+	}
+	return r.NewInode(ctx, &pinCtl{}, StableAttr{Ino: 42}), 0
+}
+
+func TestPinForget(t *testing.T) {
+	root := &pinRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	lookup := func() uint64 {
+		var out fuse.EntryOut
+		if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "ctl", &out); !code.Ok() {
+			t.Fatalf("Lookup: %v", code)
+		}
+		return out.NodeId
+	}
+
+	id := lookup()
+	ch := root.GetChild("ctl")
+	ctl := ch.Operations().(*pinCtl)
+	ctl.state = 1
+	ch.Pin()
+
+	rawFS.Forget(id, 1)
+	if ch.IsForgotten() {
+		t.Fatal("pinned node was forgotten")
+	}
+	if got := root.GetChild("ctl"); got != ch {
+		t.Fatalf("got child %v, want %v", got, ch)
+	}
+
+	// Lookup creates a new node, but the pinned one is used.
+	if got := lookup(); got != id {
+		t.Errorf("got node ID %d, want %d", got, id)
+	}
+	if got := root.GetChild("ctl").Operations().(*pinCtl); got != ctl || got.state != 1 {
+		t.Errorf("got %p (state %d), want %p", got, got.state, ctl)
+	}
+
+	// Pins are counted.
+	ch.Pin()
+	ch.Unpin()
+	rawFS.Forget(id, 1)
+	if ch.IsForgotten() {
+		t.Fatal("node was forgotten with a pin left")
+	}
+
+	ch.Unpin()
+	if !ch.IsForgotten() {
+		t.Error("node not forgotten after Unpin")
+	}
+	if root.GetChild("ctl") != nil {
+		t.Error("unpinned node still in the tree")
+	}
+}
+
+func TestPinUnmount(t *testing.T) {
+	root := &pinRoot{}
+	rawFS := NewNodeFS(root, &Options{})
+	var out fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "ctl", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	ch := root.GetChild("ctl")
+	ch.Pin()
+	rawFS.Forget(out.NodeId, 1)
+
+	// A pinned node that was removed from the tree is also released.
+	root.RmChild("ctl")
+	if ch.IsForgotten() {
+		t.Fatal("pinned node was forgotten")
+	}
+
+	rawFS.(*rawBridge).OnUnmount()
+	if !ch.IsForgotten() {
+		t.Error("pinned node not forgotten on unmount")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -86,6 +87,12 @@ type Inode struct {
 	// When you change this, you MUST increment changeCounter.
 	persistent bool
 
+	// pinCount is the number of Pin calls not yet balanced by
+	// Unpin. While it is nonzero, the node is kept as if it were
+	// persistent.
+	// When you change this, you MUST increment changeCounter.
+	pinCount int
+
 	// changeCounter increments every time the mutable state
 	// (lookupCount, persistent, children, parents) protected by
 	// mu is modified.
@@ -106,6 +113,18 @@ type Inode struct {
 	// Parents of this Inode. Can be more than one due to hard links.
 	// When you change this, you MUST increment changeCounter.
 	parents inodeParents
+
+	// forgotten is set when OnForget has been called, and cleared
+	// when the node is added back to the tree or looked up again.
+	forgotten bool
+
+	// entryExpiry is when the kernel entry for this node expires,
+	// if Options.ReaddirPlusSkipCached is set.
+	entryExpiry time.Time
+
+	// keepCache, if nonzero, overrides FOPEN_KEEP_CACHE on open:
+	// 1 sets it, -1 clears it. See SetKeepCache.
+	keepCache int8
 }
 
 func (n *Inode) IsDir() bool {
@@ -134,7 +153,7 @@ func initInode(n *Inode, ops InodeEmbedder, attr StableAttr, bridge *rawBridge,
 // Set node ID and mode in EntryOut
 func (n *Inode) setEntryOut(out *fuse.EntryOut) {
 	out.NodeId = n.nodeId
-	out.Ino = n.stableAttr.Ino
+	out.Ino = n.bridge.kernelIno(n.stableAttr.Ino)
 	out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
 }
 
@@ -267,11 +286,37 @@ func unlockNodes(ns ...*Inode) {
 // creation (NewInode) and adding the node into the tree, which
 // happens after Lookup/Mkdir/etc. return.
 //
-// Deprecated: use NodeOnForgetter instead.
+// Deprecated: use NodeOnForgetter or IsForgotten instead.
 func (n *Inode) Forgotten() bool {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	return n.lookupCount == 0 && n.parents.count() == 0 && !n.persistent
+	return n.lookupCount == 0 && n.parents.count() == 0 && !n.keep()
+}
+
+// IsForgotten returns true if the node was dropped from the tree,
+// ie. NodeOnForgetter.OnForget has been called for it, or would
+// have been if the node implemented it. Unlike Forgotten, it is
+// false for nodes that were created but not yet added, and it
+// becomes false again if the node is revived, eg. by AddChild.
+func (n *Inode) IsForgotten() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.forgotten
+}
+
+// forget marks the node as forgotten, and calls OnForget if it was
+// not forgotten already.
+func (n *Inode) forget() {
+	n.mu.Lock()
+	already := n.forgotten
+	n.forgotten = true
+	n.mu.Unlock()
+	if already {
+		return
+	}
+	if nf, ok := n.ops.(NodeOnForgetter); ok {
+		nf.OnForget()
+	}
 }
 
 // Operations returns the object implementing the file system
@@ -362,6 +407,60 @@ func (n *Inode) ForgetPersistent() {
 	n.removeRef(0, true)
 }
 
+// Pin keeps the node in the tree, even after the kernel forgets it,
+// so the same node (and any state it holds) is found on the next
+// lookup. This is useful for eg. control files. If the parent
+// implements NodeLookuper, its Lookup may return a new Inode with the
+// StableAttr of the pinned node; the pinned node is used instead.
+//
+// Pins are counted, so every Pin must be balanced by an Unpin. The
+// kernel references are tracked as usual, and RmChild still removes
+// the node from its parent. All pins are released on unmount.
+func (n *Inode) Pin() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pinCount++
+	n.changeCounter++
+}
+
+// Unpin undoes a Pin. When the last pin is released and the kernel
+// has no references to the node, it is dropped from the tree like a
+// forgotten node.
+func (n *Inode) Unpin() {
+	n.mu.Lock()
+	if n.pinCount == 0 {
+		n.mu.Unlock()
+		log.Panicf("n%d: Unpin without Pin", n.nodeId)
+	}
+	n.pinCount--
+	n.changeCounter++
+	last := n.pinCount == 0
+	n.mu.Unlock()
+
+	if !last {
+		return
+	}
+	if hasLookups, isPersistent, hasChildren := n.removeRef(0, false); !hasLookups && !isPersistent && !hasChildren {
+		n.forget()
+	}
+}
+
+// unpinAll releases all pins, on unmount.
+func (n *Inode) unpinAll() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pinCount > 0 {
+		n.pinCount = 0
+		n.changeCounter++
+	}
+}
+
+// keep returns whether the node must stay in the tree without kernel
+// references. Must be called with n.mu held.
+func (n *Inode) keep() bool {
+	return n.persistent || n.pinCount > 0
+}
+
 // NewInode returns an inode for the given InodeEmbedder. The mode
 // should be standard mode argument (eg. S_IFDIR). The inode number in
 // id.Ino argument is used to implement hard-links.  If it is given,
@@ -384,14 +483,20 @@ func (n *Inode) newInode(ctx context.Context, ops InodeEmbedder, id StableAttr,
 // the node to be forgotten (for kernel references), and whether it is
 // live (ie. was not dropped from the tree)
 func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (hasLookups, isPersistent, hasChildren bool) {
+	hasLookups, isPersistent, hasChildren, _ = n.removeRefForgotten(nlookup, dropPersistence, nil)
+	return
+}
+
+// removeRefForgotten is removeRef, but also appends the nodes that
+// became unreachable to forgotten.
+func (n *Inode) removeRefForgotten(nlookup uint64, dropPersistence bool, forgotten []*Inode) (hasLookups, isPersistent, hasChildren bool, _ []*Inode) {
 	var beforeLookups, beforePersistence, beforeChildren bool
 	var unusedParents []*Inode
 	beforeLookups, hasLookups, beforePersistence, isPersistent, beforeChildren, hasChildren, unusedParents = n.removeRefInner(nlookup, dropPersistence, unusedParents)
 
 	if !hasLookups && !isPersistent && !hasChildren && (beforeChildren || beforeLookups || beforePersistence) {
-		if nf, ok := n.ops.(NodeOnForgetter); ok {
-			nf.OnForget()
-		}
+		n.forget()
+		forgotten = append(forgotten, n)
 	}
 
 	for len(unusedParents) > 0 {
@@ -400,12 +505,11 @@ func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (hasLookups, isP
 		unusedParents = unusedParents[:l-1]
 		_, _, _, _, _, _, unusedParents = p.removeRefInner(0, false, unusedParents)
 
-		if nf, ok := p.ops.(NodeOnForgetter); ok {
-			nf.OnForget()
-		}
+		p.forget()
+		forgotten = append(forgotten, p)
 	}
 
-	return
+	return hasLookups, isPersistent, hasChildren, forgotten
 }
 
 func (n *Inode) removeRefInner(nlookup uint64, dropPersistence bool, inputUnusedParents []*Inode) (beforeLookups, hasLookups, beforePersistent, isPersistent, beforeChildren, hasChildren bool, unusedParents []*Inode) {
@@ -416,7 +520,7 @@ func (n *Inode) removeRefInner(nlookup uint64, dropPersistence bool, inputUnused
 
 	n.mu.Lock()
 	beforeLookups = n.lookupCount > 0
-	beforePersistent = n.persistent
+	beforePersistent = n.keep()
 	beforeChildren = n.children.len() > 0
 	if nlookup > 0 && dropPersistence {
 		log.Panic("only one allowed")
@@ -434,7 +538,16 @@ func (n *Inode) removeRefInner(nlookup uint64, dropPersistence bool, inputUnused
 	if n.lookupCount == 0 {
 		// Dropping the node from stableAttrs guarantees that no new references to this node are
 		// handed out to the kernel, hence we can also safely delete it from kernelNodeIds.
-		delete(n.bridge.stableAttrs, n.stableAttr)
+		// A pinned node stays, so lookups find it again; new references are serialized by n.mu.
+		cur, ok := n.bridge.stableAttrs[n.stableAttr]
+		if n.pinCount == 0 && cur == n {
+			delete(n.bridge.stableAttrs, n.stableAttr)
+		}
+		// Unless a newer node took over the inode number, the
+		// kernel no longer refers to it.
+		if n.bridge.ino32 != nil && (!ok || cur == n) {
+			n.bridge.releaseIno32(n.stableAttr.Ino)
+		}
 		delete(n.bridge.kernelNodeIds, n.nodeId)
 	}
 	n.bridge.mu.Unlock()
@@ -446,7 +559,7 @@ retry:
 		nChange := n.changeCounter
 		hasLookups = n.lookupCount > 0
 		hasChildren = n.children.len() > 0
-		isPersistent = n.persistent
+		isPersistent = n.keep()
 		for _, p := range n.parents.all() {
 			parents = append(parents, p)
 			lockme = append(lockme, p.parent)
@@ -473,7 +586,7 @@ retry:
 			}
 			parentNode.children.del(p.parent, p.name)
 
-			if parentNode.children.len() == 0 && parentNode.lookupCount == 0 && !parentNode.persistent {
+			if parentNode.children.len() == 0 && parentNode.lookupCount == 0 && !parentNode.keep() {
 				unusedParents = append(unusedParents, parentNode)
 			}
 		}
@@ -551,7 +664,38 @@ func (n *Inode) childrenList() []childEntry {
 	return n.children.list()
 }
 
-// Parents returns a parent of this Inode, or nil if this Inode is
+// anyOpenFile returns one of the file handles open on this Inode, or
+// nil if there are none.
+func (n *Inode) anyOpenFile() FileHandle {
+	n.bridge.mu.Lock()
+	defer n.bridge.mu.Unlock()
+	for _, fh := range n.openFiles {
+		return n.bridge.files[fh].file
+	}
+	return nil
+}
+
+// SetKeepCache overrides the FOPEN_KEEP_CACHE flag that the file
+// system returns from Open and Create for this Inode. With keep ==
+// false, the kernel drops its cached data for the file on each
+// subsequent open; with keep == true, it keeps it. A caching file
+// system can clear the flag after it detects that the backing data
+// changed, and set it again once the kernel has reread it.
+//
+// Independently of this flag, the kernel drops cached data when it
+// notices that the mtime or size of a file changed, unless
+// MountOptions.ExplicitDataCacheControl is set.
+func (n *Inode) SetKeepCache(keep bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if keep {
+		n.keepCache = 1
+	} else {
+		n.keepCache = -1
+	}
+}
+
+// Parent returns a parent of this Inode, or nil if this Inode is
 // deleted or is the root
 func (n *Inode) Parent() (string, *Inode) {
 	n.mu.Lock()
@@ -563,6 +707,31 @@ func (n *Inode) Parent() (string, *Inode) {
 	return p.name, p.parent
 }
 
+// ParentData is a directory entry that refers to an Inode.
+type ParentData struct {
+	Parent *Inode
+	Name   string
+}
+
+// Parents returns all directory entries that refer to this Inode. A
+// file with hard links may have several. The first entry is the one
+// returned by Parent; the order of the others is unspecified. The
+// result is a snapshot, and does not track later changes to the
+// tree. It returns nil if this Inode is deleted or is the root.
+func (n *Inode) Parents() []ParentData {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	all := n.parents.all()
+	if all == nil {
+		return nil
+	}
+	out := make([]ParentData, 0, len(all))
+	for _, p := range all {
+		out = append(out, ParentData{Parent: p.parent, Name: p.name})
+	}
+	return out
+}
+
 // RmAllChildren recursively drops a tree, forgetting all persistent
 // nodes.
 func (n *Inode) RmAllChildren() {
@@ -579,6 +748,74 @@ func (n *Inode) RmAllChildren() {
 	n.removeRef(0, true)
 }
 
+// ReplaceChildren replaces all children of this directory by the
+// given set in a single step, so concurrent lookups see either the
+// old or the new children, but never a mix of both. Children that
+// are no longer referenced are dropped from the tree, as with
+// RmChild. Afterwards, the kernel is told to invalidate every name
+// whose Inode changed, so it looks them up again.
+func (n *Inode) ReplaceChildren(children map[string]*Inode) {
+	for name := range children {
+		if len(name) == 0 {
+			log.Panic("empty name for inode")
+		}
+	}
+
+	var lockme []*Inode
+	var old []childEntry
+retry:
+	for {
+		n.mu.Lock()
+		nChange := n.changeCounter
+		old = n.children.list()
+		n.mu.Unlock()
+
+		lockme = append(lockme[:0], n)
+		for _, e := range old {
+			lockme = append(lockme, e.Inode)
+		}
+		for _, ch := range children {
+			lockme = append(lockme, ch)
+		}
+		lockNodes(lockme...)
+		if n.changeCounter != nChange {
+			unlockNodes(lockme...)
+			continue retry
+		}
+
+		for _, e := range old {
+			n.children.del(n, e.Name)
+		}
+		for name, ch := range children {
+			n.children.set(n, name, ch)
+		}
+		unlockNodes(lockme...)
+		break
+	}
+
+	var changed []string
+	oldNames := make(map[string]struct{}, len(old))
+	for _, e := range old {
+		oldNames[e.Name] = struct{}{}
+		if children[e.Name] != e.Inode {
+			changed = append(changed, e.Name)
+			e.Inode.removeRef(0, false)
+		}
+	}
+	for name := range children {
+		if _, ok := oldNames[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+
+	if n.bridge == nil || n.bridge.serverCallbacks() == nil {
+		return
+	}
+	for _, name := range changed {
+		n.NotifyEntry(name)
+	}
+}
+
 // RmChild removes multiple children.  Returns whether the removal
 // succeeded and whether the node is still live afterward. The removal
 // is transactional: it only succeeds if all names are children, and
@@ -614,7 +851,7 @@ retry:
 			n.children.del(n, nm)
 		}
 
-		live = n.lookupCount > 0 || n.children.len() > 0 || n.persistent
+		live = n.lookupCount > 0 || n.children.len() > 0 || n.keep()
 		unlockNodes(lockme...)
 
 		// removal successful
@@ -726,37 +963,137 @@ retry:
 	}
 }
 
+// LookupPath resolves the slash-separated path relPath relative to
+// this Inode. Children that are in the tree are used directly; for
+// others, the node's Lookup method is called. The results of Lookup
+// are not added to the tree, as the kernel does not know about them.
+// Empty segments and "." are skipped, and ".." goes to the parent.
+// LookupPath returns EINVAL for absolute paths and for paths that go
+// above the root of the file system, and ENOTDIR if a non-directory
+// is traversed.
+func (n *Inode) LookupPath(ctx context.Context, relPath string) (*Inode, syscall.Errno) {
+	if strings.HasPrefix(relPath, "/") {
+		return nil, syscall.EINVAL
+	}
+
+	// Nodes from Lookup may not have a parent, so track the way back.
+	stack := []*Inode{n}
+	for _, name := range strings.Split(relPath, "/") {
+		cur := stack[len(stack)-1]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			if cur.IsRoot() {
+				return nil, syscall.EINVAL
+			}
+			_, parent := cur.Parent()
+			if parent == nil {
+				return nil, syscall.ENOENT
+			}
+			stack[0] = parent
+			continue
+		}
+
+		if !cur.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		child := cur.GetChild(name)
+		if child == nil {
+			lu, ok := cur.ops.(NodeLookuper)
+			if !ok {
+				return nil, syscall.ENOENT
+			}
+			var out fuse.EntryOut
+			var errno syscall.Errno
+			child, errno = lu.Lookup(ctx, name, &out)
+			if errno != 0 {
+				return nil, errno
+			}
+			if child == nil {
+				return nil, syscall.ENOENT
+			}
+		}
+		stack = append(stack, child)
+	}
+	return stack[len(stack)-1], 0
+}
+
+// Errorf returns errno, and if MountOptions.Debug is set, logs it
+// together with the formatted message and the path of the inode.
+// FUSE only carries the errno to the caller, so this is a way to
+// record why an operation failed:
+//
+//	if err := backend.Get(key); err != nil {
+//		return n.Errorf(syscall.EIO, "Get(%q): %v", key, err)
+//	}
+func (n *Inode) Errorf(errno syscall.Errno, format string, args ...interface{}) syscall.Errno {
+	b := n.bridge
+	if b == nil || !b.options.Debug {
+		return errno
+	}
+	b.logf("%s: %v: %s", n.Path(nil), errno, fmt.Sprintf(format, args...))
+	return errno
+}
+
 // NotifyEntry notifies the kernel that data for a (directory, name)
 // tuple should be invalidated. On next access, a LOOKUP operation
 // will be started.
 func (n *Inode) NotifyEntry(name string) syscall.Errno {
-	status := n.bridge.server.EntryNotify(n.nodeId, name)
+	n.bridge.invalidateAttr(n, n.GetChild(name))
+	status := n.bridge.serverCallbacks().EntryNotify(n.nodeId, name)
 	return syscall.Errno(status)
 }
 
 // NotifyDelete notifies the kernel that the given inode was removed
 // from this directory as entry under the given name. It is equivalent
-// to NotifyEntry, but also sends an event to inotify watchers.
+// to NotifyEntry, but also sends an IN_DELETE event to inotify
+// watchers, and detaches the entry even if it is in use, eg. as the
+// working directory of a process. It does not change the Inode tree,
+// so call RmChild too if the child was added to it.
 func (n *Inode) NotifyDelete(name string, child *Inode) syscall.Errno {
-	// XXX arg ordering?
-	return syscall.Errno(n.bridge.server.DeleteNotify(n.nodeId, child.nodeId, name))
-
+	n.bridge.invalidateAttr(n, child)
+	return syscall.Errno(n.bridge.serverCallbacks().DeleteNotify(n.nodeId, child.nodeId, name))
 }
 
 // NotifyContent notifies the kernel that content under the given
-// inode should be flushed from buffers.
+// inode should be flushed from buffers. The cached attributes are
+// always invalidated; a negative offset invalidates only the
+// attributes. If sz is not positive, the content is invalidated up to
+// the end of the file. If the kernel does not know the inode, ENOENT
+// is returned. See also Options.NotifyDebounce.
 func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
 	// XXX how does this work for directories?
-	return syscall.Errno(n.bridge.server.InodeNotify(n.nodeId, off, sz))
+	n.bridge.invalidateAttr(n)
+	if n.bridge.options.NotifyDebounce > 0 {
+		return n.bridge.debounceNotify(n, off, sz)
+	}
+	return syscall.Errno(n.bridge.serverCallbacks().InodeNotify(n.nodeId, off, sz))
+}
+
+// NotifyAttr notifies the kernel that the attributes (size, mtime,
+// etc.) of the inode have changed, without dropping cached
+// content. If the kernel does not know the inode, ENOENT is returned.
+func (n *Inode) NotifyAttr() syscall.Errno {
+	return n.NotifyContent(-1, 0)
 }
 
-// WriteCache stores data in the kernel cache.
+// WriteCache stores data in the kernel cache, so reads of the
+// region are served without calling Read. It returns ENOENT if the
+// kernel does not know the inode. See
+// fuse.Server.InodeNotifyStoreCache.
 func (n *Inode) WriteCache(offset int64, data []byte) syscall.Errno {
-	return syscall.Errno(n.bridge.server.InodeNotifyStoreCache(n.nodeId, offset, data))
+	return syscall.Errno(n.bridge.serverCallbacks().InodeNotifyStoreCache(n.nodeId, offset, data))
 }
 
-// ReadCache reads data from the kernel cache.
+// ReadCache reads data from the kernel cache, eg. to recover dirty
+// pages of a write-back cache. It returns the number of consecutive
+// bytes cached at offset. See fuse.Server.InodeRetrieveCache.
 func (n *Inode) ReadCache(offset int64, dest []byte) (count int, errno syscall.Errno) {
-	c, s := n.bridge.server.InodeRetrieveCache(n.nodeId, offset, dest)
+	c, s := n.bridge.serverCallbacks().InodeRetrieveCache(n.nodeId, offset, dest)
 	return c, syscall.Errno(s)
 }
@@ -91,6 +91,7 @@ func (c *inodeChildren) set(parent *Inode, name string, ch *Inode) {
 
 	ch.parents.add(parentData{name, parent})
 	ch.changeCounter++
+	ch.forgotten = false
 }
 
 func (c *inodeChildren) len() int {
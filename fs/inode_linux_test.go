@@ -0,0 +1,72 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNotifyDeleteInotify(t *testing.T) {
+	root := &Inode{}
+	var child *Inode
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			child = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG})
+			root.AddChild("file", child, false)
+		},
+	}
+	mnt, _ := testMount(t, root, opts)
+
+	if _, err := os.Stat(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if _, err := unix.InotifyAddWatch(fd, mnt, unix.IN_DELETE); err != nil {
+		t.Fatal(err)
+	}
+
+	root.RmChild("file")
+	if errno := root.NotifyDelete("file", child); errno != 0 {
+		t.Fatalf("NotifyDelete: %v", errno)
+	}
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 5000); err != nil {
+		t.Fatal(err)
+	} else if n == 0 {
+		t.Fatal("timeout waiting for inotify event")
+	}
+
+	buf := make([]byte, 4096)
+	n, err := unix.Read(fd, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < unix.SizeofInotifyEvent {
+		t.Fatalf("short inotify read: %d bytes", n)
+	}
+	ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	nameBytes := buf[unix.SizeofInotifyEvent : unix.SizeofInotifyEvent+int(ev.Len)]
+	name := string(bytes.TrimRight(nameBytes, "\x00"))
+	if ev.Mask&unix.IN_DELETE == 0 || name != "file" {
+		t.Errorf("got event mask %x name %q, want IN_DELETE for %q", ev.Mask, name, "file")
+	}
+
+	if _, err := os.Stat(mnt + "/file"); !os.IsNotExist(err) {
+		t.Errorf("Stat after delete: got %v, want ENOENT", err)
+	}
+}
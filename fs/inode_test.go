@@ -1,8 +1,15 @@
 package fs
 
 import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
 func TestInodeIsDir(t *testing.T) {
@@ -26,3 +33,170 @@ func TestInodeIsDir(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceChildren(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+	newChild := func() *Inode {
+		return root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	}
+
+	a, b := newChild(), newChild()
+	oldSet := map[string]*Inode{"a": a, "b": b}
+	newSet := map[string]*Inode{"b": newChild(), "c": newChild()}
+	root.ReplaceChildren(oldSet)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			got := root.Children()
+			if !reflect.DeepEqual(got, oldSet) && !reflect.DeepEqual(got, newSet) {
+				t.Errorf("torn view: %v", got)
+				return
+			}
+		}
+	}()
+	root.ReplaceChildren(newSet)
+	<-done
+
+	if got := root.Children(); !reflect.DeepEqual(got, newSet) {
+		t.Errorf("got %v, want %v", got, newSet)
+	}
+	for _, ch := range []*Inode{a, b} {
+		if name, p := ch.Parent(); p != nil {
+			t.Errorf("old child still attached as %q", name)
+		}
+	}
+}
+
+func TestInodeErrorf(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		var buf bytes.Buffer
+		root := &Inode{}
+		opts := &Options{Logger: log.New(&buf, "", 0)}
+		opts.Debug = debug
+		NewNodeFS(root, opts)
+
+		child := root.NewPersistentInode(context.Background(), &Inode{}, StableAttr{Mode: syscall.S_IFREG})
+		root.AddChild("file", child, false)
+
+		if errno := child.Errorf(syscall.EIO, "backend: %s", "timeout"); errno != syscall.EIO {
+			t.Errorf("got %v, want EIO", errno)
+		}
+		got := buf.String()
+		if debug && !strings.Contains(got, "file: "+syscall.EIO.Error()+": backend: timeout") {
+			t.Errorf("debug: got log %q", got)
+		}
+		if !debug && got != "" {
+			t.Errorf("no debug: got log %q", got)
+		}
+	}
+}
+
+// lookupCountDir creates a directory for every name looked up.
+type lookupCountDir struct {
+	Inode
+	lookups *int
+}
+
+var _ = (NodeLookuper)((*lookupCountDir)(nil))
+
+func (d *lookupCountDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	*d.lookups++
+	if name == "missing" {
+		return nil, syscall.ENOENT
+	}
+	ch := &lookupCountDir{lookups: d.lookups}
+	return d.NewInode(ctx, ch, StableAttr{Mode: syscall.S_IFDIR}), 0
+}
+
+func TestInodeLookupPath(t *testing.T) {
+	var lookups int
+	root := &lookupCountDir{lookups: &lookups}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	dir := root.NewPersistentInode(ctx, &lookupCountDir{lookups: &lookups}, StableAttr{Mode: syscall.S_IFDIR})
+	root.AddChild("dir", dir, false)
+	file := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG})
+	dir.AddChild("file", file, false)
+
+	for _, tc := range []struct {
+		path    string
+		want    *Inode
+		errno   syscall.Errno
+		lookups int
+	}{
+		{"", &root.Inode, 0, 0},
+		{".", &root.Inode, 0, 0},
+		{"dir/file", file, 0, 0},
+		{"dir//./file", file, 0, 0},
+		{"dir/../dir/file", file, 0, 0},
+		{"dir/new/..", dir, 0, 1},
+		{"dir/new/../file", file, 0, 1},
+		{"dir/file/x", nil, syscall.ENOTDIR, 0},
+		{"dir/missing", nil, syscall.ENOENT, 1},
+		{"/dir", nil, syscall.EINVAL, 0},
+		{"..", nil, syscall.EINVAL, 0},
+		{"dir/../..", nil, syscall.EINVAL, 0},
+	} {
+		lookups = 0
+		got, errno := root.LookupPath(ctx, tc.path)
+		if errno != tc.errno {
+			t.Errorf("LookupPath(%q): got errno %v, want %v", tc.path, errno, tc.errno)
+			continue
+		}
+		if tc.want != nil && got != tc.want {
+			t.Errorf("LookupPath(%q): got %v, want %v", tc.path, got, tc.want)
+		}
+		if lookups != tc.lookups {
+			t.Errorf("LookupPath(%q): got %d Lookup calls, want %d", tc.path, lookups, tc.lookups)
+		}
+	}
+
+	got, errno := dir.LookupPath(ctx, "../dir/a/b")
+	if errno != 0 {
+		t.Fatalf("LookupPath: %v", errno)
+	}
+	if !got.IsDir() || got.GetChild("x") != nil || lookups != 2 {
+		t.Errorf("got %v after %d lookups, want new directory after 2", got, lookups)
+	}
+}
+
+func TestInodeParentsHardlinks(t *testing.T) {
+	root := &Inode{}
+	NewNodeFS(root, &Options{})
+	ctx := context.Background()
+
+	dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	root.AddChild("dir", dir, false)
+	file := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	root.AddChild("a", file, false)
+	dir.AddChild("b", file, false)
+	root.AddChild("c", file, false)
+
+	if got := root.Parents(); got != nil {
+		t.Errorf("root: got parents %v, want nil", got)
+	}
+
+	got := map[string]bool{}
+	for _, p := range file.Parents() {
+		got[p.Parent.Path(root)+"/"+p.Name] = true
+	}
+	want := map[string]bool{"/a": true, "dir/b": true, "/c": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	name, parent := file.Parent()
+	if first := file.Parents()[0]; first.Name != name || first.Parent != parent {
+		t.Errorf("first parent %q, want %q as returned by Parent", first.Name, name)
+	}
+
+	dir.RmChild("b")
+	if n := len(file.Parents()); n != 2 {
+		t.Errorf("after RmChild: got %d parents, want 2", n)
+	}
+}
@@ -75,3 +75,66 @@ func TestInterrupt(t *testing.T) {
 		t.Errorf("open request was not interrupted")
 	}
 }
+
+// blockingReadNode blocks reads until they are interrupted.
+type blockingReadNode struct {
+	Inode
+
+	reading     chan struct{}
+	interrupted chan struct{}
+}
+
+var _ = (NodeOpener)((*blockingReadNode)(nil))
+
+func (n *blockingReadNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, 0
+}
+
+var _ = (NodeReader)((*blockingReadNode)(nil))
+
+func (n *blockingReadNode) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	close(n.reading)
+	select {
+	case <-ctx.Done():
+		close(n.interrupted)
+		return nil, syscall.EINTR
+	case <-time.After(5 * time.Second):
+		return nil, syscall.EIO
+	}
+}
+
+func TestInterruptRead(t *testing.T) {
+	root := &Inode{}
+	node := &blockingReadNode{
+		reading:     make(chan struct{}),
+		interrupted: make(chan struct{}),
+	}
+	mntDir, _ := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file",
+				root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+
+	cmd := exec.Command("cat", mntDir+"/file")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("run %v: %v", cmd, err)
+	}
+	defer cmd.Wait()
+
+	select {
+	case <-node.reading:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("read did not start")
+	}
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+
+	select {
+	case <-node.interrupted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("read was not interrupted")
+	}
+}
@@ -9,10 +9,12 @@ import (
 	"context"
 	"os"
 	"reflect"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"unsafe"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/ioctl"
 )
 
@@ -54,3 +56,85 @@ func TestIoctl(t *testing.T) {
 		t.Logf("got %v, want %v", arg, want)
 	}
 }
+
+var counterCmd = ioctl.New(ioctl.WRITE, 'c', 1, unsafe.Sizeof(uint64(0)))
+
+// counterNode answers counterCmd with the number of calls so far.
+type counterNode struct {
+	Inode
+
+	count uint64
+}
+
+var _ = (NodeIoctler)((*counterNode)(nil))
+
+func (n *counterNode) Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno) {
+	if ioctl.Command(cmd) != counterCmd {
+		return 0, syscall.ENOTTY
+	}
+	if len(output) != 8 {
+		return 0, syscall.EINVAL
+	}
+	*(*uint64)(unsafe.Pointer(&output[0])) = atomic.AddUint64(&n.count, 1)
+	return 0, 0
+}
+
+func TestIoctlCounter(t *testing.T) {
+	root := &counterNode{}
+	mntDir, _ := testMount(t, root, nil)
+	f, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	for want := uint64(1); want <= 3; want++ {
+		var got uint64
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(counterCmd), uintptr(unsafe.Pointer(&got)))
+		if errno != 0 {
+			t.Fatalf("ioctl: %v", errno)
+		}
+		if got != want {
+			t.Errorf("got %d, want %d", got, want)
+		}
+	}
+}
+
+// TestIoctlUnrestrictedRetry checks that unrestricted ioctls are
+// retried with the argument size from the command.
+func TestIoctlUnrestrictedRetry(t *testing.T) {
+	root := &counterNode{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	in := fuse.IoctlIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Flags:    fuse.IOCTL_UNRESTRICTED,
+		Cmd:      uint32(counterCmd),
+		Arg:      0x1000,
+	}
+	var out fuse.IoctlOut
+	outbuf := make([]byte, 4096)[:0]
+	if code := rawFS.Ioctl(nil, &in, nil, &out, outbuf); !code.Ok() {
+		t.Fatalf("Ioctl: %v", code)
+	}
+	if out.Flags&fuse.IOCTL_RETRY == 0 || out.InIovs != 0 || out.OutIovs != 1 {
+		t.Fatalf("got %#v, want retry with 1 output iovec", out)
+	}
+	iov := *(*fuse.IoctlIovec)(unsafe.Pointer(&outbuf[:1][0]))
+	if want := (fuse.IoctlIovec{Base: 0x1000, Len: 8}); iov != want {
+		t.Errorf("got iovec %v, want %v", iov, want)
+	}
+
+	in.OutSize = 8
+	out = fuse.IoctlOut{}
+	outbuf = make([]byte, 8)
+	if code := rawFS.Ioctl(nil, &in, nil, &out, outbuf); !code.Ok() {
+		t.Fatalf("Ioctl: %v", code)
+	}
+	if out.Flags&fuse.IOCTL_RETRY != 0 {
+		t.Errorf("got retry for complete request")
+	}
+	if got := *(*uint64)(unsafe.Pointer(&outbuf[0])); got != 1 {
+		t.Errorf("got counter %d, want 1", got)
+	}
+}
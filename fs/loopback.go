@@ -19,6 +19,11 @@ import (
 // LoopbackRoot holds the parameters for creating a new loopback
 // filesystem. Loopback filesystem delegate their operations to an
 // underlying POSIX file system.
+//
+// Inode numbers are derived from the (device, inode) pair of the
+// backing files, so all hard links to a file share a single *Inode,
+// and report the same inode number. The bridge drops the mapping once
+// the kernel has forgotten all links.
 type LoopbackRoot struct {
 	// The path to the root of the underlying file system.
 	Path string
@@ -243,7 +248,7 @@ var _ = (NodeCreater)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	p := filepath.Join(n.path(), name)
-	flags = flags &^ syscall.O_APPEND
+	flags = n.openFlags(flags)
 	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
 	if err != nil {
 		return nil, nil, 0, ToErrno(err)
@@ -322,7 +327,18 @@ var _ = (NodeLinker)((*LoopbackNode)(nil))
 func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 
 	p := filepath.Join(n.path(), name)
-	err := syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	var err error
+	if _, parent := target.EmbeddedInode().Parent(); parent == nil && !target.EmbeddedInode().IsRoot() {
+		// An O_TMPFILE file has no path; link it through its
+		// open file.
+		f, ok := target.EmbeddedInode().anyOpenFile().(*loopbackFile)
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		err = f.linkTo(p)
+	} else {
+		err = syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
+	}
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -358,9 +374,21 @@ func (n *LoopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 
 var _ = (NodeOpener)((*LoopbackNode)(nil))
 
+// openFlags adjusts the flags of OPEN and CREATE for the backing
+// file. O_APPEND is dropped, because the kernel passes the offset
+// for each write. With writeback caching, the kernel may read
+// pages of a file that was opened write-only.
+func (n *LoopbackNode) openFlags(flags uint32) uint32 {
+	flags &^= syscall.O_APPEND
+	if n.EmbeddedInode().bridge.writebackCache && flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
+	return flags
+}
+
 // Symlink-safe through use of OpenSymlinkAware.
 func (n *LoopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	flags = flags &^ (syscall.O_APPEND | fuse.FMODE_EXEC)
+	flags = n.openFlags(flags &^ fuse.FMODE_EXEC)
 
 	f, err := openat.OpenSymlinkAware(n.RootData.Path, n.relativePath(), int(flags), 0)
 	if err != nil {
@@ -380,6 +408,20 @@ func (n *LoopbackNode) OpendirHandle(ctx context.Context, flags uint32) (FileHan
 	return ds, 0, errno
 }
 
+var _ = (NodeFsyncDirer)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Fsyncdir(ctx context.Context, f FileHandle, flags uint32) syscall.Errno {
+	if fsd, ok := f.(FileFsyncdirer); ok {
+		return fsd.Fsyncdir(ctx, flags)
+	}
+	fd, err := syscall.Open(n.path(), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return ToErrno(fsyncFd(fd, flags))
+}
+
 var _ = (NodeReaddirer)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
@@ -524,8 +566,7 @@ func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	}
 	signedOffIn := int64(offIn)
 	signedOffOut := int64(offOut)
-	doCopyFileRange(lfIn.fd, signedOffIn, lfOut.fd, signedOffOut, int(len), int(flags))
-	return 0, syscall.ENOSYS
+	return doCopyFileRange(lfIn.fd, signedOffIn, lfOut.fd, signedOffOut, int(len), int(flags))
 }
 
 // NewLoopbackRoot returns a root node for a loopback file system whose
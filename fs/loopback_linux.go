@@ -27,6 +27,39 @@ func intDev(dev uint32) int {
 	return int(dev)
 }
 
+var _ = (NodeSyncfser)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Syncfs(ctx context.Context) syscall.Errno {
+	fd, err := syscall.Open(n.path(), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return ToErrno(unix.Syncfs(fd))
+}
+
+var _ = (NodeTmpfiler)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	flags = n.openFlags(flags)
+	fd, err := syscall.Open(n.path(), int(flags), mode)
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+
+	node := n.RootData.newNode(n.EmbeddedInode(), "", &st)
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	lf := NewLoopbackFile(fd)
+
+	out.FromStat(&st)
+	return ch, lf, 0, 0
+}
+
 var _ = (NodeStatxer)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Statx(ctx context.Context, f FileHandle,
@@ -6,7 +6,12 @@ package fs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"testing"
@@ -15,6 +20,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"github.com/hanwen/go-fuse/v2/splice"
 	"golang.org/x/sys/unix"
 )
 
@@ -45,7 +51,261 @@ func TestRenameNoOverwrite(t *testing.T) {
 	}
 }
 
+func TestRenameNoReplace(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	tc.writeOrig("file", "hello", 0644)
+
+	f, err := syscall.Open(tc.mntDir+"/", syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer syscall.Close(f)
+
+	if err := unix.Renameat2(f, "file", f, "new", RENAME_NOREPLACE); err != nil {
+		t.Fatalf("rename NOREPLACE: %v", err)
+	}
+	if _, err := os.Lstat(tc.origDir + "/file"); !os.IsNotExist(err) {
+		t.Errorf("source still exists: %v", err)
+	}
+	if got, err := os.ReadFile(tc.mntDir + "/new"); err != nil {
+		t.Errorf("ReadFile: %v", err)
+	} else if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestRenameInvalidFlags checks that conflicting flag combinations
+// are rejected with EINVAL.
+func TestRenameInvalidFlags(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	tc.writeOrig("file", "hello", 0644)
+	tc.writeOrig("other", "x", 0644)
+
+	f, err := syscall.Open(tc.mntDir+"/", syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer syscall.Close(f)
+
+	for _, flags := range []uint{
+		RENAME_EXCHANGE | RENAME_NOREPLACE,
+		RENAME_EXCHANGE | RENAME_WHITEOUT,
+	} {
+		if err := unix.Renameat2(f, "file", f, "other", flags); err != syscall.EINVAL {
+			t.Errorf("rename flags %#x: got %v, want EINVAL", flags, err)
+		}
+	}
+}
+
+func TestSyncfs(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+
+	for _, nm := range []string{"a", "b", "c"} {
+		f, err := os.Create(tc.mntDir + "/" + nm)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("dirty " + nm); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	f, err := os.Open(tc.mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if err := unix.Syncfs(int(f.Fd())); err != nil {
+		t.Fatalf("Syncfs: %v", err)
+	}
+
+	for _, nm := range []string{"a", "b", "c"} {
+		if got, err := os.ReadFile(tc.origDir + "/" + nm); err != nil {
+			t.Errorf("ReadFile: %v", err)
+		} else if string(got) != "dirty "+nm {
+			t.Errorf("%s: got %q", nm, got)
+		}
+	}
+}
+
+// TestTmpfileCreate exercises O_TMPFILE through CREATE, as used by
+// kernels that have no separate TMPFILE opcode.
+func TestTmpfileCreate(t *testing.T) {
+	dir := t.TempDir()
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	in := fuse.CreateIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Flags:    unix.O_TMPFILE | syscall.O_RDWR,
+		Mode:     0644,
+	}
+	var out fuse.CreateOut
+	if code := rawFS.Create(nil, &in, "", &out); code == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("backing file system does not support O_TMPFILE")
+	} else if !code.Ok() {
+		t.Fatalf("Create: %v", code)
+	}
+	if len(root.EmbeddedInode().Children()) != 0 {
+		t.Errorf("tmpfile was added to the tree: %v", root.EmbeddedInode().Children())
+	}
+
+	data := []byte("hello")
+	if n, code := rawFS.Write(nil, &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, Fh: out.Fh}, data); !code.Ok() || int(n) != len(data) {
+		t.Fatalf("Write: %d, %v", n, code)
+	}
+
+	var linkOut fuse.EntryOut
+	linkIn := fuse.LinkIn{InHeader: fuse.InHeader{NodeId: 1}, Oldnodeid: out.NodeId}
+	if code := rawFS.Link(nil, &linkIn, "linked", &linkOut); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	if linkOut.NodeId != out.NodeId {
+		t.Errorf("got node %d after link, want %d", linkOut.NodeId, out.NodeId)
+	}
+	if got, err := os.ReadFile(dir + "/linked"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(got) != string(data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+// TestTmpfileOpcode exercises O_TMPFILE through the TMPFILE opcode.
+func TestTmpfileOpcode(t *testing.T) {
+	dir := t.TempDir()
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	in := fuse.CreateIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Flags:    unix.O_TMPFILE | syscall.O_RDWR,
+		Mode:     0644,
+	}
+	var out fuse.CreateOut
+	if code := rawFS.Tmpfile(nil, &in, &out); code == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("backing file system does not support O_TMPFILE")
+	} else if !code.Ok() {
+		t.Fatalf("Tmpfile: %v", code)
+	}
+	if len(root.EmbeddedInode().Children()) != 0 {
+		t.Errorf("tmpfile was added to the tree: %v", root.EmbeddedInode().Children())
+	}
+	if out.NodeId == 0 || out.Attr.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		t.Errorf("got entry %v", &out.EntryOut)
+	}
+
+	var linkOut fuse.EntryOut
+	linkIn := fuse.LinkIn{InHeader: fuse.InHeader{NodeId: 1}, Oldnodeid: out.NodeId}
+	if code := rawFS.Link(nil, &linkIn, "linked", &linkOut); !code.Ok() {
+		t.Fatalf("Link: %v", code)
+	}
+	if _, err := os.Stat(dir + "/linked"); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	// Directories that do not implement NodeTmpfiler refuse the
+	// request, rather than making the kernel stop sending TMPFILE.
+	mem := NewNodeFS(&Inode{}, &Options{})
+	if code := mem.Tmpfile(nil, &in, &out); code != fuse.ENOTSUP {
+		t.Errorf("got %v, want ENOTSUP", code)
+	}
+}
+
+func TestTmpfileMount(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+
+	fd, err := syscall.Open(tc.mntDir, unix.O_TMPFILE|syscall.O_RDWR, 0644)
+	if err == syscall.EOPNOTSUPP && tc.server.KernelSettings().Minor < 37 {
+		t.Skip("kernel does not support O_TMPFILE on FUSE")
+	} else if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if _, err := syscall.Write(fd, []byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd), unix.AT_FDCWD, tc.mntDir+"/linked", unix.AT_SYMLINK_FOLLOW); err != nil {
+		t.Fatalf("Linkat: %v", err)
+	}
+	if got, err := os.ReadFile(tc.origDir + "/linked"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestKillPrivV2 checks that the set-user-ID and set-group-ID bits
+// are cleared when another user modifies a file, while the server
+// runs as root.
+func TestKillPrivV2(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to modify files as another user")
+	}
+	// Writes through backing files do not reach the file system.
+	tc := newTestCase(t, &testOptions{allowOther: true, killPrivV2: true, atomicTrunc: true, noPassthrough: true})
+	if tc.server.KernelSettings().Flags64()&fuse.CAP_HANDLE_KILLPRIV_V2 == 0 {
+		t.Skip("kernel does not support HANDLE_KILLPRIV_V2")
+	}
+	// Let the other user reach the mount point.
+	for _, d := range []string{filepath.Dir(tc.dir), tc.dir} {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		script string
+	}{
+		{"write", `echo hello >> "$0"`},
+		{"truncate", `truncate -s 1 "$0"`},
+		{"otrunc", `echo hello > "$0"`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			orig := tc.origDir + "/" + c.name
+			tc.writeOrig(c.name, "data", 0777)
+			if err := syscall.Chmod(orig, 06777); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command("/bin/sh", "-c", c.script, tc.mntDir+"/"+c.name)
+			cmd.SysProcAttr = &syscall.SysProcAttr{
+				Credential: &syscall.Credential{Uid: 65534, Gid: 65534},
+			}
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%s: %v, %s", c.script, err, out)
+			}
+
+			var st syscall.Stat_t
+			if err := syscall.Stat(orig, &st); err != nil {
+				t.Fatal(err)
+			}
+			if got := st.Mode & 07777; got != 0777 {
+				t.Errorf("got mode %o, want 0777", got)
+			}
+		})
+	}
+}
+
 func TestRenameWhiteOut(t *testing.T) {
+	// The loopback file system passes the flag on, so the
+	// backing file system must support it.
+	probe := t.TempDir()
+	if err := os.WriteFile(probe+"/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, probe+"/file", unix.AT_FDCWD, probe+"/new", RENAME_WHITEOUT); err != nil {
+		t.Skipf("rename WHITEOUT not supported outside FUSE: %v", err)
+	}
+
 	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
 
 	if err := os.Mkdir(tc.origDir+"/dir", 0755); err != nil {
@@ -64,7 +324,7 @@ func TestRenameWhiteOut(t *testing.T) {
 	}
 	defer syscall.Close(f2)
 
-	if err := unix.Renameat2(f1, "file", f2, "file", unix.RENAME_WHITEOUT); err != nil {
+	if err := unix.Renameat2(f1, "file", f2, "file", RENAME_WHITEOUT); err != nil {
 		t.Errorf("rename WHITEOUT: %v", err)
 	}
 
@@ -173,6 +433,172 @@ func TestCopyFileRange(t *testing.T) {
 
 }
 
+func TestLseekSparse(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+
+	if !tc.server.KernelSettings().SupportsVersion(7, 24) {
+		t.Skip("need v7.24 for Lseek")
+	}
+
+	// Write data after a 1 MiB hole.
+	holeSize := int64(1 << 20)
+	f, err := os.Create(tc.origDir + "/sparse")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("data"), holeSize); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	want, err := unix.Seek(int(f.Fd()), 0, unix.SEEK_DATA)
+	f.Close()
+	if err != nil {
+		t.Skipf("SEEK_DATA unsupported on %s: %v", tc.origDir, err)
+	}
+	if want == 0 {
+		t.Skipf("%s does not support sparse files", tc.origDir)
+	}
+
+	fd, err := syscall.Open(tc.mntDir+"/sparse", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	got, err := unix.Seek(fd, 0, unix.SEEK_DATA)
+	if err != nil {
+		t.Fatalf("Seek SEEK_DATA: %v", err)
+	}
+	if got != want {
+		t.Errorf("SEEK_DATA: got offset %d, want %d", got, want)
+	}
+	if got > holeSize {
+		t.Errorf("SEEK_DATA: got offset %d beyond data at %d", got, holeSize)
+	}
+
+	got, err = unix.Seek(fd, 0, unix.SEEK_HOLE)
+	if err != nil {
+		t.Fatalf("Seek SEEK_HOLE: %v", err)
+	}
+	if got != 0 {
+		t.Errorf("SEEK_HOLE: got offset %d, want 0", got)
+	}
+}
+
+// checkPunchHole punches a hole in the middle of a 3-block file
+// through fallocate, and checks that it reads back as zeros and
+// frees blocks.
+func checkPunchHole(t *testing.T, fallocate func(fd int, mode uint32, off, sz int64) error, fd int) {
+	t.Helper()
+	const blk = 1 << 16
+	data := bytes.Repeat([]byte("x"), 3*blk)
+	if _, err := syscall.Pwrite(fd, data, 0); err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+	if err := syscall.Fsync(fd); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+	var before syscall.Stat_t
+	if err := syscall.Fstat(fd, &before); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+
+	err := fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, blk, blk)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("PUNCH_HOLE not supported by the backing file system")
+	} else if err != nil {
+		t.Fatalf("fallocate(PUNCH_HOLE): %v", err)
+	}
+
+	var after syscall.Stat_t
+	if err := syscall.Fstat(fd, &after); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+	if after.Size != before.Size {
+		t.Errorf("size changed from %d to %d", before.Size, after.Size)
+	}
+	if after.Blocks >= before.Blocks {
+		t.Errorf("blocks did not shrink: before %d, after %d", before.Blocks, after.Blocks)
+	}
+
+	got := make([]byte, len(data))
+	if _, err := syscall.Pread(fd, got, 0); err != nil {
+		t.Fatalf("Pread: %v", err)
+	}
+	copy(data[blk:2*blk], make([]byte, blk))
+	if !bytes.Equal(got, data) {
+		t.Error("hole does not read back as zeros")
+	}
+}
+
+func TestLoopbackFilePunchHole(t *testing.T) {
+	fd, err := syscall.Open(t.TempDir()+"/file", syscall.O_CREAT|syscall.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewLoopbackFile(fd).(*loopbackFile)
+	defer f.Release(context.Background())
+
+	checkPunchHole(t, func(fd int, mode uint32, off, sz int64) error {
+		if errno := f.Allocate(context.Background(), uint64(off), uint64(sz), mode); errno != 0 {
+			return errno
+		}
+		return nil
+	}, fd)
+}
+
+func TestFallocatePunchHole(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: false, entryCache: true})
+
+	fd, err := syscall.Open(tc.mntDir+"/file", syscall.O_CREAT|syscall.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	checkPunchHole(t, func(fd int, mode uint32, off, sz int64) error {
+		return unix.Fallocate(fd, mode, off, sz)
+	}, fd)
+}
+
+// TestWritebackCacheWriteOnly checks that partial page writes to a
+// write-only file work with writeback caching, which makes the
+// kernel read the rest of the page first.
+func TestWritebackCacheWriteOnly(t *testing.T) {
+	orig := t.TempDir()
+	root, err := NewLoopbackRoot(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt, srv := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableWritebackCache: true},
+	})
+	if srv.KernelSettings().Flags64()&fuse.CAP_WRITEBACK_CACHE == 0 {
+		t.Skip("kernel does not support writeback caching")
+	}
+
+	if err := os.WriteFile(orig+"/file", []byte("hello world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(mnt+"/file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("W"), 6); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := os.ReadFile(orig + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello World"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 // Wait for a change in /proc/self/mounts. Efficient through the use of
 // unix.Poll().
 func waitProcMountsChange() error {
@@ -396,3 +822,147 @@ func TestIoctlLoopbackDir(t *testing.T) {
 		t.Fatalf("didn't work: after %v, before %v", after, before)
 	}
 }
+
+func TestLoopbackFileSetlkwInterrupt(t *testing.T) {
+	fn := t.TempDir() + "/file"
+	if err := os.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *loopbackFile {
+		fd, err := syscall.Open(fn, syscall.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewLoopbackFile(fd).(*loopbackFile)
+		t.Cleanup(func() { f.Release(context.Background()) })
+		return f
+	}
+	f1, f2 := open(), open()
+
+	for _, flags := range []uint32{0, fuse.FUSE_LK_FLOCK} {
+		wrlock := fuse.FileLock{End: 1<<63 - 1, Typ: syscall.F_WRLCK}
+		unlock := wrlock
+		unlock.Typ = syscall.F_UNLCK
+		if errno := f1.Setlk(context.Background(), 1, &wrlock, flags); errno != 0 {
+			t.Fatalf("flags %d: Setlk: %v", flags, errno)
+		}
+		if errno := f2.Setlk(context.Background(), 2, &wrlock, flags); errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK {
+			t.Fatalf("flags %d: conflicting Setlk: got %v, want EAGAIN", flags, errno)
+		}
+
+		// An interrupted wait returns EINTR, and does not block
+		// other operations on the file.
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan syscall.Errno, 1)
+		go func() { done <- f2.Setlkw(ctx, 2, &wrlock, flags) }()
+		time.Sleep(10 * time.Millisecond)
+		var st fuse.AttrOut
+		if errno := f2.Getattr(context.Background(), &st); errno != 0 {
+			t.Fatalf("flags %d: Getattr: %v", flags, errno)
+		}
+		cancel()
+		if errno := <-done; errno != syscall.EINTR {
+			t.Errorf("flags %d: interrupted Setlkw: got %v, want EINTR", flags, errno)
+		}
+
+		// The abandoned wait gives the lock back once it is
+		// granted.
+		if errno := f1.Setlk(context.Background(), 1, &unlock, flags); errno != 0 {
+			t.Fatalf("flags %d: unlock: %v", flags, errno)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			errno := f1.Setlk(context.Background(), 1, &wrlock, flags)
+			if errno == 0 {
+				break
+			}
+			if errno != syscall.EAGAIN && errno != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+				t.Fatalf("flags %d: relock: %v", flags, errno)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// The wait succeeds once the lock is released.
+		go func() { done <- f2.Setlkw(context.Background(), 2, &wrlock, flags) }()
+		time.Sleep(10 * time.Millisecond)
+		if errno := f1.Setlk(context.Background(), 1, &unlock, flags); errno != 0 {
+			t.Fatalf("flags %d: unlock: %v", flags, errno)
+		}
+		select {
+		case errno := <-done:
+			if errno != 0 {
+				t.Errorf("flags %d: Setlkw: %v", flags, errno)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("flags %d: Setlkw did not finish", flags)
+		}
+		if errno := f2.Setlk(context.Background(), 2, &unlock, flags); errno != 0 {
+			t.Fatalf("flags %d: unlock: %v", flags, errno)
+		}
+	}
+}
+
+// TestFlockContention runs an external flock process against a lock
+// held through the mount.
+func TestFlockContention(t *testing.T) {
+	cmd, err := exec.LookPath("flock")
+	if err != nil {
+		t.Skip("flock command not found.")
+	}
+	tc := newTestCase(t, &testOptions{enableLocks: true})
+	tc.writeOrig("file", "hello", 0644)
+
+	f, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+
+	run := func() error {
+		return exec.Command(cmd, "--exclusive", "--nonblock", tc.mntDir+"/file", "true").Run()
+	}
+	if err := run(); err == nil {
+		t.Errorf("flock succeeded on a locked file")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatalf("Flock(LOCK_UN): %v", err)
+	}
+	if err := run(); err != nil {
+		t.Errorf("flock on unlocked file: %v", err)
+	}
+}
+
+// TestReadSpliceModes reads a large file with and without splice,
+// and checks that splice is only used if enabled.
+func TestReadSpliceModes(t *testing.T) {
+	want := make([]byte, 1<<20+123)
+	rand.Read(want)
+	for _, disable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable=%v", disable), func(t *testing.T) {
+			splice.ClearSplicePool()
+			tc := newTestCase(t, &testOptions{
+				disableSplice: disable,
+				suppressDebug: true,
+				noPassthrough: true,
+			})
+			tc.writeOrig("file", string(want), 0644)
+
+			got, err := os.ReadFile(tc.mntDir + "/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("content differs: got %d bytes, want %d", len(got), len(want))
+			}
+
+			used := splice.Total() > 0
+			if disable && used {
+				t.Errorf("splice used with DisableSplice")
+			} else if !disable && !used && splice.Resizable() {
+				t.Errorf("splice not used")
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/renameat"
@@ -151,3 +152,147 @@ func TestLoopbackNonRoot(t *testing.T) {
 		t.Errorf("got %q, want %q", data, content)
 	}
 }
+
+func TestLoopbackHardlinkInode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/a", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dir+"/a", dir+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir+"/a", &st); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	header := fuse.InHeader{NodeId: 1}
+	var outA, outB fuse.EntryOut
+	if code := rawFS.Lookup(nil, &header, "a", &outA); !code.Ok() {
+		t.Fatalf("Lookup(a): %v", code)
+	}
+	if code := rawFS.Lookup(nil, &header, "b", &outB); !code.Ok() {
+		t.Fatalf("Lookup(b): %v", code)
+	}
+	if outA.NodeId != outB.NodeId {
+		t.Errorf("got NodeIds %d and %d for hard links", outA.NodeId, outB.NodeId)
+	}
+	if outA.Ino != st.Ino || outB.Ino != st.Ino {
+		t.Errorf("got inode numbers %d, %d, want %d", outA.Ino, outB.Ino, st.Ino)
+	}
+
+	rootInode := root.EmbeddedInode()
+	if a, b := rootInode.GetChild("a"), rootInode.GetChild("b"); a == nil || a != b {
+		t.Fatalf("got children %p, %p, want the same Inode", a, b)
+	}
+
+	// Forgetting one lookup keeps the node alive for the other link.
+	rawFS.Forget(outA.NodeId, 1)
+	if rootInode.GetChild("b") == nil {
+		t.Fatal("child dropped after partial forget")
+	}
+	rawFS.Forget(outA.NodeId, 1)
+	if a, b := rootInode.GetChild("a"), rootInode.GetChild("b"); a != nil || b != nil {
+		t.Errorf("children %p, %p still present after forget", a, b)
+	}
+}
+
+func TestLoopbackFlock(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var entry fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	open := func() uint64 {
+		var out fuse.OpenOut
+		in := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: syscall.O_RDWR}
+		if code := rawFS.Open(nil, &in, &out); !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+		return out.Fh
+	}
+	fh1, fh2 := open(), open()
+	lkIn := func(fh, owner uint64, typ uint32) *fuse.LkIn {
+		return &fuse.LkIn{
+			InHeader: fuse.InHeader{NodeId: entry.NodeId},
+			Fh:       fh,
+			Owner:    owner,
+			Lk:       fuse.FileLock{Typ: typ},
+			LkFlags:  fuse.FUSE_LK_FLOCK,
+		}
+	}
+
+	if code := rawFS.SetLk(nil, lkIn(fh1, 1, syscall.F_WRLCK)); !code.Ok() {
+		t.Fatalf("SetLk: %v", code)
+	}
+	// Non-blocking requests fail rather than wait.
+	if code := rawFS.SetLk(nil, lkIn(fh2, 2, syscall.F_WRLCK)); code != fuse.Status(syscall.EAGAIN) {
+		t.Fatalf("contended SetLk: got %v, want EAGAIN", code)
+	}
+
+	done := make(chan fuse.Status, 1)
+	go func() {
+		done <- rawFS.SetLkw(nil, lkIn(fh2, 2, syscall.F_WRLCK))
+	}()
+	select {
+	case code := <-done:
+		t.Fatalf("SetLkw returned %v while the lock is held", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Releasing a file with FLOCK_UNLOCK drops its lock.
+	rawFS.Release(nil, &fuse.ReleaseIn{
+		InHeader:     fuse.InHeader{NodeId: entry.NodeId},
+		Fh:           fh1,
+		ReleaseFlags: fuse.FUSE_RELEASE_FLOCK_UNLOCK,
+		LockOwner:    1,
+	})
+	select {
+	case code := <-done:
+		if !code.Ok() {
+			t.Errorf("SetLkw: %v", code)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("SetLkw did not finish after release")
+	}
+	rawFS.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: fh2})
+}
+
+func TestLoopbackStatUnlinkedOpen(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	tc.writeOrig("file", "hello", 0644)
+
+	f, err := os.Open(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	if err := os.Remove(tc.mntDir + "/file"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// The path is gone, so this only works if the loopback
+	// fstats the open file.
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatalf("Fstat: %v", err)
+	}
+	if st.Size != 5 || st.Nlink != 0 {
+		t.Errorf("got size %d nlink %d, want 5, 0", st.Size, st.Nlink)
+	}
+}
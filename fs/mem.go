@@ -8,6 +8,7 @@ import (
 	"context"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -78,9 +79,32 @@ func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.A
 func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if mode, ok := in.GetMode(); ok {
+		f.Attr.Mode = (f.Attr.Mode &^ 07777) | mode
+	}
+	if uid, ok := in.GetUID(); ok {
+		f.Attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		f.Attr.Gid = gid
+	}
 	if sz, ok := in.GetSize(); ok {
+		if sz > uint64(len(f.Data)) {
+			f.Data = append(f.Data, make([]byte, sz-uint64(len(f.Data)))...)
+		}
 		f.Data = f.Data[:sz]
 	}
+	if atime, ok := in.GetATime(); ok {
+		f.Attr.SetTimes(&atime, nil, nil)
+	}
+	if mtime, ok := in.GetMTime(); ok {
+		f.Attr.SetTimes(nil, &mtime, nil)
+	}
+	ctime, ok := in.GetCTime()
+	if !ok {
+		ctime = time.Now()
+	}
+	f.Attr.SetTimes(nil, nil, &ctime)
 	out.Attr = f.Attr
 	out.Size = uint64(len(f.Data))
 	return OK
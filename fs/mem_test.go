@@ -7,6 +7,7 @@ package fs
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -17,6 +18,7 @@ import (
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/fusetest"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 	"github.com/hanwen/go-fuse/v2/posixtest"
 )
@@ -236,6 +238,33 @@ func TestDataSymlink(t *testing.T) {
 	}
 }
 
+func TestLongSymlink(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789abcde/"), 256)[:maxSymlinkLen]
+	tooLong := append(append([]byte{}, long...), 'x')
+	want := string(long)
+
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			for name, data := range map[string][]byte{"long": long, "toolong": tooLong} {
+				root.AddChild(name, root.NewPersistentInode(ctx, &MemSymlink{Data: data},
+					StableAttr{Mode: syscall.S_IFLNK}), false)
+			}
+		},
+	}
+	mntDir, _ := testMount(t, root, opts)
+
+	if got, err := os.Readlink(mntDir + "/long"); err != nil {
+		t.Fatalf("Readlink: %v", err)
+	} else if got != want {
+		t.Errorf("Readlink: got %d bytes, want %d", len(got), len(want))
+	}
+
+	if _, err := os.Readlink(mntDir + "/toolong"); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("Readlink: got %v, want ENAMETOOLONG", err)
+	}
+}
+
 func readDirStream(st DirStream) (result []fuse.DirEntry, errno syscall.Errno) {
 	for st.HasNext() {
 		var de fuse.DirEntry
@@ -401,3 +430,651 @@ func TestMemPosix(t *testing.T) {
 		})
 	}
 }
+
+// onMountRoot records the order of OnMount and Lookup calls.
+type onMountRoot struct {
+	Inode
+
+	mu     sync.Mutex
+	events []string
+}
+
+var _ = (NodeLookuper)((*onMountRoot)(nil))
+
+func (r *onMountRoot) record(ev string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *onMountRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	r.record("lookup " + name)
+	return nil, syscall.ENOENT
+}
+
+func TestOnMount(t *testing.T) {
+	root := &onMountRoot{}
+	opts := &Options{}
+	opts.OnMount = func(ctx context.Context, n *Inode) {
+		if n != root.EmbeddedInode() {
+			t.Errorf("OnMount: got root %v, want %v", n, root.EmbeddedInode())
+		}
+		// The connection is up.
+		if errno := n.NotifyEntry("x"); errno != 0 {
+			t.Errorf("NotifyEntry: %v", errno)
+		}
+		root.record("mount")
+	}
+	rawFS := NewNodeFS(root, opts)
+
+	h, err := fusetest.NewTestHarness(rawFS, &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+	if _, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "a")); err != nil {
+		t.Fatalf("LOOKUP: %v", err)
+	}
+
+	// A second mount of the same tree does not run OnMount again.
+	h2, err := fusetest.NewTestHarness(rawFS, &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h2.Close()
+	if _, err := h2.Send(h2.LookupRequest(fuse.FUSE_ROOT_ID, "b")); err != nil {
+		t.Fatalf("LOOKUP: %v", err)
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	want := []string{"mount", "lookup a", "lookup b"}
+	if !reflect.DeepEqual(root.events, want) {
+		t.Errorf("got %q, want %q", root.events, want)
+	}
+}
+
+// serverStatsNode reports the LOOKUP count of its server as its size.
+type serverStatsNode struct {
+	Inode
+
+	mu     sync.Mutex
+	server *fuse.Server
+}
+
+var _ = (NodeGetattrer)((*serverStatsNode)(nil))
+
+func (n *serverStatsNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	srv, ok := ServerFromContext(ctx)
+	if !ok {
+		return syscall.EIO
+	}
+	n.mu.Lock()
+	n.server = srv
+	n.mu.Unlock()
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = srv.Stats()["LOOKUP"].Count
+	return 0
+}
+
+func TestServerFromContext(t *testing.T) {
+	root := &Inode{}
+	node := &serverStatsNode{}
+	var mountServer *fuse.Server
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("stats", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+		OnMount: func(ctx context.Context, n *Inode) {
+			mountServer, _ = ServerFromContext(ctx)
+		},
+	}
+	opts.RecordStats = true
+	mnt, srv := testMount(t, root, opts)
+
+	fi, err := os.Stat(mnt + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() == 0 {
+		t.Errorf("got no LOOKUPs in Stats")
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.server != srv {
+		t.Errorf("Getattr: got server %p, want %p", node.server, srv)
+	}
+	if mountServer != srv {
+		t.Errorf("OnMount: got server %p, want %p", mountServer, srv)
+	}
+}
+
+// TestMemHarness serves a MemRegularFile through fusetest.TestHarness,
+// so it runs without /dev/fuse.
+func TestMemHarness(t *testing.T) {
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &MemRegularFile{
+				Data: []byte("hello world"),
+				Attr: fuse.Attr{Mode: 0644},
+			}, StableAttr{}), false)
+		},
+	}
+	h, err := fusetest.NewTestHarness(NewNodeFS(root, opts), &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if err != nil {
+		t.Fatalf("LOOKUP: %v", err)
+	}
+	e := r.EntryOut()
+	if !r.Status().Ok() || e == nil || e.Size != 11 || e.Mode != fuse.S_IFREG|0644 {
+		t.Fatalf("LOOKUP: got %v, %v", r.Status(), e)
+	}
+
+	r, err = h.Send(h.OpenRequest(e.NodeId, syscall.O_RDONLY))
+	if err != nil {
+		t.Fatalf("OPEN: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("OPEN: %v", r.Status())
+	}
+	fh := r.OpenOut().Fh
+
+	r, err = h.Send(h.ReadRequest(e.NodeId, fh, 6, 100))
+	if err != nil {
+		t.Fatalf("READ: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("READ: %v", r.Status())
+	}
+	if got := string(r.Data); got != "world" {
+		t.Errorf("READ: got %q, want %q", got, "world")
+	}
+
+	if r, err := h.Send(h.ReleaseRequest(e.NodeId, fh)); err != nil {
+		t.Errorf("RELEASE: %v", err)
+	} else if !r.Status().Ok() {
+		t.Errorf("RELEASE: %v", r.Status())
+	}
+}
+
+// TestMemOpenTrunc checks that an OPEN with O_TRUNC, as sent with
+// CAP_ATOMIC_O_TRUNC, truncates a MemRegularFile, whose Open ignores
+// the flags.
+func TestMemOpenTrunc(t *testing.T) {
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &MemRegularFile{
+				Data: []byte("hello"),
+				Attr: fuse.Attr{Mode: 0644},
+			}, StableAttr{}), false)
+		},
+	}
+	opts.EnableAtomicTrunc = true
+	h, err := fusetest.NewTestHarness(NewNodeFS(root, opts), &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+	if h.Server().Capabilities()&fuse.CAP_ATOMIC_O_TRUNC == 0 {
+		t.Fatal("CAP_ATOMIC_O_TRUNC not negotiated")
+	}
+
+	r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if err != nil {
+		t.Fatalf("LOOKUP: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("LOOKUP: %v", r.Status())
+	}
+	id := r.EntryOut().NodeId
+
+	r, err = h.Send(h.OpenRequest(id, syscall.O_WRONLY|syscall.O_TRUNC))
+	if err != nil {
+		t.Fatalf("OPEN: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("OPEN: %v", r.Status())
+	}
+
+	r, err = h.Send(h.GetAttrRequest(id))
+	if err != nil {
+		t.Fatalf("GETATTR: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("GETATTR: %v", r.Status())
+	}
+	if sz := r.AttrOut().Size; sz != 0 {
+		t.Errorf("size after O_TRUNC: got %d, want 0", sz)
+	}
+}
+
+// countingCreateNode counts the calls that creating a file makes
+// into the file system.
+type countingCreateNode struct {
+	Inode
+
+	mu       sync.Mutex
+	creates  int
+	getattrs int
+}
+
+func (n *countingCreateNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	n.mu.Lock()
+	n.creates++
+	n.mu.Unlock()
+
+	out.Attr.Mode = mode | syscall.S_IFREG
+	out.Attr.Size = 42
+	out.SetAttrTimeout(time.Hour)
+	ch := n.NewInode(ctx, &MemRegularFile{}, StableAttr{Mode: syscall.S_IFREG})
+	return ch, &struct{}{}, 0, 0
+}
+
+func (n *countingCreateNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	n.getattrs++
+	n.mu.Unlock()
+	out.Mode = fuse.S_IFDIR | 0755
+	return 0
+}
+
+func TestCreateEntryOut(t *testing.T) {
+	root := &countingCreateNode{}
+	opts := &Options{}
+	h, err := fusetest.NewTestHarness(NewNodeFS(root, opts), &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	r, err := h.Send(h.CreateRequest(fuse.FUSE_ROOT_ID, "file", syscall.O_WRONLY, 0644))
+	if err != nil {
+		t.Fatalf("CREATE: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("CREATE: %v", r.Status())
+	}
+	out := r.CreateOut()
+	if out == nil {
+		t.Fatalf("short CREATE reply: %d bytes", len(r.Data))
+	}
+	if out.NodeId == 0 || out.Size != 42 || out.Mode != syscall.S_IFREG|0644 {
+		t.Errorf("got EntryOut %v, want size 42, mode %o", &out.EntryOut, syscall.S_IFREG|0644)
+	}
+	if got := out.AttrTimeout(); got != time.Hour {
+		t.Errorf("got attr timeout %v, want %v", got, time.Hour)
+	}
+	if out.Fh == 0 {
+		t.Error("CREATE returned no file handle")
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.creates != 1 || root.getattrs != 0 {
+		t.Errorf("got %d Create, %d Getattr calls, want 1, 0", root.creates, root.getattrs)
+	}
+}
+
+func TestSetKeepCache(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("hello")}
+	mntDir, _ := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	p := mntDir + "/file"
+
+	read := func() string {
+		content, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		return string(content)
+	}
+	if got := read(); got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+
+	// Change the data behind the kernel's back. MemRegularFile
+	// returns FOPEN_KEEP_CACHE, so the old data is still cached.
+	file.mu.Lock()
+	file.Data = []byte("world")
+	file.mu.Unlock()
+	if got := read(); got != "hello" {
+		t.Fatalf("got %q, want cached %q", got, "hello")
+	}
+
+	file.SetKeepCache(false)
+	if got := read(); got != "world" {
+		t.Errorf("after SetKeepCache(false): got %q, want %q", got, "world")
+	}
+}
+
+// TestSetKeepCacheFlags checks that SetKeepCache overrides the
+// FOPEN_KEEP_CACHE flag returned from Open.
+func TestSetKeepCacheFlags(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("hello")}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	}
+	h, err := fusetest.NewTestHarness(NewNodeFS(root, opts), &opts.MountOptions)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if err != nil {
+		t.Fatalf("LOOKUP: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("LOOKUP: %v", r.Status())
+	}
+	id := r.EntryOut().NodeId
+	keepCache := func() bool {
+		r, err := h.Send(h.OpenRequest(id, syscall.O_RDONLY))
+		if err != nil {
+			t.Fatalf("OPEN: %v", err)
+		}
+		if !r.Status().Ok() {
+			t.Fatalf("OPEN: %v", r.Status())
+		}
+		return r.OpenOut().OpenFlags&fuse.FOPEN_KEEP_CACHE != 0
+	}
+
+	if !keepCache() {
+		t.Error("default: FOPEN_KEEP_CACHE not set")
+	}
+	file.SetKeepCache(false)
+	if keepCache() {
+		t.Error("SetKeepCache(false): FOPEN_KEEP_CACHE set")
+	}
+	file.SetKeepCache(true)
+	if !keepCache() {
+		t.Error("SetKeepCache(true): FOPEN_KEEP_CACHE not set")
+	}
+}
+
+// shortWriteFile accepts at most chunk bytes per Write call.
+type shortWriteFile struct {
+	MemRegularFile
+	chunk    int
+	directIO bool
+
+	mu    sync.Mutex
+	calls int
+	errno syscall.Errno
+	// extra is added to the written count, to simulate buggy
+	// file systems.
+	extra uint32
+}
+
+var _ = (NodeWriter)((*shortWriteFile)(nil))
+
+func (f *shortWriteFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if f.directIO {
+		return nil, fuse.FOPEN_DIRECT_IO, 0
+	}
+	return f.MemRegularFile.Open(ctx, flags)
+}
+
+func (f *shortWriteFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	f.calls++
+	errno, extra := f.errno, f.extra
+	f.mu.Unlock()
+	if len(data) > f.chunk {
+		data = data[:f.chunk]
+	}
+	w, _ := f.MemRegularFile.Write(ctx, fh, data, off)
+	return w + extra, errno
+}
+
+func TestShortWrite(t *testing.T) {
+	for _, directIO := range []bool{false, true} {
+		t.Run(fmt.Sprintf("directIO=%v", directIO), func(t *testing.T) {
+			root := &Inode{}
+			file := &shortWriteFile{chunk: 1000, directIO: directIO}
+			mntDir, _ := testMount(t, root, &Options{
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+				},
+			})
+
+			want := make([]byte, 20000)
+			rand.Read(want)
+			// Use syscall.Write, as os.File.Write retries
+			// short writes.
+			fd, err := syscall.Open(mntDir+"/file", syscall.O_WRONLY, 0)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer syscall.Close(fd)
+			// The kernel returns the short count of the
+			// first WRITE to the application.
+			n, err := syscall.Write(fd, want)
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if n != file.chunk {
+				t.Fatalf("Write: got %d bytes, want %d", n, file.chunk)
+			}
+			for todo := want[n:]; len(todo) > 0; todo = todo[n:] {
+				n, err = syscall.Write(fd, todo)
+				if err != nil || n == 0 {
+					t.Fatalf("Write: %d, %v", n, err)
+				}
+			}
+			got, err := os.ReadFile(mntDir + "/file")
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %d bytes, want %d bytes, equal prefix %v", len(got), len(want), bytes.HasPrefix(want, got))
+			}
+			file.mu.Lock()
+			defer file.mu.Unlock()
+			if min := len(want) / file.chunk; file.calls < min {
+				t.Errorf("got %d Write calls, want at least %d", file.calls, min)
+			}
+		})
+	}
+}
+
+func TestShortWriteReply(t *testing.T) {
+	root := &Inode{}
+	file := &shortWriteFile{chunk: 3, errno: syscall.ENOSPC}
+	rawFS := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	var out fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !code.Ok() {
+		t.Fatalf("Lookup: %v", code)
+	}
+	in := &fuse.WriteIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}
+
+	// A partial write hides the error, which is reported on the
+	// next call.
+	if w, code := rawFS.Write(nil, in, []byte("hello")); !code.Ok() || w != 3 {
+		t.Errorf("partial write: got %d, %v, want 3, OK", w, code)
+	}
+	in.Offset = 3
+	if w, code := rawFS.Write(nil, in, []byte{}); code != fuse.Status(syscall.ENOSPC) || w != 0 {
+		t.Errorf("empty write: got %d, %v, want 0, ENOSPC", w, code)
+	}
+
+	// Claiming more than was sent is an error.
+	file.errno = 0
+	file.extra = 1
+	if w, code := rawFS.Write(nil, in, []byte("lo")); code != fuse.EIO || w != 0 {
+		t.Errorf("overlong write: got %d, %v, want 0, EIO", w, code)
+	}
+}
+
+func TestTimestampNanoseconds(t *testing.T) {
+	atime := syscall.Timespec{Sec: 1000, Nsec: 123456789}
+	mtime := syscall.Timespec{Sec: 2000, Nsec: 987654321}
+
+	for _, tc := range []struct {
+		name string
+		gran time.Duration
+		want [2]syscall.Timespec
+	}{
+		{"default", 0, [2]syscall.Timespec{atime, mtime}},
+		{"millisecond", time.Millisecond, [2]syscall.Timespec{{Sec: 1000, Nsec: 123000000}, {Sec: 2000, Nsec: 987000000}}},
+		{"second", time.Second, [2]syscall.Timespec{{Sec: 1000}, {Sec: 2000}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			loopDir := t.TempDir()
+			if err := os.WriteFile(loopDir+"/file", []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			loopRoot, err := NewLoopbackRoot(loopDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			memRoot := &Inode{}
+			onAdd := func(ctx context.Context) {
+				memRoot.AddChild("file", memRoot.NewPersistentInode(ctx, &MemRegularFile{
+					Data: []byte("hello"),
+					Attr: fuse.Attr{Mode: 0644},
+				}, StableAttr{}), false)
+			}
+
+			for _, root := range []InodeEmbedder{memRoot, loopRoot} {
+				zero := time.Duration(0)
+				opts := &Options{
+					AttrTimeout: &zero,
+					OnAdd:       onAdd,
+				}
+				opts.TimeGranularity = tc.gran
+				mntDir, server := testMount(t, root, opts)
+
+				want := uint32(tc.gran.Nanoseconds())
+				if want == 0 {
+					want = 1
+				}
+				if got := server.ServerSettings().TimeGran; got != want {
+					t.Errorf("%T: TimeGran: got %d, want %d", root, got, want)
+				}
+
+				fn := mntDir + "/file"
+				if err := syscall.UtimesNano(fn, []syscall.Timespec{atime, mtime}); err != nil {
+					t.Fatalf("UtimesNano: %v", err)
+				}
+				var st syscall.Stat_t
+				if err := syscall.Stat(fn, &st); err != nil {
+					t.Fatalf("Stat: %v", err)
+				}
+				var a fuse.Attr
+				a.FromStat(&st)
+				got := [2]syscall.Timespec{
+					{Sec: int64(a.Atime), Nsec: int64(a.Atimensec)},
+					{Sec: int64(a.Mtime), Nsec: int64(a.Mtimensec)},
+				}
+				if got != tc.want {
+					t.Errorf("%T: got atime, mtime %v, want %v", root, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// setattrRecorder records the SetAttrIn.Valid masks it receives.
+type setattrRecorder struct {
+	MemRegularFile
+
+	valid []uint32
+}
+
+func (f *setattrRecorder) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	f.valid = append(f.valid, in.Valid)
+	f.mu.Unlock()
+	return f.MemRegularFile.Setattr(ctx, fh, in, out)
+}
+
+func TestMemSetattr(t *testing.T) {
+	file := &setattrRecorder{
+		MemRegularFile: MemRegularFile{
+			Data: []byte("hello"),
+			Attr: fuse.Attr{Mode: 0644},
+		},
+	}
+	root := &Inode{}
+	zero := time.Duration(0)
+	mntDir, _ := testMount(t, root, &Options{
+		AttrTimeout: &zero,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	fn := mntDir + "/file"
+
+	mtime := time.Unix(2000, 0)
+	for _, tc := range []struct {
+		name  string
+		op    func() error
+		valid uint32
+		check func(a *fuse.Attr) bool
+	}{
+		{"chmod", func() error { return os.Chmod(fn, 0600) }, fuse.FATTR_MODE,
+			func(a *fuse.Attr) bool { return a.Mode&07777 == 0600 }},
+		{"chown", func() error { return os.Chown(fn, 42, -1) }, fuse.FATTR_UID,
+			func(a *fuse.Attr) bool { return a.Uid == 42 }},
+		{"chgrp", func() error { return os.Chown(fn, -1, 43) }, fuse.FATTR_GID,
+			func(a *fuse.Attr) bool { return a.Gid == 43 }},
+		{"truncate", func() error { return os.Truncate(fn, 2) }, fuse.FATTR_SIZE,
+			func(a *fuse.Attr) bool { return a.Size == 2 }},
+		{"utimes", func() error { return os.Chtimes(fn, mtime, mtime) }, fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+			func(a *fuse.Attr) bool { return a.Atime == 2000 && a.Mtime == 2000 }},
+	} {
+		file.mu.Lock()
+		file.valid = nil
+		file.Attr.Ctime = 0
+		file.mu.Unlock()
+
+		if tc.valid&(fuse.FATTR_UID|fuse.FATTR_GID) != 0 && os.Geteuid() != 0 {
+			continue
+		}
+		if err := tc.op(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		file.mu.Lock()
+		valid := file.valid
+		file.mu.Unlock()
+		// The kernel may pass the file handle and lock owner
+		// along, which do not change attributes.
+		if len(valid) != 1 || valid[0]&^(fuse.FATTR_FH|fuse.FATTR_LOCKOWNER) != tc.valid {
+			t.Errorf("%s: got Valid %x, want [%x]", tc.name, valid, tc.valid)
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Stat(fn, &st); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		var a fuse.Attr
+		a.FromStat(&st)
+		if !tc.check(&a) {
+			t.Errorf("%s: attributes not applied: %v", tc.name, &a)
+		}
+		if a.Ctime == 0 {
+			t.Errorf("%s: ctime not updated", tc.name)
+		}
+	}
+}
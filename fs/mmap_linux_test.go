@@ -0,0 +1,63 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMmapSharedWrite(t *testing.T) {
+	for _, writeback := range []bool{false, true} {
+		t.Run(fmt.Sprintf("writeback=%v", writeback), func(t *testing.T) {
+			root := &Inode{}
+			file := &MemRegularFile{Data: make([]byte, 8192)}
+			opts := &Options{
+				OnAdd: func(ctx context.Context) {
+					root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+				},
+			}
+			opts.EnableWritebackCache = writeback
+			mntDir, _ := testMount(t, root, opts)
+
+			f, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			mem, err := unix.Mmap(int(f.Fd()), 0, 8192, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+			if err != nil {
+				t.Fatalf("Mmap: %v", err)
+			}
+			defer unix.Munmap(mem)
+
+			// Fault in the pages with a system call. A page fault
+			// on a FUSE mapping blocks the thread without the Go
+			// runtime knowing, which can deadlock the test.
+			if err := unix.Mlock(mem); err != nil {
+				t.Fatalf("Mlock: %v", err)
+			}
+			defer unix.Munlock(mem)
+
+			want := []byte("written through mmap")
+			copy(mem[4096:], want)
+			if err := unix.Msync(mem, unix.MS_SYNC); err != nil {
+				t.Fatalf("msync: %v", err)
+			}
+
+			file.mu.Lock()
+			got := file.Data[4096 : 4096+len(want)]
+			file.mu.Unlock()
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -23,8 +23,29 @@ func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, erro
 		}
 	}
 
-	rawFS := NewNodeFS(root, options)
-	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	return MountShared(dir, NewNodeFS(root, options), &options.MountOptions)
+}
+
+// MountShared mounts rawFS, which must be returned by NewNodeFS, on
+// the directory, and starts serving requests. It can be called
+// several times with the same rawFS to serve one Inode tree on
+// several mount points. The MountOptions of the mounts may differ in
+// options that only concern one mount, such as FsName or AllowOther,
+// but the ones that change the protocol, such as EnableWritebackCache
+// and DisabledCapabilities, must match: the bridge behaves according
+// to the options and kernel capabilities of the first mount for all
+// of them. Each mount has its own kernel caches, so the
+// Inode.NotifyXxx methods send their notifications to all mounts.
+// When a mount is unmounted, the others keep working; OnForget is
+// only called for the live nodes after the last one is gone. The
+// kernel does not forget the inodes of a mount that goes away, so
+// they stay in memory.
+//
+// Backing files (see FilePassthroughFder) are only used until the
+// second mount is added, because they cannot be shared between
+// mounts.
+func MountShared(dir string, rawFS fuse.RawFileSystem, mountOpts *fuse.MountOptions) (*fuse.Server, error) {
+	server, err := fuse.NewServer(rawFS, dir, mountOpts)
 	if err != nil {
 		return nil, err
 	}
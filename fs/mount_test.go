@@ -0,0 +1,92 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestMountShared(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("hello")}
+	hour := time.Hour
+	opts := &Options{
+		EntryTimeout:    &hour,
+		AttrTimeout:     &hour,
+		NegativeTimeout: &hour,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	}
+	opts.Debug = testutil.VerboseTest()
+	rawFS := NewNodeFS(root, opts)
+
+	var dirs []string
+	var servers []*fuse.Server
+	for i := 0; i < 2; i++ {
+		dir := t.TempDir()
+		server, err := MountShared(dir, rawFS, &opts.MountOptions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first mount is unmounted by the test already.
+		t.Cleanup(func() { server.Unmount() })
+		dirs = append(dirs, dir)
+		servers = append(servers, server)
+	}
+
+	// check reads file and new through all mounts, with new absent
+	// if want is "".
+	check := func(dirs []string, want, wantNew string) {
+		t.Helper()
+		for _, dir := range dirs {
+			if got, err := os.ReadFile(dir + "/file"); err != nil {
+				t.Errorf("ReadFile: %v", err)
+			} else if string(got) != want {
+				t.Errorf("%s: got %q, want %q", dir, got, want)
+			}
+			got, err := os.ReadFile(dir + "/new")
+			if wantNew == "" && !os.IsNotExist(err) {
+				t.Errorf("%s: got %q, %v, want ENOENT", dir, got, err)
+			} else if wantNew != "" && string(got) != wantNew {
+				t.Errorf("%s: got %q, %v, want %q", dir, got, err, wantNew)
+			}
+		}
+	}
+	update := func(data string) {
+		file.mu.Lock()
+		file.Data = []byte(data)
+		file.mu.Unlock()
+		if errno := file.NotifyContent(0, 0); errno != 0 {
+			t.Errorf("NotifyContent: %v", errno)
+		}
+	}
+
+	// Fill the caches of both mounts.
+	check(dirs, "hello", "")
+
+	update("changed")
+	ch := root.NewPersistentInode(context.Background(), &MemRegularFile{Data: []byte("new")}, StableAttr{})
+	root.AddChild("new", ch, false)
+	if errno := root.NotifyEntry("new"); errno != 0 {
+		t.Errorf("NotifyEntry: %v", errno)
+	}
+	check(dirs, "changed", "new")
+
+	// The remaining mount still gets notifications after the
+	// other one is gone.
+	if err := servers[0].Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	servers[0].Wait()
+	update("changed again")
+	check(dirs[1:], "changed again", "new")
+}
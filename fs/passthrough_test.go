@@ -110,3 +110,45 @@ func TestPassthrough(t *testing.T) {
 		t.Errorf("got writecount %d want 0", n.writes)
 	}
 }
+
+func TestPassthroughDisabled(t *testing.T) {
+	mnt := t.TempDir()
+	n := &rwRegisteringNode{}
+
+	rootData := &LoopbackRoot{
+		Path: t.TempDir(),
+		NewNode: func(rootData *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
+			return n
+		},
+	}
+	n.RootData = rootData
+	root := &LoopbackNode{
+		RootData: rootData,
+	}
+	opts := &Options{}
+	opts.Debug = testutil.VerboseTest()
+	opts.DisablePassthrough = true
+	server, err := Mount(mnt, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	fn := mnt + "/file"
+	want := "hello there"
+	if err := os.WriteFile(fn, []byte(want), 0666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+	server.Unmount()
+
+	if n.writes == 0 {
+		t.Errorf("got writecount 0, want > 0")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// PathFS is a file system that is addressed by path names rather
+// than by Inodes. It is the path-based API of the deprecated pathfs
+// package, on top of the Inode tree. Names are slash-separated and
+// relative to the root of the PathFS, which has the name "".
+//
+// The adapter returned by NewPathFSRoot maintains the Inode tree, so
+// renames are reflected in the names passed to later calls. Files
+// that report the same (non-zero) Attr.Ino share a single Inode, so
+// hard links behave as expected: the name passed for such a file is
+// one of its links.
+//
+// Besides the methods below, a PathFS may implement the PathXxxer
+// interfaces to support mutations. Operations whose interface is not
+// implemented return ENOTSUP.
+type PathFS interface {
+	// GetAttr fills in the attributes of the named file. It
+	// doubles as Lookup: ENOENT means the file does not exist.
+	GetAttr(ctx context.Context, name string, out *fuse.Attr) syscall.Errno
+
+	// Open opens the named file. The returned FileHandle should
+	// implement FileReader, FileWriter, etc.
+	Open(ctx context.Context, name string, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+
+	// Readdir lists the named directory.
+	Readdir(ctx context.Context, name string) (DirStream, syscall.Errno)
+}
+
+// PathReadlinker reads the target of a symlink.
+type PathReadlinker interface {
+	Readlink(ctx context.Context, name string) ([]byte, syscall.Errno)
+}
+
+// PathSetattrer changes the attributes of a file. The new
+// attributes are read back with GetAttr.
+type PathSetattrer interface {
+	SetAttr(ctx context.Context, name string, in *fuse.SetAttrIn) syscall.Errno
+}
+
+// PathMkdirer creates a directory.
+type PathMkdirer interface {
+	Mkdir(ctx context.Context, name string, mode uint32) syscall.Errno
+}
+
+// PathCreater creates and opens a regular file.
+type PathCreater interface {
+	Create(ctx context.Context, name string, flags uint32, mode uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
+// PathUnlinker removes a file.
+type PathUnlinker interface {
+	Unlink(ctx context.Context, name string) syscall.Errno
+}
+
+// PathRmdirer removes a directory.
+type PathRmdirer interface {
+	Rmdir(ctx context.Context, name string) syscall.Errno
+}
+
+// PathRenamer moves a file or directory. The flags are as for
+// NodeRenamer.
+type PathRenamer interface {
+	Rename(ctx context.Context, oldName, newName string, flags uint32) syscall.Errno
+}
+
+// PathLinker creates newName as a hard link to oldName.
+type PathLinker interface {
+	Link(ctx context.Context, oldName, newName string) syscall.Errno
+}
+
+// PathSymlinker creates a symlink called name, pointing to target.
+type PathSymlinker interface {
+	Symlink(ctx context.Context, target, name string) syscall.Errno
+}
+
+type pathFSRoot struct {
+	fs   PathFS
+	root *pathNode
+}
+
+// pathNode is the InodeEmbedder for all files of a PathFS.
+type pathNode struct {
+	Inode
+
+	r *pathFSRoot
+}
+
+// NewPathFSRoot returns the root node for serving pfs. The result can
+// be passed to Mount, or added to a larger tree with NewPersistentInode.
+func NewPathFSRoot(pfs PathFS) InodeEmbedder {
+	r := &pathFSRoot{fs: pfs}
+	r.root = &pathNode{r: r}
+	return r.root
+}
+
+// path returns the name of this node, relative to the PathFS root.
+func (n *pathNode) path() string {
+	return n.Path(n.r.root.EmbeddedInode())
+}
+
+// childPath returns the name of the child called name.
+func (n *pathNode) childPath(name string) string {
+	return filepath.Join(n.path(), name)
+}
+
+// newChild looks up the attributes of p and returns the Inode for it.
+func (n *pathNode) newChild(ctx context.Context, p string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if errno := n.r.fs.GetAttr(ctx, p, &out.Attr); errno != 0 {
+		return nil, errno
+	}
+	node := &pathNode{r: n.r}
+	return n.NewInode(ctx, node, StableAttr{Mode: out.Attr.Mode & syscall.S_IFMT, Ino: out.Attr.Ino}), 0
+}
+
+var _ = (NodeLookuper)((*pathNode)(nil))
+
+func (n *pathNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return n.newChild(ctx, n.childPath(name), out)
+}
+
+var _ = (NodeGetattrer)((*pathNode)(nil))
+
+func (n *pathNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if fga, ok := f.(FileGetattrer); ok {
+		return fga.Getattr(ctx, out)
+	}
+	return n.r.fs.GetAttr(ctx, n.path(), &out.Attr)
+}
+
+var _ = (NodeSetattrer)((*pathNode)(nil))
+
+func (n *pathNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	sa, ok := n.r.fs.(PathSetattrer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	p := n.path()
+	if errno := sa.SetAttr(ctx, p, in); errno != 0 {
+		return errno
+	}
+	return n.r.fs.GetAttr(ctx, p, &out.Attr)
+}
+
+var _ = (NodeOpener)((*pathNode)(nil))
+
+func (n *pathNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return n.r.fs.Open(ctx, n.path(), flags)
+}
+
+var _ = (NodeReaddirer)((*pathNode)(nil))
+
+func (n *pathNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return n.r.fs.Readdir(ctx, n.path())
+}
+
+var _ = (NodeReadlinker)((*pathNode)(nil))
+
+func (n *pathNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	rl, ok := n.r.fs.(PathReadlinker)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	return rl.Readlink(ctx, n.path())
+}
+
+var _ = (NodeMkdirer)((*pathNode)(nil))
+
+func (n *pathNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	mk, ok := n.r.fs.(PathMkdirer)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	p := n.childPath(name)
+	if errno := mk.Mkdir(ctx, p, mode); errno != 0 {
+		return nil, errno
+	}
+	return n.newChild(ctx, p, out)
+}
+
+var _ = (NodeCreater)((*pathNode)(nil))
+
+func (n *pathNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	cr, ok := n.r.fs.(PathCreater)
+	if !ok {
+		return nil, nil, 0, syscall.ENOTSUP
+	}
+	p := n.childPath(name)
+	fh, fuseFlags, errno := cr.Create(ctx, p, flags, mode)
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+	ch, errno := n.newChild(ctx, p, out)
+	if errno != 0 {
+		if rel, ok := fh.(FileReleaser); ok {
+			rel.Release(ctx)
+		}
+		return nil, nil, 0, errno
+	}
+	return ch, fh, fuseFlags, 0
+}
+
+var _ = (NodeSymlinker)((*pathNode)(nil))
+
+func (n *pathNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	sl, ok := n.r.fs.(PathSymlinker)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	p := n.childPath(name)
+	if errno := sl.Symlink(ctx, target, p); errno != 0 {
+		return nil, errno
+	}
+	return n.newChild(ctx, p, out)
+}
+
+var _ = (NodeLinker)((*pathNode)(nil))
+
+func (n *pathNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	ln, ok := n.r.fs.(PathLinker)
+	if !ok {
+		return nil, syscall.ENOTSUP
+	}
+	t, ok := target.(*pathNode)
+	if !ok || t.r != n.r {
+		return nil, syscall.EXDEV
+	}
+	p := n.childPath(name)
+	if errno := ln.Link(ctx, t.path(), p); errno != 0 {
+		return nil, errno
+	}
+	return n.newChild(ctx, p, out)
+}
+
+var _ = (NodeUnlinker)((*pathNode)(nil))
+
+func (n *pathNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	ul, ok := n.r.fs.(PathUnlinker)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return ul.Unlink(ctx, n.childPath(name))
+}
+
+var _ = (NodeRmdirer)((*pathNode)(nil))
+
+func (n *pathNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	rd, ok := n.r.fs.(PathRmdirer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	return rd.Rmdir(ctx, n.childPath(name))
+}
+
+var _ = (NodeRenamer)((*pathNode)(nil))
+
+func (n *pathNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	rn, ok := n.r.fs.(PathRenamer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	p2, ok := newParent.(*pathNode)
+	if !ok || p2.r != n.r {
+		return syscall.EXDEV
+	}
+	return rn.Rename(ctx, n.childPath(name), p2.childPath(newName), flags)
+}
@@ -0,0 +1,376 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type memPathEntry struct {
+	attr   fuse.Attr
+	data   []byte
+	target string
+}
+
+// memPathFS is an in-memory PathFS. Hard links share a
+// memPathEntry.
+type memPathFS struct {
+	mu       sync.Mutex
+	entries  map[string]*memPathEntry
+	nextIno  uint64
+	getattrs []string
+}
+
+func newMemPathFS() *memPathFS {
+	fs := &memPathFS{entries: map[string]*memPathEntry{}}
+	fs.add("", syscall.S_IFDIR|0755)
+	return fs
+}
+
+func (fs *memPathFS) add(name string, mode uint32) *memPathEntry {
+	fs.nextIno++
+	e := &memPathEntry{
+		attr: fuse.Attr{Ino: fs.nextIno, Mode: mode, Nlink: 1},
+	}
+	fs.entries[name] = e
+	return e
+}
+
+// checkParent returns the errno for creating name.
+func (fs *memPathFS) checkParent(name string) syscall.Errno {
+	if _, ok := fs.entries[name]; ok {
+		return syscall.EEXIST
+	}
+	dir := filepath.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+	if e, ok := fs.entries[dir]; !ok || e.attr.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return syscall.ENOENT
+	}
+	return 0
+}
+
+func (fs *memPathFS) GetAttr(ctx context.Context, name string, out *fuse.Attr) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.getattrs = append(fs.getattrs, name)
+	e, ok := fs.entries[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	*out = e.attr
+	return 0
+}
+
+func (fs *memPathFS) Open(ctx context.Context, name string, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return nil, 0, syscall.ENOENT
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		e.data = nil
+		e.attr.Size = 0
+	}
+	return &memPathFile{fs: fs, e: e}, 0, 0
+}
+
+func (fs *memPathFS) Readdir(ctx context.Context, name string) (DirStream, syscall.Errno) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var r []fuse.DirEntry
+	for k, e := range fs.entries {
+		if k == "" {
+			continue
+		}
+		dir := filepath.Dir(k)
+		if dir == "." {
+			dir = ""
+		}
+		if dir != name {
+			continue
+		}
+		r = append(r, fuse.DirEntry{Name: filepath.Base(k), Mode: e.attr.Mode, Ino: e.attr.Ino})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return NewListDirStream(r), 0
+}
+
+func (fs *memPathFS) Readlink(ctx context.Context, name string) ([]byte, syscall.Errno) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return []byte(e.target), 0
+}
+
+func (fs *memPathFS) SetAttr(ctx context.Context, name string, in *fuse.SetAttrIn) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if sz, ok := in.GetSize(); ok {
+		e.data = append(e.data, make([]byte, int(sz))...)[:sz]
+		e.attr.Size = sz
+	}
+	if m, ok := in.GetMode(); ok {
+		e.attr.Mode = e.attr.Mode&syscall.S_IFMT | m&07777
+	}
+	return 0
+}
+
+func (fs *memPathFS) Mkdir(ctx context.Context, name string, mode uint32) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if errno := fs.checkParent(name); errno != 0 {
+		return errno
+	}
+	fs.add(name, syscall.S_IFDIR|mode)
+	return 0
+}
+
+func (fs *memPathFS) Create(ctx context.Context, name string, flags uint32, mode uint32) (FileHandle, uint32, syscall.Errno) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if errno := fs.checkParent(name); errno != 0 {
+		return nil, 0, errno
+	}
+	e := fs.add(name, syscall.S_IFREG|mode)
+	return &memPathFile{fs: fs, e: e}, 0, 0
+}
+
+func (fs *memPathFS) Symlink(ctx context.Context, target, name string) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if errno := fs.checkParent(name); errno != 0 {
+		return errno
+	}
+	e := fs.add(name, syscall.S_IFLNK|0777)
+	e.target = target
+	e.attr.Size = uint64(len(target))
+	return 0
+}
+
+func (fs *memPathFS) Link(ctx context.Context, oldName, newName string) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[oldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if errno := fs.checkParent(newName); errno != 0 {
+		return errno
+	}
+	e.attr.Nlink++
+	fs.entries[newName] = e
+	return 0
+}
+
+func (fs *memPathFS) Unlink(ctx context.Context, name string) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	e.attr.Nlink--
+	delete(fs.entries, name)
+	return 0
+}
+
+func (fs *memPathFS) Rmdir(ctx context.Context, name string) syscall.Errno {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.entries[name]; !ok {
+		return syscall.ENOENT
+	}
+	for k := range fs.entries {
+		if strings.HasPrefix(k, name+"/") {
+			return syscall.ENOTEMPTY
+		}
+	}
+	delete(fs.entries, name)
+	return 0
+}
+
+func (fs *memPathFS) Rename(ctx context.Context, oldName, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.EINVAL
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	e, ok := fs.entries[oldName]
+	if !ok {
+		return syscall.ENOENT
+	}
+	delete(fs.entries, oldName)
+	fs.entries[newName] = e
+	for k, v := range fs.entries {
+		if strings.HasPrefix(k, oldName+"/") {
+			delete(fs.entries, k)
+			fs.entries[newName+k[len(oldName):]] = v
+		}
+	}
+	return 0
+}
+
+type memPathFile struct {
+	fs *memPathFS
+	e  *memPathEntry
+}
+
+var _ = (FileReader)((*memPathFile)(nil))
+var _ = (FileWriter)((*memPathFile)(nil))
+
+func (f *memPathFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	end := off + int64(len(dest))
+	if end > int64(len(f.e.data)) {
+		end = int64(len(f.e.data))
+	}
+	if off > end {
+		off = end
+	}
+	return fuse.ReadResultData(append([]byte{}, f.e.data[off:end]...)), 0
+}
+
+func (f *memPathFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	end := off + int64(len(data))
+	if end > int64(len(f.e.data)) {
+		f.e.data = append(f.e.data, make([]byte, end-int64(len(f.e.data)))...)
+	}
+	copy(f.e.data[off:], data)
+	f.e.attr.Size = uint64(len(f.e.data))
+	return uint32(len(data)), 0
+}
+
+func TestPathFSRename(t *testing.T) {
+	pfs := newMemPathFS()
+	pfs.add("dir", syscall.S_IFDIR|0755)
+	pfs.add("dir/file", syscall.S_IFREG|0644)
+
+	rawFS := NewNodeFS(NewPathFSRoot(pfs), &Options{})
+	var dirOut, fileOut fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "dir", &dirOut); !code.Ok() {
+		t.Fatalf("Lookup dir: %v", code)
+	}
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: dirOut.NodeId}, "file", &fileOut); !code.Ok() {
+		t.Fatalf("Lookup file: %v", code)
+	}
+	if code := rawFS.Rename(nil, &fuse.RenameIn{InHeader: fuse.InHeader{NodeId: 1}, Newdir: 1}, "dir", "dir2"); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+
+	pfs.getattrs = nil
+	var attrOut fuse.AttrOut
+	if code := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: fileOut.NodeId}}, &attrOut); !code.Ok() {
+		t.Fatalf("GetAttr: %v", code)
+	}
+	if want := []string{"dir2/file"}; len(pfs.getattrs) != 1 || pfs.getattrs[0] != want[0] {
+		t.Errorf("GetAttr called for %q, want %q", pfs.getattrs, want)
+	}
+}
+
+func TestPathFSHardlinkLookup(t *testing.T) {
+	pfs := newMemPathFS()
+	pfs.add("a", syscall.S_IFREG|0644)
+	pfs.Link(context.Background(), "a", "b")
+
+	rawFS := NewNodeFS(NewPathFSRoot(pfs), &Options{})
+	var aOut, bOut fuse.EntryOut
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "a", &aOut); !code.Ok() {
+		t.Fatalf("Lookup a: %v", code)
+	}
+	if code := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "b", &bOut); !code.Ok() {
+		t.Fatalf("Lookup b: %v", code)
+	}
+	if aOut.NodeId != bOut.NodeId {
+		t.Errorf("hard links got different nodes: %d != %d", aOut.NodeId, bOut.NodeId)
+	}
+}
+
+func TestPathFSMount(t *testing.T) {
+	pfs := newMemPathFS()
+	mntDir, _ := testMount(t, NewPathFSRoot(pfs), nil)
+
+	if err := os.Mkdir(mntDir+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	content := []byte("hello")
+	if err := os.WriteFile(mntDir+"/dir/file", content, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Rename(mntDir+"/dir", mntDir+"/dir2"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if got, err := os.ReadFile(mntDir + "/dir2/file"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+	if _, err := os.Stat(mntDir + "/dir/file"); !os.IsNotExist(err) {
+		t.Errorf("Stat old name: got %v, want ENOENT", err)
+	}
+
+	if err := os.Link(mntDir+"/dir2/file", mntDir+"/link"); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/dir2/file", &st1); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if err := syscall.Stat(mntDir+"/link", &st2); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st1.Ino != st2.Ino || st2.Nlink != 2 {
+		t.Errorf("hard link: ino %d, %d nlink %d", st1.Ino, st2.Ino, st2.Nlink)
+	}
+	if err := os.Remove(mntDir + "/dir2/file"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got, err := os.ReadFile(mntDir + "/link"); err != nil {
+		t.Fatalf("ReadFile link: %v", err)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+
+	if err := os.Symlink("link", mntDir+"/sym"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if got, err := os.Readlink(mntDir + "/sym"); err != nil || got != "link" {
+		t.Errorf("Readlink: got %q, %v", got, err)
+	}
+
+	entries, err := os.ReadDir(mntDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if got, want := strings.Join(names, ","), "dir2,link,sym"; got != want {
+		t.Errorf("ReadDir: got %q, want %q", got, want)
+	}
+}
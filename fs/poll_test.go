@@ -0,0 +1,108 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// pollNode becomes readable once ready is set.
+type pollNode struct {
+	Inode
+
+	mu    sync.Mutex
+	ready bool
+	kh    uint64
+}
+
+var _ = (NodeOpener)((*pollNode)(nil))
+
+func (n *pollNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, 0
+}
+
+var _ = (NodePoller)((*pollNode)(nil))
+
+func (n *pollNode) Poll(ctx context.Context, f FileHandle, events uint32, kh uint64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return events & unix.POLLIN, 0
+	}
+	if kh != 0 {
+		n.kh = kh
+	}
+	return 0, 0
+}
+
+// setReady marks the node readable, and returns the kernel handle
+// to notify.
+func (n *pollNode) setReady() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ready = true
+	return n.kh
+}
+
+func TestPollNotify(t *testing.T) {
+	root := &Inode{}
+	node := &pollNode{}
+	mnt, server := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnablePoll: true},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file",
+				root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+
+	// Use syscall.Open, so the Go runtime does not poll the file.
+	fd, err := syscall.Open(mnt+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		if kh := node.setReady(); kh != 0 {
+			if code := server.PollNotify(kh); !code.Ok() {
+				t.Errorf("PollNotify: %v", code)
+			}
+		}
+	}()
+
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	start := time.Now()
+	n, err := unix.Poll(fds, 5000)
+	<-done
+	if err != nil {
+		t.Fatalf("Poll: %v", err)
+	}
+	if n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+		t.Fatalf("got n=%d revents=0x%x, want POLLIN", n, fds[0].Revents)
+	}
+	if dt := time.Since(start); dt > 4*time.Second {
+		t.Errorf("poll was not woken up, took %v", dt)
+	}
+}
+
+// TestPollDisabled checks that POLL is switched off without
+// EnablePoll.
+func TestPollDisabled(t *testing.T) {
+	rawFS := NewNodeFS(&pollNode{}, &Options{})
+	in := &fuse.PollIn{InHeader: fuse.InHeader{NodeId: 1}, Events: unix.POLLIN}
+	if code := rawFS.Poll(nil, in, &fuse.PollOut{}); code != fuse.ENOSYS {
+		t.Errorf("Poll: got %v, want ENOSYS", code)
+	}
+}
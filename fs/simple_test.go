@@ -6,6 +6,7 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -64,6 +65,12 @@ type testOptions struct {
 	directMountStrict bool // sets MountOptions.DirectMountStrict
 	disableSplice     bool // sets MountOptions.DisableSplice
 	idMappedMount     bool // sets MountOptions.IDMappedMount
+	enableAcl         bool // sets MountOptions.EnableAcl
+	readOnly          bool // sets MountOptions.ReadOnly
+	atomicTrunc       bool // sets MountOptions.EnableAtomicTrunc
+	allowOther        bool // sets MountOptions.AllowOther
+	killPrivV2        bool // sets MountOptions.HandleKillPrivV2
+	noPassthrough     bool // sets MountOptions.DisablePassthrough
 }
 
 // newTestCase creates the directories `orig` and `mnt` inside a temporary
@@ -116,7 +123,13 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 		EnableLocks:       opts.enableLocks,
 		DisableSplice:     opts.disableSplice,
 		IDMappedMount:     opts.idMappedMount,
+		EnableAcl:         opts.enableAcl,
+		ReadOnly:          opts.readOnly,
+		EnableAtomicTrunc: opts.atomicTrunc,
+		AllowOther:        opts.allowOther,
+		HandleKillPrivV2:  opts.killPrivV2,
 	}
+	mOpts.DisablePassthrough = opts.noPassthrough
 	if !opts.suppressDebug {
 		mOpts.Debug = testutil.VerboseTest()
 	}
@@ -422,6 +435,40 @@ func TestReadDisableSplice(t *testing.T) {
 	posixtest.FileBasic(t, tc.mntDir)
 }
 
+func TestReadOnly(t *testing.T) {
+	tc := newTestCase(t, &testOptions{readOnly: true})
+	tc.writeOrig("file", "hello", 0644)
+	if err := os.Mkdir(tc.origDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := os.ReadFile(tc.mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	file := tc.mntDir + "/file"
+	for name, op := range map[string]func() error{
+		"open":     func() error { f, err := os.OpenFile(file, os.O_WRONLY, 0); f.Close(); return err },
+		"truncate": func() error { return syscall.Truncate(file, 0) },
+		"chmod":    func() error { return os.Chmod(file, 0600) },
+		"create":   func() error { _, err := os.Create(tc.mntDir + "/new"); return err },
+		"mkdir":    func() error { return os.Mkdir(tc.mntDir+"/newdir", 0755) },
+		"mknod":    func() error { return syscall.Mknod(tc.mntDir+"/fifo", syscall.S_IFIFO|0644, 0) },
+		"symlink":  func() error { return os.Symlink("file", tc.mntDir+"/link") },
+		"link":     func() error { return os.Link(file, tc.mntDir+"/hardlink") },
+		"unlink":   func() error { return os.Remove(file) },
+		"rmdir":    func() error { return os.Remove(tc.mntDir + "/dir") },
+		"rename":   func() error { return os.Rename(file, tc.mntDir+"/renamed") },
+		"setxattr": func() error { return unix.Setxattr(file, "user.attr", []byte("x"), 0) },
+	} {
+		if err := op(); !errors.Is(err, syscall.EROFS) {
+			t.Errorf("%s: got %v, want EROFS", name, err)
+		}
+	}
+}
+
 func TestOpenDirectIO(t *testing.T) {
 	// Apparently, tmpfs does not allow O_DIRECT, so try to create
 	// a test temp directory in /var/tmp.
@@ -886,3 +933,59 @@ func TestStatx(t *testing.T) {
 		t.Errorf("got, want: %s", diff)
 	}
 }
+
+func TestStatxBtime(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	tc.writeOrig("file", "hello", 0644)
+
+	want, err := lstatxPath(tc.origDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Mask&unix.STATX_BTIME == 0 {
+		t.Skip("backing file system does not support STATX_BTIME")
+	}
+	got, err := lstatxPath(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mask&unix.STATX_BTIME == 0 {
+		t.Fatalf("STATX_BTIME missing from mask %x", got.Mask)
+	}
+	if got.Btime != want.Btime {
+		t.Errorf("got btime %v, want %v", got.Btime, want.Btime)
+	}
+}
+
+func TestOpenTrunc(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("atomic=%v", atomic), func(t *testing.T) {
+			tc := newTestCase(t, &testOptions{atomicTrunc: atomic, attrCache: true})
+			if got := tc.server.Capabilities()&fuse.CAP_ATOMIC_O_TRUNC != 0; got != atomic &&
+				tc.server.KernelSettings().Flags64()&fuse.CAP_ATOMIC_O_TRUNC != 0 {
+				t.Errorf("CAP_ATOMIC_O_TRUNC: got %v, want %v", got, atomic)
+			}
+			tc.writeOrig("file", "hello", 0644)
+
+			// Read it first, so the kernel caches size and data.
+			if got, err := os.ReadFile(tc.mntDir + "/file"); err != nil || string(got) != "hello" {
+				t.Fatalf("ReadFile: %q, %v", got, err)
+			}
+
+			f, err := os.OpenFile(tc.mntDir+"/file", os.O_WRONLY|os.O_TRUNC, 0)
+			if err != nil {
+				t.Fatalf("OpenFile: %v", err)
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil || fi.Size() != 0 {
+				t.Errorf("Stat after O_TRUNC: %v, %v", fi, err)
+			}
+			if fi, err := os.Stat(tc.origDir + "/file"); err != nil || fi.Size() != 0 {
+				t.Errorf("Stat backing file: %v, %v", fi, err)
+			}
+			if got, err := os.ReadFile(tc.mntDir + "/file"); err != nil || len(got) != 0 {
+				t.Errorf("ReadFile after O_TRUNC: %q, %v", got, err)
+			}
+		})
+	}
+}
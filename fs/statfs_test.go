@@ -0,0 +1,61 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type statfsNode struct {
+	Inode
+
+	blocks uint64
+}
+
+var _ = (NodeStatfser)((*statfsNode)(nil))
+
+func (n *statfsNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Blocks = n.blocks
+	out.Bsize = 4096
+	return 0
+}
+
+var _ = (NodeOnAdder)((*statfsNode)(nil))
+
+func (n *statfsNode) OnAdd(ctx context.Context) {
+	if n.blocks != 1 {
+		return
+	}
+	branch := n.NewPersistentInode(ctx, &statfsNode{blocks: 2}, StableAttr{Mode: syscall.S_IFDIR})
+	n.AddChild("branch", branch, false)
+	plain := n.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	n.AddChild("plain", plain, false)
+}
+
+func TestStatfsSubtree(t *testing.T) {
+	root := &statfsNode{blocks: 1}
+	mnt, _ := testMount(t, root, nil)
+
+	for _, tc := range []struct {
+		path string
+		want uint64
+	}{
+		{"", 1},
+		{"/branch", 2},
+		{"/plain", 1},
+	} {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mnt+tc.path, &st); err != nil {
+			t.Fatalf("Statfs(%q): %v", tc.path, err)
+		}
+		if st.Blocks != tc.want {
+			t.Errorf("Statfs(%q): got %d blocks, want %d", tc.path, st.Blocks, tc.want)
+		}
+	}
+}
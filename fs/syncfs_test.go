@@ -0,0 +1,59 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type fsyncCountFile struct {
+	count *int32
+}
+
+var _ = (FileFsyncer)((*fsyncCountFile)(nil))
+
+func (f *fsyncCountFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	atomic.AddInt32(f.count, 1)
+	return 0
+}
+
+type fsyncCountNode struct {
+	Inode
+
+	count int32
+}
+
+var _ = (NodeOpener)((*fsyncCountNode)(nil))
+
+func (n *fsyncCountNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &fsyncCountFile{&n.count}, 0, 0
+}
+
+// TestSyncfsFallback checks that SYNCFS fsyncs all open files if
+// the root does not implement NodeSyncfser.
+func TestSyncfsFallback(t *testing.T) {
+	root := &fsyncCountNode{}
+	rawFS := NewNodeFS(root, &Options{})
+
+	header := fuse.InHeader{NodeId: 1}
+	for i := 0; i < 3; i++ {
+		var out fuse.OpenOut
+		if code := rawFS.Open(nil, &fuse.OpenIn{InHeader: header}, &out); !code.Ok() {
+			t.Fatalf("Open: %v", code)
+		}
+	}
+
+	if code := rawFS.SyncFs(nil, &fuse.SyncFsIn{InHeader: header}); !code.Ok() {
+		t.Fatalf("SyncFs: %v", code)
+	}
+	if got := atomic.LoadInt32(&root.count); got != 3 {
+		t.Errorf("got %d fsyncs, want 3", got)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
+)
+
+// XattrNamespace returns the namespace of an extended attribute
+// name, ie. the part before the first '.', such as "user",
+// "trusted", "security" or "system". It returns "" if the name has
+// no namespace.
+func XattrNamespace(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+func (b *rawBridge) xattrAllowed(ctx context.Context, name string) bool {
+	return b.options.XattrFilter == nil || b.options.XattrFilter(ctx, XattrNamespace(name), name)
+}
+
+// listxattrFiltered runs Listxattr, and drops the names rejected by
+// Options.XattrFilter. The complete list is needed to compute the
+// filtered size, so it is read into a scratch buffer first.
+func (b *rawBridge) listxattrFiltered(ctx context.Context, xops NodeListxattrer, dest []byte) (uint32, syscall.Errno) {
+	buf := make([]byte, len(dest)+1024)
+	var sz uint32
+	for {
+		var errno syscall.Errno
+		sz, errno = xops.Listxattr(ctx, buf)
+		if errno == 0 {
+			break
+		}
+		if errno != syscall.ERANGE {
+			return 0, errno
+		}
+		if int(sz) <= len(buf) {
+			sz = uint32(2 * len(buf))
+		}
+		buf = make([]byte, sz)
+	}
+
+	var out []byte
+	for _, name := range bytes.Split(buf[:sz], []byte{0}) {
+		if len(name) == 0 || !b.xattrAllowed(ctx, string(name)) {
+			continue
+		}
+		out = append(out, name...)
+		out = append(out, 0)
+	}
+	if len(out) > len(dest) {
+		return uint32(len(out)), syscall.ERANGE
+	}
+	return uint32(copy(dest, out)), 0
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type xattrMapNode struct {
+	Inode
+
+	attrs map[string]string
+}
+
+var _ = (NodeGetxattrer)((*xattrMapNode)(nil))
+
+func (n *xattrMapNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	v, ok := n.attrs[attr]
+	if !ok {
+		return 0, ENOATTR
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), 0
+}
+
+var _ = (NodeListxattrer)((*xattrMapNode)(nil))
+
+func (n *xattrMapNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	var names []string
+	for k := range n.attrs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	list := strings.Join(names, "\x00") + "\x00"
+	if len(dest) < len(list) {
+		return uint32(len(list)), syscall.ERANGE
+	}
+	return uint32(copy(dest, list)), 0
+}
+
+var _ = (NodeSetxattrer)((*xattrMapNode)(nil))
+
+func (n *xattrMapNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	n.attrs[attr] = string(data)
+	return 0
+}
+
+func TestXattrNamespace(t *testing.T) {
+	for in, want := range map[string]string{
+		"user.foo":                "user",
+		"system.posix_acl_access": "system",
+		"trusted.overlay.opaque":  "trusted",
+		"nonamespace":             "",
+	} {
+		if got := XattrNamespace(in); got != want {
+			t.Errorf("XattrNamespace(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestXattrFilter(t *testing.T) {
+	root := &xattrMapNode{attrs: map[string]string{
+		"user.a":                  "1",
+		"trusted.b":               "2",
+		"system.posix_acl_access": "3",
+	}}
+	rawFS := NewNodeFS(root, &Options{
+		XattrFilter: func(ctx context.Context, ns, name string) bool {
+			caller, _ := fuse.FromContext(ctx)
+			return ns != "trusted" || caller.Uid == 0
+		},
+	})
+
+	user := fuse.InHeader{NodeId: 1, Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1000}}}
+	rootUser := fuse.InHeader{NodeId: 1}
+
+	buf := make([]byte, 100)
+	if _, code := rawFS.GetXAttr(nil, &user, "trusted.b", buf); code != fuse.ENOATTR {
+		t.Errorf("GetXAttr trusted.b as user: got %v, want ENOATTR", code)
+	}
+	if sz, code := rawFS.GetXAttr(nil, &rootUser, "trusted.b", buf); !code.Ok() || string(buf[:sz]) != "2" {
+		t.Errorf("GetXAttr trusted.b as root: got %q, %v", buf[:sz], code)
+	}
+	if sz, code := rawFS.GetXAttr(nil, &user, "system.posix_acl_access", buf); !code.Ok() || string(buf[:sz]) != "3" {
+		t.Errorf("GetXAttr system.posix_acl_access: got %q, %v", buf[:sz], code)
+	}
+
+	setIn := fuse.SetXAttrIn{InHeader: user}
+	if code := rawFS.SetXAttr(nil, &setIn, "trusted.c", []byte("x")); code != fuse.EPERM {
+		t.Errorf("SetXAttr trusted.c as user: got %v, want EPERM", code)
+	}
+
+	// Size probe, then the list itself.
+	want := "system.posix_acl_access\x00user.a\x00"
+	if sz, code := rawFS.ListXAttr(nil, &user, nil); code != fuse.ERANGE || int(sz) != len(want) {
+		t.Errorf("ListXAttr size: got %d, %v, want %d, ERANGE", sz, code, len(want))
+	}
+	if sz, code := rawFS.ListXAttr(nil, &user, buf); !code.Ok() || string(buf[:sz]) != want {
+		t.Errorf("ListXAttr as user: got %q, %v, want %q", buf[:sz], code, want)
+	}
+	if sz, code := rawFS.ListXAttr(nil, &rootUser, buf); !code.Ok() || !strings.Contains(string(buf[:sz]), "trusted.b\x00") {
+		t.Errorf("ListXAttr as root: got %q, %v", buf[:sz], code)
+	}
+}
@@ -121,6 +121,11 @@
 //
 // [2] https://sylabs.io/guides/3.7/user-guide/bind_paths_and_mounts.html#fuse-mounts
 //
+// 4) If `MountOptions.DeviceFd` is set, the same happens as in 3), but the fd
+// is passed explicitly, eg. when received through socket activation or over a
+// unix socket. The `mountPoint` argument is then only used for
+// informational purposes.
+//
 // # Aborting a file system
 //
 // A caller that has an open file in a buggy or crashed FUSE
@@ -132,7 +137,10 @@
 // the Dev field in the Stat_t result for a file in the mount.
 package fuse
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 // Types for users to implement.
 
@@ -144,7 +152,8 @@ import "log"
 type ReadResult interface {
 	// Returns the raw bytes for the read, possibly using the
 	// passed buffer. The buffer should be larger than the return
-	// value from Size.
+	// value from Size. The result may be shared with other
+	// reads, eg. for ReadResultZero, so it must not be modified.
 	Bytes(buf []byte) ([]byte, Status)
 
 	// Size returns how many bytes this return value takes at most.
@@ -157,11 +166,32 @@ type ReadResult interface {
 type MountOptions struct {
 	AllowOther bool
 
+	// DefaultPermissions, if set, adds the "default_permissions"
+	// mount option: the kernel checks file access against the
+	// mode, uid and gid of the inodes, and never sends ACCESS.
+	// Without it, the file system is responsible for
+	// permission checks.
+	DefaultPermissions bool
+
+	// DontMask, if set, negotiates CAP_DONT_MASK, so the kernel
+	// does not apply the umask of the caller to the mode of
+	// CREATE, MKDIR, MKNOD and SYMLINK requests. The file system
+	// gets the umask separately and can apply it as it sees fit,
+	// eg. after applying default ACLs. DontMask and
+	// DefaultPermissions are independent: the former affects
+	// the modes of new files, the latter how access to existing
+	// files is checked.
+	DontMask bool
+
 	// Options are the options passed as -o string to fusermount.
 	Options []string
 
 	// MaxBackground controls the maximum number of allowed backgruond
-	// asynchronous I/O requests.
+	// asynchronous I/O requests, eg. readahead and writeback.
+	// A file system with slow backends may use a low value to
+	// apply backpressure, while a fast one may want a deeper
+	// queue. The kernel caps the value for unprivileged mounts
+	// (see /proc/sys/fs/fuse/max_user_bgreq).
 	//
 	// If unset, the default is _DEFAULT_BACKGROUND_TASKS, 12.
 	// Concurrency for synchronous I/O is not limited.
@@ -191,6 +221,14 @@ type MountOptions struct {
 	// * MaxReadAhead, passed via InitOut.MaxReadAhead.
 	MaxWrite int
 
+	// MaxPages is the max size for requests, in units of memory pages
+	// (usually 4 kiB), that is requested from the kernel via
+	// InitOut.MaxPages. If 0, it is derived from MaxWrite, rounding
+	// up. The value is capped at the kernel maximum (see
+	// /proc/sys/fs/fuse/max_pages_limit on Linux). The negotiated value
+	// is available from Server.MaxPages.
+	MaxPages int
+
 	// MaxReadAhead is the max read ahead size to use. It controls how much data the
 	// kernel reads in advance to satisfy future read requests from applications.
 	// How much exactly is subject to clever heuristics in the kernel
@@ -209,19 +247,27 @@ type MountOptions struct {
 	// requests return NO_DATA without passing through the
 	// user defined filesystem. You should only set this if you
 	// file system implements extended attributes, and you are not
-	// interested in security labels.
+	// interested in security labels. POSIX ACLs are still passed
+	// through if EnableAcl is set.
 	IgnoreSecurityLabels bool // ignoring labels should be provided as a fusermount mount option.
 
 	// RememberInodes, if set, makes go-fuse never forget inodes.
-	// This may be useful for NFS.
+	// This may be useful for NFS, see EnableExportSupport.
 	RememberInodes bool
 
 	// FsName is the name of the filesystem, shown in "df -T"
-	// and friends (as the first column, "Filesystem").
+	// and friends (as the first column, "Filesystem"), and as the
+	// mount source in /proc/self/mountinfo. It defaults to Name.
 	FsName string
 
 	// Name is the "fuse.<name>" suffix, shown in "df -T" and friends
-	// (as the second column, "Type")
+	// (as the second column, "Type"), and as the file system type in
+	// /proc/self/mountinfo. It defaults to the String() of the
+	// RawFileSystem.
+	//
+	// FsName and Name are passed as the "fsname" and "subtype"
+	// options to fusermount, and to mount(2) directly with
+	// DirectMount, so both appear the same either way.
 	Name string
 
 	// SingleThreaded, if set, wraps the file system in a single-threaded
@@ -235,7 +281,11 @@ type MountOptions struct {
 	// Debug, if set, enables verbose debugging information.
 	Debug bool
 
-	// Logger, if set, is an alternate log sink for debug statements.
+	// Logger, if set, is an alternate log sink for debug statements,
+	// and for errors in handling requests, such as unknown opcodes
+	// or malformed requests. These are logged with the opcode,
+	// unique request ID and node ID as key=value pairs. If nil,
+	// the standard logger is used.
 	//
 	// To increase signal/noise ratio Go-FUSE uses abbreviations in its debug log
 	// output. Here is how to read it:
@@ -277,14 +327,71 @@ type MountOptions struct {
 	// When used, you must implement the GetLk/SetLk/SetLkw methods.
 	EnableLocks bool
 
-	// EnableSymlinkCaching, if set, makes the kernel cache all Readlink return values.
-	// The filesystem must use content notification to force the
-	// kernel to issue a new Readlink call.
+	// EnableSymlinkCaching, if set, negotiates
+	// CAP_CACHE_SYMLINKS, so the kernel keeps symlink targets
+	// in the page cache, rather than sending READLINK for every
+	// path resolution through the link. This helps file
+	// systems with many stable symlinks.
+	//
+	// The cached target is kept until the inode is evicted or
+	// its content is invalidated, independent of the attribute
+	// timeout. If a target changes, the file system must call
+	// InodeNotify (Inode.NotifyContent in the fs package) for
+	// the kernel to issue a new READLINK.
 	EnableSymlinkCaching bool
 
+	// EnableAtomicTrunc, if set, negotiates CAP_ATOMIC_O_TRUNC.
+	// The kernel then delivers open(2) with O_TRUNC as a single
+	// OPEN request with O_TRUNC in its flags, and the file system
+	// must truncate the file while opening it. Otherwise, the
+	// kernel strips O_TRUNC from OPEN, and truncates the file
+	// with a separate SETATTR request first. The fs package
+	// handles both, but truncates through Setattr, so only set
+	// this if all files that can be opened with O_TRUNC
+	// implement it, or handle O_TRUNC in Open.
+	EnableAtomicTrunc bool
+
+	// EnableExportSupport, if set, negotiates CAP_EXPORT_SUPPORT,
+	// which lets the mount be exported over NFS, and lets
+	// open_by_handle_at(2) work on files that are no longer in the
+	// kernel's inode cache. A file handle holds the NodeId and
+	// Generation of a file. To open it, the kernel sends a LOOKUP
+	// of "." on the NodeId, and a LOOKUP of ".." to find the
+	// parent directory. The file system must answer these for any
+	// NodeId it handed out, or return ESTALE if it no longer knows
+	// the NodeId. The fs package does so; combine with
+	// RememberInodes to keep handles valid after the kernel has
+	// forgotten the inode.
+	EnableExportSupport bool
+
+	// EnablePoll, if set, forwards poll(2) and epoll(7) on files
+	// to RawFileSystem.Poll. By default, go-fuse switches off
+	// POLL when mounting, as a process that accesses its own
+	// mount may deadlock: the Go runtime puts all files into its
+	// epoll set, and the resulting POLL requests must be served
+	// by the same process. Only set this if the FUSE process does
+	// not read its own mount, or if GOMAXPROCS leaves threads to
+	// serve these requests.
+	EnablePoll bool
+
+	// EnableWritebackCache, if set, asks the kernel to buffer
+	// writes in the page cache and flush them later, rather than
+	// forwarding each write(2) immediately. In this mode the kernel
+	// owns the file size and mtime while dirty pages exist, and
+	// it may issue READs to fill partial pages, so files opened
+	// O_WRONLY must be readable by the filesystem. O_APPEND is
+	// handled by the kernel, and the WRITE offsets are already
+	// positioned at the end of the file; filesystems should not
+	// apply O_APPEND again. Writes flushed from the cache carry
+	// WRITE_CACHE in WriteIn.WriteFlags, and their Caller need not
+	// be the process that wrote the data.
+	EnableWritebackCache bool
+
 	// ExplicitDataCacheControl, if set, asks the kernel not to do automatic
 	// data cache invalidation. The filesystem is fully responsible for
-	// invalidating data cache.
+	// invalidating data cache. Otherwise, go-fuse negotiates
+	// CAP_AUTO_INVAL_DATA, and the kernel drops cached data of a file
+	// when it sees its mtime or size change.
 	ExplicitDataCacheControl bool
 
 	// SyncRead, if set, makes go-fuse enable the
@@ -314,6 +421,13 @@ type MountOptions struct {
 	// DirectMountStrict, if set, is like DirectMount but no fallback to fusermount is
 	// performed. If both DirectMount and DirectMountStrict are set,
 	// DirectMountStrict wins.
+	//
+	// On Linux 4.18 and newer, this also works for unprivileged
+	// users inside a user namespace that owns the current mount
+	// namespace (e.g. after "unshare -Urm"), as in rootless
+	// containers. fusermount does not work there, so this is the
+	// option to use. If the kernel refuses the mount with EPERM,
+	// the error explains which requirement is not met.
 	DirectMountStrict bool
 
 	// DirectMountFlags are the mountflags passed to syscall.Mount. If zero, the
@@ -323,7 +437,13 @@ type MountOptions struct {
 	// by the kernel. See `man 2 mount` for details about MS_MGC_VAL.
 	DirectMountFlags uintptr
 
-	// EnableAcl, if set, enables kernel ACL support.
+	// EnableAcl, if set, enables kernel ACL support. The kernel
+	// then enforces the system.posix_acl_access and
+	// system.posix_acl_default attributes, which are stored
+	// through the regular xattr calls, and implicitly turns on
+	// DefaultPermissions. On CREATE and MKDIR, the mode already
+	// reflects the parent's default ACL, so the file system
+	// should not apply the umask again.
 	//
 	// See the comments to FUSE_CAP_POSIX_ACL
 	// in https://github.com/libfuse/libfuse/blob/master/include/fuse_common.h
@@ -335,11 +455,35 @@ type MountOptions struct {
 	// '-l') can be faster with ReadDir, as no per-file stat calls are needed.
 	DisableReadDirPlus bool
 
-	// DisableSplice, if set, disables splicing from files to the FUSE device.
+	// DisableSplice, if set, disables splicing from files to the
+	// FUSE device. Data of a ReadResultFd is then copied into a
+	// buffer before it is written to the device. The kernel
+	// capabilities are not affected. This is useful to rule out
+	// splice when debugging data corruption.
 	DisableSplice bool
 
-	// MaxStackDepth is the maximum stacking depth for passthrough files.
-	// If unset, the default is 1.
+	// DisablePassthrough, if set, disables the passthrough capability, so
+	// read and write calls are always served by the FUSE process, even
+	// if the file system provides backing file descriptors.
+	DisablePassthrough bool
+
+	// MapAlignment, if nonzero, negotiates CAP_MAP_ALIGNMENT with
+	// the kernel: file and memory offsets in SETUPMAPPING and
+	// REMOVEMAPPING requests will be aligned to 1<<MapAlignment
+	// bytes. This is only useful for virtiofs-style transports
+	// that configure a DAX window.
+	MapAlignment int
+
+	// MaxStackDepth is the stacking depth of this file system,
+	// sent to the kernel when passthrough (CAP_PASSTHROUGH) is
+	// negotiated. A backing file for passthrough must live on a
+	// file system with a lower depth. With the default of 1,
+	// backing files must be on a plain file system such as ext4.
+	// Set it to 2 to use backing files on overlayfs, or on another
+	// FUSE file system with passthrough; such a mount cannot
+	// itself be stacked upon further, eg. as an overlayfs lower
+	// layer. The kernel supports at most 2, so higher values are
+	// capped.
 	MaxStackDepth int
 
 	// RawFileSystem, if set, enables an ID-mapped mount if the Kernel supports
@@ -358,6 +502,162 @@ type MountOptions struct {
 	// DisabledCapabilities is a bitmask, containing capablities (the CAP_* bitmasks) that
 	// must be disabled for the entire mount.
 	DisabledCapabilities uint64
+
+	// RequestTimeout, if nonzero, bounds the time the kernel waits
+	// for a reply. When a request is not answered within this
+	// duration, its cancel channel (Context.Done) is closed, and
+	// the kernel gets EIO, so processes do not hang on an
+	// unresponsive backend. The reply produced by the file system
+	// afterwards is dropped.
+	//
+	// This only frees the kernel side: the file system must watch
+	// the cancel channel and abandon the operation, or the
+	// goroutine serving it stays blocked. As the kernel never
+	// learns about the nodes and handles in a dropped reply, the
+	// server undoes them: it calls Forget for the nodes returned
+	// by LOOKUP, CREATE, MKNOD, MKDIR, SYMLINK, LINK and
+	// READDIRPLUS, and Release or ReleaseDir for the handles
+	// returned by OPEN, OPENDIR and CREATE.
+	RequestTimeout time.Duration
+
+	// RecordStats, if set, collects per-opcode request counts,
+	// error counts and latencies, which can be read with
+	// Server.Stats.
+	RecordStats bool
+
+	// DeviceFd, if positive, is an open and already mounted FUSE
+	// device (/dev/fuse) to serve, instead of mounting the file
+	// system ourselves. NewServer verifies that the fd is a FUSE
+	// device, and performs the INIT handshake on it. As the
+	// Server did not mount the file system, Unmount returns an
+	// error; whoever mounted it should unmount it.
+	DeviceFd int
+
+	// MaxReaders is the maximum number of goroutines that read
+	// requests from the FUSE device in parallel. Readers are
+	// started on demand. Each request is served on its own
+	// goroutine, so this only limits how fast requests are read
+	// and decoded. If zero, GOMAXPROCS is used, limited to the
+	// range 2 to 16.
+	MaxReaders int
+
+	// CongestionThreshold is the number of pending background
+	// requests at which the kernel considers the file system
+	// congested, and starts to throttle writeback and readahead.
+	// If zero, 3/4 of MaxBackground is used. Values larger than
+	// MaxBackground are lowered to MaxBackground, with a warning.
+	CongestionThreshold int
+
+	// ReadOnly, if set, makes the server reply EROFS to all
+	// requests that would change the file system, such as WRITE,
+	// CREATE, MKDIR, UNLINK and SETATTR, and to OPEN for writing
+	// or truncation, without passing them to the file system.
+	// This is a safety net; you may also want to pass "ro" in
+	// Options, so the kernel refuses writes itself.
+	ReadOnly bool
+
+	// AllowedUIDs and AllowedGIDs, if either is non-empty, restrict
+	// access to callers whose user ID is in AllowedUIDs or whose
+	// primary group ID is in AllowedGIDs. Requests from other
+	// callers fail with EACCES before reaching the file system.
+	// Root and the user that created the server are always
+	// allowed. This is useful with AllowOther, to serve some
+	// users but not all of them.
+	AllowedUIDs []uint32
+	AllowedGIDs []uint32
+
+	// MountRetries is the number of times to retry mounting if
+	// it fails with a transient error (EBUSY or EAGAIN), eg.
+	// because of a race on the mount point. Retries back off
+	// exponentially, starting at 10ms. Other errors, such as
+	// EPERM or ENOENT, are returned immediately.
+	MountRetries int
+
+	// RetrieveTimeout, if positive, bounds how long
+	// Server.InodeRetrieveCache waits for the kernel to answer a
+	// retrieve request. On timeout, it returns ETIMEDOUT, and a
+	// late answer is dropped. If zero, it waits indefinitely.
+	RetrieveTimeout time.Duration
+
+	// MaxConcurrentRequests, if positive, caps the number of
+	// requests that are processed by the file system at the
+	// same time. Further requests wait in line until one
+	// finishes; they are not dropped. This protects slow
+	// backends against a flood of operations. Requests the
+	// kernel does not wait for (FORGET, INTERRUPT,
+	// NOTIFY_REPLY) are exempt, so an operation that waits for
+	// a notify reply cannot deadlock. See also
+	// Server.InflightRequests.
+	MaxConcurrentRequests int
+
+	// PrioritizeSyncRequests, if set, lets requests that a
+	// process waits for, such as LOOKUP and GETATTR, go ahead of
+	// waiting background requests when MaxConcurrentRequests is
+	// reached. Background requests are those that move file
+	// data (READ, WRITE, COPY_FILE_RANGE), which includes
+	// readahead and writeback, and RELEASE and RELEASEDIR. This
+	// keeps interactive latency low under bulk I/O, at the
+	// expense of throughput. Without MaxConcurrentRequests,
+	// requests never wait, and this has no effect.
+	PrioritizeSyncRequests bool
+
+	// RequestFilter, if set, is called for each request before it
+	// is passed to the file system. If it returns a status other
+	// than OK, the request fails with that status, and the file
+	// system does not see it. The filter may modify the header,
+	// eg. to rewrite the caller. Use OpcodeName to identify
+	// header.Opcode. It is called concurrently, and must not
+	// block. INIT, CUSE_INIT, DESTROY, FORGET, BATCH_FORGET,
+	// INTERRUPT, NOTIFY_REPLY, RELEASE and RELEASEDIR are not
+	// filtered, as they must not fail.
+	//
+	// This can be used to enforce access policies, for audit
+	// logging, or to inject faults in tests.
+	RequestFilter func(header *InHeader) Status
+
+	// FusermountPath, if set, is the mount helper to run instead
+	// of the one found in $PATH: fusermount3 or fusermount on
+	// Linux, mount_macfuse on OSX and mount_fusefs on FreeBSD. On
+	// Linux, it is used both for mounting and for unmounting.
+	// Mounting fails if it is not an executable file.
+	FusermountPath string
+
+	// HandleKillPrivV2, if set, negotiates
+	// CAP_HANDLE_KILLPRIV_V2 (Linux 5.12 and newer). The kernel
+	// then leaves it to the file system to clear the set-user-ID
+	// and set-group-ID bits when a user without CAP_FSETID
+	// writes to or truncates a file, and signals this with
+	// WRITE_KILL_SUIDGID in WriteIn.WriteFlags,
+	// FATTR_KILL_SUIDGID in SetAttrIn.Valid, and
+	// OPEN_KILL_SUIDGID in the open flags of OpenIn. The fs
+	// package handles these by changing the mode with Setattr.
+	// Writes to passthrough files do not reach the file system,
+	// so the bits are not cleared for them.
+	//
+	// This is useful if the file system runs with CAP_FSETID, eg.
+	// as root, because the kernel otherwise clears the bits with
+	// a separate SETATTR, which is racy.
+	HandleKillPrivV2 bool
+
+	// IDMap, if set, translates user and group IDs between the
+	// kernel and the file system, similar to an idmapped mount.
+	// The caller in the request header and the owner in SETATTR
+	// are mapped from host to file system IDs before the file
+	// system sees them; the owner in returned attributes is
+	// mapped back. The RequestFilter and AllowedUIDs checks see
+	// the unmapped IDs. IDs in extended attributes, such as
+	// POSIX ACLs, are not translated.
+	IDMap *IDMap
+
+	// TimeGranularity is the granularity of the timestamps that
+	// the file system stores, for example time.Second for a file
+	// system that only keeps whole seconds. The kernel truncates
+	// timestamps that it generates itself, eg. for
+	// utimensat(UTIME_NOW) or with the writeback cache, to this
+	// granularity, so they match the result of a later GETATTR.
+	// If unset, timestamps have nanosecond precision. The value
+	// is capped at one second.
+	TimeGranularity time.Duration
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -444,10 +744,22 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(cancel <-chan struct{}, input *CreateIn, name string, out *CreateOut) (code Status)
+
+	// Tmpfile creates and opens an unnamed file in the directory
+	// input.NodeId, for open(2) with O_TMPFILE. The kernel sends
+	// it since Linux 6.1 (protocol 7.37), and stops doing so
+	// once it returns ENOSYS; O_TMPFILE then fails with
+	// EOPNOTSUPP.
+	Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status)
 	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
 	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
 	Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status
 
+	// Bmap maps a block of a file to a block on the underlying
+	// block device. The kernel only sends it for file systems
+	// mounted as "fuseblk", eg. to use a file as a loop device.
+	Bmap(cancel <-chan struct{}, input *BmapIn, out *BmapOut) (code Status)
+
 	// File locking
 	GetLk(cancel <-chan struct{}, input *LkIn, out *LkOut) (code Status)
 	SetLk(cancel <-chan struct{}, input *LkIn) (code Status)
@@ -471,7 +783,23 @@ type RawFileSystem interface {
 
 	StatFs(cancel <-chan struct{}, input *InHeader, out *StatfsOut) (code Status)
 
+	// SyncFs is called for syncfs(2) on any file in the mount,
+	// after the kernel has written back its dirty pages. There
+	// is no capability flag for it: the kernel sends it from
+	// protocol 7.34 on, and stops after an ENOSYS reply.
+	SyncFs(cancel <-chan struct{}, input *SyncFsIn) (code Status)
+
 	Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status)
+
+	// Poll is only called if MountOptions.EnablePoll is set.
+	// Returning ENOSYS makes the kernel stop sending POLL for
+	// the whole mount.
+	Poll(cancel <-chan struct{}, input *PollIn, out *PollOut) (code Status)
+
+	// DAX window management, for virtiofs-style transports.
+	SetupMapping(cancel <-chan struct{}, input *SetupMappingIn) (code Status)
+	RemoveMapping(cancel <-chan struct{}, input *RemoveMappingIn, mappings []RemoveMappingOne) (code Status)
+
 	// This is called on processing the first request. The
 	// filesystem implementation can use the server argument to
 	// talk back to the kernel (through notify methods).
@@ -480,3 +808,18 @@ type RawFileSystem interface {
 	// Called after processing the last request.
 	OnUnmount()
 }
+
+// BatchForgetter is an optional interface for RawFileSystem. If
+// implemented, BATCH_FORGET requests are delivered in a single
+// call, rather than as a series of Forget calls.
+type BatchForgetter interface {
+	BatchForget(forgets []ForgetOne)
+}
+
+// TimeoutUpdater is an optional interface for RawFileSystem. It is
+// implemented by file systems that fill in entry and attribute
+// timeouts from configuration, so the timeouts can be changed
+// without remounting. See Server.UpdateTimeouts.
+type TimeoutUpdater interface {
+	UpdateTimeouts(entry, attr, negative time.Duration)
+}
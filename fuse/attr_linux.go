@@ -28,6 +28,25 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Blksize = uint32(s.Blksize)
 }
 
+// FromAttr fills the basic statistics (STATX_BASIC_STATS) from a.
+// Fields that Attr does not carry, such as Btime, are left alone.
+func (a *Statx) FromAttr(attr *Attr) {
+	a.Mask |= unix.STATX_BASIC_STATS
+	a.Ino = attr.Ino
+	a.Size = attr.Size
+	a.Blocks = attr.Blocks
+	a.Atime = SxTime{Sec: attr.Atime, Nsec: attr.Atimensec}
+	a.Ctime = SxTime{Sec: attr.Ctime, Nsec: attr.Ctimensec}
+	a.Mtime = SxTime{Sec: attr.Mtime, Nsec: attr.Mtimensec}
+	a.Mode = uint16(attr.Mode)
+	a.Nlink = attr.Nlink
+	a.Uid = attr.Uid
+	a.Gid = attr.Gid
+	a.Blksize = attr.Blksize
+	a.RdevMajor = unix.Major(uint64(attr.Rdev))
+	a.RdevMinor = unix.Minor(uint64(attr.Rdev))
+}
+
 func (a *Statx) FromStatx(s *unix.Statx_t) {
 	a.Ino = uint64(s.Ino)
 	a.Size = uint64(s.Size)
@@ -15,10 +15,21 @@ import (
 // interface.
 //
 // When a FUSE request is canceled, and the file system chooses to honor
-// the cancellation, the response should be EINTR.
+// the cancellation, the response should be EINTR. The Cancel channel
+// is also closed when MountOptions.RequestTimeout expires.
 type Context struct {
 	Caller
+
+	// Unique is the ID of the request, as in InHeader.Unique.
+	Unique uint64
+
 	Cancel <-chan struct{}
+
+	// Server is the server serving the file system, if known.
+	// The RawFileSystem sets it; a file system that is served by
+	// several servers may not know which one received the
+	// request. The fs package sets the first server.
+	Server *Server
 }
 
 func (c *Context) Deadline() (time.Time, bool) {
@@ -51,9 +62,48 @@ func NewContext(ctx context.Context, caller *Caller) context.Context {
 	return context.WithValue(ctx, callerKey, caller)
 }
 
+type uniqueKeyType struct{}
+
+var uniqueKey uniqueKeyType
+
+// UniqueFromContext returns the ID of the request that ctx was
+// created for.
+func UniqueFromContext(ctx context.Context) (uint64, bool) {
+	v, ok := ctx.Value(uniqueKey).(uint64)
+	return v, ok
+}
+
+type serverKeyType struct{}
+
+var serverKey serverKeyType
+
+// ServerFromContext returns the server of the Context that ctx was
+// derived from, or the one passed to NewServerContext. See
+// Context.Server: this is not necessarily the server that received
+// the request.
+func ServerFromContext(ctx context.Context) (*Server, bool) {
+	v, ok := ctx.Value(serverKey).(*Server)
+	return v, ok
+}
+
+// NewServerContext returns a context carrying s, for calls into the
+// file system that are not made for a request.
+func NewServerContext(ctx context.Context, s *Server) context.Context {
+	return context.WithValue(ctx, serverKey, s)
+}
+
 func (c *Context) Value(key interface{}) interface{} {
-	if key == callerKey {
+	switch key {
+	case callerKey:
 		return &c.Caller
+	case uniqueKey:
+		if c.Unique != 0 {
+			return c.Unique
+		}
+	case serverKey:
+		if c.Server != nil {
+			return c.Server
+		}
 	}
 	return nil
 }
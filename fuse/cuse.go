@@ -0,0 +1,163 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// CUSEDevice is a character device implemented in userspace
+// ("CUSE"). A character device has no name space, so there are no
+// LOOKUP or GETATTR calls; the kernel only forwards calls on open
+// file handles. The NodeId of all requests is zero.
+type CUSEDevice interface {
+	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
+	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
+	Write(cancel <-chan struct{}, input *WriteIn, data []byte) (written uint32, code Status)
+	Release(cancel <-chan struct{}, input *ReleaseIn)
+
+	// Ioctl is called for all ioctl(2) calls on the
+	// device. Unrestricted ioctls are enabled, so see IoctlIn
+	// for how to request argument buffers for ioctls whose
+	// arguments are not described by the command number.
+	Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, outbuf []byte) (code Status)
+}
+
+// cuseParams holds the device parameters sent in the CUSE_INIT
+// reply.
+type cuseParams struct {
+	devName  string
+	devMajor uint32
+	devMinor uint32
+}
+
+// cuseFileSystem adapts a CUSEDevice to the RawFileSystem used by
+// the Server. Other operations return ENOSYS.
+type cuseFileSystem struct {
+	RawFileSystem
+	dev CUSEDevice
+}
+
+func (fs *cuseFileSystem) String() string {
+	return fmt.Sprintf("%T", fs.dev)
+}
+
+func (fs *cuseFileSystem) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	return fs.dev.Open(cancel, input, out)
+}
+
+func (fs *cuseFileSystem) Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status) {
+	return fs.dev.Read(cancel, input, buf)
+}
+
+func (fs *cuseFileSystem) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (uint32, Status) {
+	return fs.dev.Write(cancel, input, data)
+}
+
+func (fs *cuseFileSystem) Release(cancel <-chan struct{}, input *ReleaseIn) {
+	fs.dev.Release(cancel, input)
+}
+
+func (fs *cuseFileSystem) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, outbuf []byte) Status {
+	return fs.dev.Ioctl(cancel, input, inbuf, output, outbuf)
+}
+
+// NewCUSEServer creates the character device /dev/{name}, served by
+// dev. If major is zero, the kernel picks a free major device
+// number. This requires access to /dev/cuse, which is usually
+// restricted to root.
+//
+// Call Serve on the result to start serving requests. The device
+// is removed when the process exits; Unmount is a no-op for CUSE
+// servers.
+func NewCUSEServer(name string, major, minor uint32, dev CUSEDevice, opts *MountOptions) (*Server, error) {
+	ms := newServer(&cuseFileSystem{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		dev:           dev,
+	}, opts)
+	ms.cuse = &cuseParams{
+		devName:  name,
+		devMajor: major,
+		devMinor: minor,
+	}
+
+	fd, err := syscall.Open("/dev/cuse", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/cuse: %v", err)
+	}
+	close(ms.ready)
+	ms.mountFd = fd
+
+	ms.loops.Add(1)
+	if code := ms.handleInit(); !code.Ok() {
+		ms.loops.Done()
+		syscall.Close(fd)
+		return nil, fmt.Errorf("init: %s", code)
+	}
+	return ms, nil
+}
+
+var cuseInitHandler = &operationHandler{
+	Name:       "CUSE_INIT",
+	Func:       doCuseInit,
+	InputSize:  unsafe.Sizeof(_CuseInitIn{}),
+	OutputSize: unsafe.Sizeof(_CuseInitOut{}),
+	InType:     _CuseInitIn{},
+	OutType:    _CuseInitOut{},
+}
+
+// doCuseInit handles CUSE_INIT, the CUSE variant of INIT. The reply
+// carries the device parameters, followed by a list of
+// NUL-terminated KEY=VALUE strings.
+func doCuseInit(server *protocolServer, req *request) {
+	if server.cuse == nil {
+		req.status = ENOSYS
+		return
+	}
+	input := (*_CuseInitIn)(req.inData())
+	if input.Major != _FUSE_KERNEL_VERSION {
+		server.opts.Logger.Printf("CUSE_INIT: major version does not match: unique=%d got=%d want=%d",
+			input.Unique, input.Major, _FUSE_KERNEL_VERSION)
+		req.status = EIO
+		return
+	}
+	if input.Minor < _MINIMUM_MINOR_VERSION {
+		server.opts.Logger.Printf("CUSE_INIT: minor version is less than we support: unique=%d got=%d want>=%d",
+			input.Unique, input.Minor, _MINIMUM_MINOR_VERSION)
+		req.status = EIO
+		return
+	}
+
+	server.kernelSettings = InitIn{
+		InHeader: input.InHeader,
+		Major:    input.Major,
+		Minor:    input.Minor,
+	}
+
+	out := (*_CuseInitOut)(req.outData())
+	*out = _CuseInitOut{
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _OUR_MINOR_VERSION,
+		Flags:    input.Flags & CUSE_UNRESTRICTED_IOCTL,
+		MaxRead:  uint32(server.opts.MaxWrite),
+		MaxWrite: uint32(server.opts.MaxWrite),
+		DevMajor: server.cuse.devMajor,
+		DevMinor: server.cuse.devMinor,
+	}
+	if out.Minor > input.Minor {
+		out.Minor = input.Minor
+	}
+
+	info := "DEVNAME=" + server.cuse.devName + "\x00"
+	if len(info) > CUSE_INIT_INFO_MAX {
+		server.opts.Logger.Printf("CUSE_INIT: device name too long: %d bytes", len(server.cuse.devName))
+		req.status = EINVAL
+		return
+	}
+	req.outPayload = []byte(info)
+	req.status = OK
+}
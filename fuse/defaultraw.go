@@ -159,6 +159,10 @@ func (fs *defaultRawFileSystem) FsyncDir(cancel <-chan struct{}, input *FsyncIn)
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) SyncFs(cancel <-chan struct{}, input *SyncFsIn) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Fallocate(cancel <-chan struct{}, in *FallocateIn) (code Status) {
 	return ENOSYS
 }
@@ -175,6 +179,26 @@ func (fs *defaultRawFileSystem) Lseek(cancel <-chan struct{}, in *LseekIn, out *
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) Bmap(cancel <-chan struct{}, input *BmapIn, out *BmapOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status) {
 	return ENOSYS
 }
+
+func (fs *defaultRawFileSystem) Poll(cancel <-chan struct{}, input *PollIn, out *PollOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetupMapping(cancel <-chan struct{}, input *SetupMappingIn) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) RemoveMapping(cancel <-chan struct{}, input *RemoveMappingIn, mappings []RemoveMappingOne) (code Status) {
+	return ENOSYS
+}
@@ -59,6 +59,15 @@ func (d *DirEntry) Parse(buf []byte) int {
 	return int(n)
 }
 
+// SetNameBytes sets Name to name, without copying it. This avoids an
+// allocation per entry when the names are generated into a buffer
+// that is reused, eg. by a DirStream listing a large directory. Name
+// changes along with the buffer, so the entry may only be used until
+// the buffer is overwritten.
+func (d *DirEntry) SetNameBytes(name []byte) {
+	d.Name = *(*string)(unsafe.Pointer(&name))
+}
+
 // DirEntryList holds the return value for READDIR and READDIRPLUS
 // opcodes.
 type DirEntryList struct {
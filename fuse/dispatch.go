@@ -0,0 +1,73 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import "sync"
+
+// dispatchQueue admits a limited number of requests to the file
+// system at a time; see MountOptions.MaxConcurrentRequests. Waiting
+// requests are admitted in arrival order, but with
+// MountOptions.PrioritizeSyncRequests, background requests only get
+// a slot if no other request is waiting.
+type dispatchQueue struct {
+	mu   sync.Mutex
+	free int
+
+	// waiting holds the channels of waiting requests, for
+	// foreground and background requests respectively.
+	waiting [2][]chan struct{}
+}
+
+func newDispatchQueue(n int) *dispatchQueue {
+	if n <= 0 {
+		return nil
+	}
+	return &dispatchQueue{free: n}
+}
+
+// acquire waits for a slot.
+func (q *dispatchQueue) acquire(background bool) {
+	q.mu.Lock()
+	if q.free > 0 {
+		q.free--
+		q.mu.Unlock()
+		return
+	}
+	prio := 0
+	if background {
+		prio = 1
+	}
+	ch := make(chan struct{})
+	q.waiting[prio] = append(q.waiting[prio], ch)
+	q.mu.Unlock()
+	<-ch
+}
+
+// release hands the slot to the next waiting request, or frees it.
+func (q *dispatchQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, w := range q.waiting {
+		if len(w) > 0 {
+			close(w[0])
+			w[0] = nil
+			q.waiting[i] = w[1:]
+			return
+		}
+	}
+	q.free++
+}
+
+// isBackground returns whether req moves file data, or cleans up
+// after a file was closed. The kernel sends such requests in the
+// background for readahead, writeback and close(2), so no process
+// waits for them directly.
+func isBackground(req *request) bool {
+	switch req.inHeader().Opcode {
+	case _OP_READ, _OP_WRITE, _OP_COPY_FILE_RANGE, _OP_RELEASE, _OP_RELEASEDIR:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,436 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fusetest serves a fuse.RawFileSystem without mounting it,
+// so the protocol handling of file systems can be tested on
+// machines without /dev/fuse.
+package fusetest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Opcodes of the requests that the harness creates.
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opSetattr     = 4
+	opOpen        = 14
+	opRead        = 15
+	opRelease     = 18
+	opInit        = 26
+	opCreate      = 35
+	opInterrupt   = 36
+	opNotifyReply = 41
+	opBatchForget = 42
+	opReaddirplus = 44
+	opTmpfile     = 51
+)
+
+// The protocol version that the harness announces in INIT.
+const (
+	kernelVersion      = 7
+	kernelMinorVersion = 28
+)
+
+// maxReplySize bounds the size of replies. It covers the largest
+// MaxWrite, plus the headers and the retry data of ioctls.
+const maxReplySize = 1<<20 + 64<<10
+
+var sizeOfOutHeader = int(unsafe.Sizeof(fuse.OutHeader{}))
+
+// TestHarness plays the kernel for a Server created with
+// fuse.NewSocketServer. Tests send request buffers, as the kernel
+// would write them to /dev/fuse, and get back the serialized
+// replies. The requests go through the same reading, parsing and
+// dispatch code as those of a mounted Server, so this can test
+// opcode handling deterministically.
+type TestHarness struct {
+	server *fuse.Server
+	fd     int
+	stream bool
+	done   chan struct{}
+
+	readMu sync.Mutex
+	buf    []byte
+
+	mu     sync.Mutex
+	unique uint64
+	caller fuse.Caller
+}
+
+// Reply is a reply or notification captured by a TestHarness.
+type Reply struct {
+	fuse.OutHeader
+
+	// Data holds the reply after the OutHeader: the fixed size
+	// output struct for the opcode, followed by the payload, if
+	// any. For READ, it is the file data.
+	Data []byte
+}
+
+// Status returns the status of the reply. For notifications, it
+// is the notification code.
+func (r *Reply) Status() fuse.Status {
+	return fuse.Status(-r.OutHeader.Status)
+}
+
+func (r *Reply) out(size uintptr) unsafe.Pointer {
+	if uintptr(len(r.Data)) < size {
+		return nil
+	}
+	return unsafe.Pointer(&r.Data[0])
+}
+
+// EntryOut decodes the reply of LOOKUP, MKDIR, etc. It returns nil
+// if the reply is too short.
+func (r *Reply) EntryOut() *fuse.EntryOut {
+	return (*fuse.EntryOut)(r.out(unsafe.Sizeof(fuse.EntryOut{})))
+}
+
+// AttrOut decodes the reply of GETATTR and SETATTR. It returns nil
+// if the reply is too short.
+func (r *Reply) AttrOut() *fuse.AttrOut {
+	return (*fuse.AttrOut)(r.out(unsafe.Sizeof(fuse.AttrOut{})))
+}
+
+// OpenOut decodes the reply of OPEN and OPENDIR. It returns nil if
+// the reply is too short.
+func (r *Reply) OpenOut() *fuse.OpenOut {
+	return (*fuse.OpenOut)(r.out(unsafe.Sizeof(fuse.OpenOut{})))
+}
+
+// CreateOut decodes the reply of CREATE. It returns nil if the reply
+// is too short.
+func (r *Reply) CreateOut() *fuse.CreateOut {
+	return (*fuse.CreateOut)(r.out(unsafe.Sizeof(fuse.CreateOut{})))
+}
+
+// InitOut decodes the reply of INIT. It returns nil if the reply is
+// too short.
+func (r *Reply) InitOut() *fuse.InitOut {
+	return (*fuse.InitOut)(r.out(unsafe.Sizeof(fuse.InitOut{})))
+}
+
+// NewTestHarness performs the INIT handshake with fs over a
+// SOCK_SEQPACKET socket pair, and starts serving it. The caller must
+// call Close when done.
+func NewTestHarness(fs fuse.RawFileSystem, opts *fuse.MountOptions) (*TestHarness, error) {
+	h, _, err := NewSocketTestHarness(syscall.SOCK_SEQPACKET, nil, fs, opts)
+	return h, err
+}
+
+// NewSocketTestHarness is like NewTestHarness, but connects over a
+// socket pair of the given type, eg. syscall.SOCK_STREAM, and sends
+// the INIT request in. The header of in is filled in by the
+// harness, as are the version and read-ahead if they are zero. If in
+// is nil, it sends the INIT request of NewTestHarness. It also
+// returns the reply to INIT.
+func NewSocketTestHarness(typ int, in *fuse.InitIn, fs fuse.RawFileSystem, opts *fuse.MountOptions) (*TestHarness, *Reply, error) {
+	init := fuse.InitIn{
+		Flags: uint32(fuse.CAP_ASYNC_READ | fuse.CAP_ATOMIC_O_TRUNC | fuse.CAP_BIG_WRITES |
+			fuse.CAP_READDIRPLUS | fuse.CAP_PARALLEL_DIROPS | fuse.CAP_AUTO_INVAL_DATA),
+	}
+	if in != nil {
+		init = *in
+	}
+	if init.Major == 0 {
+		init.Major = kernelVersion
+		init.Minor = kernelMinorVersion
+	}
+	if init.MaxReadAhead == 0 {
+		init.MaxReadAhead = 128 << 10
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, typ, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	f := os.NewFile(uintptr(fds[0]), "fusetest")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+
+	h := &TestHarness{
+		fd:     fds[1],
+		stream: typ == syscall.SOCK_STREAM,
+		done:   make(chan struct{}),
+		buf:    make([]byte, maxReplySize),
+		caller: fuse.Caller{
+			Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+			Pid:   uint32(os.Getpid()),
+		},
+	}
+
+	// The socket buffers the INIT request until the server
+	// reads it.
+	if err := h.Write(h.newRequest(opInit, 0, unsafe.Pointer(&init), unsafe.Sizeof(init))); err != nil {
+		conn.Close()
+		syscall.Close(h.fd)
+		return nil, nil, err
+	}
+	h.server, err = fuse.NewSocketServer(conn, fs, opts)
+	if err != nil {
+		syscall.Close(h.fd)
+		return nil, nil, err
+	}
+	go func() {
+		h.server.Serve()
+		close(h.done)
+	}()
+
+	r, err := h.Read()
+	if err == nil && !r.Status().Ok() {
+		err = fmt.Errorf("init: %s", r.Status())
+	}
+	if err != nil {
+		h.Close()
+		return nil, nil, err
+	}
+	return h, r, nil
+}
+
+// Server returns the Server that handles the requests.
+func (h *TestHarness) Server() *fuse.Server {
+	return h.server
+}
+
+// SetCaller sets the caller for requests created after this call.
+// The default is the current process.
+func (h *TestHarness) SetCaller(c fuse.Caller) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.caller = c
+}
+
+// Done returns a channel that is closed when Serve returns.
+func (h *TestHarness) Done() <-chan struct{} {
+	return h.done
+}
+
+// Shutdown shuts down the writing side of the connection, which the
+// Server sees as EOF.
+func (h *TestHarness) Shutdown() error {
+	return os.NewSyscallError("shutdown", syscall.Shutdown(h.fd, syscall.SHUT_WR))
+}
+
+// Close stops serving, and waits for the Server to exit.
+func (h *TestHarness) Close() {
+	syscall.Close(h.fd)
+	<-h.done
+}
+
+// newRequest serializes a request for opcode. The input struct in,
+// which must start with an InHeader, is followed by the
+// NUL-terminated names.
+func (h *TestHarness) newRequest(opcode uint32, nodeID uint64, in unsafe.Pointer, inSize uintptr, names ...string) []byte {
+	buf := make([]byte, inSize)
+	copy(buf, unsafe.Slice((*byte)(in), inSize))
+	for _, n := range names {
+		buf = append(buf, n...)
+		buf = append(buf, 0)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unique++
+	hdr := (*fuse.InHeader)(unsafe.Pointer(&buf[0]))
+	hdr.Length = uint32(len(buf))
+	hdr.Opcode = opcode
+	hdr.Unique = h.unique
+	hdr.NodeId = nodeID
+	hdr.Caller = h.caller
+	return buf
+}
+
+// LookupRequest returns a LOOKUP request for name in directory
+// nodeID.
+func (h *TestHarness) LookupRequest(nodeID uint64, name string) []byte {
+	var in fuse.InHeader
+	return h.newRequest(opLookup, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in), name)
+}
+
+// ForgetRequest returns a FORGET request, which has no reply.
+func (h *TestHarness) ForgetRequest(nodeID uint64, nlookup uint64) []byte {
+	in := fuse.ForgetIn{Nlookup: nlookup}
+	return h.newRequest(opForget, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// GetAttrRequest returns a GETATTR request.
+func (h *TestHarness) GetAttrRequest(nodeID uint64) []byte {
+	var in fuse.GetAttrIn
+	return h.newRequest(opGetattr, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// SetAttrRequest returns a SETATTR request. The header of in is
+// filled in by the harness.
+func (h *TestHarness) SetAttrRequest(nodeID uint64, in fuse.SetAttrIn) []byte {
+	return h.newRequest(opSetattr, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// OpenRequest returns an OPEN request with the given open(2) flags.
+func (h *TestHarness) OpenRequest(nodeID uint64, flags uint32) []byte {
+	in := fuse.OpenIn{Flags: flags}
+	return h.newRequest(opOpen, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// CreateRequest returns a CREATE request for name in directory
+// nodeID.
+func (h *TestHarness) CreateRequest(nodeID uint64, name string, flags uint32, mode uint32) []byte {
+	in := fuse.CreateIn{Flags: flags, Mode: mode}
+	return h.newRequest(opCreate, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in), name)
+}
+
+// TmpfileRequest returns a TMPFILE request for directory nodeID.
+func (h *TestHarness) TmpfileRequest(nodeID uint64, flags uint32, mode uint32) []byte {
+	in := fuse.CreateIn{Flags: flags, Mode: mode}
+	return h.newRequest(opTmpfile, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in), "/")
+}
+
+// ReadRequest returns a READ request for size bytes at offset off
+// of the open file fh.
+func (h *TestHarness) ReadRequest(nodeID uint64, fh uint64, off uint64, size uint32) []byte {
+	in := fuse.ReadIn{Fh: fh, Offset: off, Size: size}
+	return h.newRequest(opRead, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// ReadDirPlusRequest returns a READDIRPLUS request for size bytes
+// of entries after offset off of the open directory fh.
+func (h *TestHarness) ReadDirPlusRequest(nodeID uint64, fh uint64, off uint64, size uint32) []byte {
+	in := fuse.ReadIn{Fh: fh, Offset: off, Size: size}
+	return h.newRequest(opReaddirplus, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// ReleaseRequest returns a RELEASE request for the open file fh.
+func (h *TestHarness) ReleaseRequest(nodeID uint64, fh uint64) []byte {
+	in := fuse.ReleaseIn{Fh: fh}
+	return h.newRequest(opRelease, nodeID, unsafe.Pointer(&in), unsafe.Sizeof(in))
+}
+
+// NotifyReplyRequest returns the answer to the NOTIFY_RETRIEVE
+// query q, carrying data found at offset off.
+func (h *TestHarness) NotifyReplyRequest(q *fuse.NotifyRetrieveOut, off uint64, data []byte) []byte {
+	in := fuse.NotifyRetrieveIn{Offset: off, Size: uint32(len(data))}
+	req := h.newRequest(opNotifyReply, q.Nodeid, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	req = append(req, data...)
+	hdr := (*fuse.InHeader)(unsafe.Pointer(&req[0]))
+	hdr.Length = uint32(len(req))
+	hdr.Unique = q.NotifyUnique
+	return req
+}
+
+// expectsReply reports whether the server answers opcode.
+func expectsReply(opcode uint32) bool {
+	switch opcode {
+	case opForget, opBatchForget, opInterrupt, opNotifyReply:
+		return false
+	}
+	return true
+}
+
+// Send sends the request and waits for its reply, skipping
+// notifications. It returns nil for requests that have no reply,
+// such as FORGET. Requests must be sent one at a time.
+func (h *TestHarness) Send(req []byte) (*Reply, error) {
+	if len(req) < int(unsafe.Sizeof(fuse.InHeader{})) {
+		return nil, fmt.Errorf("request too short: %d bytes", len(req))
+	}
+	hdr := (*fuse.InHeader)(unsafe.Pointer(&req[0]))
+	if err := h.Write(req); err != nil {
+		return nil, err
+	}
+	if !expectsReply(hdr.Opcode) {
+		return nil, nil
+	}
+	for {
+		r, err := h.Read()
+		if err != nil {
+			return nil, err
+		}
+		if r.Unique == 0 {
+			// A notification.
+			continue
+		}
+		if r.Unique != hdr.Unique {
+			return nil, fmt.Errorf("got reply for unique %d, want %d", r.Unique, hdr.Unique)
+		}
+		return r, nil
+	}
+}
+
+// Write writes req, or a part of it on a stream, without waiting
+// for the reply. Use Read to collect the replies.
+func (h *TestHarness) Write(req []byte) error {
+	_, err := syscall.Write(h.fd, req)
+	if err != nil {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+// Read reads the next reply or notification from the server.
+func (h *TestHarness) Read() (*Reply, error) {
+	h.readMu.Lock()
+	defer h.readMu.Unlock()
+
+	var n int
+	var err error
+	if h.stream {
+		if err = h.readFull(h.buf[:sizeOfOutHeader]); err == nil {
+			n = int(*(*uint32)(unsafe.Pointer(&h.buf[0])))
+			if n < sizeOfOutHeader || n > len(h.buf) {
+				return nil, fmt.Errorf("bad reply length %d", n)
+			}
+			err = h.readFull(h.buf[sizeOfOutHeader:n])
+		}
+	} else {
+		n, err = syscall.Read(h.fd, h.buf)
+		if err != nil {
+			err = os.NewSyscallError("read", err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n < sizeOfOutHeader {
+		return nil, fmt.Errorf("short reply: %d bytes", n)
+	}
+	buf := append([]byte(nil), h.buf[:n]...)
+	r := &Reply{
+		OutHeader: *(*fuse.OutHeader)(unsafe.Pointer(&buf[0])),
+		Data:      buf[sizeOfOutHeader:],
+	}
+	if int(r.Length) != n {
+		return nil, fmt.Errorf("reply length %d does not match size %d", r.Length, n)
+	}
+	return r, nil
+}
+
+// readFull fills buf from the stream.
+func (h *TestHarness) readFull(buf []byte) error {
+	for len(buf) > 0 {
+		n, err := syscall.Read(h.fd, buf)
+		if err != nil {
+			return os.NewSyscallError("read", err)
+		}
+		if n == 0 {
+			return fmt.Errorf("read: unexpected EOF")
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
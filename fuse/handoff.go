@@ -0,0 +1,99 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// ServerState holds the outcome of the INIT handshake of a mount. It
+// is needed to continue serving the mount from another process with
+// NewServerFromFd, since the kernel only sends INIT once. It can be
+// serialized, eg. with encoding/json.
+type ServerState struct {
+	// KernelSettings is the INIT request of the kernel.
+	KernelSettings InitIn
+
+	// ServerSettings is the INIT reply that was sent back.
+	ServerSettings InitOut
+}
+
+// Handoff returns the FUSE device and the INIT state of the mount,
+// so another process can take over serving it with
+// NewServerFromFd. The typical use is daemonizing: the parent mounts
+// with NewServer, starts a child that inherits the fd (eg. through
+// exec.Cmd.ExtraFiles) and the state, and exits without calling
+// Serve or Unmount.
+//
+// Handoff fails once Serve was called: a reader blocked on the
+// device cannot be interrupted, and would steal requests from the
+// new process. The state only covers the connection, not the node
+// IDs handed out by the file system, so the new process should
+// start from a mount that has not served any requests, or use a
+// RawFileSystem that can resolve the node IDs of the old process.
+//
+// The fd remains owned by the Server; do not use the Server after
+// handing it off.
+func (ms *Server) Handoff() (fd int, state ServerState, err error) {
+	if ms.conn != nil {
+		return -1, state, fmt.Errorf("cannot hand off a socket server")
+	}
+	if ms.serving {
+		return -1, state, fmt.Errorf("cannot hand off a server after Serve")
+	}
+	state.KernelSettings = ms.kernelSettings
+	state.ServerSettings = ms.initOut
+	return ms.mountFd, state, nil
+}
+
+// NewServerFromFd creates a Server that continues serving the mount
+// on the FUSE device fd, as handed off by Server.Handoff in another
+// process. No INIT handshake takes place; instead, the negotiated
+// settings are taken from state. The mountPoint is only used by
+// Unmount, and may be empty if unknown. opts should match the
+// options of the original server; it fails if MaxWrite or MaxPages
+// are below the negotiated values.
+//
+// WaitMount returns immediately, since the mount is already up. Call
+// Serve to start serving requests.
+func NewServerFromFd(fs RawFileSystem, fd int, mountPoint string, state *ServerState, opts *MountOptions) (*Server, error) {
+	if state.ServerSettings.Major != _FUSE_KERNEL_VERSION {
+		return nil, fmt.Errorf("invalid server state: major version %d", state.ServerSettings.Major)
+	}
+	if err := checkFuseDevice(fd); err != nil {
+		return nil, err
+	}
+
+	ms := newServer(fs, opts)
+	if max := state.ServerSettings.MaxWrite; max > uint32(ms.opts.MaxWrite) {
+		return nil, fmt.Errorf("MaxWrite %d is below the negotiated %d", ms.opts.MaxWrite, max)
+	}
+	// Request buffers are sized from MaxPages, so smaller buffers
+	// would truncate large requests.
+	if max := int(state.ServerSettings.MaxPages); max > ms.opts.MaxPages {
+		return nil, fmt.Errorf("MaxPages %d is below the negotiated %d", ms.opts.MaxPages, max)
+	}
+	if mountPoint != "" {
+		mountPoint = filepath.Clean(mountPoint)
+	}
+	syscall.CloseOnExec(fd)
+	ms.mountPoint = mountPoint
+	ms.mountFd = fd
+	ms.kernelSettings = state.KernelSettings
+	ms.initOut = state.ServerSettings
+	ms.capabilities = state.ServerSettings.Flags64()
+	ms.resumed = true
+	close(ms.ready)
+
+	// As in NewServer, this prepares for Serve.
+	ms.loops.Add(1)
+	if ms.kernelSettings.Minor >= 13 {
+		ms.setSplice()
+	}
+	ms.fileSystem.Init(ms)
+	return ms, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"encoding/json"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// inoFS answers GETATTR for the root with a fixed inode number.
+type inoFS struct {
+	RawFileSystem
+	ino uint64
+}
+
+func (fs *inoFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Ino = fs.ino
+	out.Mode = S_IFDIR | 0755
+	return OK
+}
+
+func TestHandoff(t *testing.T) {
+	mnt := t.TempDir()
+	opts := &MountOptions{
+		Debug: testutil.VerboseTest(),
+	}
+	old, err := NewServer(&inoFS{NewDefaultRawFileSystem(), 1}, mnt, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, state, err := old.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff: %v", err)
+	}
+
+	// Pass the state as another process would get it.
+	data, err := json.Marshal(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var newState ServerState
+	if err := json.Unmarshal(data, &newState); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fd must be inherited, not shared.
+	newFd, err := syscall.Dup(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+
+	srv, err := NewServerFromFd(&inoFS{NewDefaultRawFileSystem(), 42}, newFd, mnt, &newState, opts)
+	if err != nil {
+		t.Fatalf("NewServerFromFd: %v", err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatalf("WaitMount: %v", err)
+	}
+	if got, want := *srv.ServerSettings(), state.ServerSettings; got != want {
+		t.Errorf("ServerSettings: got %v, want %v", &got, &want)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if st.Ino != 42 {
+		t.Errorf("got ino %d, want 42 from the new server", st.Ino)
+	}
+
+	if _, _, err := srv.Handoff(); err == nil {
+		t.Errorf("Handoff succeeded after Serve")
+	}
+}
+
+func TestNewServerFromFdBadState(t *testing.T) {
+	if _, err := NewServerFromFd(NewDefaultRawFileSystem(), 0, "", &ServerState{}, nil); err == nil {
+		t.Fatal("NewServerFromFd succeeded without INIT state")
+	}
+}
+
+func TestNewServerFromFdMaxPages(t *testing.T) {
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("open /dev/fuse: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	state := &ServerState{
+		ServerSettings: InitOut{Major: _FUSE_KERNEL_VERSION, MaxWrite: 4096, MaxPages: 256},
+	}
+	opts := &MountOptions{MaxWrite: 4096, MaxPages: 16}
+	if _, err := NewServerFromFd(NewDefaultRawFileSystem(), fd, "", state, opts); err == nil {
+		t.Fatal("NewServerFromFd accepted MaxPages below the negotiated value")
+	}
+}
@@ -0,0 +1,552 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/fusetest"
+)
+
+// harnessFS has a single file "file" (node 2) with content "hello".
+type harnessFS struct {
+	fuse.RawFileSystem
+}
+
+func (fs *harnessFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if header.NodeId != fuse.FUSE_ROOT_ID || name != "file" {
+		return fuse.ENOENT
+	}
+	out.NodeId = 2
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = 5
+	return fuse.OK
+}
+
+func (fs *harnessFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	out.Fh = 42
+	return fuse.OK
+}
+
+func (fs *harnessFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	data := []byte("hello")
+	if input.Fh != 42 {
+		return nil, fuse.EBADF
+	}
+	if input.Offset > uint64(len(data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	return fuse.ReadResultData(data[input.Offset:]), fuse.OK
+}
+
+func TestTestHarness(t *testing.T) {
+	h, err := fusetest.NewTestHarness(&harnessFS{fuse.NewDefaultRawFileSystem()}, nil)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	if s := h.Server().KernelSettings(); s.Major != 7 {
+		t.Errorf("KernelSettings: got major %d", s.Major)
+	}
+
+	r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "missing"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if r.Status() != fuse.ENOENT || len(r.Data) != 0 {
+		t.Errorf("LOOKUP missing: got %v, %d bytes", r.Status(), len(r.Data))
+	}
+
+	r, err = h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if e := r.EntryOut(); !r.Status().Ok() || e == nil || e.NodeId != 2 || e.Size != 5 {
+		t.Fatalf("LOOKUP file: got %v, %v", r.Status(), e)
+	}
+
+	r, err = h.Send(h.OpenRequest(2, 0))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	o := r.OpenOut()
+	if !r.Status().Ok() || o == nil || o.Fh != 42 {
+		t.Fatalf("OPEN: got %v, %v", r.Status(), o)
+	}
+
+	r, err = h.Send(h.ReadRequest(2, o.Fh, 1, 100))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !r.Status().Ok() || string(r.Data) != "ello" {
+		t.Errorf("READ: got %v, %q", r.Status(), r.Data)
+	}
+
+	// GETATTR is not implemented by harnessFS.
+	r, err = h.Send(h.GetAttrRequest(2))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if r.Status() != fuse.ENOSYS {
+		t.Errorf("GETATTR: got %v, want fuse.ENOSYS", r.Status())
+	}
+
+	if r, err := h.Send(h.ForgetRequest(2, 1)); err != nil || r != nil {
+		t.Errorf("FORGET: got %v, %v, want no reply", r, err)
+	}
+}
+
+// holeFS is harnessFS, but "file" is a hole.
+type holeFS struct {
+	harnessFS
+}
+
+func (fs *holeFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	return fuse.ReadResultZero(int(input.Size)), fuse.OK
+}
+
+func TestReadHole(t *testing.T) {
+	h, err := fusetest.NewTestHarness(&holeFS{harnessFS{fuse.NewDefaultRawFileSystem()}}, nil)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	r, err := h.Send(h.ReadRequest(2, 42, 0, 4096))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !r.Status().Ok() || !bytes.Equal(r.Data, make([]byte, 4096)) {
+		t.Errorf("READ: got %v, %d bytes", r.Status(), len(r.Data))
+	}
+}
+
+// readRetrieve reads the NOTIFY_RETRIEVE query that the server sent
+// to the harness.
+func readRetrieve(t *testing.T, h *fusetest.TestHarness) *fuse.NotifyRetrieveOut {
+	t.Helper()
+	r, err := h.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if r.Unique != 0 || r.Status() != fuse.NOTIFY_RETRIEVE_CACHE {
+		t.Fatalf("got unique %d code %d, want fuse.NOTIFY_RETRIEVE_CACHE", r.Unique, r.Status())
+	}
+	q := *(*fuse.NotifyRetrieveOut)(unsafe.Pointer(&r.Data[0]))
+	return &q
+}
+
+func TestInodeRetrieveCache(t *testing.T) {
+	h, err := fusetest.NewTestHarness(fuse.NewDefaultRawFileSystem(), nil)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	type result struct {
+		n  int
+		st fuse.Status
+	}
+	done := make(chan result, 1)
+	dest := make([]byte, 10)
+	go func() {
+		n, st := h.Server().InodeRetrieveCache(2, 3, dest)
+		done <- result{n, st}
+	}()
+
+	q := readRetrieve(t, h)
+	if q.Nodeid != 2 || q.Offset != 3 || q.Size != 10 {
+		t.Fatalf("got query %+v", q)
+	}
+
+	// The kernel answers with a NOTIFY_REPLY whose unique is
+	// the one of the query.
+	req := h.NotifyReplyRequest(q, q.Offset, []byte("hello"))
+	if _, err := h.Send(req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// The data ends at offset 8, so another query follows.
+	q = readRetrieve(t, h)
+	if q.Offset != 8 || q.Size != 5 {
+		t.Fatalf("got second query %+v", q)
+	}
+	req = h.NotifyReplyRequest(q, q.Offset, nil)
+	if _, err := h.Send(req); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	res := <-done
+	if res.n != 5 || !res.st.Ok() || string(dest[:5]) != "hello" {
+		t.Errorf("got %d, %v, %q", res.n, res.st, dest[:res.n])
+	}
+}
+
+func TestInodeRetrieveCacheTimeout(t *testing.T) {
+	h, err := fusetest.NewTestHarness(fuse.NewDefaultRawFileSystem(), &fuse.MountOptions{
+		RetrieveTimeout: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	done := make(chan fuse.Status, 1)
+	go func() {
+		_, st := h.Server().InodeRetrieveCache(2, 0, make([]byte, 10))
+		done <- st
+	}()
+	readRetrieve(t, h)
+	if st := <-done; st != fuse.Status(syscall.ETIMEDOUT) {
+		t.Errorf("got %v, want ETIMEDOUT", st)
+	}
+}
+
+// blockingFS blocks GETATTR until release is closed.
+type blockingFS struct {
+	fuse.RawFileSystem
+
+	release chan struct{}
+	forgets chan uint64
+
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (fs *blockingFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	fs.mu.Lock()
+	fs.active++
+	if fs.active > fs.maxSeen {
+		fs.maxSeen = fs.active
+	}
+	fs.mu.Unlock()
+
+	<-fs.release
+
+	fs.mu.Lock()
+	fs.active--
+	fs.mu.Unlock()
+	out.Mode = fuse.S_IFREG | 0644
+	return fuse.OK
+}
+
+func (fs *blockingFS) Forget(nodeid, nlookup uint64) {
+	fs.forgets <- nodeid
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	fs := &blockingFS{
+		RawFileSystem: fuse.NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+		forgets:       make(chan uint64, 1),
+	}
+	h, err := fusetest.NewTestHarness(fs, &fuse.MountOptions{MaxConcurrentRequests: 2})
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	const N = 5
+	for i := 0; i < N; i++ {
+		if err := h.Write(h.GetAttrRequest(fuse.FUSE_ROOT_ID)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Server().InflightRequests() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := h.Server().InflightRequests(); got != 2 {
+		t.Errorf("InflightRequests: got %d, want 2", got)
+	}
+
+	// Requests without reply bypass the queue.
+	if err := h.Write(h.ForgetRequest(7, 1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case id := <-fs.forgets:
+		if id != 7 {
+			t.Errorf("Forget: got node %d, want 7", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("FORGET was queued behind GETATTR")
+	}
+
+	close(fs.release)
+	for i := 0; i < N; i++ {
+		r, err := h.Read()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !r.Status().Ok() {
+			t.Errorf("GETATTR: %v", r.Status())
+		}
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.maxSeen != 2 {
+		t.Errorf("got %d concurrent GETATTRs, want 2", fs.maxSeen)
+	}
+}
+
+// orderFS records the order of GETATTR and READ calls. The first
+// GETATTR blocks until release is closed.
+type orderFS struct {
+	fuse.RawFileSystem
+
+	release chan struct{}
+
+	mu    sync.Mutex
+	order []string
+}
+
+func (fs *orderFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	fs.mu.Lock()
+	first := len(fs.order) == 0
+	fs.order = append(fs.order, "GETATTR")
+	fs.mu.Unlock()
+	if first {
+		<-fs.release
+	}
+	out.Mode = fuse.S_IFREG | 0644
+	return fuse.OK
+}
+
+func (fs *orderFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	fs.mu.Lock()
+	fs.order = append(fs.order, "READ")
+	fs.mu.Unlock()
+	return fuse.ReadResultData(nil), fuse.OK
+}
+
+func TestPrioritizeSyncRequests(t *testing.T) {
+	for _, prio := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prioritize=%v", prio), func(t *testing.T) {
+			fs := &orderFS{
+				RawFileSystem: fuse.NewDefaultRawFileSystem(),
+				release:       make(chan struct{}),
+			}
+			h, err := fusetest.NewTestHarness(fs, &fuse.MountOptions{
+				MaxConcurrentRequests:  1,
+				PrioritizeSyncRequests: prio,
+			})
+			if err != nil {
+				t.Fatalf("NewTestHarness: %v", err)
+			}
+			defer h.Close()
+
+			// Occupy the only slot, then queue two READs
+			// before a GETATTR.
+			reqs := [][]byte{
+				h.GetAttrRequest(fuse.FUSE_ROOT_ID),
+				h.ReadRequest(2, 1, 0, 10),
+				h.ReadRequest(2, 1, 10, 10),
+				h.GetAttrRequest(fuse.FUSE_ROOT_ID),
+			}
+			for _, r := range reqs {
+				if err := h.Write(r); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(fs.release)
+			for range reqs {
+				if _, err := h.Read(); err != nil {
+					t.Fatalf("read: %v", err)
+				}
+			}
+
+			want := []string{"GETATTR", "READ", "READ", "GETATTR"}
+			if prio {
+				want = []string{"GETATTR", "GETATTR", "READ", "READ"}
+			}
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+			if !reflect.DeepEqual(fs.order, want) {
+				t.Errorf("got order %v, want %v", fs.order, want)
+			}
+		})
+	}
+}
+
+// countingOpenFS counts the OPEN calls that reach the file system.
+type countingOpenFS struct {
+	harnessFS
+	opens int32
+}
+
+func (fs *countingOpenFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	atomic.AddInt32(&fs.opens, 1)
+	return fs.harnessFS.Open(cancel, input, out)
+}
+
+func TestRequestFilter(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	opts := &fuse.MountOptions{
+		RequestFilter: func(header *fuse.InHeader) fuse.Status {
+			name := fuse.OpcodeName(header.Opcode)
+			mu.Lock()
+			seen = append(seen, name)
+			mu.Unlock()
+			switch name {
+			case "LOOKUP":
+				return fuse.OK
+			case "FORGET", "BATCH_FORGET", "INTERRUPT", "NOTIFY_REPLY", "RELEASE", "RELEASEDIR":
+				t.Errorf("filter called for %s", name)
+			}
+			return fuse.EACCES
+		},
+	}
+	fs := &countingOpenFS{harnessFS: harnessFS{fuse.NewDefaultRawFileSystem()}}
+	h, err := fusetest.NewTestHarness(fs, opts)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Fatalf("LOOKUP: %v", r.Status())
+	}
+	if _, err := h.Send(h.ForgetRequest(2, 1)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	r, err = h.Send(h.OpenRequest(2, syscall.O_RDONLY))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if r.Status() != fuse.EACCES {
+		t.Errorf("OPEN: got %v, want fuse.EACCES", r.Status())
+	}
+	if n := atomic.LoadInt32(&fs.opens); n != 0 {
+		t.Errorf("file system saw %d OPEN calls, want 0", n)
+	}
+	// A failed RELEASE would leak the file handle.
+	r, err = h.Send(h.ReleaseRequest(2, 0))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Errorf("RELEASE: got %v, want OK", r.Status())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]bool{"LOOKUP": true, "OPEN": true}
+	for _, name := range seen {
+		delete(want, name)
+	}
+	if len(want) > 0 {
+		t.Errorf("filter did not see %v; got %v", want, seen)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	fs := &blockingFS{
+		RawFileSystem: fuse.NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+	}
+	h, err := fusetest.NewTestHarness(fs, nil)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	slow := h.GetAttrRequest(fuse.FUSE_ROOT_ID)
+	if err := h.Write(slow); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Server().InflightRequests() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.Server().Shutdown(context.Background())
+	}()
+
+	// New requests are refused once Shutdown has started. LOOKUP
+	// is not blocked by blockingFS.
+	for {
+		r, err := h.Send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		if r.Status() == fuse.Status(syscall.ENOTCONN) {
+			break
+		}
+		if r.Status() != fuse.ENOSYS {
+			t.Fatalf("LOOKUP: got %v, want ENOSYS or ENOTCONN", r.Status())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the slow request finished: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(fs.release)
+	r, err := h.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !r.Status().Ok() {
+		t.Errorf("slow GETATTR: got %v, want fuse.OK", r.Status())
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	fs := &blockingFS{
+		RawFileSystem: fuse.NewDefaultRawFileSystem(),
+		release:       make(chan struct{}),
+	}
+	h, err := fusetest.NewTestHarness(fs, nil)
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+	defer close(fs.release)
+
+	if err := h.Write(h.GetAttrRequest(fuse.FUSE_ROOT_ID)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Server().InflightRequests() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = h.Server().Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "abandoned 1 requests") {
+		t.Errorf("got %v, want 1 abandoned request", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"unsafe"
+)
+
+// OverflowID is the user or group ID that callers and file owners
+// without a mapping in an IDMap are translated to. This is the
+// default value of /proc/sys/kernel/overflowuid on Linux.
+const OverflowID = 65534
+
+// noID is the ID the kernel sends for requests without credentials.
+const noID = ^uint32(0)
+
+// IDMapRange maps a contiguous range of IDs, like a line of
+// /proc/PID/uid_map, or a triple passed to newuidmap(1).
+type IDMapRange struct {
+	// ID is the first ID in the range, as seen by the file
+	// system.
+	ID uint32
+
+	// HostID is the first ID in the range, as seen by the kernel
+	// and the processes accessing the mount.
+	HostID uint32
+
+	// Size is the number of IDs in the range.
+	Size uint32
+}
+
+// IDMap describes the translation of user and group IDs for
+// MountOptions.IDMap. IDs outside all ranges translate to
+// OverflowID. If UIDs (or GIDs) is empty, user (or group) IDs are
+// passed through unchanged.
+type IDMap struct {
+	UIDs []IDMapRange
+	GIDs []IDMapRange
+}
+
+// mapID translates id through ranges. If toHost is set, it maps
+// from file system to host IDs, otherwise the other way around.
+func mapID(ranges []IDMapRange, id uint32, toHost bool) (uint32, bool) {
+	if len(ranges) == 0 || id == noID {
+		return id, true
+	}
+	for _, r := range ranges {
+		from, to := r.HostID, r.ID
+		if toHost {
+			from, to = to, from
+		}
+		if id >= from && uint64(id) < uint64(from)+uint64(r.Size) {
+			return to + (id - from), true
+		}
+	}
+	return OverflowID, false
+}
+
+// toFS translates an owner from host to file system IDs.
+func (m *IDMap) toFS(o *Owner) bool {
+	var uidOK, gidOK bool
+	o.Uid, uidOK = mapID(m.UIDs, o.Uid, false)
+	o.Gid, gidOK = mapID(m.GIDs, o.Gid, false)
+	return uidOK && gidOK
+}
+
+// toHost translates an owner from file system to host IDs.
+func (m *IDMap) toHost(o *Owner) {
+	o.Uid, _ = mapID(m.UIDs, o.Uid, true)
+	o.Gid, _ = mapID(m.GIDs, o.Gid, true)
+}
+
+// mapRequest translates the IDs in the input of req for the file
+// system. Changing ownership to an ID without a mapping fails with
+// EINVAL, like chown(2) in a user namespace.
+func (m *IDMap) mapRequest(req *request) Status {
+	hdr := req.inHeader()
+	m.toFS(&hdr.Caller.Owner)
+	if hdr.Opcode != _OP_SETATTR {
+		return OK
+	}
+
+	in := (*SetAttrIn)(req.inData())
+	if in.Valid&FATTR_UID != 0 {
+		var ok bool
+		if in.Uid, ok = mapID(m.UIDs, in.Uid, false); !ok {
+			return EINVAL
+		}
+	}
+	if in.Valid&FATTR_GID != 0 {
+		var ok bool
+		if in.Gid, ok = mapID(m.GIDs, in.Gid, false); !ok {
+			return EINVAL
+		}
+	}
+	return OK
+}
+
+// mapReply translates the owners in the reply of req back to host
+// IDs.
+func (m *IDMap) mapReply(req *request) {
+	if !req.status.Ok() {
+		return
+	}
+	switch req.inHeader().Opcode {
+	case _OP_LOOKUP, _OP_MKNOD, _OP_MKDIR, _OP_SYMLINK, _OP_LINK,
+		_OP_CREATE, _OP_TMPFILE:
+		// CreateOut starts with an EntryOut.
+		m.toHost(&(*EntryOut)(req.outData()).Owner)
+	case _OP_GETATTR, _OP_SETATTR:
+		m.toHost(&(*AttrOut)(req.outData()).Owner)
+	case _OP_STATX:
+		out := (*StatxOut)(req.outData())
+		o := Owner{Uid: out.Uid, Gid: out.Gid}
+		m.toHost(&o)
+		out.Uid, out.Gid = o.Uid, o.Gid
+	case _OP_READDIRPLUS:
+		m.mapDirEntries(req.outPayload)
+	}
+}
+
+// mapDirEntries translates the owners in a READDIRPLUS reply, as
+// produced by DirEntryList.AddDirLookupEntry.
+func (m *IDMap) mapDirEntries(buf []byte) {
+	const entryOutSize = int(unsafe.Sizeof(EntryOut{}))
+	for len(buf) >= entryOutSize+direntSize {
+		m.toHost(&(*EntryOut)(unsafe.Pointer(&buf[0])).Owner)
+		dirent := (*_Dirent)(unsafe.Pointer(&buf[entryOutSize]))
+		nameLen := int(dirent.NameLen)
+		n := entryOutSize + direntSize + nameLen + (8-nameLen&7)&7
+		if n > len(buf) {
+			return
+		}
+		buf = buf[n:]
+	}
+}
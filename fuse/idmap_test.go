@@ -0,0 +1,163 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse_test
+
+import (
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/fusetest"
+)
+
+// idmapFS serves "file" (node 2), owned by file system IDs 1/1,
+// and records the caller and the owner passed to SETATTR.
+type idmapFS struct {
+	fuse.RawFileSystem
+
+	mu     sync.Mutex
+	caller fuse.Owner
+	chown  fuse.Owner
+}
+
+func (fs *idmapFS) record(c *fuse.Caller) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.caller = c.Owner
+}
+
+func (fs *idmapFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	fs.record(&header.Caller)
+	out.NodeId = 2
+	out.Mode = fuse.S_IFREG | 0644
+	out.Owner = fuse.Owner{Uid: 1, Gid: 1}
+	return fuse.OK
+}
+
+func (fs *idmapFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	fs.record(&input.Caller)
+	out.Mode = fuse.S_IFREG | 0644
+	// Not in the map.
+	out.Owner = fuse.Owner{Uid: 70000, Gid: 70000}
+	return fuse.OK
+}
+
+func (fs *idmapFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	fs.record(&input.Caller)
+	fs.mu.Lock()
+	fs.chown = input.Owner
+	fs.mu.Unlock()
+	out.Mode = fuse.S_IFREG | 0644
+	out.Owner = input.Owner
+	return fuse.OK
+}
+
+func (fs *idmapFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	fs.record(&input.Caller)
+	for i, name := range []string{"a", "bcdefghij"} {
+		e := out.AddDirLookupEntry(fuse.DirEntry{Name: name, Mode: fuse.S_IFREG, Ino: uint64(i + 2)})
+		e.NodeId = uint64(i + 2)
+		e.Owner = fuse.Owner{Uid: uint32(i), Gid: uint32(i)}
+	}
+	return fuse.OK
+}
+
+func TestIDMap(t *testing.T) {
+	fs := &idmapFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	h, err := fusetest.NewTestHarness(fs, &fuse.MountOptions{
+		IDMap: &fuse.IDMap{
+			UIDs: []fuse.IDMapRange{{ID: 0, HostID: 100000, Size: 65536}},
+			GIDs: []fuse.IDMapRange{{ID: 0, HostID: 200000, Size: 65536}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewTestHarness: %v", err)
+	}
+	defer h.Close()
+
+	send := func(req []byte) *fusetest.Reply {
+		t.Helper()
+		r, err := h.Send(req)
+		if err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		return r
+	}
+	checkCaller := func(want fuse.Owner) {
+		t.Helper()
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if fs.caller != want {
+			t.Errorf("caller: got %v, want %v", fs.caller, want)
+		}
+	}
+
+	// A mapped caller.
+	h.SetCaller(fuse.Caller{Owner: fuse.Owner{Uid: 100002, Gid: 200003}})
+	r := send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	if !r.Status().Ok() {
+		t.Fatalf("LOOKUP: %v", r.Status())
+	}
+	checkCaller(fuse.Owner{Uid: 2, Gid: 3})
+	if got, want := r.EntryOut().Owner, (fuse.Owner{Uid: 100001, Gid: 200001}); got != want {
+		t.Errorf("LOOKUP owner: got %v, want %v", got, want)
+	}
+
+	// File owners without a mapping are reported as the overflow ID.
+	r = send(h.GetAttrRequest(2))
+	if got, want := r.AttrOut().Owner, (fuse.Owner{Uid: fuse.OverflowID, Gid: fuse.OverflowID}); !r.Status().Ok() || got != want {
+		t.Errorf("GETATTR: got %v, %v, want owner %v", r.Status(), got, want)
+	}
+
+	r = send(h.SetAttrRequest(2, fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_UID | fuse.FATTR_GID,
+		Owner: fuse.Owner{Uid: 100005, Gid: 200006},
+	}}))
+	if !r.Status().Ok() {
+		t.Fatalf("SETATTR: %v", r.Status())
+	}
+	fs.mu.Lock()
+	if want := (fuse.Owner{Uid: 5, Gid: 6}); fs.chown != want {
+		t.Errorf("SETATTR: file system got owner %v, want %v", fs.chown, want)
+	}
+	fs.mu.Unlock()
+	if got, want := r.AttrOut().Owner, (fuse.Owner{Uid: 100005, Gid: 200006}); got != want {
+		t.Errorf("SETATTR owner: got %v, want %v", got, want)
+	}
+
+	// Changing to an unmapped owner is refused.
+	r = send(h.SetAttrRequest(2, fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_UID,
+		Owner: fuse.Owner{Uid: 1000},
+	}}))
+	if r.Status() != fuse.EINVAL {
+		t.Errorf("SETATTR unmapped: got %v, want fuse.EINVAL", r.Status())
+	}
+
+	r = send(h.ReadDirPlusRequest(fuse.FUSE_ROOT_ID, 0, 0, 4096))
+	if !r.Status().Ok() {
+		t.Fatalf("READDIRPLUS: %v", r.Status())
+	}
+	var owners []fuse.Owner
+	buf := r.Data
+	// Each entry is an EntryOut, then a struct fuse_dirent: ino,
+	// off, namelen and type, followed by the padded name.
+	const entryOutSize = int(unsafe.Sizeof(fuse.EntryOut{}))
+	const direntSize = 24
+	for len(buf) > 0 {
+		owners = append(owners, (*fuse.EntryOut)(unsafe.Pointer(&buf[0])).Owner)
+		nameLen := int(*(*uint32)(unsafe.Pointer(&buf[entryOutSize+16])))
+		buf = buf[entryOutSize+direntSize+nameLen+(8-nameLen&7)&7:]
+	}
+	if len(owners) != 2 || owners[0] != (fuse.Owner{Uid: 100000, Gid: 200000}) || owners[1] != (fuse.Owner{Uid: 100001, Gid: 200001}) {
+		t.Errorf("READDIRPLUS owners: got %v", owners)
+	}
+
+	// An unmapped caller is seen as the overflow ID.
+	h.SetCaller(fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	send(h.LookupRequest(fuse.FUSE_ROOT_ID, "file"))
+	checkCaller(fuse.Owner{Uid: fuse.OverflowID, Gid: fuse.OverflowID})
+}
@@ -6,8 +6,10 @@ package fuse
 
 import (
 	"os"
+	"reflect"
 	"syscall"
 	"testing"
+	"unsafe"
 )
 
 func TestToStatus(t *testing.T) {
@@ -28,3 +30,81 @@ func TestToStatus(t *testing.T) {
 		t.Errorf("Wrong conversion %v != %v", errNo, syscall.ENOENT)
 	}
 }
+
+type removeMappingFS struct {
+	defaultRawFileSystem
+
+	got []RemoveMappingOne
+}
+
+func (fs *removeMappingFS) RemoveMapping(cancel <-chan struct{}, in *RemoveMappingIn, mappings []RemoveMappingOne) Status {
+	fs.got = append(fs.got, mappings...)
+	return OK
+}
+
+func TestRemoveMappingDecode(t *testing.T) {
+	want := []RemoveMappingOne{{Moffset: 4096, Len: 8192}, {Moffset: 1 << 21, Len: 1 << 21}}
+
+	// fuse_removemapping_in is InHeader plus a uint32, and the
+	// entries follow it without padding.
+	hdrSize := int(unsafe.Sizeof(InHeader{}))
+	entSize := int(unsafe.Sizeof(RemoveMappingOne{}))
+	buf := make([]byte, hdrSize+4+len(want)*entSize)
+	hdr := (*InHeader)(unsafe.Pointer(&buf[0]))
+	hdr.Length = uint32(len(buf))
+	hdr.Opcode = _OP_REMOVEMAPPING
+	*(*uint32)(unsafe.Pointer(&buf[hdrSize])) = uint32(len(want))
+	for i, m := range want {
+		*(*RemoveMappingOne)(unsafe.Pointer(&buf[hdrSize+4+i*entSize])) = m
+	}
+
+	h, inSize, _, _, code := parseRequest(buf, nil)
+	if !code.Ok() {
+		t.Fatalf("parseRequest: %v", code)
+	}
+	if inSize != hdrSize+4 {
+		t.Fatalf("got inSize %d, want %d", inSize, hdrSize+4)
+	}
+
+	fs := &removeMappingFS{}
+	req := &request{
+		inputBuf:  buf[:inSize],
+		inPayload: buf[inSize:],
+	}
+	h.Func(&protocolServer{fileSystem: fs, opts: &MountOptions{}}, req)
+	if !req.status.Ok() {
+		t.Fatalf("RemoveMapping: %v", req.status)
+	}
+	if !reflect.DeepEqual(fs.got, want) {
+		t.Errorf("got %v, want %v", fs.got, want)
+	}
+}
+
+func TestRetryMount(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		errs  []error
+		calls int
+		fail  bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"transient", []error{syscall.EBUSY, syscall.EAGAIN, nil}, 3, false},
+		{"permanent", []error{syscall.EPERM, nil}, 1, true},
+		{"exhausted", []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY}, 4, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			_, err := retryMount(&MountOptions{MountRetries: 3}, func() (int, error) {
+				err := tc.errs[calls]
+				calls++
+				return 0, err
+			})
+			if calls != tc.calls {
+				t.Errorf("got %d calls, want %d", calls, tc.calls)
+			}
+			if (err != nil) != tc.fail {
+				t.Errorf("got err %v, want failure %v", err, tc.fail)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package fuse
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"syscall"
+	"time"
 )
 
 var reservedFDs []*os.File
@@ -31,6 +33,18 @@ func init() {
 	}
 }
 
+// checkFuseDevice returns an error if fd is not an open FUSE device.
+func checkFuseDevice(fd int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("fstat(%d): %v", fd, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || !isFuseDevice(&st) {
+		return fmt.Errorf("fd %d is not a FUSE device", fd)
+	}
+	return nil
+}
+
 func getConnection(local *os.File) (int, error) {
 	conn, err := net.FileConn(local)
 	if err != nil {
@@ -70,3 +84,43 @@ func getConnection(local *os.File) (int, error) {
 	}
 	return fd, nil
 }
+
+// checkMountHelper returns an error if the mount helper configured
+// in MountOptions.FusermountPath is not an executable file.
+func checkMountHelper(path string) (string, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("FusermountPath: %v", err)
+	}
+	if !st.Mode().IsRegular() || st.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("FusermountPath: %q is not an executable file", path)
+	}
+	return path, nil
+}
+
+// retryMount calls mountFn, and retries it up to
+// opts.MountRetries times, with exponential backoff, if it fails
+// with a transient error. It returns the last error if all
+// attempts fail.
+func retryMount(opts *MountOptions, mountFn func() (int, error)) (int, error) {
+	delay := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		fd, err := mountFn()
+		if err == nil || i >= opts.MountRetries || !isTransientMountError(err) {
+			return fd, err
+		}
+		if opts.Debug {
+			opts.Logger.Printf("mount: attempt %d failed, retrying in %v: %v", i+1, delay, err)
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+// isTransientMountError returns true for mount errors that may go
+// away when trying again, eg. because the mount point is busy.
+func isTransientMountError(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN)
+}
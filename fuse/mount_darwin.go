@@ -39,7 +39,7 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	defer local.Close()
 	defer remote.Close()
 
-	bin, err := fusermountBinary()
+	bin, err := fusermountBinary(opts)
 	if err != nil {
 		return 0, err
 	}
@@ -98,7 +98,10 @@ func unmount(dir string, opts *MountOptions) error {
 	return syscall.Unmount(dir, 0)
 }
 
-func fusermountBinary() (string, error) {
+func fusermountBinary(opts *MountOptions) (string, error) {
+	if opts.FusermountPath != "" {
+		return checkMountHelper(opts.FusermountPath)
+	}
 	binPaths := []string{
 		"/Library/Filesystems/macfuse.fs/Contents/Resources/mount_macfuse",
 		"/Library/Filesystems/osxfuse.fs/Contents/Resources/mount_osxfuse",
@@ -112,3 +115,7 @@ func fusermountBinary() (string, error) {
 
 	return "", fmt.Errorf("no FUSE mount utility found")
 }
+
+func isFuseDevice(st *syscall.Stat_t) bool {
+	return true
+}
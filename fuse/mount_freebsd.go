@@ -12,7 +12,7 @@ func getMaxWrite() int {
 }
 
 func callMountFuseFs(mountPoint string, opts *MountOptions) (devFuseFd int, err error) {
-	bin, err := fusermountBinary()
+	bin, err := fusermountBinary(opts)
 	if err != nil {
 		return -1, err
 	}
@@ -88,7 +88,7 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	// Note: opts.DirectMount is not supported in FreeBSD, but the intended
 	// behavior is to *attempt* a direct mount when it's set, not to return an
 	// error. So in this case, we just ignore it and use the binary from
-	// fusermountBinary().
+	// fusermountBinary(opts).
 
 	// Using the same logic from libfuse to prevent chaos
 	for {
@@ -131,7 +131,10 @@ func unmount(mountPoint string, opts *MountOptions) (err error) {
 	return syscall.Unmount(mountPoint, 0)
 }
 
-func fusermountBinary() (string, error) {
+func fusermountBinary(opts *MountOptions) (string, error) {
+	if opts.FusermountPath != "" {
+		return checkMountHelper(opts.FusermountPath)
+	}
 	binPaths := []string{
 		"/sbin/mount_fusefs",
 	}
@@ -144,3 +147,7 @@ func fusermountBinary() (string, error) {
 
 	return "", fmt.Errorf("no FUSE mount utility found")
 }
+
+func isFuseDevice(st *syscall.Stat_t) bool {
+	return true
+}
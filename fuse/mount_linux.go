@@ -7,12 +7,15 @@ package fuse
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func unixgramSocketpair() (l, r *os.File, err error) {
@@ -31,7 +34,7 @@ func unixgramSocketpair() (l, r *os.File, err error) {
 func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, err error) {
 	fd, err = syscall.Open("/dev/fuse", os.O_RDWR, 0) // use syscall.Open since we want an int fd
 	if err != nil {
-		return
+		return -1, fmt.Errorf("open /dev/fuse: %w", err)
 	}
 
 	// managed to open dev/fuse, attempt to mount
@@ -93,7 +96,7 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	if opts.AllowOther {
 		r = append(r, "allow_other")
 	}
-	if opts.IDMappedMount && !opts.containsOption("default_permissions") {
+	if opts.needsDefaultPermissions() {
 		r = append(r, "default_permissions")
 	}
 
@@ -104,7 +107,10 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	err = syscall.Mount(source, mountPoint, "fuse."+opts.Name, flags, strings.Join(r, ","))
 	if err != nil {
 		syscall.Close(fd)
-		return
+		if err == syscall.EPERM {
+			return -1, fmt.Errorf("mount(2): %w (%s)", err, directMountEPERMReason())
+		}
+		return -1, fmt.Errorf("mount(2): %w", err)
 	}
 
 	// success
@@ -112,6 +118,96 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	return
 }
 
+// directMountEPERMReason explains why mount(2) may have failed with
+// EPERM. Unprivileged users can mount FUSE file systems in a user
+// namespace (Linux 4.18 and newer), provided they also created a
+// mount namespace from within it, like "unshare -Urm" does.
+func directMountEPERMReason() string {
+	userns := inUserNamespace()
+	switch {
+	case !hasCapSysAdmin() && !userns:
+		return "CAP_SYS_ADMIN is required; unprivileged users must mount from a user namespace"
+	case !hasCapSysAdmin():
+		return "CAP_SYS_ADMIN is required in the user namespace"
+	case userns && !kernelAtLeast(4, 18):
+		return "mounting FUSE in a user namespace requires Linux 4.18 or newer"
+	case userns:
+		return "the mount namespace must be owned by the current user namespace"
+	}
+	return "permission denied by the kernel"
+}
+
+// inUserNamespace returns true if the process does not run in the
+// initial user namespace, whose uid_map covers all uids.
+func inUserNamespace() bool {
+	data, err := os.ReadFile("/proc/self/uid_map")
+	if err != nil {
+		return false
+	}
+	return strings.Join(strings.Fields(string(data)), " ") != "0 0 4294967295"
+}
+
+// hasCapSysAdmin returns true if CAP_SYS_ADMIN is in the effective
+// capability set of the process.
+func hasCapSysAdmin() bool {
+	data, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(l, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(l[len("CapEff:"):]), 16, 64)
+		return err == nil && caps&(1<<unix.CAP_SYS_ADMIN) != 0
+	}
+	return false
+}
+
+// kernelAtLeast returns true if the running kernel is at least
+// version major.minor.
+func kernelAtLeast(major, minor int) bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	release := string(uts.Release[:bytes.IndexByte(uts.Release[:], 0)])
+	var maj, min int
+	if _, err := fmt.Sscanf(release, "%d.%d", &maj, &min); err != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
+
+// fusermountError is returned if fusermount fails. If its output
+// was captured, the errno it reports can be found with errors.Is.
+type fusermountError struct {
+	status string
+	stderr string
+}
+
+func (e *fusermountError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("fusermount exited with code %s\n", e.status)
+	}
+	return fmt.Sprintf("fusermount exited with code %s: %s", e.status, e.stderr)
+}
+
+// Unwrap returns the errno whose message fusermount printed, or nil.
+func (e *fusermountError) Unwrap() error {
+	// Go's messages are the lowercased strerror(3) ones.
+	msg := strings.ToLower(e.stderr)
+	for _, errno := range []syscall.Errno{
+		syscall.EBUSY, syscall.EAGAIN, syscall.EPERM, syscall.EACCES,
+		syscall.ENOENT, syscall.ENOTDIR, syscall.ENODEV, syscall.EINVAL,
+	} {
+		if strings.Contains(msg, errno.Error()) {
+			return errno
+		}
+	}
+	return nil
+}
+
 // callFusermount calls the `fusermount` suid helper with the right options so
 // that it:
 // * opens `/dev/fuse`
@@ -127,7 +223,7 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 	defer local.Close()
 	defer remote.Close()
 
-	bin, err := fusermountBinary()
+	bin, err := fusermountBinary(opts)
 	if err != nil {
 		return 0, err
 	}
@@ -139,12 +235,37 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 	if opts.Debug {
 		opts.Logger.Printf("callFusermount: executing %q", cmd)
 	}
+
+	// To decide whether a failure is worth retrying, we need
+	// the error message, so tee stderr.
+	stderr := os.Stderr
+	var errBuf bytes.Buffer
+	var errDone chan struct{}
+	if opts.MountRetries > 0 {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return -1, err
+		}
+		defer w.Close()
+		errDone = make(chan struct{})
+		go func() {
+			// With auto_unmount, fusermount leaves a child
+			// holding stderr, so this may outlive the mount.
+			io.Copy(io.MultiWriter(os.Stderr, &errBuf), r)
+			r.Close()
+			close(errDone)
+		}()
+		stderr = w
+	}
+
 	proc, err := os.StartProcess(bin,
 		cmd,
 		&os.ProcAttr{
 			Env:   []string{"_FUSE_COMMFD=3"},
-			Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, remote}})
-
+			Files: []*os.File{os.Stdin, os.Stdout, stderr, remote}})
+	if stderr != os.Stderr {
+		stderr.Close()
+	}
 	if err != nil {
 		return
 	}
@@ -154,8 +275,12 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 		return
 	}
 	if !w.Success() {
-		err = fmt.Errorf("fusermount exited with code %v\n", w.Sys())
-		return
+		fmErr := &fusermountError{status: fmt.Sprint(w.Sys())}
+		if errDone != nil {
+			<-errDone
+			fmErr.stderr = errBuf.String()
+		}
+		return -1, fmErr
 	}
 
 	fd, err = getConnection(local)
@@ -215,7 +340,7 @@ func unmount(mountPoint string, opts *MountOptions) (err error) {
 		}
 	}
 
-	bin, err := fusermountBinary()
+	bin, err := fusermountBinary(opts)
 	if err != nil {
 		return err
 	}
@@ -245,9 +370,13 @@ func lookPathFallback(file string, fallbackDir string) (string, error) {
 	return exec.LookPath(abs)
 }
 
-// fusermountBinary returns the path to the `fusermount3` binary, or, if not
-// found, the `fusermount` binary.
-func fusermountBinary() (string, error) {
+// fusermountBinary returns opts.FusermountPath if set. Otherwise, it
+// returns the path to the `fusermount3` binary, or, if not found, the
+// `fusermount` binary.
+func fusermountBinary(opts *MountOptions) (string, error) {
+	if opts.FusermountPath != "" {
+		return checkMountHelper(opts.FusermountPath)
+	}
 	if path, err := lookPathFallback("fusermount3", "/bin"); err == nil {
 		return path, nil
 	}
@@ -277,3 +406,9 @@ func maxPageLimit() (lim int) {
 
 	return newLim
 }
+
+// isFuseDevice checks for the /dev/fuse device numbers (10, 229).
+func isFuseDevice(st *syscall.Stat_t) bool {
+	rdev := uint64(st.Rdev)
+	return unix.Major(rdev) == 10 && unix.Minor(rdev) == 229
+}
@@ -1,8 +1,11 @@
 package fuse
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -64,6 +67,60 @@ func TestMountDevFd(t *testing.T) {
 	}
 }
 
+// TestMountDeviceFd is like TestMountDevFd, but passes the fd through
+// MountOptions.DeviceFd.
+func TestMountDeviceFd(t *testing.T) {
+	realMountPoint := t.TempDir()
+
+	var fuOpts MountOptions
+	fd, err := callFusermount(realMountPoint, &fuOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := NewDefaultRawFileSystem()
+	opts := MountOptions{
+		Debug:    testutil.VerboseTest(),
+		DeviceFd: fd,
+	}
+	srv, err := NewServer(fs, realMountPoint, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	err = syscall.Stat(realMountPoint, &st)
+	if err != syscall.ENOSYS {
+		t.Errorf("expected ENOSYS, got %v", err)
+	}
+
+	// We did not mount, so we should not unmount either.
+	if err := srv.Unmount(); err == nil {
+		t.Error("Unmount succeeded for DeviceFd mount")
+	}
+	if err := unmount(realMountPoint, &fuOpts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeviceFdNotFuse(t *testing.T) {
+	f, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = NewServer(NewDefaultRawFileSystem(), "/mnt", &MountOptions{DeviceFd: int(f.Fd())})
+	if err == nil {
+		t.Fatal("NewServer succeeded on a directory fd")
+	}
+}
+
 // TestMountMaxWrite makes sure that mounting works with all MaxWrite settings.
 // We used to fail with EINVAL below 8k because readPool got too small.
 func TestMountMaxWrite(t *testing.T) {
@@ -95,6 +152,31 @@ func TestMountMaxWrite(t *testing.T) {
 	}
 }
 
+// TestMountMaxPages checks that MaxPages is capped at the kernel limit.
+func TestMountMaxPages(t *testing.T) {
+	limit := maxPageLimit()
+	for _, maxPages := range []int{0, 1, 32, limit, limit + 1} {
+		t.Run(fmt.Sprintf("MaxPages%d", maxPages), func(t *testing.T) {
+			mnt := t.TempDir()
+			fs := NewDefaultRawFileSystem()
+			srv, err := NewServer(fs, mnt, &MountOptions{MaxPages: maxPages})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve()
+			defer srv.Unmount()
+
+			got := srv.MaxPages()
+			if got <= 0 || got > limit {
+				t.Errorf("got MaxPages %d, want in range [1, %d]", got, limit)
+			}
+			if maxPages > 0 && maxPages <= limit && srv.KernelSettings().Flags64()&CAP_MAX_PAGES != 0 && got != maxPages {
+				t.Errorf("got MaxPages %d, want %d", got, maxPages)
+			}
+		})
+	}
+}
+
 // mountCheckOptions mounts a defaultRawFileSystem and extracts the resulting effective
 // mount options from /proc/self/mounts.
 // The mount options are a comma-separated string like this:
@@ -156,6 +238,9 @@ func TestDirectMount(t *testing.T) {
 		{Options: []string{"noexec"}},
 		{Options: []string{"exec", "noexec"}},
 		{Options: []string{"noexec", "exec"}},
+
+		{DefaultPermissions: true},
+		{DefaultPermissions: true, Options: []string{"default_permissions"}},
 	}
 	for _, opts := range optsTable {
 		opts.Debug = testutil.VerboseTest()
@@ -173,6 +258,9 @@ fusermount:  %#v`, o2, o1)
 			// Skip it for less noise in the logs.
 			continue
 		}
+		if opts.DefaultPermissions && !strings.Contains(o1.VFSOptions, "default_permissions") {
+			t.Errorf("DefaultPermissions: got super options %q, want default_permissions", o1.VFSOptions)
+		}
 		if os.Geteuid() == 0 {
 			// With DirectMountStrict
 			opts.DirectMountStrict = true
@@ -186,6 +274,40 @@ fusermount:        %#v`, o3, o1)
 	}
 }
 
+// TestMountFsName checks that FsName and Name show up as the source
+// and file system type in /proc/self/mountinfo.
+func TestMountFsName(t *testing.T) {
+	for _, tc := range []struct {
+		opts       MountOptions
+		wantSource string
+		wantType   string
+	}{
+		{MountOptions{FsName: "myfs", Name: "mytype"}, "myfs", "fuse.mytype"},
+		{MountOptions{Name: "onlytype"}, "onlytype", "fuse.onlytype"},
+	} {
+		modes := map[string]MountOptions{}
+		opts := tc.opts
+		modes["fusermount"] = opts
+		opts.DirectMount = true
+		modes["DirectMount"] = opts
+		if os.Geteuid() == 0 {
+			opts.DirectMountStrict = true
+			modes["DirectMountStrict"] = opts
+		}
+		for mode, opts := range modes {
+			t.Run(tc.wantSource+"/"+mode, func(t *testing.T) {
+				info := mountCheckOptions(t, opts)
+				if info.Source != tc.wantSource {
+					t.Errorf("got source %q, want %q", info.Source, tc.wantSource)
+				}
+				if info.FSType != tc.wantType {
+					t.Errorf("got fstype %q, want %q", info.FSType, tc.wantType)
+				}
+			})
+		}
+	}
+}
+
 // TestDirectMountDevSuid checks that [no]dev/suid works with DirectMount and DirectMountStrict
 // and show the same effective mount options in /proc/self/mounts
 func TestDirectMountDevSuid(t *testing.T) {
@@ -261,3 +383,187 @@ func TestEscapedMountOption(t *testing.T) {
 		t.Errorf("mountinfo(%q): got %q want %q", mnt, m.Source, fsname)
 	}
 }
+
+func TestFusermountErrorTransient(t *testing.T) {
+	for stderr, want := range map[string]bool{
+		"fusermount3: mount failed: Device or resource busy\n":                     true,
+		"fusermount3: mount failed: Operation not permitted\n":                     false,
+		"fusermount3: failed to access mountpoint /x: No such file or directory\n": false,
+		"": false,
+	} {
+		err := &fusermountError{status: "1", stderr: stderr}
+		if got := isTransientMountError(err); got != want {
+			t.Errorf("%q: got transient %v, want %v", stderr, got, want)
+		}
+	}
+}
+
+// TestFusermountPath checks that a configured mount helper is used
+// for both mounting and unmounting.
+func TestFusermountPath(t *testing.T) {
+	dir := t.TempDir()
+	log := dir + "/log"
+	helper := dir + "/helper"
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\nexit 1\n", log)
+	if err := os.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + "/mnt"
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &MountOptions{FusermountPath: helper}
+	if _, err := NewServer(NewDefaultRawFileSystem(), mnt, opts); err == nil {
+		t.Fatal("NewServer succeeded with a failing helper")
+	}
+	if err := unmount(mnt, opts); err == nil {
+		t.Fatal("unmount succeeded with a failing helper")
+	}
+	got, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+	if len(lines) != 2 || strings.Fields(lines[0])[0] != mnt || lines[1] != "-u "+mnt {
+		t.Errorf("helper called with %q", lines)
+	}
+
+	for _, bad := range []string{dir + "/nonexistent", log, dir} {
+		opts := &MountOptions{FusermountPath: bad}
+		if _, err := NewServer(NewDefaultRawFileSystem(), mnt, opts); err == nil || !strings.Contains(err.Error(), "FusermountPath") {
+			t.Errorf("%s: got error %v, want FusermountPath error", bad, err)
+		}
+	}
+}
+
+// userNSMountEnv carries the mount point to the child process of
+// TestDirectMountUserNamespace.
+const userNSMountEnv = "GO_FUSE_TEST_USERNS_MOUNT"
+
+// TestDirectMountUserNamespace re-executes the test binary in a new
+// user and mount namespace, and checks that DirectMountStrict works
+// there without privileges.
+func TestDirectMountUserNamespace(t *testing.T) {
+	if mnt := os.Getenv(userNSMountEnv); mnt != "" {
+		srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{DirectMountStrict: true})
+		if err != nil {
+			t.Fatalf("NewServer in user namespace: %v", err)
+		}
+		go srv.Serve()
+		if err := srv.WaitMount(); err != nil {
+			t.Fatalf("WaitMount: %v", err)
+		}
+		if err := srv.Unmount(); err != nil {
+			t.Fatalf("Unmount: %v", err)
+		}
+		return
+	}
+
+	if !kernelAtLeast(4, 18) {
+		t.Skip("FUSE in user namespaces needs Linux 4.18")
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		t.Skipf("no FUSE device: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDirectMountUserNamespace$", "-test.v")
+	cmd.Env = append(os.Environ(), userNSMountEnv+"="+t.TempDir())
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Skipf("cannot create user namespace: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+func TestDirectMountEPERMReason(t *testing.T) {
+	if r := directMountEPERMReason(); r == "" {
+		t.Error("got empty reason")
+	}
+	if !kernelAtLeast(2, 6) {
+		t.Error("kernelAtLeast(2, 6) = false")
+	}
+	if kernelAtLeast(1000, 0) {
+		t.Error("kernelAtLeast(1000, 0) = true")
+	}
+}
+
+// hangingOpenDirFS blocks in OpenDir until the request is canceled.
+type hangingOpenDirFS struct {
+	RawFileSystem
+	called   chan struct{}
+	canceled chan struct{}
+}
+
+func (fs *hangingOpenDirFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Mode = S_IFDIR | 0755
+	return OK
+}
+
+func (fs *hangingOpenDirFS) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	close(fs.called)
+	<-cancel
+	close(fs.canceled)
+	return EINTR
+}
+
+func TestServeAbort(t *testing.T) {
+	fs := &hangingOpenDirFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		called:        make(chan struct{}),
+		canceled:      make(chan struct{}),
+	}
+	mnt := t.TempDir()
+	srv, err := NewServer(fs, mnt, &MountOptions{Debug: testutil.VerboseTest()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		srv.Serve()
+		serveErr <- srv.Err()
+	}()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Capabilities()&CAP_ABORT_ERROR == 0 {
+		t.Skip("kernel does not support CAP_ABORT_ERROR")
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	openErr := make(chan error, 1)
+	go func() {
+		fd, err := syscall.Open(mnt, syscall.O_DIRECTORY, 0)
+		if err == nil {
+			syscall.Close(fd)
+		}
+		openErr <- err
+	}()
+	<-fs.called
+
+	if err := os.WriteFile(fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", st.Dev), []byte{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-openErr; err != syscall.ECONNABORTED {
+		t.Errorf("opendir: got %v, want ECONNABORTED", err)
+	}
+	<-fs.canceled
+
+	if err := <-serveErr; !errors.Is(err, ErrConnectionAborted) {
+		t.Errorf("Err: got %v, want ErrConnectionAborted", err)
+	}
+	if err := srv.Unmount(); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+}
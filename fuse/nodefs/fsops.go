@@ -504,10 +504,34 @@ func (fs *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.L
 	return fuse.ENOSYS
 }
 
+func (fs *rawBridge) Tmpfile(cancel <-chan struct{}, in *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) Bmap(cancel <-chan struct{}, in *fuse.BmapIn, out *fuse.BmapOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (fs *rawBridge) Statx(cancel <-chan struct{}, in *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
 	return fuse.ENOSYS
 }
 
+func (fs *rawBridge) SyncFs(cancel <-chan struct{}, in *fuse.SyncFsIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) SetupMapping(cancel <-chan struct{}, in *fuse.SetupMappingIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (fs *rawBridge) RemoveMapping(cancel <-chan struct{}, in *fuse.RemoveMappingIn, mappings []fuse.RemoveMappingOne) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (fs *rawBridge) OnUnmount() {
 
 }
@@ -72,8 +72,9 @@ const (
 	_OP_NOTIFY_STORE_CACHE    = uint32(102)
 	_OP_NOTIFY_RETRIEVE_CACHE = uint32(103)
 	_OP_NOTIFY_DELETE         = uint32(104) // protocol version 18
+	_OP_NOTIFY_POLL           = uint32(105)
 
-	_OPCODE_COUNT = uint32(105)
+	_OPCODE_COUNT = uint32(106)
 
 	// Constants from Linux kernel fs/fuse/fuse_i.h
 	// Default MaxPages value in all kernel versions
@@ -87,12 +88,14 @@ const (
 func doInit(server *protocolServer, req *request) {
 	input := (*InitIn)(req.inData())
 	if input.Major != _FUSE_KERNEL_VERSION {
-		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, _FUSE_KERNEL_VERSION)
+		server.opts.Logger.Printf("INIT: major version does not match: unique=%d got=%d want=%d",
+			input.Unique, input.Major, _FUSE_KERNEL_VERSION)
 		req.status = EIO
 		return
 	}
 	if input.Minor < _MINIMUM_MINOR_VERSION {
-		log.Printf("Minor version is less than we support. Given %d, want at least %d\n", input.Minor, _MINIMUM_MINOR_VERSION)
+		server.opts.Logger.Printf("INIT: minor version is less than we support: unique=%d got=%d want>=%d",
+			input.Unique, input.Minor, _MINIMUM_MINOR_VERSION)
 		req.status = EIO
 		return
 	}
@@ -108,9 +111,24 @@ func doInit(server *protocolServer, req *request) {
 	if server.opts.EnableSymlinkCaching {
 		kernelFlags |= CAP_CACHE_SYMLINKS
 	}
+	if server.opts.EnableAtomicTrunc {
+		kernelFlags |= input.Flags64() & CAP_ATOMIC_O_TRUNC
+	}
+	if server.opts.EnableExportSupport {
+		kernelFlags |= input.Flags64() & CAP_EXPORT_SUPPORT
+	}
+	if server.opts.HandleKillPrivV2 {
+		kernelFlags |= input.Flags64() & CAP_HANDLE_KILLPRIV_V2
+	}
 	if server.opts.EnableAcl {
 		kernelFlags |= CAP_POSIX_ACL
 	}
+	if server.opts.DontMask {
+		kernelFlags |= input.Flags64() & CAP_DONT_MASK
+	}
+	if server.opts.EnableWritebackCache {
+		kernelFlags |= input.Flags64() & CAP_WRITEBACK_CACHE
+	}
 
 	if server.opts.ExplicitDataCacheControl {
 		// we don't want CAP_AUTO_INVAL_DATA even if we cannot go into fully explicit mode
@@ -119,12 +137,20 @@ func doInit(server *protocolServer, req *request) {
 		kernelFlags |= input.Flags64() & CAP_AUTO_INVAL_DATA
 	}
 
+	// Report ECONNABORTED after an abort, so Serve can tell it
+	// from an unmount.
+	kernelFlags |= input.Flags64() & CAP_ABORT_ERROR
+
+	if server.opts.MapAlignment > 0 {
+		kernelFlags |= input.Flags64() & CAP_MAP_ALIGNMENT
+	}
+
 	kernelFlags = kernelFlags &^ server.opts.DisabledCapabilities
 
-	// maxPages is the maximum request size we want the kernel to use, in units of
-	// memory pages (usually 4kiB). Linux v4.19 and older ignore this and always use
-	// 128kiB.
-	maxPages := (server.opts.MaxWrite-1)/syscall.Getpagesize() + 1 // Round up
+	// The kernel ignores passthrough with the writeback cache.
+	if kernelFlags&CAP_WRITEBACK_CACHE != 0 {
+		kernelFlags &^= CAP_PASSTHROUGH
+	}
 
 	out := (*InitOut)(req.outData())
 	*out = InitOut{
@@ -132,22 +158,45 @@ func doInit(server *protocolServer, req *request) {
 		Minor:               _OUR_MINOR_VERSION,
 		MaxReadAhead:        input.MaxReadAhead,
 		MaxWrite:            uint32(server.opts.MaxWrite),
-		CongestionThreshold: uint16(server.opts.MaxBackground * 3 / 4),
+		CongestionThreshold: uint16(server.opts.CongestionThreshold),
 		MaxBackground:       uint16(server.opts.MaxBackground),
-		MaxPages:            uint16(maxPages),
-		MaxStackDepth:       uint32(server.opts.MaxStackDepth),
+		MaxPages:            uint16(server.opts.MaxPages),
+		TimeGran:            1,
+	}
+	if kernelFlags&CAP_PASSTHROUGH != 0 {
+		out.MaxStackDepth = uint32(server.opts.MaxStackDepth)
+	}
+	if server.opts.TimeGranularity > 0 {
+		out.TimeGran = uint32(server.opts.TimeGranularity.Nanoseconds())
 	}
 	out.setFlags(kernelFlags)
+	server.capabilities = kernelFlags
+	if kernelFlags&CAP_MAP_ALIGNMENT != 0 {
+		out.MapAlignment = uint16(server.opts.MapAlignment)
+	}
 	if server.opts.MaxReadAhead != 0 && uint32(server.opts.MaxReadAhead) < out.MaxReadAhead {
 		out.MaxReadAhead = uint32(server.opts.MaxReadAhead)
 	}
 	if out.Minor > input.Minor {
 		out.Minor = input.Minor
 	}
+	server.initOut = *out
 
 	req.status = OK
 }
 
+// mutates returns true if the request would change the file system.
+func mutates(h *operationHandler, req *request) bool {
+	if h.Mutating {
+		return true
+	}
+	if req.inHeader().Opcode == _OP_OPEN {
+		flags := (*OpenIn)(req.inData()).Flags
+		return flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0
+	}
+	return false
+}
+
 func doOpen(server *protocolServer, req *request) {
 	out := (*OpenOut)(req.outData())
 	status := server.fileSystem.Open(req.cancel, (*OpenIn)(req.inData()), out)
@@ -163,6 +212,13 @@ func doCreate(server *protocolServer, req *request) {
 	req.status = status
 }
 
+// doTmpfile handles TMPFILE. The kernel sends the name of the
+// unnamed dentry, which is meaningless, so it is not passed on.
+func doTmpfile(server *protocolServer, req *request) {
+	out := (*CreateOut)(req.outData())
+	req.status = server.fileSystem.Tmpfile(req.cancel, (*CreateIn)(req.inData()), out)
+}
+
 func doReadDir(server *protocolServer, req *request) {
 	in := (*ReadIn)(req.inData())
 	out := NewDirEntryList(req.outPayload, uint64(in.Offset))
@@ -248,8 +304,8 @@ func doGetXAttr(server *protocolServer, req *request) {
 
 	if server.opts.IgnoreSecurityLabels && req.inHeader().Opcode == _OP_GETXATTR {
 		fn := req.filename()
-		if fn == _SECURITY_CAPABILITY || fn == _SECURITY_ACL_DEFAULT ||
-			fn == _SECURITY_ACL {
+		isACL := fn == _SECURITY_ACL_DEFAULT || fn == _SECURITY_ACL
+		if fn == _SECURITY_CAPABILITY || (isACL && !server.opts.EnableAcl) {
 			req.status = ENOATTR
 			return
 		}
@@ -300,14 +356,15 @@ func doForget(server *protocolServer, req *request) {
 // doBatchForget - forget a list of NodeIds
 func doBatchForget(server *protocolServer, req *request) {
 	in := (*_BatchForgetIn)(req.inData())
-	wantBytes := uintptr(in.Count) * unsafe.Sizeof(_ForgetOne{})
+	wantBytes := uintptr(in.Count) * unsafe.Sizeof(ForgetOne{})
 	if uintptr(len(req.inPayload)) < wantBytes {
 		// We have no return value to complain, so log an error.
 		server.opts.Logger.Printf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
 			len(req.inPayload), wantBytes, in.Count)
 	}
 
-	forgets := unsafe.Slice((*_ForgetOne)(unsafe.Pointer(&req.inPayload[0])), in.Count)
+	forgets := unsafe.Slice((*ForgetOne)(unsafe.Pointer(&req.inPayload[0])), in.Count)
+	batch := make([]ForgetOne, 0, len(forgets))
 	for i, f := range forgets {
 		if server.opts.Debug {
 			server.opts.Logger.Printf("doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
@@ -316,6 +373,14 @@ func doBatchForget(server *protocolServer, req *request) {
 		if f.NodeId == pollHackInode {
 			continue
 		}
+		batch = append(batch, f)
+	}
+
+	if bf, ok := server.fileSystem.(BatchForgetter); ok {
+		bf.BatchForget(batch)
+		return
+	}
+	for _, f := range batch {
 		server.fileSystem.Forget(f.NodeId, f.Nlookup)
 	}
 }
@@ -433,9 +498,56 @@ func doStatFs(server *protocolServer, req *request) {
 	}
 }
 
+// ioctlRetrySize is the output space needed for an IOCTL_RETRY
+// reply.
+const ioctlRetrySize = FUSE_IOCTL_MAX_IOV * int(unsafe.Sizeof(IoctlIovec{}))
+
 func doIoctl(server *protocolServer, req *request) {
-	req.status = server.fileSystem.Ioctl(req.cancel, (*IoctlIn)(req.inData()), req.inPayload, (*IoctlOut)(req.outData()),
-		req.outPayload)
+	in := (*IoctlIn)(req.inData())
+	out := (*IoctlOut)(req.outData())
+
+	// For unrestricted ioctls, the buffer may have extra room
+	// for IOCTL_RETRY iovecs.
+	outbuf := req.outPayload
+	if len(outbuf) > int(in.OutSize) {
+		outbuf = outbuf[:in.OutSize]
+	}
+	req.status = server.fileSystem.Ioctl(req.cancel, in, req.inPayload, out, outbuf)
+	if req.status.Ok() && out.Flags&IOCTL_RETRY != 0 {
+		// The counts come from the file system, so check
+		// them against the room reserved in parseRequest.
+		n := uint64(out.InIovs) + uint64(out.OutIovs)
+		sz := n * uint64(unsafe.Sizeof(IoctlIovec{}))
+		if in.Flags&IOCTL_UNRESTRICTED == 0 || n > FUSE_IOCTL_MAX_IOV || sz > uint64(cap(req.outPayload)) {
+			req.status = EIO
+			return
+		}
+		outbuf = req.outPayload[:sz]
+	}
+	req.outPayload = outbuf
+}
+
+func doPoll(server *protocolServer, req *request) {
+	req.status = server.fileSystem.Poll(req.cancel, (*PollIn)(req.inData()), (*PollOut)(req.outData()))
+}
+
+func doSetupMapping(server *protocolServer, req *request) {
+	req.status = server.fileSystem.SetupMapping(req.cancel, (*SetupMappingIn)(req.inData()))
+}
+
+func doRemoveMapping(server *protocolServer, req *request) {
+	in := (*RemoveMappingIn)(req.inData())
+	wantBytes := uintptr(in.Count) * unsafe.Sizeof(RemoveMappingOne{})
+	if uintptr(len(req.inPayload)) < wantBytes {
+		req.status = EINVAL
+		return
+	}
+
+	var mappings []RemoveMappingOne
+	if in.Count > 0 {
+		mappings = unsafe.Slice((*RemoveMappingOne)(unsafe.Pointer(&req.inPayload[0])), in.Count)
+	}
+	req.status = server.fileSystem.RemoveMapping(req.cancel, in, mappings)
 }
 
 func doDestroy(server *protocolServer, req *request) {
@@ -458,12 +570,22 @@ func doSetLkw(server *protocolServer, req *request) {
 	req.status = server.fileSystem.SetLkw(req.cancel, (*LkIn)(req.inData()))
 }
 
+func doSyncFs(server *protocolServer, req *request) {
+	req.status = server.fileSystem.SyncFs(req.cancel, (*SyncFsIn)(req.inData()))
+}
+
 func doLseek(server *protocolServer, req *request) {
 	in := (*LseekIn)(req.inData())
 	out := (*LseekOut)(req.outData())
 	req.status = server.fileSystem.Lseek(req.cancel, in, out)
 }
 
+func doBmap(server *protocolServer, req *request) {
+	in := (*BmapIn)(req.inData())
+	out := (*BmapOut)(req.outData())
+	req.status = server.fileSystem.Bmap(req.cancel, in, out)
+}
+
 func doCopyFileRange(server *protocolServer, req *request) {
 	in := (*CopyFileRangeIn)(req.inData())
 	out := (*WriteOut)(req.outData())
@@ -491,10 +613,21 @@ type operationHandler struct {
 	OutType     interface{}
 	FileNames   int
 	FileNameOut bool
+
+	// Mutating is set for opcodes that change the file system,
+	// which are refused on a ReadOnly mount.
+	Mutating bool
 }
 
 var operationHandlers []*operationHandler
 
+// OpcodeName returns the name of a FUSE opcode, eg. "LOOKUP" or
+// "READ", as used in the kernel headers without the "FUSE_" prefix.
+// It returns "unknown" for unknown opcodes.
+func OpcodeName(op uint32) string {
+	return operationName(op)
+}
+
 func operationName(op uint32) string {
 	h := getHandler(op)
 	if h == nil {
@@ -504,6 +637,9 @@ func operationName(op uint32) string {
 }
 
 func getHandler(o uint32) *operationHandler {
+	if o == CUSE_INIT {
+		return cuseInitHandler
+	}
 	if o >= _OPCODE_COUNT {
 		return nil
 	}
@@ -524,6 +660,16 @@ func init() {
 		operationHandlers[op].FileNameOut = true
 	}
 
+	mutatingOps := []uint32{
+		_OP_SETATTR, _OP_SYMLINK, _OP_MKNOD, _OP_MKDIR, _OP_UNLINK,
+		_OP_RMDIR, _OP_RENAME, _OP_LINK, _OP_WRITE, _OP_SETXATTR,
+		_OP_REMOVEXATTR, _OP_CREATE, _OP_FALLOCATE, _OP_RENAME2,
+		_OP_COPY_FILE_RANGE, _OP_TMPFILE,
+	}
+	for _, op := range mutatingOps {
+		operationHandlers[op].Mutating = true
+	}
+
 	for op, v := range map[uint32]string{
 		_OP_LOOKUP:                "LOOKUP",
 		_OP_FORGET:                "FORGET",
@@ -570,6 +716,7 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    "NOTIFY_STORE",
 		_OP_NOTIFY_RETRIEVE_CACHE: "NOTIFY_RETRIEVE",
 		_OP_NOTIFY_DELETE:         "NOTIFY_DELETE",
+		_OP_NOTIFY_POLL:           "NOTIFY_POLL",
 		_OP_FALLOCATE:             "FALLOCATE",
 		_OP_READDIRPLUS:           "READDIRPLUS",
 		_OP_RENAME2:               "RENAME2",
@@ -589,6 +736,7 @@ func init() {
 		_OP_WRITE:           doWrite,
 		_OP_OPENDIR:         doOpenDir,
 		_OP_CREATE:          doCreate,
+		_OP_TMPFILE:         doTmpfile,
 		_OP_SETATTR:         doSetattr,
 		_OP_GETXATTR:        doGetXAttr,
 		_OP_LISTXATTR:       doGetXAttr,
@@ -627,15 +775,21 @@ func init() {
 		_OP_INTERRUPT:       doInterrupt,
 		_OP_COPY_FILE_RANGE: doCopyFileRange,
 		_OP_LSEEK:           doLseek,
+		_OP_BMAP:            doBmap,
+		_OP_SYNCFS:          doSyncFs,
+		_OP_POLL:            doPoll,
+		_OP_SETUPMAPPING:    doSetupMapping,
+		_OP_REMOVEMAPPING:   doRemoveMapping,
 	} {
 		operationHandlers[op].Func = v
 	}
 
 	// Outputs.
 	for op, f := range map[uint32]interface{}{
-		_OP_BMAP:                  _BmapOut{},
+		_OP_BMAP:                  BmapOut{},
 		_OP_COPY_FILE_RANGE:       WriteOut{},
 		_OP_CREATE:                CreateOut{},
+		_OP_TMPFILE:               CreateOut{},
 		_OP_GETATTR:               AttrOut{},
 		_OP_GETLK:                 LkOut{},
 		_OP_GETXATTR:              GetXAttrOut{},
@@ -648,13 +802,14 @@ func init() {
 		_OP_MKDIR:                 EntryOut{},
 		_OP_MKNOD:                 EntryOut{},
 		_OP_NOTIFY_DELETE:         NotifyInvalDeleteOut{},
+		_OP_NOTIFY_POLL:           NotifyPollWakeupOut{},
 		_OP_NOTIFY_INVAL_ENTRY:    NotifyInvalEntryOut{},
 		_OP_NOTIFY_INVAL_INODE:    NotifyInvalInodeOut{},
 		_OP_NOTIFY_RETRIEVE_CACHE: NotifyRetrieveOut{},
 		_OP_NOTIFY_STORE_CACHE:    NotifyStoreOut{},
 		_OP_OPEN:                  OpenOut{},
 		_OP_OPENDIR:               OpenOut{},
-		_OP_POLL:                  _PollOut{},
+		_OP_POLL:                  PollOut{},
 		_OP_SETATTR:               AttrOut{},
 		_OP_STATFS:                StatfsOut{},
 		_OP_SYMLINK:               EntryOut{},
@@ -668,9 +823,10 @@ func init() {
 	for op, f := range map[uint32]interface{}{
 		_OP_ACCESS:          AccessIn{},
 		_OP_BATCH_FORGET:    _BatchForgetIn{},
-		_OP_BMAP:            _BmapIn{},
+		_OP_BMAP:            BmapIn{},
 		_OP_COPY_FILE_RANGE: CopyFileRangeIn{},
 		_OP_CREATE:          CreateIn{},
+		_OP_TMPFILE:         CreateIn{},
 		_OP_FALLOCATE:       FallocateIn{},
 		_OP_FLUSH:           FlushIn{},
 		_OP_FORGET:          ForgetIn{},
@@ -685,12 +841,13 @@ func init() {
 		_OP_LINK:            LinkIn{},
 		_OP_LISTXATTR:       GetXAttrIn{},
 		_OP_LSEEK:           LseekIn{},
+		_OP_SYNCFS:          SyncFsIn{},
 		_OP_MKDIR:           MkdirIn{},
 		_OP_MKNOD:           MknodIn{},
 		_OP_NOTIFY_REPLY:    NotifyRetrieveIn{},
 		_OP_OPEN:            OpenIn{},
 		_OP_OPENDIR:         OpenIn{},
-		_OP_POLL:            _PollIn{},
+		_OP_POLL:            PollIn{},
 		_OP_READ:            ReadIn{},
 		_OP_READDIR:         ReadIn{},
 		_OP_READDIRPLUS:     ReadIn{},
@@ -702,6 +859,8 @@ func init() {
 		_OP_SETLK:           LkIn{},
 		_OP_SETLKW:          LkIn{},
 		_OP_SETXATTR:        SetXAttrIn{},
+		_OP_SETUPMAPPING:    SetupMappingIn{},
+		_OP_REMOVEMAPPING:   RemoveMappingIn{},
 		_OP_WRITE:           WriteIn{},
 	} {
 		operationHandlers[op].InType = f
@@ -711,10 +870,15 @@ func init() {
 			maxInputSize = sz
 		}
 	}
+	// fuse_removemapping_in is a lone uint32, so the mapping
+	// entries start right after Count rather than at the padded
+	// end of RemoveMappingIn.
+	operationHandlers[_OP_REMOVEMAPPING].InputSize = unsafe.Offsetof(RemoveMappingIn{}.Count) + unsafe.Sizeof(RemoveMappingIn{}.Count)
 
 	// File name args.
 	for op, count := range map[uint32]int{
 		_OP_CREATE:      1,
+		_OP_TMPFILE:     1,
 		_OP_SETXATTR:    1,
 		_OP_GETXATTR:    1,
 		_OP_LINK:        1,
@@ -0,0 +1,50 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestInitMaxStackDepth(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		opts  MountOptions
+		depth uint32
+	}{
+		{"default", MountOptions{}, 1},
+		{"2", MountOptions{MaxStackDepth: 2}, 2},
+		{"capped", MountOptions{MaxStackDepth: 5}, _FILESYSTEM_MAX_STACK_DEPTH},
+		{"disabled", MountOptions{MaxStackDepth: 2, DisablePassthrough: true}, 0},
+		{"writeback", MountOptions{MaxStackDepth: 2, EnableWritebackCache: true}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ms := newServer(NewDefaultRawFileSystem(), &tc.opts)
+			in := InitIn{
+				Major:  _FUSE_KERNEL_VERSION,
+				Minor:  _OUR_MINOR_VERSION,
+				Flags:  uint32(CAP_WRITEBACK_CACHE | CAP_INIT_EXT),
+				Flags2: uint32(CAP_PASSTHROUGH >> 32),
+			}
+			req := &request{
+				inputBuf:  (*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(&in))[:],
+				outputBuf: make([]byte, sizeOfOutHeader+unsafe.Sizeof(InitOut{})),
+			}
+			doInit(&ms.protocolServer, req)
+			if !req.status.Ok() {
+				t.Fatalf("doInit: %v", req.status)
+			}
+
+			out := (*InitOut)(req.outData())
+			if out.MaxStackDepth != tc.depth {
+				t.Errorf("MaxStackDepth: got %d, want %d", out.MaxStackDepth, tc.depth)
+			}
+			if got, want := ms.Capabilities()&CAP_PASSTHROUGH != 0, tc.depth > 0; got != want {
+				t.Errorf("CAP_PASSTHROUGH: got %v, want %v", got, want)
+			}
+		})
+	}
+}
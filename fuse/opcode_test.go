@@ -0,0 +1,323 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestInitCapabilities(t *testing.T) {
+	opts := &MountOptions{
+		DisabledCapabilities: CAP_PARALLEL_DIROPS,
+	}
+	ms := &Server{
+		protocolServer: protocolServer{opts: opts},
+		opts:           opts,
+	}
+
+	in := InitIn{
+		Major: _FUSE_KERNEL_VERSION,
+		Minor: _MINIMUM_MINOR_VERSION,
+		Flags: uint32(CAP_ASYNC_READ | CAP_READDIRPLUS | CAP_PARALLEL_DIROPS | CAP_FLOCK_LOCKS),
+	}
+	req := &request{
+		inputBuf:  (*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(&in))[:],
+		outputBuf: make([]byte, sizeOfOutHeader+unsafe.Sizeof(InitOut{})),
+	}
+	doInit(&ms.protocolServer, req)
+	if !req.status.Ok() {
+		t.Fatalf("doInit: %v", req.status)
+	}
+
+	if got, want := ms.Capabilities(), uint64(CAP_ASYNC_READ|CAP_READDIRPLUS); got != want {
+		t.Errorf("Capabilities: got %x, want %x", got, want)
+	}
+	if got := ms.ProtocolMinor(); got != _MINIMUM_MINOR_VERSION {
+		t.Errorf("ProtocolMinor: got %d, want %d", got, _MINIMUM_MINOR_VERSION)
+	}
+	if got := ms.KernelSettings().Flags64(); got != uint64(in.Flags) {
+		t.Errorf("KernelSettings: got flags %x, want %x", got, in.Flags)
+	}
+}
+
+func TestInitBackground(t *testing.T) {
+	opts := &MountOptions{
+		MaxBackground:       64,
+		CongestionThreshold: 48,
+	}
+	ms := &Server{
+		protocolServer: protocolServer{opts: opts},
+		opts:           opts,
+	}
+	if s := ms.ServerSettings(); s != nil {
+		t.Errorf("ServerSettings before INIT: got %v, want nil", s)
+	}
+
+	in := InitIn{
+		Major: _FUSE_KERNEL_VERSION,
+		Minor: _MINIMUM_MINOR_VERSION,
+	}
+	req := &request{
+		inputBuf:  (*[unsafe.Sizeof(InitIn{})]byte)(unsafe.Pointer(&in))[:],
+		outputBuf: make([]byte, sizeOfOutHeader+unsafe.Sizeof(InitOut{})),
+	}
+	doInit(&ms.protocolServer, req)
+	if !req.status.Ok() {
+		t.Fatalf("doInit: %v", req.status)
+	}
+
+	out := (*InitOut)(req.outData())
+	if out.MaxBackground != 64 || out.CongestionThreshold != 48 {
+		t.Errorf("got MaxBackground %d, CongestionThreshold %d, want 64, 48",
+			out.MaxBackground, out.CongestionThreshold)
+	}
+	if s := ms.ServerSettings(); s == nil || *s != *out {
+		t.Errorf("ServerSettings: got %v, want %v", s, out)
+	}
+}
+
+func TestCuseInit(t *testing.T) {
+	opts := &MountOptions{MaxWrite: 1 << 16}
+	ms := &protocolServer{
+		opts: opts,
+		cuse: &cuseParams{devName: "zero", devMajor: 10, devMinor: 42},
+	}
+
+	in := _CuseInitIn{
+		InHeader: InHeader{Opcode: CUSE_INIT},
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _MINIMUM_MINOR_VERSION,
+		Flags:    CUSE_UNRESTRICTED_IOCTL,
+	}
+	buf := (*[unsafe.Sizeof(_CuseInitIn{})]byte)(unsafe.Pointer(&in))[:]
+	h, _, outSize, _, code := parseRequest(buf, nil)
+	if !code.Ok() {
+		t.Fatalf("parseRequest: %v", code)
+	}
+	req := &request{
+		inputBuf:  buf,
+		outputBuf: make([]byte, int(sizeOfOutHeader)+outSize),
+	}
+	ms.handleRequest(h, req)
+	if !req.status.Ok() {
+		t.Fatalf("CUSE_INIT: %v", req.status)
+	}
+
+	out := (*_CuseInitOut)(req.outData())
+	if out.DevMajor != 10 || out.DevMinor != 42 {
+		t.Errorf("got device %d:%d, want 10:42", out.DevMajor, out.DevMinor)
+	}
+	if out.Flags != CUSE_UNRESTRICTED_IOCTL {
+		t.Errorf("got flags %x, want %x", out.Flags, CUSE_UNRESTRICTED_IOCTL)
+	}
+	if out.MaxWrite != 1<<16 || out.Minor != _MINIMUM_MINOR_VERSION {
+		t.Errorf("got MaxWrite %d minor %d", out.MaxWrite, out.Minor)
+	}
+	if got, want := string(req.outPayload), "DEVNAME=zero\x00"; got != want {
+		t.Errorf("got info %q, want %q", got, want)
+	}
+
+	// A FUSE server does not accept CUSE_INIT.
+	ms.cuse = nil
+	req = &request{
+		inputBuf:  buf,
+		outputBuf: make([]byte, int(sizeOfOutHeader)+outSize),
+	}
+	ms.handleRequest(h, req)
+	if req.status != ENOSYS {
+		t.Errorf("CUSE_INIT on FUSE server: got %v, want ENOSYS", req.status)
+	}
+}
+
+// mkdirFS records whether Mkdir and Open were called.
+type mkdirFS struct {
+	RawFileSystem
+	called []string
+}
+
+func (fs *mkdirFS) Mkdir(cancel <-chan struct{}, input *MkdirIn, name string, out *EntryOut) Status {
+	fs.called = append(fs.called, "MKDIR")
+	return OK
+}
+
+func (fs *mkdirFS) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	fs.called = append(fs.called, "OPEN")
+	return OK
+}
+
+func TestReadOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		in       []byte
+		readOnly bool
+		want     Status
+	}{
+		{"mkdir", mkdirIn(), false, OK},
+		{"mkdir ro", mkdirIn(), true, EROFS},
+		{"open rdonly ro", openIn(syscall.O_RDONLY), true, OK},
+		{"open rdwr ro", openIn(syscall.O_RDWR), true, EROFS},
+		{"open trunc ro", openIn(syscall.O_RDONLY | syscall.O_TRUNC), true, EROFS},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &mkdirFS{RawFileSystem: NewDefaultRawFileSystem()}
+			opts := &MountOptions{ReadOnly: tc.readOnly, Logger: log.Default()}
+			ms := &protocolServer{fileSystem: fs, opts: opts}
+
+			buf := append(tc.in, "dir\x00"...)
+			h, inSize, outSize, _, status := parseRequest(buf, nil)
+			if !status.Ok() {
+				t.Fatalf("parseRequest: %v", status)
+			}
+			req := &request{
+				inputBuf:  buf[:inSize],
+				inPayload: buf[inSize:],
+				outputBuf: make([]byte, int(sizeOfOutHeader)+outSize),
+			}
+			ms.handleRequest(h, req)
+			if req.status != tc.want {
+				t.Errorf("got %v, want %v", req.status, tc.want)
+			}
+			if reached := len(fs.called) > 0; reached != tc.want.Ok() {
+				t.Errorf("file system called: %v, want %v", fs.called, tc.want.Ok())
+			}
+		})
+	}
+}
+
+func mkdirIn() []byte {
+	in := MkdirIn{InHeader: InHeader{Opcode: _OP_MKDIR}}
+	return append([]byte{}, (*[unsafe.Sizeof(MkdirIn{})]byte)(unsafe.Pointer(&in))[:]...)
+}
+
+func openIn(flags uint32) []byte {
+	in := OpenIn{InHeader: InHeader{Opcode: _OP_OPEN}, Flags: flags}
+	return append([]byte{}, (*[unsafe.Sizeof(OpenIn{})]byte)(unsafe.Pointer(&in))[:]...)
+}
+
+func TestUnimplementedOpcodeLog(t *testing.T) {
+	var logBuf bytes.Buffer
+	opts := &MountOptions{Logger: log.New(&logBuf, "", 0)}
+	ms := &protocolServer{fileSystem: NewDefaultRawFileSystem(), opts: opts}
+
+	// Opcode 7 is unassigned.
+	in := InHeader{Opcode: 7, Unique: 42, NodeId: 7}
+	buf := append([]byte{}, (*[unsafe.Sizeof(InHeader{})]byte)(unsafe.Pointer(&in))[:]...)
+	h, inSize, outSize, _, status := parseRequest(buf, nil)
+	if !status.Ok() {
+		t.Fatalf("parseRequest: %v", status)
+	}
+	req := &request{
+		inputBuf:  buf[:inSize],
+		outputBuf: make([]byte, int(sizeOfOutHeader)+outSize),
+	}
+	ms.handleRequest(h, req)
+	if req.status != ENOSYS {
+		t.Errorf("got %v, want ENOSYS", req.status)
+	}
+	if got, want := logBuf.String(), "unimplemented opcode: opcode=OPCODE-7 unique=42 nodeid=7\n"; got != want {
+		t.Errorf("got log %q, want %q", got, want)
+	}
+}
+
+func TestAllowedUIDs(t *testing.T) {
+	opts := &MountOptions{
+		AllowedUIDs: []uint32{1001},
+		AllowedGIDs: []uint32{2002},
+	}
+	for _, tc := range []struct {
+		name     string
+		uid, gid uint32
+		want     Status
+	}{
+		{"root", 0, 0, OK},
+		{"mounter", 500, 500, OK},
+		{"allowed uid", 1001, 1, OK},
+		{"allowed gid", 3, 2002, OK},
+		{"other", 3, 3, EACCES},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &mkdirFS{RawFileSystem: NewDefaultRawFileSystem()}
+			ms := &protocolServer{fileSystem: fs, opts: opts, mountUid: 500}
+
+			in := MkdirIn{InHeader: InHeader{Opcode: _OP_MKDIR}}
+			in.Uid = tc.uid
+			in.Gid = tc.gid
+			buf := append([]byte{}, (*[unsafe.Sizeof(MkdirIn{})]byte)(unsafe.Pointer(&in))[:]...)
+			buf = append(buf, "dir\x00"...)
+			h, inSize, outSize, _, status := parseRequest(buf, nil)
+			if !status.Ok() {
+				t.Fatalf("parseRequest: %v", status)
+			}
+			req := &request{
+				inputBuf:  buf[:inSize],
+				inPayload: buf[inSize:],
+				outputBuf: make([]byte, int(sizeOfOutHeader)+outSize),
+			}
+			ms.handleRequest(h, req)
+			if req.status != tc.want {
+				t.Errorf("got %v, want %v", req.status, tc.want)
+			}
+			if reached := len(fs.called) > 0; reached != tc.want.Ok() {
+				t.Errorf("file system called: %v, want %v", fs.called, tc.want.Ok())
+			}
+		})
+	}
+}
+
+// retryIoctlFS answers every ioctl with IOCTL_RETRY and the given
+// iovec counts, without going through IoctlOut.Retry.
+type retryIoctlFS struct {
+	RawFileSystem
+	inIovs, outIovs uint32
+}
+
+func (fs *retryIoctlFS) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, output *IoctlOut, outbuf []byte) Status {
+	output.Flags |= IOCTL_RETRY
+	output.InIovs = fs.inIovs
+	output.OutIovs = fs.outIovs
+	return OK
+}
+
+func TestIoctlRetryCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		flags           uint32
+		inIovs, outIovs uint32
+		want            Status
+	}{
+		{"unrestricted", IOCTL_UNRESTRICTED, 1, 2, OK},
+		{"restricted", 0, 1, 0, EIO},
+		{"too many", IOCTL_UNRESTRICTED, FUSE_IOCTL_MAX_IOV, 1, EIO},
+		{"overflow", IOCTL_UNRESTRICTED, 1 << 31, 1 << 31, EIO},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &retryIoctlFS{RawFileSystem: NewDefaultRawFileSystem(), inIovs: tc.inIovs, outIovs: tc.outIovs}
+			ms := &protocolServer{fileSystem: fs, opts: &MountOptions{Logger: log.Default()}}
+
+			in := IoctlIn{InHeader: InHeader{Opcode: _OP_IOCTL}, Flags: tc.flags, OutSize: 8}
+			buf := append([]byte{}, (*[unsafe.Sizeof(IoctlIn{})]byte)(unsafe.Pointer(&in))[:]...)
+			h, inSize, outSize, outPayloadSize, status := parseRequest(buf, nil)
+			if !status.Ok() {
+				t.Fatalf("parseRequest: %v", status)
+			}
+			req := &request{
+				inputBuf:   buf[:inSize],
+				outputBuf:  make([]byte, int(sizeOfOutHeader)+outSize),
+				outPayload: make([]byte, outPayloadSize),
+			}
+			ms.handleRequest(h, req)
+			if req.status != tc.want {
+				t.Errorf("got %v, want %v", req.status, tc.want)
+			}
+			if want := int(tc.inIovs+tc.outIovs) * int(unsafe.Sizeof(IoctlIovec{})); req.status.Ok() && len(req.outPayload) != want {
+				t.Errorf("got %d bytes of iovecs, want %d", len(req.outPayload), want)
+			}
+		})
+	}
+}
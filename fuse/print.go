@@ -209,6 +209,9 @@ func (in *SetAttrIn) string() string {
 	if in.Valid&FATTR_FH != 0 {
 		s = append(s, fmt.Sprintf("fh %d", in.Fh))
 	}
+	if in.Valid&FATTR_KILL_SUIDGID != 0 {
+		s = append(s, "kill_suidgid")
+	}
 	// TODO - FATTR_ATIME_NOW = (1 << 7), FATTR_MTIME_NOW = (1 << 8), FATTR_LOCKOWNER = (1 << 9)
 	return fmt.Sprintf("{%s}", strings.Join(s, ", "))
 }
@@ -345,6 +348,14 @@ func (i *CopyFileRangeIn) string() string {
 		i.FhIn, i.OffIn, i.Len, i.NodeIdOut, i.FhOut, i.OffOut, i.Len)
 }
 
+func (in *SetupMappingIn) string() string {
+	return fmt.Sprintf("{Fh %d [%d +%d) => %d 0x%x}", in.Fh, in.Foffset, in.Len, in.Moffset, in.Flags)
+}
+
+func (in *RemoveMappingIn) string() string {
+	return fmt.Sprintf("{%d}", in.Count)
+}
+
 func (in *InterruptIn) string() string {
 	return fmt.Sprintf("{ix %d}", in.Unique)
 }
@@ -357,6 +368,10 @@ var seekNames = map[uint32]string{
 	4: "HOLE",
 }
 
+func (in *SyncFsIn) string() string {
+	return "{}"
+}
+
 func (in *LseekIn) string() string {
 	return fmt.Sprintf("{Fh %d [%s +%d)}", in.Fh,
 		seekNames[in.Whence], in.Offset)
@@ -366,8 +381,16 @@ func (o *LseekOut) string() string {
 	return fmt.Sprintf("{%d}", o.Offset)
 }
 
-func (p *_PollIn) string() string {
-	return fmt.Sprintf("Fh %d Kh %d Flags 0x%x", p.Fh, p.Kh, p.Flags)
+func (in *BmapIn) string() string {
+	return fmt.Sprintf("{block %d blocksize %d}", in.Block, in.Blocksize)
+}
+
+func (o *BmapOut) string() string {
+	return fmt.Sprintf("{%d}", o.Block)
+}
+
+func (p *PollIn) string() string {
+	return fmt.Sprintf("{Fh %d Kh %d Flags 0x%x Events 0x%x}", p.Fh, p.Kh, p.Flags, p.Events)
 }
 
 // Print pretty prints FUSE data types for kernel communication
@@ -386,14 +409,14 @@ func (a *Attr) string() string {
 		"{M0%o SZ=%d L=%d "+
 			"%d:%d "+
 			"B%d*%d i%d:%d "+
-			"A %f "+
-			"M %f "+
-			"C %f}",
+			"A %d.%09d "+
+			"M %d.%09d "+
+			"C %d.%09d}",
 		a.Mode, a.Size, a.Nlink,
 		a.Uid, a.Gid,
 		a.Blocks, a.Blksize,
-		a.Rdev, a.Ino, ft(a.Atime, a.Atimensec), ft(a.Mtime, a.Mtimensec),
-		ft(a.Ctime, a.Ctimensec))
+		a.Rdev, a.Ino, a.Atime, a.Atimensec, a.Mtime, a.Mtimensec,
+		a.Ctime, a.Ctimensec)
 }
 
 func (m *BackingMap) string() string {
@@ -20,8 +20,21 @@ type protocolServer struct {
 
 	kernelSettings InitIn
 
+	// capabilities agreed on in INIT.
+	capabilities uint64
+
+	// initOut is the INIT reply sent to the kernel.
+	initOut InitOut
+
 	opts *MountOptions
 
+	// mountUid is the user that created the server. It is always
+	// allowed access, regardless of MountOptions.AllowedUIDs.
+	mountUid uint32
+
+	// cuse is set for servers created with NewCUSEServer.
+	cuse *cuseParams
+
 	// in-flight notify-retrieve queries
 	retrieveMu   sync.Mutex
 	retrieveNext uint64
@@ -39,9 +52,22 @@ func (ms *protocolServer) handleRequest(h *operationHandler, req *request) {
 	if req.inHeader().NodeId == pollHackInode ||
 		req.inHeader().NodeId == FUSE_ROOT_ID && h.FileNames > 0 && req.filename() == pollHackName {
 		doPollHackLookup(ms, req)
+	} else if req.status.Ok() && (len(ms.opts.AllowedUIDs) > 0 || len(ms.opts.AllowedGIDs) > 0) && !ms.callerAllowed(req) {
+		req.status = EACCES
+	} else if code := ms.filterRequest(req); !code.Ok() {
+		req.status = code
+	} else if req.status.Ok() && ms.opts.ReadOnly && mutates(h, req) {
+		req.status = EROFS
 	} else if req.status.Ok() && h.Func == nil {
-		ms.opts.Logger.Printf("Unimplemented opcode %v", operationName(req.inHeader().Opcode))
+		hdr := req.inHeader()
+		ms.opts.Logger.Printf("unimplemented opcode: opcode=%s unique=%d nodeid=%d",
+			operationName(hdr.Opcode), hdr.Unique, hdr.NodeId)
 		req.status = ENOSYS
+	} else if m := ms.opts.IDMap; m != nil && req.status.Ok() {
+		if req.status = m.mapRequest(req); req.status.Ok() {
+			h.Func(ms, req)
+			m.mapReply(req)
+		}
 	} else if req.status.Ok() {
 		h.Func(ms, req)
 	}
@@ -79,6 +105,57 @@ func (ms *protocolServer) handleRequest(h *operationHandler, req *request) {
 	}
 }
 
+// mustNotFail returns true for the opcodes that access no data,
+// and that access checks must therefore let through: failing the
+// handshake breaks the mount, the kernel does not retry failed
+// releases, and the others have no reply to fail.
+func mustNotFail(opcode uint32) bool {
+	switch opcode {
+	case _OP_INIT, CUSE_INIT, _OP_DESTROY, _OP_FORGET, _OP_BATCH_FORGET,
+		_OP_INTERRUPT, _OP_NOTIFY_REPLY, _OP_RELEASE, _OP_RELEASEDIR:
+		return true
+	}
+	return false
+}
+
+// filterRequest returns the result of MountOptions.RequestFilter
+// for req, or OK if there is no filter. Requests that must not
+// fail, such as FORGET, are not filtered.
+func (ms *protocolServer) filterRequest(req *request) Status {
+	if ms.opts.RequestFilter == nil || !req.status.Ok() {
+		return OK
+	}
+	hdr := req.inHeader()
+	if mustNotFail(hdr.Opcode) {
+		return OK
+	}
+	return ms.opts.RequestFilter(hdr)
+}
+
+// callerAllowed returns true if the caller of req may access the
+// file system according to MountOptions.AllowedUIDs and
+// MountOptions.AllowedGIDs.
+func (ms *protocolServer) callerAllowed(req *request) bool {
+	hdr := req.inHeader()
+	if mustNotFail(hdr.Opcode) {
+		return true
+	}
+	if hdr.Uid == 0 || hdr.Uid == ms.mountUid {
+		return true
+	}
+	for _, uid := range ms.opts.AllowedUIDs {
+		if hdr.Uid == uid {
+			return true
+		}
+	}
+	for _, gid := range ms.opts.AllowedGIDs {
+		if hdr.Gid == gid {
+			return true
+		}
+	}
+	return false
+}
+
 func (ms *protocolServer) addInflight(req *request) {
 	ms.interruptMu.Lock()
 	defer ms.interruptMu.Unlock()
@@ -114,6 +191,14 @@ func (ms *protocolServer) interruptRequest(unique uint64) Status {
 	return EAGAIN
 }
 
+// isConnectionDead returns whether the read loop saw the connection
+// go away.
+func (ms *protocolServer) isConnectionDead() bool {
+	ms.interruptMu.Lock()
+	defer ms.interruptMu.Unlock()
+	return ms.connectionDead
+}
+
 func (ms *protocolServer) cancelAll() {
 	ms.interruptMu.Lock()
 	defer ms.interruptMu.Unlock()
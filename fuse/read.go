@@ -26,10 +26,54 @@ func (r *readResultData) Bytes(buf []byte) ([]byte, Status) {
 	return r.Data, OK
 }
 
+// ReadResultData returns a ReadResult for data that is already in
+// memory.
 func ReadResultData(b []byte) ReadResult {
 	return &readResultData{b}
 }
 
+// zeroes is never written, as the results of ReadResult.Bytes are
+// read-only, so the kernel backs it with its shared zero page, and
+// it takes no memory.
+var zeroes [1 << 20]byte
+
+// ReadResultZero returns a ReadResult for size zero bytes, eg. for a
+// read from a hole in a sparse file. It does not allocate: reads up
+// to 1 MiB are served from a shared buffer of zeroes, and larger ones
+// are zeroed in the buffer passed to Bytes.
+func ReadResultZero(size int) ReadResult {
+	return readResultZero(size)
+}
+
+type readResultZero int
+
+func (r readResultZero) Size() int {
+	return int(r)
+}
+
+func (r readResultZero) Done() {
+}
+
+func (r readResultZero) Bytes(buf []byte) ([]byte, Status) {
+	sz := int(r)
+	if len(buf) < sz {
+		sz = len(buf)
+	}
+	if sz <= len(zeroes) {
+		return zeroes[:sz], OK
+	}
+	buf = buf[:sz]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return buf, OK
+}
+
+// ReadResultFd returns a ReadResult for sz bytes of fd, starting at
+// off. When the server can use splice, the data is moved from fd to
+// the FUSE device without copying it into userspace; otherwise it
+// is read with pread. The fd must stay open until the reply has
+// been sent, ie. until the file is released.
 func ReadResultFd(fd uintptr, off int64, sz int) ReadResult {
 	return &readResultFd{fd, off, sz}
 }
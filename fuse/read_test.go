@@ -0,0 +1,29 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadResultZero(t *testing.T) {
+	for _, sz := range []int{0, 10, len(zeroes), len(zeroes) + 10} {
+		buf := bytes.Repeat([]byte{'x'}, sz+5)
+		got, code := ReadResultZero(sz).Bytes(buf)
+		if !code.Ok() || len(got) != sz || !bytes.Equal(got, make([]byte, sz)) {
+			t.Errorf("size %d: got %v, %d bytes, want %d zeroes", sz, code, len(got), sz)
+		}
+
+		// The result is capped by the buffer, also if it has
+		// no spare capacity.
+		if got, _ := ReadResultZero(sz).Bytes(buf[:sz/2]); len(got) != sz/2 {
+			t.Errorf("size %d: got %d bytes, want %d", sz, len(got), sz/2)
+		}
+		if got, _ := ReadResultZero(2 * sz).Bytes(buf[:sz:sz]); len(got) != sz {
+			t.Errorf("size %d: got %d bytes, want %d", 2*sz, len(got), sz)
+		}
+	}
+}
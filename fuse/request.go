@@ -7,7 +7,6 @@ package fuse
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 	"time"
@@ -189,6 +188,10 @@ func (r *request) inData() unsafe.Pointer {
 	return unsafe.Pointer(&r.inputBuf[0])
 }
 
+// parseRequest returns the handler and sizes for the request in
+// `in`. It returns ENOSYS for unknown opcodes, and EIO if `in` is too
+// short. The caller should log errors.
+//
 // note: outSize is without OutHeader
 func parseRequest(in []byte, kernelSettings *InitIn) (h *operationHandler, inSize, outSize, outPayloadSize int, errno Status) {
 	inSize = int(unsafe.Sizeof(InHeader{}))
@@ -200,7 +203,6 @@ func parseRequest(in []byte, kernelSettings *InitIn) (h *operationHandler, inSiz
 	hdr := (*InHeader)(inData)
 	h = getHandler(hdr.Opcode)
 	if h == nil {
-		log.Printf("Unknown opcode %d", hdr.Opcode)
 		errno = ENOSYS
 		return
 	}
@@ -215,7 +217,6 @@ func parseRequest(in []byte, kernelSettings *InitIn) (h *operationHandler, inSiz
 		inSize = len(in)
 	}
 	if len(in) < inSize {
-		log.Printf("Short read for %v: %q", h.Name, in)
 		errno = EIO
 		return
 	}
@@ -226,7 +227,11 @@ func parseRequest(in []byte, kernelSettings *InitIn) (h *operationHandler, inSiz
 	case _OP_GETXATTR, _OP_LISTXATTR:
 		outPayloadSize = int(((*GetXAttrIn)(inData)).Size)
 	case _OP_IOCTL:
-		outPayloadSize = int(((*IoctlIn)(inData)).OutSize)
+		in := (*IoctlIn)(inData)
+		outPayloadSize = int(in.OutSize)
+		if in.Flags&IOCTL_UNRESTRICTED != 0 && outPayloadSize < ioctlRetrySize {
+			outPayloadSize = ioctlRetrySize
+		}
 	}
 
 	outSize = int(h.OutputSize)
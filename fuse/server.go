@@ -5,9 +5,12 @@
 package fuse
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"os"
 	"path"
 	"path/filepath"
@@ -15,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -33,10 +37,19 @@ const (
 	// defaultMaxWrite is the default value for MountOptions.MaxWrite
 	defaultMaxWrite = 128 * 1024 // 128 kiB
 
+	// Linux kernel constant from include/linux/fs.h. The kernel
+	// disables passthrough if MaxStackDepth exceeds it.
+	_FILESYSTEM_MAX_STACK_DEPTH = 2
+
 	minMaxReaders = 2
 	maxMaxReaders = 16
 )
 
+// ErrConnectionAborted is returned by Server.Err if the connection
+// was aborted, eg. through /sys/fs/fuse/connections/N/abort or
+// umount -f, rather than unmounted normally.
+var ErrConnectionAborted = errors.New("fuse: connection aborted")
+
 // Server contains the logic for reading from the FUSE device and
 // translating it to RawFileSystem interface calls.
 type Server struct {
@@ -51,9 +64,18 @@ type Server struct {
 	// I/O with kernel and daemon.
 	mountFd int
 
+	// conn replaces mountFd for servers created with
+	// NewSocketServer. connReadMu serializes reads, which take
+	// more than one call for a stream. connPacket is set if conn
+	// preserves message boundaries.
+	conn       net.Conn
+	connReadMu sync.Mutex
+	connPacket bool
+
 	opts *MountOptions
 
-	// maxReaders is the maximum number of goroutines reading requests
+	// maxReaders is the maximum number of goroutines reading
+	// requests. See MountOptions.MaxReaders.
 	maxReaders int
 
 	// Pools for []byte
@@ -67,6 +89,10 @@ type Server struct {
 	reqMu      sync.Mutex
 	reqReaders int
 
+	// serveErr is the error that stopped the read loops, to be
+	// returned from Err. Protected by reqMu.
+	serveErr error
+
 	singleReader bool
 	canSplice    bool
 	loops        sync.WaitGroup
@@ -75,8 +101,31 @@ type Server struct {
 	// Used to implement WaitMount on macos.
 	ready chan error
 
+	// resumed is set for servers created with NewServerFromFd,
+	// whose mount was set up by another process.
+	resumed bool
+
 	// for implementing single threaded processing.
 	requestProcessingMu sync.Mutex
+
+	// dispatchQueue limits the requests being dispatched, if
+	// MountOptions.MaxConcurrentRequests is set.
+	dispatchQueue *dispatchQueue
+
+	// dispatching is the number of requests being processed
+	// by the file system. Accessed atomically.
+	dispatching int32
+
+	// shuttingDown is set by Shutdown. Accessed atomically.
+	shuttingDown int32
+
+	// drained is created by Shutdown, and closed once no
+	// requests are being dispatched after shuttingDown is set.
+	drainedMu sync.Mutex
+	drained   chan struct{}
+
+	// per-opcode counters, if MountOptions.RecordStats is set.
+	stats serverStats
 }
 
 // SetDebug is deprecated. Use MountOptions.Debug instead.
@@ -87,13 +136,56 @@ func (ms *Server) SetDebug(dbg bool) {
 
 // KernelSettings returns the Init message from the kernel, so
 // filesystems can adapt to availability of features of the kernel
-// driver. The message should not be altered.
+// driver. The message should not be altered. See ServerSettings for
+// the reply.
 func (ms *Server) KernelSettings() *InitIn {
 	s := ms.kernelSettings
 
 	return &s
 }
 
+// Capabilities returns the CAP_* flags agreed on with the kernel
+// during INIT, ie. the capabilities supported by both the kernel and
+// this server, minus MountOptions.DisabledCapabilities. Use
+// KernelSettings to see everything the kernel offered. It returns 0
+// before the mount is initialized.
+func (ms *Server) Capabilities() uint64 {
+	return ms.capabilities
+}
+
+// ServerSettings returns the INIT reply that was sent to the kernel,
+// ie. the limits (such as MaxBackground, CongestionThreshold and
+// MaxWrite) and capabilities this server asked for. The kernel may
+// lower some of them further. It returns nil before the mount is
+// initialized.
+func (ms *Server) ServerSettings() *InitOut {
+	if ms.initOut.Major == 0 {
+		return nil
+	}
+	s := ms.initOut
+	return &s
+}
+
+// ProtocolMinor returns the minor version of the FUSE protocol
+// spoken with the kernel, ie. the lower of the kernel's and ours.
+func (ms *Server) ProtocolMinor() uint32 {
+	if ms.kernelSettings.Minor < _OUR_MINOR_VERSION {
+		return ms.kernelSettings.Minor
+	}
+	return _OUR_MINOR_VERSION
+}
+
+// MaxPages returns the maximum size of a request, in units of memory
+// pages, as negotiated with the kernel. Kernels that do not support
+// CAP_MAX_PAGES (Linux v4.19 and older) use a fixed limit of 32 pages.
+func (ms *Server) MaxPages() int {
+	if ms.kernelSettings.Flags64()&CAP_MAX_PAGES == 0 ||
+		ms.opts.DisabledCapabilities&CAP_MAX_PAGES != 0 {
+		return _FUSE_DEFAULT_MAX_PAGES_PER_REQ
+	}
+	return ms.opts.MaxPages
+}
+
 const _MAX_NAME_LEN = 20
 
 // This type may be provided for recording latencies of each FUSE
@@ -117,14 +209,25 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 //
 //	fusermount -u /path/to/real/mountpoint
 //
-// in this case.
+// in this case. For a server created with NewSocketServer, Unmount
+// closes the connection.
 func (ms *Server) Unmount() (err error) {
+	if ms.conn != nil {
+		// There is no mount. Closing the connection stops
+		// the readers.
+		ms.conn.Close()
+		ms.loops.Wait()
+		return nil
+	}
 	if ms.mountPoint == "" {
 		return nil
 	}
 	if parseFuseFd(ms.mountPoint) >= 0 {
 		return fmt.Errorf("Cannot unmount magic mountpoint %q. Please use `fusermount -u REALMOUNTPOINT` instead.", ms.mountPoint)
 	}
+	if ms.opts.DeviceFd > 0 {
+		return fmt.Errorf("Cannot unmount %q served from MountOptions.DeviceFd %d. Please unmount it where it was mounted.", ms.mountPoint, ms.opts.DeviceFd)
+	}
 	delay := time.Duration(0)
 	for try := 0; try < 5; try++ {
 		err = unmount(ms.mountPoint, ms.opts)
@@ -162,6 +265,53 @@ func alignSlice(buf []byte, alignedByte, blockSize, size uintptr) []byte {
 // See the "Mount styles" section in the package documentation if you want to
 // know about the inner workings of the mount process. Usually you do not.
 func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	ms := newServer(fs, opts)
+	o := ms.opts
+	mountPoint = filepath.Clean(mountPoint)
+	if !filepath.IsAbs(mountPoint) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
+	}
+	var fd int
+	var err error
+	if o.DeviceFd > 0 {
+		fd = o.DeviceFd
+		if err := checkFuseDevice(fd); err != nil {
+			return nil, err
+		}
+		syscall.CloseOnExec(fd)
+		close(ms.ready)
+	} else {
+		fd, err = retryMount(o, func() (int, error) {
+			return mount(mountPoint, o, ms.ready)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ms.mountPoint = mountPoint
+	ms.mountFd = fd
+
+	// This prepares for Serve being called somewhere, either
+	// synchronously or asynchronously. It is done before INIT, so
+	// RawFileSystem.Init may call Wait.
+	ms.loops.Add(1)
+	if code := ms.handleInit(); !code.Ok() {
+		ms.loops.Done()
+		syscall.Close(fd)
+		// TODO - unmount as well?
+		return nil, fmt.Errorf("init: %s", code)
+	}
+	return ms, nil
+}
+
+// newServer applies defaults to opts, and returns a Server that is
+// not yet connected to a device.
+func newServer(fs RawFileSystem, opts *MountOptions) *Server {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -181,9 +331,41 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	if o.MaxWrite > kernelMaxWrite {
 		o.MaxWrite = kernelMaxWrite
 	}
-	if o.MaxStackDepth == 0 {
+	if o.MaxPages <= 0 {
+		o.MaxPages = (o.MaxWrite-1)/syscall.Getpagesize() + 1 // Round up
+	}
+	if kernelMaxPages := kernelMaxWrite / syscall.Getpagesize(); o.MaxPages > kernelMaxPages {
+		o.MaxPages = kernelMaxPages
+	}
+	if o.MaxBackground <= 0 {
+		o.MaxBackground = _DEFAULT_BACKGROUND_TASKS
+	}
+	if o.MaxBackground > math.MaxUint16 {
+		o.MaxBackground = math.MaxUint16
+	}
+	if o.CongestionThreshold <= 0 {
+		o.CongestionThreshold = o.MaxBackground * 3 / 4
+	}
+	if o.CongestionThreshold > o.MaxBackground {
+		o.Logger.Printf("CongestionThreshold %d exceeds MaxBackground %d; using %d",
+			o.CongestionThreshold, o.MaxBackground, o.MaxBackground)
+		o.CongestionThreshold = o.MaxBackground
+	}
+	if o.MaxStackDepth <= 0 {
 		o.MaxStackDepth = 1
 	}
+	if o.MaxStackDepth > _FILESYSTEM_MAX_STACK_DEPTH {
+		o.Logger.Printf("MaxStackDepth %d exceeds the kernel limit; using %d",
+			o.MaxStackDepth, _FILESYSTEM_MAX_STACK_DEPTH)
+		o.MaxStackDepth = _FILESYSTEM_MAX_STACK_DEPTH
+	}
+	if o.TimeGranularity < 0 {
+		o.TimeGranularity = 0
+	}
+	if o.TimeGranularity > time.Second {
+		o.Logger.Printf("TimeGranularity %v exceeds 1s; using 1s", o.TimeGranularity)
+		o.TimeGranularity = time.Second
+	}
 	if o.Name == "" {
 		name := fs.String()
 		l := len(name)
@@ -199,6 +381,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	}{
 		{o.SyncRead, CAP_ASYNC_READ},
 		{o.DisableReadDirPlus, CAP_READDIRPLUS},
+		{o.DisablePassthrough, CAP_PASSTHROUGH},
 		{!o.IDMappedMount, CAP_ALLOW_IDMAP},
 	} {
 		if s.flag {
@@ -212,12 +395,17 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	} else if maxReaders > maxMaxReaders {
 		maxReaders = maxMaxReaders
 	}
+	if o.MaxReaders > 0 {
+		maxReaders = o.MaxReaders
+	}
 
 	ms := &Server{
+		dispatchQueue: newDispatchQueue(o.MaxConcurrentRequests),
 		protocolServer: protocolServer{
 			fileSystem:  fs,
 			retrieveTab: make(map[uint64]*retrieveCacheRequest),
 			opts:        &o,
+			mountUid:    uint32(os.Getuid()),
 		},
 		opts:         &o,
 		maxReaders:   maxReaders,
@@ -231,8 +419,16 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 			},
 		}
 	}
+	// No request payload can exceed the negotiated max_pages,
+	// which is at most o.MaxPages: the kernel may lower it, but
+	// never raise it. WRITE is further limited by MaxWrite, but
+	// eg. SETXATTR is not.
+	maxPayload := o.MaxPages * syscall.Getpagesize()
+	if maxPayload < o.MaxWrite {
+		maxPayload = o.MaxWrite
+	}
 	ms.readPool.New = func() interface{} {
-		targetSize := o.MaxWrite + int(maxInputSize)
+		targetSize := maxPayload + int(maxInputSize)
 		if targetSize < _FUSE_MIN_READ_BUFFER {
 			targetSize = _FUSE_MIN_READ_BUFFER
 		}
@@ -244,32 +440,7 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		buf = alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(targetSize))
 		return buf
 	}
-	mountPoint = filepath.Clean(mountPoint)
-	if !filepath.IsAbs(mountPoint) {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
-	}
-	fd, err := mount(mountPoint, &o, ms.ready)
-	if err != nil {
-		return nil, err
-	}
-
-	ms.mountPoint = mountPoint
-	ms.mountFd = fd
-
-	if code := ms.handleInit(); !code.Ok() {
-		syscall.Close(fd)
-		// TODO - unmount as well?
-		return nil, fmt.Errorf("init: %s", code)
-	}
-
-	// This prepares for Serve being called somewhere, either
-	// synchronously or asynchronously.
-	ms.loops.Add(1)
-	return ms, nil
+	return ms
 }
 
 func escape(optionValue string) string {
@@ -297,7 +468,7 @@ func (o *MountOptions) optionsStrings() []string {
 	if runtime.GOOS == "darwin" {
 		r = append(r, "daemon_timeout=0")
 	}
-	if o.IDMappedMount && !o.containsOption("default_permissions") {
+	if o.needsDefaultPermissions() {
 		r = append(r, "default_permissions")
 	}
 
@@ -321,6 +492,12 @@ func (o *MountOptions) containsOption(opt string) bool {
 	return false
 }
 
+// needsDefaultPermissions returns true if "default_permissions" must
+// be added to the mount options.
+func (o *MountOptions) needsDefaultPermissions() bool {
+	return (o.DefaultPermissions || o.IDMappedMount) && !o.containsOption("default_permissions")
+}
+
 // DebugData returns internal status information for debugging
 // purposes.
 func (ms *Server) DebugData() string {
@@ -355,7 +532,7 @@ func handleEINTR(fn func() error) (err error) {
 // nil, OK if we have too many readers already.
 func (ms *Server) readRequest() (req *requestAlloc, code Status) {
 	ms.reqMu.Lock()
-	if ms.reqReaders > ms.maxReaders {
+	if ms.reqReaders >= ms.maxReaders {
 		ms.reqMu.Unlock()
 		return nil, OK
 	}
@@ -367,12 +544,28 @@ func (ms *Server) readRequest() (req *requestAlloc, code Status) {
 	destIface := ms.readPool.Get()
 	dest := destIface.([]byte)
 
+	// WRITE data is read straight into dest, and passed on
+	// without copying. Splicing requests into a pipe instead (as
+	// libfuse does with SPLICE_READ) could move WRITE data to a
+	// backing file without passing through userspace, but costs
+	// extra syscalls for every other request; passthrough is the
+	// better way to reach backing files.
 	var n int
-	err := handleEINTR(func() error {
-		var err error
-		n, err = syscall.Read(ms.mountFd, dest)
-		return err
-	})
+	var err error
+	if ms.conn != nil {
+		n, err = ms.readConn(dest)
+	} else {
+		err = handleEINTR(func() error {
+			var err error
+			n, err = syscall.Read(ms.mountFd, dest)
+			return err
+		})
+	}
+	if err == nil && n == 0 {
+		// /dev/fuse does not return EOF, but a socket does
+		// when the peer closes it.
+		err = syscall.ENODEV
+	}
 	if err != nil {
 		code = ToStatus(err)
 		ms.reqPool.Put(reqIface)
@@ -382,14 +575,14 @@ func (ms *Server) readRequest() (req *requestAlloc, code Status) {
 		return nil, code
 	}
 
-	if ms.latencies != nil {
+	if ms.latencies != nil || ms.opts.RecordStats {
 		req.startTime = time.Now()
 	}
 	ms.reqMu.Lock()
 	defer ms.reqMu.Unlock()
 	gobbled := req.setInput(dest[:n])
 	if len(req.inputBuf) < int(unsafe.Sizeof(InHeader{})) {
-		log.Printf("Short read for input header: %v", req.inputBuf)
+		ms.opts.Logger.Printf("short read for input header: len=%d", len(req.inputBuf))
 		return nil, EINVAL
 	}
 	//opCode := ((*InHeader)(unsafe.Pointer(&req.inputBuf[0]))).Opcode
@@ -402,7 +595,16 @@ func (ms *Server) readRequest() (req *requestAlloc, code Status) {
 		ms.readPool.Put(destIface)
 	}
 	ms.reqReaders--
-	if  ms.reqReaders <= 8  {
+
+	// Keep up to maxReaders goroutines reading the device. In
+	// singleReader mode, this goroutine returns to reading right
+	// after dispatching the request. No readers are started
+	// while handling INIT.
+	readers := ms.reqReaders
+	if ms.singleReader {
+		readers++
+	}
+	if ms.serving && readers < ms.maxReaders {
 		ms.loops.Add(1)
 		go ms.loop()
 	}
@@ -432,11 +634,17 @@ func (ms *Server) returnRequest(req *requestAlloc) {
 }
 
 func (ms *Server) recordStats(req *request) {
+	if ms.latencies == nil && !ms.opts.RecordStats {
+		return
+	}
+	dt := time.Now().Sub(req.startTime)
+	opname := operationName(req.inHeader().Opcode)
 	if ms.latencies != nil {
-		dt := time.Now().Sub(req.startTime)
-		opname := operationName(req.inHeader().Opcode)
 		ms.latencies.Add(opname, dt)
 	}
+	if ms.opts.RecordStats {
+		ms.stats.add(opname, dt, req.status)
+	}
 }
 
 // Serve initiates the FUSE loop. Normally, callers should run Serve()
@@ -444,6 +652,11 @@ func (ms *Server) recordStats(req *request) {
 // goroutine.
 //
 // Each filesystem operation executes in a separate goroutine.
+//
+// Serve returns when the file system is unmounted, or when the
+// connection is aborted; Err tells the two apart. In either case,
+// outstanding requests are canceled, and RawFileSystem.OnUnmount is
+// called before Serve returns.
 func (ms *Server) Serve() {
 	if ms.serving {
 		// Calling Serve() multiple times leads to a panic on unmount and fun
@@ -457,7 +670,11 @@ func (ms *Server) Serve() {
 	ms.loops.Wait()
 
 	ms.writeMu.Lock()
-	syscall.Close(ms.mountFd)
+	if ms.conn != nil {
+		ms.conn.Close()
+	} else {
+		syscall.Close(ms.mountFd)
+	}
 	ms.writeMu.Unlock()
 
 	// shutdown in-flight cache retrieves.
@@ -480,6 +697,27 @@ func (ms *Server) Serve() {
 	ms.fileSystem.OnUnmount()
 }
 
+// Err returns why Serve stopped: nil if the file system was
+// unmounted, and ErrConnectionAborted if the connection was aborted.
+// To tell the two apart, the server negotiates CAP_ABORT_ERROR, so
+// operations that are in flight during an abort fail with
+// ECONNABORTED rather than ENOTCONN. Err should be called after
+// Serve has returned.
+func (ms *Server) Err() error {
+	ms.reqMu.Lock()
+	defer ms.reqMu.Unlock()
+	return ms.serveErr
+}
+
+// setServeErr records the first error that stops a read loop.
+func (ms *Server) setServeErr(err error) {
+	ms.reqMu.Lock()
+	defer ms.reqMu.Unlock()
+	if ms.serveErr == nil {
+		ms.serveErr = err
+	}
+}
+
 // Wait waits for the serve loop to exit. This should only be called
 // after Serve has been called, or it will hang indefinitely.
 func (ms *Server) Wait() {
@@ -550,17 +788,21 @@ exit:
 			}
 		case ENOENT:
 			continue
-		case ENODEV:
+		case ENODEV, Status(syscall.ECONNABORTED):
 			// Mount was killed. The obvious place to
 			// cancel outstanding requests is at the end
 			// of Serve, but that reader might be blocked.
 			ms.cancelAll()
+			if errNo != ENODEV {
+				ms.setServeErr(ErrConnectionAborted)
+			}
 			if ms.opts.Debug {
-				ms.opts.Logger.Printf("received ENODEV (unmount request), thread exiting")
+				ms.opts.Logger.Printf("received %v (unmount request), thread exiting", errNo)
 			}
 			break exit
 		default: // some other error?
 			ms.opts.Logger.Printf("Failed to read from fuse conn: %v", errNo)
+			ms.setServeErr(fmt.Errorf("read from fuse conn: %w", syscall.Errno(errNo)))
 			break exit
 		}
 
@@ -582,7 +824,9 @@ func (ms *Server) handleRequest(req *requestAlloc) Status {
 
 	h, inSize, outSize, outPayloadSize, code := parseRequest(req.inputBuf, &ms.kernelSettings)
 	if !code.Ok() {
-		ms.opts.Logger.Printf("parseRequest: %v", code)
+		hdr := req.inHeader()
+		ms.opts.Logger.Printf("parseRequest: %v: opcode=%s (%d) unique=%d nodeid=%d len=%d",
+			code, operationName(hdr.Opcode), hdr.Opcode, hdr.Unique, hdr.NodeId, len(req.inputBuf))
 		return code
 	}
 
@@ -594,7 +838,19 @@ func (ms *Server) handleRequest(req *requestAlloc) Status {
 		req.outPayload = ms.buffers.AllocBuffer(uint32(outPayloadSize))
 		req.bufferPoolOutputBuf = req.outPayload
 	}
-	ms.protocolServer.handleRequest(h, &req.request)
+	var timeout *requestTimeout
+	if ms.opts.RequestTimeout > 0 && !isControlRequest(req.inHeader().Opcode) {
+		timeout = ms.startRequestTimeout(&req.request)
+	}
+	ms.dispatch(h, &req.request)
+	if timeout != nil && ms.stopRequestTimeout(timeout) {
+		// The kernel already got EIO for this request.
+		if req.readResult != nil {
+			req.readResult.Done()
+		}
+		ms.undoReply(&req.request)
+		return OK
+	}
 	if req.suppressReply {
 		return OK
 	}
@@ -611,9 +867,14 @@ func (ms *Server) handleRequest(req *requestAlloc) Status {
 		// RELEASE. This is because RELEASE is analogous to
 		// FORGET, and is not synchronized with the calling
 		// process, but does require a response.
-		if ms.opts.Debug || !(errno == ENOENT && (req.inHeader().Opcode == _OP_INTERRUPT ||
+		//
+		// Replies to requests that were in flight when the
+		// connection went away fail too.
+		benign := errno == ENOENT && (req.inHeader().Opcode == _OP_INTERRUPT ||
 			req.inHeader().Opcode == _OP_RELEASEDIR ||
-			req.inHeader().Opcode == _OP_RELEASE)) {
+			req.inHeader().Opcode == _OP_RELEASE) ||
+			ms.isConnectionDead()
+		if ms.opts.Debug || !benign {
 			ms.opts.Logger.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
 				errno, operationName(req.inHeader().Opcode))
 		}
@@ -621,6 +882,203 @@ func (ms *Server) handleRequest(req *requestAlloc) Status {
 	return errno
 }
 
+// dispatch processes a request, waiting for a slot if
+// MountOptions.MaxConcurrentRequests is reached. Control requests,
+// such as NOTIFY_REPLY and INTERRUPT, are never queued: an operation
+// may be waiting for them.
+func (ms *Server) dispatch(h *operationHandler, req *request) {
+	if q := ms.dispatchQueue; q != nil && !isControlRequest(req.inHeader().Opcode) {
+		q.acquire(ms.opts.PrioritizeSyncRequests && isBackground(req))
+		defer q.release()
+	}
+	atomic.AddInt32(&ms.dispatching, 1)
+	defer func() {
+		if atomic.AddInt32(&ms.dispatching, -1) == 0 && atomic.LoadInt32(&ms.shuttingDown) != 0 {
+			ms.signalDrained()
+		}
+	}()
+	// Check after counting the request, so Shutdown either sees
+	// it in InflightRequests, or the request sees shuttingDown.
+	if atomic.LoadInt32(&ms.shuttingDown) != 0 && !isControlRequest(req.inHeader().Opcode) {
+		req.status = Status(syscall.ENOTCONN)
+	}
+	ms.protocolServer.handleRequest(h, req)
+}
+
+// Shutdown stops the file system gracefully. From now on, new
+// requests fail with ENOTCONN without reaching the file system,
+// except for those that manage the connection, such as FORGET. Shutdown then waits until the requests that are being
+// processed have finished, or until ctx expires, and unmounts the
+// file system. If ctx expires first, the remaining requests are
+// abandoned: they are canceled by the unmount, and the error
+// reports how many there were.
+func (ms *Server) Shutdown(ctx context.Context) error {
+	ms.drainedMu.Lock()
+	if ms.drained == nil {
+		ms.drained = make(chan struct{})
+	}
+	drained := ms.drained
+	ms.drainedMu.Unlock()
+
+	atomic.StoreInt32(&ms.shuttingDown, 1)
+	// Requests that finished before shuttingDown was set did not
+	// signal.
+	if ms.InflightRequests() == 0 {
+		ms.signalDrained()
+	}
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("shutdown: abandoned %d requests: %w", ms.InflightRequests(), ctx.Err())
+	}
+	if uerr := ms.Unmount(); uerr != nil {
+		return uerr
+	}
+	return err
+}
+
+// signalDrained closes the channel that Shutdown waits for, if it
+// is not closed yet.
+func (ms *Server) signalDrained() {
+	ms.drainedMu.Lock()
+	defer ms.drainedMu.Unlock()
+	select {
+	case <-ms.drained:
+	default:
+		close(ms.drained)
+	}
+}
+
+// InflightRequests returns the number of requests that are being
+// processed by the file system. This excludes requests that wait
+// because MountOptions.MaxConcurrentRequests is reached.
+func (ms *Server) InflightRequests() int {
+	return int(atomic.LoadInt32(&ms.dispatching))
+}
+
+// requestTimeout tracks the RequestTimeout timer of a single
+// request. It is not reused across requests, so a timer that fires
+// late cannot touch a recycled request.
+type requestTimeout struct {
+	timer *time.Timer
+
+	// written under Server.interruptMu
+	done  bool
+	fired bool
+}
+
+// isControlRequest returns true for the opcodes that manage the
+// connection, rather than operate on the file system. These are not
+// subject to RequestTimeout, MaxConcurrentRequests or Shutdown:
+//
+//   - FORGET and BATCH_FORGET have no reply, so there is nothing to
+//     time out or fail, and dropping them leaks nodes.
+//   - INTERRUPT and NOTIFY_REPLY have no reply either, and operations
+//     that are holding a slot may be waiting for them.
+//   - INIT and DESTROY are answered, but are part of mounting and
+//     unmounting: failing them breaks the handshake or the teardown.
+func isControlRequest(opcode uint32) bool {
+	switch opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_NOTIFY_REPLY, _OP_INTERRUPT,
+		_OP_INIT, _OP_DESTROY:
+		return true
+	}
+	return false
+}
+
+func (ms *Server) startRequestTimeout(req *request) *requestTimeout {
+	t := &requestTimeout{}
+	t.timer = time.AfterFunc(ms.opts.RequestTimeout, func() {
+		ms.interruptMu.Lock()
+		if t.done {
+			ms.interruptMu.Unlock()
+			return
+		}
+		t.fired = true
+		if !req.interrupted {
+			close(req.cancel)
+			req.interrupted = true
+		}
+		unique := req.inHeader().Unique
+		opcode := req.inHeader().Opcode
+		ms.interruptMu.Unlock()
+
+		ms.opts.Logger.Printf("request %d (%s) timed out after %v",
+			unique, operationName(opcode), ms.opts.RequestTimeout)
+
+		buf := make([]byte, sizeOfOutHeader)
+		*(*OutHeader)(unsafe.Pointer(&buf[0])) = OutHeader{
+			Length: uint32(sizeOfOutHeader),
+			Status: -int32(EIO),
+			Unique: unique,
+		}
+		ms.writeMu.Lock()
+		ms.write(&request{outputBuf: buf})
+		ms.writeMu.Unlock()
+	})
+	return t
+}
+
+// stopRequestTimeout stops the timer, and returns true if it
+// already fired, ie. the request was answered with EIO, and the
+// reply of the file system must be dropped.
+func (ms *Server) stopRequestTimeout(t *requestTimeout) bool {
+	t.timer.Stop()
+	ms.interruptMu.Lock()
+	defer ms.interruptMu.Unlock()
+	t.done = true
+	return t.fired
+}
+
+// undoReply balances a reply that was dropped because the request
+// timed out: the kernel will never send FORGET for the nodes, or
+// RELEASE for the handles, that the reply would have handed out.
+func (ms *Server) undoReply(req *request) {
+	if !req.status.Ok() {
+		return
+	}
+	hdr := req.inHeader()
+	release := func(nodeId, fh uint64, flags uint32, dir bool) {
+		in := &ReleaseIn{InHeader: *hdr, Fh: fh, Flags: flags}
+		in.NodeId = nodeId
+		if dir {
+			ms.fileSystem.ReleaseDir(in)
+		} else {
+			ms.fileSystem.Release(nil, in)
+		}
+	}
+	switch hdr.Opcode {
+	case _OP_LOOKUP, _OP_MKNOD, _OP_MKDIR, _OP_SYMLINK, _OP_LINK:
+		if out := (*EntryOut)(req.outData()); out.NodeId != 0 {
+			ms.fileSystem.Forget(out.NodeId, 1)
+		}
+	case _OP_CREATE, _OP_TMPFILE:
+		out := (*CreateOut)(req.outData())
+		release(out.NodeId, out.Fh, (*CreateIn)(req.inData()).Flags, false)
+		ms.fileSystem.Forget(out.NodeId, 1)
+	case _OP_OPEN:
+		release(hdr.NodeId, (*OpenOut)(req.outData()).Fh, (*OpenIn)(req.inData()).Flags, false)
+	case _OP_OPENDIR:
+		release(hdr.NodeId, (*OpenOut)(req.outData()).Fh, (*OpenIn)(req.inData()).Flags, true)
+	case _OP_READDIRPLUS:
+		// Each entry is an EntryOut, followed by a _Dirent
+		// and the name, padded to 8 bytes.
+		const entryOutSize = int(unsafe.Sizeof(EntryOut{}))
+		buf := req.outPayload
+		for off := 0; off+entryOutSize+direntSize <= len(buf); {
+			out := (*EntryOut)(unsafe.Pointer(&buf[off]))
+			de := (*_Dirent)(unsafe.Pointer(&buf[off+entryOutSize]))
+			if out.NodeId != 0 {
+				ms.fileSystem.Forget(out.NodeId, 1)
+			}
+			nameLen := int(de.NameLen)
+			off += entryOutSize + direntSize + nameLen + (8-nameLen&7)&7
+		}
+	}
+}
+
 func (ms *Server) notifyWrite(req *request) Status {
 	req.serializeHeader(req.outPayloadSize())
 
@@ -650,12 +1108,42 @@ func newNotifyRequest(opcode uint32) *request {
 			_OP_NOTIFY_STORE_CACHE:    NOTIFY_STORE_CACHE,
 			_OP_NOTIFY_RETRIEVE_CACHE: NOTIFY_RETRIEVE_CACHE,
 			_OP_NOTIFY_DELETE:         NOTIFY_DELETE,
+			_OP_NOTIFY_POLL:           NOTIFY_POLL,
 		}[opcode],
 	}
 	r.inHeader().Opcode = opcode
 	return r
 }
 
+// UpdateTimeouts changes the entry, attribute and negative entry
+// timeouts for responses sent from now on. Entries and attributes
+// already cached by the kernel keep the timeout they were sent
+// with. It returns ENOSYS if the file system does not implement
+// TimeoutUpdater.
+func (ms *Server) UpdateTimeouts(entry, attr, negative time.Duration) Status {
+	tu, ok := ms.fileSystem.(TimeoutUpdater)
+	if !ok {
+		return ENOSYS
+	}
+	tu.UpdateTimeouts(entry, attr, negative)
+	return OK
+}
+
+// PollNotify wakes up the processes waiting in poll(2) or
+// epoll(7) on a file. The kh argument is PollIn.Kh from a POLL
+// request that had FUSE_POLL_SCHEDULE_NOTIFY set.
+func (ms *Server) PollNotify(kh uint64) Status {
+	if !ms.kernelSettings.SupportsVersion(7, 11) {
+		return ENOSYS
+	}
+
+	req := newNotifyRequest(_OP_NOTIFY_POLL)
+	wakeup := (*NotifyPollWakeupOut)(req.outData())
+	wakeup.Kh = kh
+
+	return ms.notifyWrite(req)
+}
+
 // InodeNotify invalidates the information associated with the inode
 // (ie. data cache, attributes, etc.)
 func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
@@ -676,7 +1164,11 @@ func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
 // InodeNotifyStoreCache tells kernel to store data into inode's cache.
 //
 // This call is similar to InodeNotify, but instead of only invalidating a data
-// region, it gives updated data directly to the kernel.
+// region, it gives updated data directly to the kernel, so a subsequent
+// read of the region is served without a READ request, eg. for
+// prefetching. The file size is extended if the data goes beyond it.
+// The data is sent in chunks of at most MaxWrite bytes. The kernel
+// returns ENOENT if it does not currently know the inode.
 func (ms *Server) InodeNotifyStoreCache(node uint64, offset int64, data []byte) Status {
 	if !ms.kernelSettings.SupportsNotify(NOTIFY_STORE_CACHE) {
 		return ENOSYS
@@ -690,6 +1182,9 @@ func (ms *Server) InodeNotifyStoreCache(node uint64, offset int64, data []byte)
 			// platforms int has only 31-bit for positive range.
 			size = math.MaxInt32
 		}
+		if ms.opts.MaxWrite > 0 && size > ms.opts.MaxWrite {
+			size = ms.opts.MaxWrite
+		}
 
 		st := ms.inodeNotifyStoreCache32(node, offset, data[:size])
 		if st != OK {
@@ -727,6 +1222,10 @@ func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte
 //
 // The kernel returns ENOENT if it does not currently have entry for this inode
 // in its dentry cache.
+//
+// The kernel answers asynchronously, with a NOTIFY_REPLY request that
+// is matched to the query by its unique ID. See
+// MountOptions.RetrieveTimeout to bound the wait.
 func (ms *Server) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n int, st Status) {
 	// the kernel won't send us in one go more then what we negotiated as MaxWrite.
 	// retrieve the data in chunks.
@@ -816,7 +1315,29 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 	// NotifyRetrieveOut sent to the kernel successfully. Now the kernel
 	// have to return data in a separate write-style NotifyReply request.
 	// Wait for the result.
-	<-reading.ready
+	if ms.opts.RetrieveTimeout <= 0 {
+		<-reading.ready
+		return reading.n, reading.st
+	}
+
+	timer := time.NewTimer(ms.opts.RetrieveTimeout)
+	defer timer.Stop()
+	select {
+	case <-reading.ready:
+	case <-timer.C:
+		ms.retrieveMu.Lock()
+		pending := ms.retrieveTab[q.NotifyUnique] == reading
+		if pending {
+			delete(ms.retrieveTab, q.NotifyUnique)
+		}
+		ms.retrieveMu.Unlock()
+		if pending {
+			return 0, Status(syscall.ETIMEDOUT)
+		}
+		// The reply is being processed; it writes into dest,
+		// so wait for it.
+		<-reading.ready
+	}
 	return reading.n, reading.st
 }
 
@@ -917,9 +1438,14 @@ func (ms *Server) WaitMount() error {
 	if err != nil {
 		return err
 	}
-	if parseFuseFd(ms.mountPoint) >= 0 {
-		// Magic `/dev/fd/N` mountpoint. We don't know the real mountpoint, so
-		// we cannot run the poll hack.
+	if parseFuseFd(ms.mountPoint) >= 0 || ms.opts.DeviceFd > 0 || ms.resumed {
+		// Magic `/dev/fd/N` mountpoint or externally mounted
+		// fd. We don't know the real mountpoint, so we cannot
+		// run the poll hack. A resumed mount is already up.
+		return nil
+	}
+	if ms.opts.EnablePoll {
+		// The poll hack would switch off POLL for the whole mount.
 		return nil
 	}
 	return pollHack(ms.mountPoint)
@@ -11,6 +11,9 @@ import (
 const useSingleReader = false
 
 func (ms *Server) write(req *request) Status {
+	if ms.conn != nil {
+		return ms.writeConn(req)
+	}
 	if req.outPayloadSize() == 0 {
 		err := handleEINTR(func() error {
 			_, err := syscall.Write(ms.mountFd, req.outputBuf)
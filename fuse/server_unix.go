@@ -12,6 +12,9 @@ import (
 const useSingleReader = true
 
 func (ms *Server) write(req *request) Status {
+	if ms.conn != nil {
+		return ms.writeConn(req)
+	}
 	if req.outPayloadSize() == 0 {
 		err := handleEINTR(func() error {
 			_, err := unix.Write(ms.mountFd, req.outputBuf)
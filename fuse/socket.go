@@ -0,0 +1,141 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// NewSocketServer creates a Server that speaks the FUSE protocol
+// over conn rather than over /dev/fuse. This lets the file system
+// run in a separate process or sandbox: a proxy that owns the mount
+// copies requests from /dev/fuse into the other end of conn, and
+// replies and notifications back.
+//
+// Unlike /dev/fuse, a stream does not preserve message boundaries,
+// so each message must be written to conn in one piece, and is read
+// back using the Length field of its header. Requests and replies
+// are otherwise passed on unchanged. On a socket that preserves
+// message boundaries, such as SOCK_SEQPACKET, each request is read
+// with a single read instead, so it must be sent as one packet.
+//
+// Since conn is not a FUSE device, replies are never spliced, and
+// passthrough (CAP_PASSTHROUGH) is disabled.
+//
+// The INIT request must be the first message on conn. It is handled
+// before NewSocketServer returns, so the proxy should forward it
+// right away. Call Serve on the result to serve further requests.
+// Serve returns when conn reaches EOF, or when Unmount closes it.
+func NewSocketServer(conn net.Conn, fs RawFileSystem, opts *MountOptions) (*Server, error) {
+	ms := newServer(fs, opts)
+	ms.opts.DisableSplice = true
+	ms.opts.DisabledCapabilities |= CAP_PASSTHROUGH
+	ms.conn = conn
+	ms.connPacket = isPacketConn(conn)
+	ms.mountFd = -1
+	close(ms.ready)
+
+	ms.loops.Add(1)
+	if code := ms.handleInit(); !code.Ok() {
+		ms.loops.Done()
+		conn.Close()
+		return nil, fmt.Errorf("init: %s", code)
+	}
+	return ms, nil
+}
+
+// isPacketConn reports whether conn is a socket that preserves
+// message boundaries.
+func isPacketConn(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	typ := -1
+	rc.Control(func(fd uintptr) {
+		typ, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	})
+	return typ == syscall.SOCK_SEQPACKET || typ == syscall.SOCK_DGRAM
+}
+
+// readConn reads a single request from the connection of a socket
+// server into dest.
+func (ms *Server) readConn(dest []byte) (int, error) {
+	ms.connReadMu.Lock()
+	defer ms.connReadMu.Unlock()
+
+	if ms.connPacket {
+		// Reading less than a packet discards the rest, so
+		// read it whole.
+		n, err := ms.conn.Read(dest)
+		if err != nil {
+			return 0, connError(err)
+		}
+		if n > 0 && (n < int(unsafe.Sizeof(InHeader{})) || int(*(*uint32)(unsafe.Pointer(&dest[0]))) != n) {
+			ms.opts.Logger.Printf("socket server: bad request packet of %d bytes", n)
+			ms.conn.Close()
+			return 0, syscall.EIO
+		}
+		return n, nil
+	}
+
+	const lenSize = int(unsafe.Sizeof(InHeader{}.Length))
+	if _, err := io.ReadFull(ms.conn, dest[:lenSize]); err != nil {
+		return 0, connError(err)
+	}
+	n := int(*(*uint32)(unsafe.Pointer(&dest[0])))
+	if n < int(unsafe.Sizeof(InHeader{})) || n > len(dest) {
+		// We cannot find the start of the next message, so the
+		// connection is unusable.
+		ms.opts.Logger.Printf("socket server: bad request length %d", n)
+		ms.conn.Close()
+		return 0, syscall.EIO
+	}
+	if _, err := io.ReadFull(ms.conn, dest[lenSize:n]); err != nil {
+		return 0, connError(err)
+	}
+	return n, nil
+}
+
+// writeConn writes the reply or notification req in one piece to the
+// connection of a socket server.
+func (ms *Server) writeConn(req *request) Status {
+	if req.fdData != nil {
+		req.outPayload, req.status = req.fdData.Bytes(req.outPayload)
+		req.serializeHeader(len(req.outPayload))
+	}
+	bufs := net.Buffers{req.outputBuf, req.outPayload}
+	_, err := bufs.WriteTo(ms.conn)
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
+	return ToStatus(connError(err))
+}
+
+// connError converts the error of a connection read or write into a
+// syscall.Errno. A closed connection is reported like an unmounted
+// device.
+func connError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, net.ErrClosed) {
+		return syscall.ENODEV
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/fusetest"
+)
+
+// socketFS is harnessFS, but serves READ from a file descriptor,
+// which cannot be spliced into a socket.
+type socketFS struct {
+	harnessFS
+
+	f *os.File
+}
+
+func (fs *socketFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	return fuse.ReadResultFd(fs.f.Fd(), int64(input.Offset), int(input.Size)), fuse.OK
+}
+
+// newSocketHarness returns a server for fs created with
+// NewSocketServer over a socket pair of the given type, and a
+// TestHarness that plays the kernel on the other end.
+func newSocketHarness(t *testing.T, typ int, fs fuse.RawFileSystem) *fusetest.TestHarness {
+	flags := fuse.CAP_ASYNC_READ | fuse.CAP_BIG_WRITES | fuse.CAP_INIT_EXT | fuse.CAP_PASSTHROUGH
+	in := fuse.InitIn{
+		Flags:  uint32(flags),
+		Flags2: uint32(flags >> 32),
+	}
+	h, r, err := fusetest.NewSocketTestHarness(typ, &in, fs, nil)
+	if err != nil {
+		t.Fatalf("NewSocketTestHarness: %v", err)
+	}
+	t.Cleanup(h.Close)
+
+	out := r.InitOut()
+	if out == nil {
+		t.Fatalf("INIT: short reply")
+	}
+	if out.Flags64()&fuse.CAP_PASSTHROUGH != 0 {
+		t.Errorf("INIT: CAP_PASSTHROUGH was accepted")
+	}
+	return h
+}
+
+func TestSocketServer(t *testing.T) {
+	t.Run("stream", func(t *testing.T) { testSocketServer(t, syscall.SOCK_STREAM) })
+	t.Run("seqpacket", func(t *testing.T) { testSocketServer(t, syscall.SOCK_SEQPACKET) })
+}
+
+func testSocketServer(t *testing.T, typ int) {
+	f, err := os.CreateTemp(t.TempDir(), "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSocketHarness(t, typ, &socketFS{
+		harnessFS: harnessFS{fuse.NewDefaultRawFileSystem()},
+		f:         f,
+	})
+
+	req := h.LookupRequest(fuse.FUSE_ROOT_ID, "file")
+	if typ == syscall.SOCK_STREAM {
+		// Requests on a stream need not arrive in one piece.
+		if err := h.Write(req[:3]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		req = req[3:]
+	}
+	if err := h.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	r, err := h.Read()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if e := r.EntryOut(); !r.Status().Ok() || e == nil || e.NodeId != 2 {
+		t.Fatalf("LOOKUP: got %v, %v", r.Status(), e)
+	}
+
+	r, err = h.Send(h.OpenRequest(2, 0))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	o := r.OpenOut()
+	if !r.Status().Ok() || o == nil {
+		t.Fatalf("OPEN: got %v", r.Status())
+	}
+
+	r, err = h.Send(h.ReadRequest(2, o.Fh, 1, 100))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := string(r.Data); !r.Status().Ok() || got != "ello" {
+		t.Errorf("READ: got %v %q, want %q", r.Status(), got, "ello")
+	}
+
+	if err := h.Server().Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	select {
+	case <-h.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return after Unmount")
+	}
+}
+
+// TestSocketServerEOF checks that Serve returns when the peer closes
+// the connection.
+func TestSocketServerEOF(t *testing.T) {
+	h := newSocketHarness(t, syscall.SOCK_STREAM, &harnessFS{fuse.NewDefaultRawFileSystem()})
+	if err := h.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return at EOF")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+)
+
+// LatencyBuckets holds the upper bounds of the latency buckets in
+// OpStats. Requests slower than the last bound are counted in the
+// final bucket.
+var LatencyBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// OpStats holds the counters for a single FUSE opcode.
+type OpStats struct {
+	// Count is the number of requests handled.
+	Count uint64
+
+	// ErrorCount is the number of requests that returned an
+	// error status.
+	ErrorCount uint64
+
+	// Latency[i] is the number of requests that took at most
+	// LatencyBuckets[i], and more than the previous bound. The
+	// last element counts requests slower than all bounds.
+	Latency [len(LatencyBuckets) + 1]uint64
+}
+
+func (s *OpStats) add(dt time.Duration, status Status) {
+	s.Count++
+	if status > OK {
+		s.ErrorCount++
+	}
+	i := 0
+	for i < len(LatencyBuckets) && dt > LatencyBuckets[i] {
+		i++
+	}
+	s.Latency[i]++
+}
+
+type serverStats struct {
+	mu  sync.Mutex
+	ops map[string]*OpStats
+}
+
+func (s *serverStats) add(name string, dt time.Duration, status Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ops == nil {
+		s.ops = map[string]*OpStats{}
+	}
+	op := s.ops[name]
+	if op == nil {
+		op = &OpStats{}
+		s.ops[name] = op
+	}
+	op.add(dt, status)
+}
+
+// Stats returns a snapshot of the per-opcode counters, keyed by
+// opcode name (eg. "LOOKUP"). It returns nil unless
+// MountOptions.RecordStats is set.
+func (ms *Server) Stats() map[string]OpStats {
+	if !ms.opts.RecordStats {
+		return nil
+	}
+	ms.stats.mu.Lock()
+	defer ms.stats.mu.Unlock()
+	r := make(map[string]OpStats, len(ms.stats.ops))
+	for k, v := range ms.stats.ops {
+		r[k] = *v
+	}
+	return r
+}
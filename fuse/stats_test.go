@@ -0,0 +1,42 @@
+// Copyright 2024 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerStats(t *testing.T) {
+	ms := &Server{opts: &MountOptions{RecordStats: true}}
+	ms.stats.add("LOOKUP", 50*time.Microsecond, OK)
+	ms.stats.add("LOOKUP", 5*time.Millisecond, ENOENT)
+	ms.stats.add("LOOKUP", time.Minute, OK)
+	ms.stats.add("READ", time.Millisecond, OK)
+
+	got := ms.Stats()
+	lookup := got["LOOKUP"]
+	if lookup.Count != 3 || lookup.ErrorCount != 1 {
+		t.Errorf("LOOKUP: got %+v", lookup)
+	}
+	want := [len(LatencyBuckets) + 1]uint64{1, 0, 1, 0, 0, 1}
+	if lookup.Latency != want {
+		t.Errorf("LOOKUP latency: got %v, want %v", lookup.Latency, want)
+	}
+	if read := got["READ"]; read.Count != 1 || read.Latency[1] != 1 {
+		t.Errorf("READ: got %+v", read)
+	}
+
+	// The snapshot is a copy.
+	ms.stats.add("READ", time.Millisecond, OK)
+	if got["READ"].Count != 1 {
+		t.Errorf("snapshot changed: %+v", got["READ"])
+	}
+
+	ms.opts.RecordStats = false
+	if s := ms.Stats(); s != nil {
+		t.Errorf("got %v for disabled stats", s)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -78,8 +79,8 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
-// batch forget is handled internally.
-type _ForgetOne struct {
+// ForgetOne is an entry of a BATCH_FORGET request.
+type ForgetOne struct {
 	NodeId  uint64
 	Nlookup uint64
 }
@@ -137,6 +138,31 @@ const ( // SetAttrIn.Valid
 	FATTR_KILL_SUIDGID = (1 << 11)
 )
 
+// SetAttrInCommon holds the attributes to change in SETATTR. Valid
+// is a mask of FATTR_* bits saying which fields are set; the other
+// fields hold garbage. Rather than testing Valid directly, use the
+// Has* methods to see what changes, and the Get* methods to get the
+// new values. A typical Setattr looks like
+//
+//	if mode, ok := in.GetMode(); ok {
+//		attr.Mode = (attr.Mode &^ 07777) | mode
+//	}
+//	if sz, ok := in.GetSize(); ok {
+//		truncate(sz)
+//	}
+//	if mtime, ok := in.GetMTime(); ok {
+//		attr.SetTimes(nil, &mtime, nil)
+//	}
+//	...
+//	ctime, ok := in.GetCTime()
+//	if !ok {
+//		ctime = time.Now()
+//	}
+//	attr.SetTimes(nil, nil, &ctime)
+//
+// The status change time is updated for every SETATTR, unless the
+// kernel supplies it with FATTR_CTIME, which it does with
+// MountOptions.EnableWritebackCache.
 type SetAttrInCommon struct {
 	InHeader
 
@@ -157,6 +183,51 @@ type SetAttrInCommon struct {
 	Unused5 uint32
 }
 
+// HasMode returns whether the permission bits change, eg. for chmod.
+func (s *SetAttrInCommon) HasMode() bool {
+	return s.Valid&FATTR_MODE != 0
+}
+
+// HasUID returns whether the owner changes, eg. for chown.
+func (s *SetAttrInCommon) HasUID() bool {
+	return s.Valid&FATTR_UID != 0
+}
+
+// HasGID returns whether the group changes, eg. for chown.
+func (s *SetAttrInCommon) HasGID() bool {
+	return s.Valid&FATTR_GID != 0
+}
+
+// HasSize returns whether the size changes, eg. for truncate.
+func (s *SetAttrInCommon) HasSize() bool {
+	return s.Valid&FATTR_SIZE != 0
+}
+
+// HasATime returns whether the access time changes, eg. for utimes.
+func (s *SetAttrInCommon) HasATime() bool {
+	return s.Valid&FATTR_ATIME != 0
+}
+
+// HasMTime returns whether the modification time changes, eg. for
+// utimes.
+func (s *SetAttrInCommon) HasMTime() bool {
+	return s.Valid&FATTR_MTIME != 0
+}
+
+// HasCTime returns whether the kernel supplies the status change
+// time.
+func (s *SetAttrInCommon) HasCTime() bool {
+	return s.Valid&FATTR_CTIME != 0
+}
+
+// KillSuidgid returns whether the set-user-ID and set-group-ID bits
+// must be cleared. This is only requested with
+// MountOptions.HandleKillPrivV2; the fs package handles it
+// if the mode does not change otherwise.
+func (s *SetAttrInCommon) KillSuidgid() bool {
+	return s.Valid&FATTR_KILL_SUIDGID != 0
+}
+
 // GetFh returns the file handle if available, or 0 if undefined.
 func (s *SetAttrInCommon) GetFh() (uint64, bool) {
 	if s.Valid&FATTR_FH != 0 {
@@ -165,6 +236,7 @@ func (s *SetAttrInCommon) GetFh() (uint64, bool) {
 	return 0, false
 }
 
+// GetMode returns the new permission bits, if they change.
 func (s *SetAttrInCommon) GetMode() (uint32, bool) {
 	if s.Valid&FATTR_MODE != 0 {
 		return s.Mode & 07777, true
@@ -172,6 +244,7 @@ func (s *SetAttrInCommon) GetMode() (uint32, bool) {
 	return 0, false
 }
 
+// GetUID returns the new owner, if it changes.
 func (s *SetAttrInCommon) GetUID() (uint32, bool) {
 	if s.Valid&FATTR_UID != 0 {
 		return s.Uid, true
@@ -179,6 +252,7 @@ func (s *SetAttrInCommon) GetUID() (uint32, bool) {
 	return ^uint32(0), false
 }
 
+// GetGID returns the new group, if it changes.
 func (s *SetAttrInCommon) GetGID() (uint32, bool) {
 	if s.Valid&FATTR_GID != 0 {
 		return s.Gid, true
@@ -186,6 +260,7 @@ func (s *SetAttrInCommon) GetGID() (uint32, bool) {
 	return ^uint32(0), false
 }
 
+// GetSize returns the new size, if it changes.
 func (s *SetAttrInCommon) GetSize() (uint64, bool) {
 	if s.Valid&FATTR_SIZE != 0 {
 		return s.Size, true
@@ -193,6 +268,8 @@ func (s *SetAttrInCommon) GetSize() (uint64, bool) {
 	return 0, false
 }
 
+// GetMTime returns the new modification time, if it changes. For
+// FATTR_MTIME_NOW, it returns the current time.
 func (s *SetAttrInCommon) GetMTime() (time.Time, bool) {
 	var t time.Time
 	if s.Valid&FATTR_MTIME != 0 {
@@ -207,6 +284,8 @@ func (s *SetAttrInCommon) GetMTime() (time.Time, bool) {
 	return t, false
 }
 
+// GetATime returns the new access time, if it changes. For
+// FATTR_ATIME_NOW, it returns the current time.
 func (s *SetAttrInCommon) GetATime() (time.Time, bool) {
 	var t time.Time
 	if s.Valid&FATTR_ATIME != 0 {
@@ -221,6 +300,8 @@ func (s *SetAttrInCommon) GetATime() (time.Time, bool) {
 	return t, false
 }
 
+// GetCTime returns the status change time, if the kernel supplies
+// it.
 func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 	var t time.Time
 	if s.Valid&FATTR_CTIME != 0 {
@@ -244,9 +325,17 @@ type ReleaseIn struct {
 type OpenIn struct {
 	InHeader
 	Flags uint32
-	Mode  uint32
+
+	// Mode holds the open flags of the kernel headers, eg.
+	// OPEN_KILL_SUIDGID.
+	Mode uint32
 }
 
+const (
+	// OpenIn.Mode
+	OPEN_KILL_SUIDGID = (1 << 0)
+)
+
 const (
 	// OpenOut.Flags
 	FOPEN_DIRECT_IO              = (1 << 0)
@@ -339,7 +428,7 @@ type InitOut struct {
 	MaxWrite            uint32
 	TimeGran            uint32
 	MaxPages            uint16
-	Padding             uint16
+	MapAlignment        uint16
 	Flags2              uint32
 	MaxStackDepth       uint32
 	RequestTimeout      uint16
@@ -376,14 +465,14 @@ type InterruptIn struct {
 	Unique uint64
 }
 
-type _BmapIn struct {
+type BmapIn struct {
 	InHeader
 	Block     uint64
 	Blocksize uint32
 	Padding   uint32
 }
 
-type _BmapOut struct {
+type BmapOut struct {
 	Block uint64
 }
 
@@ -423,20 +512,57 @@ type IoctlOut struct {
 	OutIovs uint32
 }
 
-type _PollIn struct {
+// IoctlIovec describes a buffer in the address space of the process
+// calling ioctl(2).
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// Retry asks the kernel to reissue an unrestricted ioctl, this time
+// copying in the caller's memory described by `in`, and providing
+// room for writing back to the memory described by `out`. The
+// iovecs are stored in outbuf, which must be the output buffer
+// passed to RawFileSystem.Ioctl. Retry is not allowed for
+// restricted ioctls.
+func (o *IoctlOut) Retry(outbuf []byte, in, out []IoctlIovec) Status {
+	n := len(in) + len(out)
+	// The server reserves room for the maximum number of iovecs
+	// beyond the requested output size.
+	outbuf = outbuf[:cap(outbuf)]
+	if n == 0 || n > FUSE_IOCTL_MAX_IOV || uintptr(len(outbuf)) < uintptr(n)*unsafe.Sizeof(IoctlIovec{}) {
+		return EINVAL
+	}
+	iovs := unsafe.Slice((*IoctlIovec)(unsafe.Pointer(&outbuf[0])), n)
+	copy(iovs, in)
+	copy(iovs[len(in):], out)
+
+	o.Flags |= IOCTL_RETRY
+	o.InIovs = uint32(len(in))
+	o.OutIovs = uint32(len(out))
+	return OK
+}
+
+type PollIn struct {
 	InHeader
-	Fh      uint64
-	Kh      uint64
-	Flags   uint32
-	Padding uint32
+	Fh uint64
+
+	// Kh is the kernel handle for the poll. Pass it to
+	// Server.PollNotify to wake up the waiters.
+	Kh uint64
+
+	// If Flags has FUSE_POLL_SCHEDULE_NOTIFY, the kernel
+	// expects a notification when the file is ready.
+	Flags  uint32
+	Events uint32
 }
 
-type _PollOut struct {
+type PollOut struct {
 	Revents uint32
 	Padding uint32
 }
 
-type _NotifyPollWakeupOut struct {
+type NotifyPollWakeupOut struct {
 	Kh uint64
 }
 
@@ -484,6 +610,13 @@ type AccessIn struct {
 	Padding uint32
 }
 
+// FsyncIn.FsyncFlags
+const (
+	// FSYNC_FDATASYNC is set for fdatasync(2), which need not
+	// flush metadata that is not needed to read the data back.
+	FSYNC_FDATASYNC = (1 << 0)
+)
+
 type FsyncIn struct {
 	InHeader
 	Fh         uint64
@@ -542,7 +675,7 @@ type NotifyRetrieveIn struct {
 }
 
 const (
-	//	NOTIFY_POLL         = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
+	NOTIFY_POLL           = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
 	NOTIFY_INVAL_INODE    = -2 // notify kernel that an inode should be invalidated
 	NOTIFY_INVAL_ENTRY    = -3 // notify kernel that a directory entry should be invalidated
 	NOTIFY_STORE_CACHE    = -4 // store data into kernel cache of an inode
@@ -561,6 +694,11 @@ type FlushIn struct {
 	LockOwner uint64
 }
 
+type SyncFsIn struct {
+	InHeader
+	Padding uint64
+}
+
 type LseekIn struct {
 	InHeader
 	Fh      uint64
@@ -852,6 +990,33 @@ type StatxIn struct {
 	SxMask       uint32
 }
 
+const (
+	SETUPMAPPING_FLAG_WRITE = (1 << 0)
+	SETUPMAPPING_FLAG_READ  = (1 << 1)
+)
+
+// SetupMappingIn asks to map [Foffset, Foffset+Len) of the file
+// opened as Fh at Moffset in the DAX window.
+type SetupMappingIn struct {
+	InHeader
+	Fh      uint64
+	Foffset uint64
+	Len     uint64
+	Flags   uint64
+	Moffset uint64
+}
+
+// RemoveMappingIn is followed by Count RemoveMappingOne entries.
+type RemoveMappingIn struct {
+	InHeader
+	Count uint32
+}
+
+type RemoveMappingOne struct {
+	Moffset uint64
+	Len     uint64
+}
+
 type StatxOut struct {
 	AttrValid     uint64
 	AttrValidNsec uint32
@@ -90,6 +90,12 @@ const (
 
 	// CAP_EXPLICIT_INVAL_DATA is not supported on Darwin.
 	CAP_EXPLICIT_INVAL_DATA = 0x0
+
+	// CAP_HANDLE_KILLPRIV_V2 is not supported on Darwin.
+	CAP_HANDLE_KILLPRIV_V2 = 0x0
+
+	// CAP_MAP_ALIGNMENT is not supported on Darwin.
+	CAP_MAP_ALIGNMENT = 0x0
 )
 
 type GetxtimesOut struct {
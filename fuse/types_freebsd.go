@@ -18,6 +18,12 @@ const (
 
 	// CAP_EXPLICIT_INVAL_DATA is not supported on FreeBSD.
 	CAP_EXPLICIT_INVAL_DATA = 0x0
+
+	// CAP_HANDLE_KILLPRIV_V2 is not supported on FreeBSD.
+	CAP_HANDLE_KILLPRIV_V2 = 0x0
+
+	// CAP_MAP_ALIGNMENT is not supported on FreeBSD.
+	CAP_MAP_ALIGNMENT = 0x0
 )
 
 func (s *StatfsOut) FromStatfsT(statfs *syscall.Statfs_t) {
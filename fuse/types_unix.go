@@ -7,6 +7,7 @@ type Attr struct {
 	Size uint64
 
 	// Blocks is the number of 512-byte blocks that the file occupies on disk.
+	// This is independent of Size, eg. for sparse files.
 	Blocks    uint64
 	Atime     uint64
 	Mtime     uint64
@@ -10,7 +10,11 @@ import (
 )
 
 // HasAccess tests if a caller can access a file with permissions
-// `perm` in mode `mask`
+// `perm` in mode `mask`, which is a combination of R_OK (4), W_OK
+// (2) and X_OK (1). Like the kernel, it uses the owner bits if the
+// caller owns the file, the group bits if the caller is in the group
+// of the file, and the other bits otherwise. All bits of mask must
+// be granted. A mask of 0 (F_OK) is always granted.
 func HasAccess(callerUid, callerGid, fileUid, fileGid uint32, perm uint32, mask uint32) bool {
 	if callerUid == 0 {
 		// root can do anything.
@@ -22,39 +26,33 @@ func HasAccess(callerUid, callerGid, fileUid, fileGid uint32, perm uint32, mask
 	}
 
 	if callerUid == fileUid {
-		if perm&(mask<<6) != 0 {
-			return true
-		}
+		return perm&(mask<<6) == mask<<6
 	}
+	groupOK := perm&(mask<<3) == mask<<3
 	if callerGid == fileGid {
-		if perm&(mask<<3) != 0 {
-			return true
-		}
+		return groupOK
 	}
-	if perm&mask != 0 {
-		return true
+	otherOK := perm&mask == mask
+	if groupOK == otherOK {
+		// avoid expensive lookup if the class doesn't matter.
+		return otherOK
 	}
 
 	// Check other groups.
-	if perm&(mask<<3) == 0 {
-		// avoid expensive lookup if it's not allowed anyway
-		return false
-	}
-
 	u, err := user.LookupId(strconv.Itoa(int(callerUid)))
 	if err != nil {
-		return false
+		return otherOK
 	}
 	gs, err := u.GroupIds()
 	if err != nil {
-		return false
+		return otherOK
 	}
 
 	fileGidStr := strconv.Itoa(int(fileGid))
 	for _, gidStr := range gs {
 		if gidStr == fileGidStr {
-			return true
+			return groupOK
 		}
 	}
-	return false
+	return otherOK
 }
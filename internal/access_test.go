@@ -62,6 +62,14 @@ func TestHasAccess(t *testing.T) {
 		{myUid, myGid, myUid, myGid, 0000, 01, false},
 		{myUid, myGid, myUid, myGid, 0200, 01, false},
 		{0, myGid, myUid + 1, notMyGid, 0700, 01, true},
+		// All bits of the mask are needed.
+		{myUid, myGid, myUid + 1, notMyGid, 0004, 06, false},
+		{myUid, myGid, myUid + 1, notMyGid, 0006, 06, true},
+		{myUid, myGid, myUid, myGid, 0400, 06, false},
+		// Only the bits of the caller's class count.
+		{myUid, myGid, myUid, myGid, 0077, 04, false},
+		{myUid, myGid, myUid + 1, myGid, 0704, 04, false},
+		{myUid, myGid, myUid + 1, notMyGid, 0040, 04, false},
 	}
 
 	if myOtherGid != 0 {
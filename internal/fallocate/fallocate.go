@@ -4,6 +4,12 @@ package fallocate
 // On Linux, it is a wrapper around fallocate(2).
 // On Darwin, it is a wrapper around fnctl(2).
 // On FreeBSD, it is a wrapper around posix_fallocate(2).
+//
+// The mode holds the Linux FALLOC_FL_* flags. On Linux it is
+// passed through unchanged, so eg. FALLOC_FL_PUNCH_HOLE and
+// FALLOC_FL_ZERO_RANGE work if the underlying file system supports
+// them. Other platforms return EOPNOTSUPP for modes they cannot
+// implement.
 func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return fallocate(fd, mode, off, len)
 }
@@ -7,9 +7,16 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// FALLOC_FL_KEEP_SIZE from <linux/falloc.h>, as sent by the kernel.
+const falloc_FL_KEEP_SIZE = 0x1
+
 func fallocate(fd int, mode uint32, off int64, len int64) error {
-	// TODO: Handle `mode` parameter.
-	_ = mode
+	// F_PREALLOCATE does not change the file size, so it only
+	// implements FALLOC_FL_KEEP_SIZE. Refuse other modes, rather
+	// than allocating when asked to punch a hole.
+	if mode&^falloc_FL_KEEP_SIZE != 0 {
+		return syscall.EOPNOTSUPP
+	}
 
 	// From `man fcntl` on OSX:
 	//     The F_PREALLOCATE command operates on the following structure:
@@ -5,8 +5,10 @@ import (
 )
 
 func fallocate(fd int, mode uint32, off int64, len int64) error {
-	// Ignore mode
-	_ = mode
+	// posix_fallocate(2) has no mode argument.
+	if mode != 0 {
+		return unix.EOPNOTSUPP
+	}
 	ret, _, _ := unix.Syscall(unix.SYS_POSIX_FALLOCATE, uintptr(fd), uintptr(off), uintptr(len))
 	if ret != 0 {
 		return unix.Errno(ret)
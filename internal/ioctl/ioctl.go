@@ -43,3 +43,8 @@ func (c Command) Number() byte {
 func (c Command) Type() byte {
 	return byte((c >> 8) & 0xff)
 }
+
+// Size returns the size of the argument
+func (c Command) Size() uintptr {
+	return uintptr((c >> 16) & (1<<14 - 1))
+}